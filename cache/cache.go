@@ -150,6 +150,32 @@ func (cache *Cache) GetPath(RepositoryUuid string, checksum string) ([]byte, err
 	return data, nil
 }
 
+func (cache *Cache) PutState(RepositoryUuid string, name string, data []byte) error {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("cache.PutState", time.Since(t0))
+	}()
+	logger.Trace("cache", "PutState(%s, %s)", RepositoryUuid, name)
+
+	key := fmt.Sprintf("State:%s:%s", RepositoryUuid, name)
+	return cache.db.Put([]byte(key), data, nil)
+}
+
+func (cache *Cache) GetState(RepositoryUuid string, name string) ([]byte, error) {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("cache.GetState", time.Since(t0))
+	}()
+	logger.Trace("cache", "GetState(%s, %s)", RepositoryUuid, name)
+
+	key := fmt.Sprintf("State:%s:%s", RepositoryUuid, name)
+	data, err := cache.db.Get([]byte(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
 func (cache *Cache) Commit() error {
 	t0 := time.Now()
 	defer func() {
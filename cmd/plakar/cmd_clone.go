@@ -27,6 +27,9 @@ import (
 	"github.com/google/uuid"
 )
 
+// number of items listed, and blobs fetched, per request
+const cloneBatchSize = 256
+
 func init() {
 	registerCommand("clone", cmd_clone)
 }
@@ -49,85 +52,92 @@ func cmd_clone(ctx Plakar, repository *storage.Repository, args []string) int {
 		return 1
 	}
 
-	packfileChecksums, err := sourceRepository.GetPackfiles()
+	// resources are listed page by page so that copies start while the
+	// rest is being listed
+	wg := sync.WaitGroup{}
+	err = sourceRepository.ForEachPage(storage.ResourcePackfiles, cloneBatchSize, func(packfileChecksums [][32]byte) error {
+		for _, _packfileChecksum := range packfileChecksums {
+			wg.Add(1)
+			go func(packfileChecksum [32]byte) {
+				defer wg.Done()
+
+				data, err := sourceRepository.GetPackfile(packfileChecksum)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: could not get packfile from repository: %s\n", sourceRepository.Location, err)
+					return
+				}
+
+				err = cloneRepository.PutPackfile(packfileChecksum, data)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: could not put packfile to repository: %s\n", cloneRepository.Location, err)
+					return
+				}
+			}(_packfileChecksum)
+		}
+		return nil
+	})
+	wg.Wait()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: could not get paclfiles list from repository: %s\n", sourceRepository.Location, err)
+		fmt.Fprintf(os.Stderr, "%s: could not get packfiles list from repository: %s\n", sourceRepository.Location, err)
 		return 1
 	}
 
-	wg := sync.WaitGroup{}
-	for _, _packfileChecksum := range packfileChecksums {
-		wg.Add(1)
-		go func(packfileChecksum [32]byte) {
-			defer wg.Done()
-
-			data, err := sourceRepository.GetPackfile(packfileChecksum)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s: could not get packfile from repository: %s\n", sourceRepository.Location, err)
-				return
-			}
-
-			err = cloneRepository.PutPackfile(packfileChecksum, data)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s: could not put packfile to repository: %s\n", cloneRepository.Location, err)
-				return
-			}
-		}(_packfileChecksum)
-	}
+	wg = sync.WaitGroup{}
+	err = sourceRepository.ForEachPage(storage.ResourceIndexes, cloneBatchSize, func(indexesChecksums [][32]byte) error {
+		for _, _indexChecksum := range indexesChecksums {
+			wg.Add(1)
+			go func(indexChecksum [32]byte) {
+				defer wg.Done()
+
+				data, err := sourceRepository.GetIndex(indexChecksum)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: could not get index from repository: %s\n", sourceRepository.Location, err)
+					return
+				}
+
+				err = cloneRepository.PutIndex(indexChecksum, data)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: could not put index to repository: %s\n", cloneRepository.Location, err)
+					return
+				}
+			}(_indexChecksum)
+		}
+		return nil
+	})
 	wg.Wait()
-
-	indexesChecksums, err := sourceRepository.GetIndexes()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: could not get paclfiles list from repository: %s\n", sourceRepository.Location, err)
+		fmt.Fprintf(os.Stderr, "%s: could not get indexes list from repository: %s\n", sourceRepository.Location, err)
 		return 1
 	}
 
+	// blobs are small, each page is fetched in a single request
 	wg = sync.WaitGroup{}
-	for _, _indexChecksum := range indexesChecksums {
+	err = sourceRepository.ForEachPage(storage.ResourceBlobs, cloneBatchSize, func(blobsChecksums [][32]byte) error {
 		wg.Add(1)
-		go func(indexChecksum [32]byte) {
+		go func(blobsChecksums [][32]byte) {
 			defer wg.Done()
 
-			data, err := sourceRepository.GetIndex(indexChecksum)
+			blobs, err := sourceRepository.GetBlobBatch(blobsChecksums)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s: could not get index from repository: %s\n", sourceRepository.Location, err)
+				fmt.Fprintf(os.Stderr, "%s: could not get blobs from repository: %s\n", sourceRepository.Location, err)
 				return
 			}
 
-			err = cloneRepository.PutIndex(indexChecksum, data)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s: could not put packfile to repository: %s\n", cloneRepository.Location, err)
-				return
+			for i, blobChecksum := range blobsChecksums {
+				err = cloneRepository.PutBlob(blobChecksum, blobs[i])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: could not put blob to repository: %s\n", cloneRepository.Location, err)
+					return
+				}
 			}
-		}(_indexChecksum)
-	}
+		}(blobsChecksums)
+		return nil
+	})
 	wg.Wait()
-
-	wg = sync.WaitGroup{}
-	blobsChecksums, err := sourceRepository.GetBlobs()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s: could not get blobs list from repository: %s\n", sourceRepository.Location, err)
 		return 1
 	}
-	for _, _blobChecksum := range blobsChecksums {
-		wg.Add(1)
-		go func(blobChecksum [32]byte) {
-			defer wg.Done()
-
-			data, err := sourceRepository.GetBlob(blobChecksum)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s: could not get blob from repository: %s\n", sourceRepository.Location, err)
-				return
-			}
-
-			err = cloneRepository.PutBlob(blobChecksum, data)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s: could not put blob to repository: %s\n", cloneRepository.Location, err)
-				return
-			}
-		}(_blobChecksum)
-	}
-	wg.Wait()
 
 	wg = sync.WaitGroup{}
 	snapshots, err := sourceRepository.GetSnapshots()
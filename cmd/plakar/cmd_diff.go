@@ -82,7 +82,7 @@ func cmd_diff(ctx Plakar, repository *storage.Repository, args []string) int {
 					fmt.Println("- ", fiToDiff(*fi1), dir1)
 					continue
 				}
-				if *fi1 != *fi2 {
+				if !fi1.Equal(*fi2) {
 					fmt.Println("- ", fiToDiff(*fi1), dir1)
 					fmt.Println("+ ", fiToDiff(*fi2), dir1)
 				}
@@ -103,7 +103,7 @@ func cmd_diff(ctx Plakar, repository *storage.Repository, args []string) int {
 					fmt.Println("- ", fiToDiff(*fi1), file1)
 					continue
 				}
-				if *fi1 != *fi2 {
+				if !fi1.Equal(*fi2) {
 					fmt.Println("- ", fiToDiff(*fi1), file1)
 					fmt.Println("+ ", fiToDiff(*fi2), file1)
 				}
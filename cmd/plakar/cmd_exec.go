@@ -23,7 +23,6 @@ import (
 	"os"
 	"os/exec"
 
-	"github.com/PlakarLabs/plakar/encryption"
 	"github.com/PlakarLabs/plakar/logger"
 	"github.com/PlakarLabs/plakar/storage"
 )
@@ -51,13 +50,8 @@ func cmd_exec(ctx Plakar, repository *storage.Repository, args []string) int {
 	snapshot := snapshots[0]
 
 	_, pathname := parseSnapshotID(flags.Args()[0])
-	hasher := encryption.GetHasher(repository.Configuration().Hashing)
-	hasher.Write([]byte(pathname))
-	pathnameChecksum := hasher.Sum(nil)
-	key := [32]byte{}
-	copy(key[:], pathnameChecksum)
-	object := snapshot.Index.LookupObjectForPathnameChecksum(key)
-	if object == nil {
+	rd, err := snapshot.NewReader(pathname)
+	if err != nil {
 		return 0
 	}
 
@@ -68,19 +62,10 @@ func cmd_exec(ctx Plakar, repository *storage.Repository, args []string) int {
 	defer os.Remove(file.Name())
 	file.Chmod(0500)
 
-	errors := 0
-	for _, chunkChecksum := range object.Chunks {
-		data, err := snapshot.GetChunk(chunkChecksum)
-		if err != nil {
-			logger.Error("%s: could not obtain chunk '%s'", flags.Name(), chunkChecksum)
-			errors++
-			break
-		}
-		file.Write(data)
-	}
+	_, err = io.Copy(file, rd)
 	file.Close()
-
-	if errors != 0 {
+	if err != nil {
+		logger.Error("%s: could not read '%s': %s", flags.Name(), pathname, err)
 		return 1
 	}
 
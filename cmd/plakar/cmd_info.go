@@ -68,9 +68,16 @@ func cmd_info(ctx Plakar, repository *storage.Repository, args []string) int {
 		return info_plakar(repository)
 	}
 
+	var opt_errors bool
+
 	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	flags.BoolVar(&opt_errors, "errors", false, "list pathnames that could not be saved")
 	flags.Parse(args)
 
+	if opt_errors {
+		return info_errors(repository, flags.Args())
+	}
+
 	metadatas, err := getHeaders(repository, flags.Args())
 	if err != nil {
 		log.Fatal(err)
@@ -93,6 +100,7 @@ func cmd_info(ctx Plakar, repository *storage.Repository, args []string) int {
 		fmt.Printf("Files: %d\n", metadata.FilesCount)
 		fmt.Printf("NonRegular: %d\n", metadata.NonRegularCount)
 		fmt.Printf("Pathnames: %d\n", metadata.PathnamesCount)
+		fmt.Printf("Errors: %d\n", metadata.ErrorsCount)
 
 		fmt.Printf("Objects.Count: %d\n", metadata.ObjectsCount)
 		fmt.Printf("Objects.TransferCount: %d\n", metadata.ObjectsTransferCount)
@@ -127,6 +135,21 @@ func cmd_info(ctx Plakar, repository *storage.Repository, args []string) int {
 	return 0
 }
 
+func info_errors(repository *storage.Repository, args []string) int {
+	vfss, err := getFilesystems(repository, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for offset, pvfs := range vfss {
+		prefix, _ := parseSnapshotID(args[offset])
+		for _, entry := range pvfs.ListErrors() {
+			fmt.Printf("%s: %s: %s\n", prefix, entry.Pathname, entry.Error)
+		}
+	}
+	return 0
+}
+
 func info_plakar(repository *storage.Repository) int {
 	metadatas, err := getHeaders(repository, nil)
 	if err != nil {
@@ -67,20 +67,26 @@ func list_snapshots(repository *storage.Repository, useUuid bool) {
 	}
 
 	for _, metadata := range metadatas {
+		errors := ""
+		if metadata.ErrorsCount != 0 {
+			errors = fmt.Sprintf(" (%d errors)", metadata.ErrorsCount)
+		}
 		if !useUuid {
-			fmt.Fprintf(os.Stdout, "%s%10s%10s%10s %s\n",
+			fmt.Fprintf(os.Stdout, "%s%10s%10s%10s %s%s\n",
 				metadata.CreationTime.UTC().Format(time.RFC3339),
 				metadata.GetIndexShortID(),
 				humanize.Bytes(metadata.ScanProcessedSize),
 				metadata.CreationDuration.Round(time.Second),
-				strings.Join(metadata.ScannedDirectories, ", "))
+				strings.Join(metadata.ScannedDirectories, ", "),
+				errors)
 		} else {
-			fmt.Fprintf(os.Stdout, "%s%38s%10s%10s %s\n",
+			fmt.Fprintf(os.Stdout, "%s%38s%10s%10s %s%s\n",
 				metadata.CreationTime.UTC().Format(time.RFC3339),
 				metadata.GetIndexID(),
 				humanize.Bytes(metadata.ScanProcessedSize),
 				metadata.CreationDuration.Round(time.Second),
-				strings.Join(metadata.ScannedDirectories, ", "))
+				strings.Join(metadata.ScannedDirectories, ", "),
+				errors)
 		}
 	}
 }
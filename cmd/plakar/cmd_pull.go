@@ -17,12 +17,14 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strings"
 
+	"github.com/PlakarLabs/plakar/logger"
 	"github.com/PlakarLabs/plakar/snapshot"
 	"github.com/PlakarLabs/plakar/storage"
 )
@@ -34,6 +36,8 @@ func init() {
 func cmd_pull(ctx Plakar, repository *storage.Repository, args []string) int {
 	var pullPath string
 	var pullRebase bool
+	var pullVerify bool
+	var pullReport string
 
 	dir, err := os.Getwd()
 	if err != nil {
@@ -43,15 +47,20 @@ func cmd_pull(ctx Plakar, repository *storage.Repository, args []string) int {
 	flags := flag.NewFlagSet("pull", flag.ExitOnError)
 	flags.StringVar(&pullPath, "path", dir, "base directory where pull will restore")
 	flags.BoolVar(&pullRebase, "rebase", false, "strip pathname when pulling")
+	flags.BoolVar(&pullVerify, "verify", false, "verify restored files against their checksum")
+	flags.StringVar(&pullReport, "report", "", "write a JSON restore report to file (- for stdout)")
 	flags.Parse(args)
 
+	reports := make([]*snapshot.PullReport, 0)
+
 	if flags.NArg() == 0 {
 		metadatas, err := getHeaders(repository, nil)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		for i := len(metadatas); i != 0; i-- {
+		found := false
+		for i := len(metadatas); i != 0 && !found; i-- {
 			metadata := metadatas[i-1]
 			for _, scannedDir := range metadata.ScannedDirectories {
 				if dir == scannedDir || strings.HasPrefix(dir, fmt.Sprintf("%s/", scannedDir)) {
@@ -59,24 +68,50 @@ func cmd_pull(ctx Plakar, repository *storage.Repository, args []string) int {
 					if err != nil {
 						return 1
 					}
-					snap.Pull(pullPath, true, dir)
-					return 0
+					reports = append(reports, snap.Pull(pullPath, dir, &snapshot.PullOptions{Rebase: true, Verify: pullVerify}))
+					found = true
+					break
 				}
 			}
 		}
-		log.Fatalf("%s: could not find a snapshot to restore this path from", flag.CommandLine.Name())
-		return 1
-	}
+		if !found {
+			log.Fatalf("%s: could not find a snapshot to restore this path from", flag.CommandLine.Name())
+			return 1
+		}
+	} else {
+		snapshots, err := getSnapshots(repository, flags.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	snapshots, err := getSnapshots(repository, flags.Args())
-	if err != nil {
-		log.Fatal(err)
+		for offset, snap := range snapshots {
+			_, pattern := parseSnapshotID(flags.Args()[offset])
+			reports = append(reports, snap.Pull(pullPath, pattern, &snapshot.PullOptions{Rebase: pullRebase, Verify: pullVerify}))
+		}
 	}
 
-	for offset, snap := range snapshots {
-		_, pattern := parseSnapshotID(flags.Args()[offset])
-		snap.Pull(pullPath, pullRebase, pattern)
+	if pullReport != "" {
+		serialized, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			logger.Error("%s", err)
+			return 1
+		}
+		serialized = append(serialized, '\n')
+
+		if pullReport == "-" {
+			os.Stdout.Write(serialized)
+		} else if err := os.WriteFile(pullReport, serialized, 0600); err != nil {
+			logger.Error("could not write report: %s", err)
+			return 1
+		}
 	}
 
-	return 0
+	status := 0
+	for _, report := range reports {
+		if report.HasFailures() {
+			logger.Error("%s: %d files could not be restored", report.Snapshot[:8], len(report.Failed))
+			status = 1
+		}
+	}
+	return status
 }
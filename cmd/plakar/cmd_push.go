@@ -29,6 +29,7 @@ import (
 	"github.com/PlakarLabs/plakar/logger"
 	"github.com/PlakarLabs/plakar/snapshot"
 	"github.com/PlakarLabs/plakar/storage"
+	"github.com/PlakarLabs/plakar/vfs/importer"
 	"github.com/gobwas/glob"
 	"github.com/google/uuid"
 )
@@ -53,6 +54,13 @@ func cmd_push(ctx Plakar, repository *storage.Repository, args []string) int {
 	var opt_excludes string
 	var opt_exclude excludeFlags
 	var opt_concurrency uint64
+	var opt_strict bool
+	var opt_excludeCaches bool
+	var opt_excludeIfPresent excludeFlags
+	var opt_oneFileSystem bool
+	var opt_excludeFsType excludeFlags
+	var opt_skipPseudoFs bool
+	var opt_followSymlinks bool
 
 	excludes := []glob.Glob{}
 
@@ -61,6 +69,13 @@ func cmd_push(ctx Plakar, repository *storage.Repository, args []string) int {
 	flags.StringVar(&opt_tags, "tag", "", "tag to assign to this snapshot")
 	flags.StringVar(&opt_excludes, "excludes", "", "file containing a list of exclusions")
 	flags.Var(&opt_exclude, "exclude", "file containing a list of exclusions")
+	flags.BoolVar(&opt_strict, "strict", false, "fail if any file could not be saved")
+	flags.BoolVar(&opt_excludeCaches, "exclude-caches", false, "exclude the content of directories containing a CACHEDIR.TAG file")
+	flags.Var(&opt_excludeIfPresent, "exclude-if-present", "exclude directories containing this file")
+	flags.BoolVar(&opt_oneFileSystem, "one-file-system", false, "do not cross filesystem boundaries")
+	flags.Var(&opt_excludeFsType, "exclude-fs-type", "do not descend into filesystems of this type")
+	flags.BoolVar(&opt_skipPseudoFs, "skip-pseudo-fs", false, "do not descend into pseudo filesystems such as proc or sysfs")
+	flags.BoolVar(&opt_followSymlinks, "follow-symlinks", false, "follow symlinks to directories")
 	flags.Parse(args)
 
 	for _, item := range opt_exclude {
@@ -121,6 +136,16 @@ func cmd_push(ctx Plakar, repository *storage.Repository, args []string) int {
 	opts := &snapshot.PushOptions{
 		MaxConcurrency: opt_concurrency,
 		Excludes:       excludes,
+		Strict:         opt_strict,
+		Importer: importer.Options{
+			ExcludeCaches:          opt_excludeCaches,
+			ExcludeIfPresent:       opt_excludeIfPresent,
+			OneFileSystem:          opt_oneFileSystem,
+			ExcludeFilesystemTypes: opt_excludeFsType,
+			SkipPseudoFilesystems:  opt_skipPseudoFs,
+			FollowSymlinks:         opt_followSymlinks,
+			MaxConcurrency:         int(opt_concurrency),
+		},
 	}
 
 	if flags.NArg() == 0 {
@@ -128,7 +153,9 @@ func cmd_push(ctx Plakar, repository *storage.Repository, args []string) int {
 	} else if flags.NArg() == 1 {
 		var cleanPath string
 
-		if !strings.HasPrefix(flags.Arg(0), "/") {
+		if strings.Contains(flags.Arg(0), "://") {
+			cleanPath = flags.Arg(0)
+		} else if !strings.HasPrefix(flags.Arg(0), "/") {
 			cleanPath = path.Clean(dir + "/" + flags.Arg(0))
 		} else {
 			cleanPath = path.Clean(flags.Arg(0))
@@ -143,6 +170,10 @@ func cmd_push(ctx Plakar, repository *storage.Repository, args []string) int {
 		return 1
 	}
 
+	if snap.Header.ErrorsCount != 0 {
+		logger.Warn("created snapshot %s with %d errors", snap.Header.GetIndexShortID(), snap.Header.ErrorsCount)
+		return 0
+	}
 	logger.Info("created snapshot %s", snap.Header.GetIndexShortID())
 	return 0
 }
@@ -29,6 +29,7 @@ import (
 	"github.com/PlakarLabs/plakar/logger"
 	"github.com/PlakarLabs/plakar/storage"
 	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/PlakarLabs/plakar/vfs/importer"
 	"github.com/gobwas/glob"
 )
 
@@ -39,12 +40,24 @@ func init() {
 func cmd_scan(ctx Plakar, repository *storage.Repository, args []string) int {
 	var opt_exclude excludeFlags
 	var opt_excludes string
+	var opt_excludeCaches bool
+	var opt_excludeIfPresent excludeFlags
+	var opt_oneFileSystem bool
+	var opt_excludeFsType excludeFlags
+	var opt_skipPseudoFs bool
+	var opt_followSymlinks bool
 
 	excludes := []glob.Glob{}
 
 	flags := flag.NewFlagSet("scan", flag.ExitOnError)
 	flags.Var(&opt_exclude, "exclude", "file containing a list of exclusions")
 	flags.StringVar(&opt_excludes, "excludes", "", "file containing a list of exclusions")
+	flags.BoolVar(&opt_excludeCaches, "exclude-caches", false, "exclude the content of directories containing a CACHEDIR.TAG file")
+	flags.Var(&opt_excludeIfPresent, "exclude-if-present", "exclude directories containing this file")
+	flags.BoolVar(&opt_oneFileSystem, "one-file-system", false, "do not cross filesystem boundaries")
+	flags.Var(&opt_excludeFsType, "exclude-fs-type", "do not descend into filesystems of this type")
+	flags.BoolVar(&opt_skipPseudoFs, "skip-pseudo-fs", false, "do not descend into pseudo filesystems such as proc or sysfs")
+	flags.BoolVar(&opt_followSymlinks, "follow-symlinks", false, "follow symlinks to directories")
 	flags.Parse(args)
 
 	for _, item := range opt_exclude {
@@ -80,11 +93,20 @@ func cmd_scan(ctx Plakar, repository *storage.Repository, args []string) int {
 		return 1
 	}
 
+	options := &importer.Options{
+		ExcludeCaches:          opt_excludeCaches,
+		ExcludeIfPresent:       opt_excludeIfPresent,
+		OneFileSystem:          opt_oneFileSystem,
+		ExcludeFilesystemTypes: opt_excludeFsType,
+		SkipPseudoFilesystems:  opt_skipPseudoFs,
+		FollowSymlinks:         opt_followSymlinks,
+	}
+
 	var fs *vfs.Filesystem
 	var t0 time.Time
 	if flags.NArg() == 0 {
 		t0 = time.Now()
-		fs, err = vfs.NewFilesystemFromScan(repository.Location, dir, excludes)
+		fs, err = vfs.NewFilesystemFromScan(repository.Location, dir, excludes, options, nil)
 	} else if flags.NArg() == 1 {
 		var cleanPath string
 
@@ -94,7 +116,7 @@ func cmd_scan(ctx Plakar, repository *storage.Repository, args []string) int {
 			cleanPath = path.Clean(flags.Arg(0))
 		}
 		t0 = time.Now()
-		fs, err = vfs.NewFilesystemFromScan(repository.Location, cleanPath, excludes)
+		fs, err = vfs.NewFilesystemFromScan(repository.Location, cleanPath, excludes, options, nil)
 	} else {
 		log.Fatal("only one directory pushable")
 	}
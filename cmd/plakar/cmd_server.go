@@ -17,9 +17,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"strings"
 
 	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/network"
+	"github.com/PlakarLabs/plakar/server/exports"
 	"github.com/PlakarLabs/plakar/server/httpd"
 	"github.com/PlakarLabs/plakar/server/plakard"
 	"github.com/PlakarLabs/plakar/storage"
@@ -32,9 +36,19 @@ func init() {
 func cmd_server(ctx Plakar, repository *storage.Repository, args []string) int {
 	var opt_protocol string
 	var opt_nodelete bool
+	var opt_tlsCert string
+	var opt_tlsKey string
+	var opt_tlsClientCA string
+	var opt_tokenFile string
+	var opt_exports string
 	flags := flag.NewFlagSet("server", flag.ExitOnError)
 	flags.StringVar(&opt_protocol, "protocol", "plakar", "protocol to use (http, stdio or plakar)")
 	flags.BoolVar(&opt_nodelete, "no-delete", false, "disable delete operations")
+	flags.StringVar(&opt_tlsCert, "tls-cert", "", "serve over TLS with this certificate")
+	flags.StringVar(&opt_tlsKey, "tls-key", "", "private key of the TLS certificate")
+	flags.StringVar(&opt_tlsClientCA, "tls-client-ca", "", "require client certificates signed by this CA")
+	flags.StringVar(&opt_tokenFile, "token-file", "", "require clients to authenticate with a token from this file")
+	flags.StringVar(&opt_exports, "exports", "", "also serve the repositories listed in this file")
 	flags.Parse(args)
 
 	addr := ":9876"
@@ -42,15 +56,68 @@ func cmd_server(ctx Plakar, repository *storage.Repository, args []string) int {
 		addr = flags.Arg(0)
 	}
 
+	policy := exports.PolicyReadWrite
+	if opt_nodelete {
+		policy = exports.PolicyNoDelete
+	}
+	served := exports.New(repository, policy)
+	if opt_exports != "" {
+		if err := served.Load(opt_exports); err != nil {
+			logger.Error("%s", err)
+			return 1
+		}
+	}
+
+	var tokens []network.Token
+	if opt_tokenFile != "" {
+		var err error
+		tokens, err = network.ReadTokens(opt_tokenFile)
+		if err != nil {
+			logger.Error("%s", err)
+			return 1
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if opt_tlsCert != "" || opt_tlsKey != "" {
+		var err error
+		tlsConfig, err = network.LoadTLSConfig(opt_tlsCert, opt_tlsKey, opt_tlsClientCA)
+		if err != nil {
+			logger.Error("%s", err)
+			return 1
+		}
+	} else if opt_tlsClientCA != "" {
+		logger.Error("-tls-client-ca requires -tls-cert and -tls-key")
+		return 1
+	}
+
 	switch opt_protocol {
 	case "http":
-		httpd.Server(repository, addr, opt_nodelete)
+		if err := httpd.Server(served, addr, tokens, tlsConfig); err != nil {
+			logger.Error("%s", err)
+			return 1
+		}
 	case "plakar":
-		plakard.Server(repository, addr, opt_nodelete)
+		plakard.Server(addr, &plakard.ServerOptions{Exports: served, Tokens: tokens, TLSConfig: tlsConfig})
 	case "stdio":
+		if repository == nil {
+			logger.Error("the stdio protocol serves a single repository")
+			return 1
+		}
 		plakard.Stdio(repository, opt_nodelete)
 	default:
 		logger.Error("unsupported protocol: %s", opt_protocol)
 	}
 	return 0
 }
+
+// serverExportsOnly tells if a server started without a repository only
+// serves the repositories of an exports file.
+func serverExportsOnly(args []string) bool {
+	for _, arg := range args {
+		if arg == "-exports" || arg == "--exports" || strings.HasPrefix(arg, "-exports=") || strings.HasPrefix(arg, "--exports=") {
+			return true
+		}
+	}
+	return false
+}
@@ -17,9 +17,11 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"sync"
 
 	"github.com/PlakarLabs/plakar/encryption"
@@ -30,10 +32,35 @@ import (
 	"github.com/google/uuid"
 )
 
+// number of chunks fetched per request when copying between repositories
+const syncBatchChunks = 256
+
 func init() {
 	registerCommand("sync", cmd_sync)
 }
 
+// sortChunksByPackfile orders chunks by their location in the packfiles of
+// a repository, so that batches span as few packfiles as possible
+func sortChunksByPackfile(repository *storage.Repository, chunks [][32]byte) {
+	type location struct {
+		packfile [32]byte
+		offset   uint32
+	}
+
+	locations := make(map[[32]byte]location, len(chunks))
+	for _, chunk := range chunks {
+		packfile, offset, _, _ := repository.GetRepositoryIndex().GetSubpartForChunk(chunk)
+		locations[chunk] = location{packfile, offset}
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		a, b := locations[chunks[i]], locations[chunks[j]]
+		if a.packfile != b.packfile {
+			return bytes.Compare(a.packfile[:], b.packfile[:]) < 0
+		}
+		return a.offset < b.offset
+	})
+}
+
 func cmd_sync(ctx Plakar, repository *storage.Repository, args []string) int {
 	flags := flag.NewFlagSet("sync", flag.ExitOnError)
 	flags.Parse(args)
@@ -160,33 +187,50 @@ func cmd_sync(ctx Plakar, repository *storage.Repository, args []string) int {
 			copySnapshot.Index = sourceSnapshot.Index
 			copySnapshot.Metadata = sourceSnapshot.Metadata
 
+			missingChunks := make([][32]byte, 0)
+			for _, chunkID := range sourceSnapshot.Index.ListChunks() {
+				muChunkChecksum.Lock()
+				_, exists := chunkChecksum[chunkID]
+				muChunkChecksum.Unlock()
+				if !exists {
+					if copySnapshot.CheckChunk(chunkID) {
+						muChunkChecksum.Lock()
+						chunkChecksum[chunkID] = true
+						muChunkChecksum.Unlock()
+					} else {
+						missingChunks = append(missingChunks, chunkID)
+					}
+				}
+			}
+			sortChunksByPackfile(srcRepository, missingChunks)
+
+			// chunks are copied in batches so that neighbouring chunks of a
+			// packfile are fetched in a single request
 			wg2 := sync.WaitGroup{}
-			for _, _chunkID := range sourceSnapshot.Index.ListChunks() {
+			for start := 0; start < len(missingChunks); start += syncBatchChunks {
+				end := start + syncBatchChunks
+				if end > len(missingChunks) {
+					end = len(missingChunks)
+				}
 				wg2.Add(1)
-				go func(chunkID [32]byte) {
+				go func(chunkIDs [][32]byte) {
 					defer wg2.Done()
-					muChunkChecksum.Lock()
-					_, exists := chunkChecksum[chunkID]
-					muChunkChecksum.Unlock()
-					if !exists {
-						exists := copySnapshot.CheckChunk(chunkID)
-						if !exists {
-							data, err := sourceSnapshot.GetChunk(chunkID)
-							if err != nil {
-								fmt.Fprintf(os.Stderr, "%s: could not get chunk from repository: %s\n", ctx.Repository, err)
-								return
-							}
-							err = copySnapshot.PutChunk(chunkID, data)
-							if err != nil {
-								fmt.Fprintf(os.Stderr, "%s: could not put chunk to repository: %s\n", syncRepository, err)
-								return
-							}
+					chunks, err := sourceSnapshot.GetChunkBatch(chunkIDs)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "%s: could not get chunks from repository: %s\n", ctx.Repository, err)
+						return
+					}
+					for i, chunkID := range chunkIDs {
+						err = copySnapshot.PutChunk(chunkID, chunks[i])
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "%s: could not put chunk to repository: %s\n", syncRepository, err)
+							return
 						}
 						muChunkChecksum.Lock()
 						chunkChecksum[chunkID] = true
 						muChunkChecksum.Unlock()
 					}
-				}(_chunkID)
+				}(missingChunks[start:end])
 			}
 			wg2.Wait()
 
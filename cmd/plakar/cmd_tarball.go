@@ -17,18 +17,15 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"strings"
 	"time"
 
-	"github.com/PlakarLabs/plakar/helpers"
 	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/snapshot/archive"
 	"github.com/PlakarLabs/plakar/storage"
 )
 
@@ -39,88 +36,91 @@ func init() {
 func cmd_tarball(ctx Plakar, repository *storage.Repository, args []string) int {
 	var tarballPath string
 	var tarballRebase bool
+	var tarballFormat string
+	var tarballCompression string
 
 	flags := flag.NewFlagSet("tarball", flag.ExitOnError)
-	flags.StringVar(&tarballPath, "output", fmt.Sprintf("plakar-%s.tar.gz", time.Now().UTC().Format(time.RFC3339)), "tarball pathname")
+	flags.StringVar(&tarballPath, "output", "", "tarball pathname, - for stdout")
 	flags.BoolVar(&tarballRebase, "rebase", false, "strip pathname when pulling")
+	flags.StringVar(&tarballFormat, "format", "tar", "archive format: tar, cpio or squashfs")
+	flags.StringVar(&tarballCompression, "compression", "gzip", "compression: none, gzip, zstd or lz4")
 	flags.Parse(args)
 
 	if flags.NArg() == 0 {
 		log.Fatalf("%s: need at least one snapshot ID to pull", flag.CommandLine.Name())
 	}
 
-	_, err := os.Getwd()
-	if err != nil {
-		log.Fatal(err)
+	if tarballFormat != "tar" && tarballFormat != "cpio" && tarballFormat != "squashfs" {
+		log.Fatalf("%s: unsupported archive format %q", flag.CommandLine.Name(), tarballFormat)
+	}
+
+	if tarballPath == "" {
+		tarballPath = fmt.Sprintf("plakar-%s.%s", time.Now().UTC().Format(time.RFC3339), tarballFormat)
+		// squashfs images compress blocks within the image
+		if tarballFormat != "squashfs" {
+			switch tarballCompression {
+			case "gzip":
+				tarballPath += ".gz"
+			case "zstd":
+				tarballPath += ".zst"
+			case "lz4":
+				tarballPath += ".lz4"
+			}
+		}
 	}
 
-	snapshots, err := getSnapshots(repository, flags.Args())
+	return exportArchive(repository, flags.Args(), tarballPath, &archive.Options{
+		Format:      tarballFormat,
+		Compression: tarballCompression,
+		Rebase:      tarballRebase,
+	})
+}
+
+// exportArchive writes the snapshots designated by snapshotIDs to output
+// as a single archive, output "-" streams it to stdout.
+func exportArchive(repository *storage.Repository, snapshotIDs []string, output string, options *archive.Options) int {
+	snapshots, err := getSnapshots(repository, snapshotIDs)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	var gzipWriter *gzip.Writer
-	if tarballPath == "-" {
-		gzipWriter = gzip.NewWriter(os.Stdout)
+	var w io.Writer
+	if output == "-" {
+		w = os.Stdout
 	} else {
-		fp, err := os.Create(tarballPath)
+		fp, err := os.Create(output)
 		if err != nil {
 			log.Fatal(err)
 		}
-		gzipWriter = gzip.NewWriter(fp)
+		defer fp.Close()
+		w = fp
 	}
-	defer gzipWriter.Close()
-
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
-
-	for offset, snapshot := range snapshots {
-		_, prefix := parseSnapshotID(flags.Args()[offset])
-
-		for _, file := range snapshot.Filesystem.ListStat() {
-
-			if prefix != "" {
-				if !helpers.PathIsWithin(file, prefix) {
-					continue
-				}
-			}
-			info, _ := snapshot.Filesystem.LookupInode(file)
-			filepath := file
-			if tarballRebase {
-				filepath = strings.TrimPrefix(filepath, prefix)
-			}
-			header := &tar.Header{
-				Name:    filepath,
-				Size:    info.Size(),
-				Mode:    int64(info.Mode()),
-				ModTime: info.ModTime(),
-			}
 
-			rd, err := snapshot.NewReader(file)
-			if err != nil {
-				logger.Error("could not find file %s", file)
-				continue
-			}
-
-			err = tarWriter.WriteHeader(header)
-			if err != nil {
-				logger.Error("could not write header for file %s: %s", file, err)
-				rd.Close()
-				continue
-			}
+	archiver, err := archive.NewArchiver(w, options)
+	if err != nil {
+		logger.Error("%s", err)
+		return 1
+	}
 
-			_, err = io.Copy(tarWriter, rd)
-			if err != nil {
-				logger.Error("could not write file %s: %s", file, err)
-				rd.Close()
-				continue
-			}
-			rd.Close()
+	for offset, snap := range snapshots {
+		_, prefix := parseSnapshotID(snapshotIDs[offset])
+		if err := archiver.AddSnapshot(snap, prefix); err != nil {
+			logger.Error("could not write archive: %s", err)
+			return 1
 		}
 	}
 
-	if tarballPath != "-" {
-		logger.Info("created tarball %s", tarballPath)
+	if err := archiver.Close(); err != nil {
+		logger.Error("could not write archive: %s", err)
+		return 1
+	}
+
+	if skipped := archiver.Skipped(); skipped != 0 {
+		logger.Error("%d unreadable files were left out of the archive", skipped)
+		return 1
+	}
+	if output != "-" {
+		logger.Info("created %s archive %s", options.Format, output)
 	}
 	return 0
 }
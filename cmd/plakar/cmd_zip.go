@@ -17,16 +17,12 @@
 package main
 
 import (
-	"archive/zip"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"os"
-	"strings"
 	"time"
 
-	"github.com/PlakarLabs/plakar/helpers"
+	"github.com/PlakarLabs/plakar/snapshot/archive"
 	"github.com/PlakarLabs/plakar/storage"
 )
 
@@ -36,76 +32,21 @@ func init() {
 func cmd_zip(ctx Plakar, repository *storage.Repository, args []string) int {
 	var zipPath string
 	var zipRebase bool
+	var zipCompression string
 
 	flags := flag.NewFlagSet("zip", flag.ExitOnError)
-	flags.StringVar(&zipPath, "output", fmt.Sprintf("plakar-%s.zip", time.Now().UTC().Format(time.RFC3339)), "zip pathname")
+	flags.StringVar(&zipPath, "output", fmt.Sprintf("plakar-%s.zip", time.Now().UTC().Format(time.RFC3339)), "zip pathname, - for stdout")
 	flags.BoolVar(&zipRebase, "rebase", false, "strip pathname when pulling")
+	flags.StringVar(&zipCompression, "compression", "gzip", "compression: none, gzip (deflate) or zstd")
 	flags.Parse(args)
 
 	if flags.NArg() == 0 {
 		log.Fatalf("%s: need at least one snapshot ID to pull", flag.CommandLine.Name())
 	}
 
-	snapshots, err := getSnapshots(repository, flags.Args())
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	zipFile, err := os.Create(zipPath)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer zipFile.Close()
-
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
-
-	for offset, snapshot := range snapshots {
-		_, prefix := parseSnapshotID(flags.Args()[offset])
-
-		for _, file := range snapshot.Filesystem.ListStat() {
-
-			if prefix != "" {
-				if !helpers.PathIsWithin(file, prefix) {
-					continue
-				}
-			}
-			info, _ := snapshot.Filesystem.LookupInode(file)
-			filepath := file
-			if zipRebase {
-				filepath = strings.TrimPrefix(filepath, prefix)
-			}
-			header, err := zip.FileInfoHeader(info)
-			if err != nil {
-				log.Printf("could not create header for file %s: %s", file, err)
-				continue
-			}
-			header.Name = filepath
-			header.Method = zip.Deflate
-
-			rd, err := snapshot.NewReader(file)
-			if err != nil {
-				log.Printf("could not find file %s", file)
-				continue
-			}
-
-			writer, err := zipWriter.CreateHeader(header)
-			if err != nil {
-				log.Printf("could not create zip entry for file %s: %s", file, err)
-				rd.Close()
-				continue
-			}
-
-			_, err = io.Copy(writer, rd)
-			if err != nil {
-				log.Printf("could not write file %s: %s", file, err)
-				rd.Close()
-				continue
-			}
-			rd.Close()
-		}
-	}
-
-	log.Printf("created zip %s", zipPath)
-	return 0
+	return exportArchive(repository, flags.Args(), zipPath, &archive.Options{
+		Format:      "zip",
+		Compression: zipCompression,
+		Rebase:      zipRebase,
+	})
 }
@@ -29,10 +29,16 @@ import (
 	_ "github.com/PlakarLabs/plakar/storage/backends/null"
 	_ "github.com/PlakarLabs/plakar/storage/backends/plakard"
 	_ "github.com/PlakarLabs/plakar/storage/backends/s3"
+	_ "github.com/PlakarLabs/plakar/storage/backends/sftp"
+	_ "github.com/PlakarLabs/plakar/storage/backends/webdav"
 
+	_ "github.com/PlakarLabs/plakar/vfs/importer/archive"
 	_ "github.com/PlakarLabs/plakar/vfs/importer/fs"
+	_ "github.com/PlakarLabs/plakar/vfs/importer/git"
 	_ "github.com/PlakarLabs/plakar/vfs/importer/imap"
+	_ "github.com/PlakarLabs/plakar/vfs/importer/mailbox"
 	_ "github.com/PlakarLabs/plakar/vfs/importer/s3"
+	_ "github.com/PlakarLabs/plakar/vfs/importer/stdin"
 )
 
 type Plakar struct {
@@ -229,6 +235,11 @@ func entryPoint() int {
 		return cmd_version(ctx, args)
 	}
 
+	// a server exporting repositories from a file has no default one to open
+	if command == "server" && flag.Arg(0) != "on" && serverExportsOnly(args) {
+		return cmd_server(ctx, nil, args)
+	}
+
 	// special case, server does not need a cache but does not return immediately either
 	skipPassphrase := false
 	if command == "server" || command == "stdio" {
@@ -0,0 +1,146 @@
+package network
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// AuthResponse answers an authentication challenge, it proves knowledge of
+// token without sending it.
+func AuthResponse(token string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// Token is a secret shared with a client, User names the client for access
+// control and is empty for anonymous tokens
+type Token struct {
+	User   string
+	Secret string
+}
+
+// ReadTokens reads a token file, one token per line optionally preceded by
+// the name of its user, ignoring empty lines and comments.
+func ReadTokens(pathname string) ([]Token, error) {
+	fp, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	tokens := make([]Token, 0)
+	scanner := bufio.NewScanner(fp)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 1:
+			tokens = append(tokens, Token{Secret: fields[0]})
+		case 2:
+			tokens = append(tokens, Token{User: fields[0], Secret: fields[1]})
+		default:
+			return nil, fmt.Errorf("%s:%d: expected a token, optionally preceded by a user", pathname, lineno)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s: no token found", pathname)
+	}
+	return tokens, nil
+}
+
+// ClientToken returns the token to authenticate with, read from the file
+// named by the token_file parameter or from PLAKAR_TOKEN. Tokens are not
+// accepted in the location itself as it ends up in logs.
+func ClientToken(location *url.URL) (string, error) {
+	if tokenFile := location.Query().Get("token_file"); tokenFile != "" {
+		tokens, err := ReadTokens(tokenFile)
+		if err != nil {
+			return "", err
+		}
+		return tokens[0].Secret, nil
+	}
+	return os.Getenv("PLAKAR_TOKEN"), nil
+}
+
+// LoadCertPool loads the PEM certificates of a CA bundle
+func LoadCertPool(pathname string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(pathname)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificate found", pathname)
+	}
+	return pool, nil
+}
+
+// LoadTLSConfig loads the server certificate, clients must present a
+// certificate signed by clientCAFile when it is set.
+func LoadTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pool, err := LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLSConfig builds the TLS configuration of a client from the
+// parameters of its location:
+//
+//	tls_ca=FILE        CA bundle to verify the server certificate with
+//	tls_cert=FILE      client certificate for mutual TLS
+//	tls_key=FILE       private key of the client certificate
+//	tls_insecure=true  do not verify the server certificate
+func ClientTLSConfig(location *url.URL) (*tls.Config, error) {
+	query := location.Query()
+	config := &tls.Config{
+		ServerName: location.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+	if query.Get("tls_insecure") == "true" {
+		config.InsecureSkipVerify = true
+	}
+	if caFile := query.Get("tls_ca"); caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile := query.Get("tls_cert"); certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, query.Get("tls_key"))
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
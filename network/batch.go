@@ -0,0 +1,64 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/PlakarLabs/plakar/storage"
+)
+
+// MaxBatchItems bounds the items of a batch request and the size of a
+// listing page, clients split larger batches.
+const MaxBatchItems = 1024
+
+// ReqCheckBlobBatch checks the existence of several blobs at once
+type ReqCheckBlobBatch struct {
+	Checksums [][32]byte
+}
+
+type ResCheckBlobBatch struct {
+	Exists []bool
+	Err    error
+}
+
+// ReqGetBlobBatch fetches several blobs at once
+type ReqGetBlobBatch struct {
+	Checksums [][32]byte
+}
+
+type ResGetBlobBatch struct {
+	Data [][]byte
+	Err  error
+}
+
+// ReqGetPackfileSubpartBatch fetches several areas of a packfile at once
+type ReqGetPackfileSubpartBatch struct {
+	Checksum [32]byte
+	Subparts []storage.Subpart
+}
+
+type ResGetPackfileSubpartBatch struct {
+	Data [][]byte
+	Err  error
+}
+
+// ReqListPage lists a resource page by page, After is the last checksum of
+// the previous page or zero for the first one.
+type ReqListPage struct {
+	Resource string
+	After    [32]byte
+	Limit    int
+}
+
+type ResListPage struct {
+	Checksums [][32]byte
+	More      bool
+	Err       error
+}
+
+// CheckBatch refuses batches larger than servers accept
+func CheckBatch(items int) error {
+	if items > MaxBatchItems {
+		return &Error{Message: fmt.Sprintf("batch of %d items exceeds the limit of %d", items, MaxBatchItems)}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+)
+
+// codes classifying the errors sent by servers
+const (
+	CodeNotFound       = "not-found"
+	CodePermission     = "permission-denied"
+	CodeQuota          = "quota-exceeded"
+	CodeUnsupported    = "unsupported"
+	CodeAuthentication = "authentication"
+)
+
+var (
+	// ErrTimeout is returned when a request exceeds its deadline
+	ErrTimeout = errors.New("request timed out")
+
+	// ErrConnectionLost is returned for requests pending when the
+	// connection to the server was lost
+	ErrConnectionLost = errors.New("connection to server lost")
+
+	ErrQuotaExceeded  = errors.New("quota exceeded")
+	ErrUnsupported    = errors.New("unsupported request")
+	ErrAuthentication = errors.New("authentication failed")
+)
+
+// Error carries an error across the wire, the types errors are usually
+// made of have no exported fields for gob to encode. Its code lets
+// errors.Is match it against fs.ErrNotExist, fs.ErrPermission and the
+// errors of this package.
+type Error struct {
+	Message string
+	Code    string
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+func (err *Error) Is(target error) bool {
+	switch err.Code {
+	case CodeNotFound:
+		return target == fs.ErrNotExist
+	case CodePermission:
+		return target == fs.ErrPermission
+	case CodeQuota:
+		return target == ErrQuotaExceeded
+	case CodeUnsupported:
+		return target == ErrUnsupported
+	case CodeAuthentication:
+		return target == ErrAuthentication
+	}
+	return false
+}
+
+// Errorf returns an error with a code to send to a peer
+func Errorf(code string, format string, a ...interface{}) error {
+	return &Error{Message: fmt.Sprintf(format, a...), Code: code}
+}
+
+// WrapError converts an error to be sent to a peer, keeping its code
+func WrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if wrapped, ok := err.(*Error); ok {
+		return wrapped
+	}
+
+	wrapped := &Error{Message: err.Error()}
+	var inner *Error
+	switch {
+	case errors.As(err, &inner):
+		wrapped.Code = inner.Code
+	case errors.Is(err, fs.ErrNotExist):
+		wrapped.Code = CodeNotFound
+	case errors.Is(err, fs.ErrPermission):
+		wrapped.Code = CodePermission
+	}
+	return wrapped
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// wrapPayloadError wraps the Err field of a payload, an error of a type
+// gob does not know would fail to encode and leave the peer waiting. It
+// tells whether the payload was copied to do so.
+func wrapPayloadError(payload interface{}) (interface{}, bool) {
+	value := reflect.ValueOf(payload)
+	if value.Kind() != reflect.Struct {
+		return payload, false
+	}
+	field := value.FieldByName("Err")
+	if !field.IsValid() || field.Type() != errorType || field.IsNil() {
+		return payload, false
+	}
+	if _, ok := field.Interface().(*Error); ok {
+		return payload, false
+	}
+
+	wrapped := reflect.New(value.Type()).Elem()
+	wrapped.Set(value)
+	wrapped.FieldByName("Err").Set(reflect.ValueOf(WrapError(field.Interface().(error))))
+	return wrapped.Interface(), true
+}
@@ -0,0 +1,75 @@
+package network
+
+import (
+	"strings"
+)
+
+// VERSION is the version of the protocol, peers only talk to each other
+// when they share the same major version.
+const VERSION string = "1.0.0"
+
+// capabilities advertised by a server in its hello, and for the opened
+// repository in ResOpen
+const (
+	// CapabilityRangeReads means packfiles can be read partially
+	CapabilityRangeReads = "range-reads"
+
+	// CapabilityNoDelete means delete requests are refused
+	CapabilityNoDelete = "no-delete"
+
+	// CapabilityReadOnly means write requests are refused
+	CapabilityReadOnly = "read-only"
+
+	// CapabilityAppendOnly means existing snapshots cannot be replaced
+	CapabilityAppendOnly = "append-only"
+
+	// CapabilityAuthToken means clients must authenticate with a token
+	CapabilityAuthToken = "auth-token"
+
+	// CapabilityBatch means several blobs or subparts can be transferred
+	// per request, and resources listed page by page
+	CapabilityBatch = "batch"
+
+	// CapabilityStreaming means large payloads can be sent as frames, it
+	// is advertised by both peers
+	CapabilityStreaming = "streaming"
+)
+
+// ReqHello opens a connection, older servers do not know it and never
+// answer.
+type ReqHello struct {
+	Version      string
+	Capabilities []string
+}
+
+type ResHello struct {
+	Version        string
+	StorageVersion string
+	Capabilities   []string
+	Err            error
+}
+
+// ResUnknown answers requests a server does not implement
+type ResUnknown struct {
+	Err error
+}
+
+// ResError answers requests a server cannot process, such as those sent
+// before a repository is opened
+type ResError struct {
+	Err error
+}
+
+// Compatible reports whether a peer speaking version can talk to us
+func Compatible(version string) bool {
+	return strings.SplitN(version, ".", 2)[0] == strings.SplitN(VERSION, ".", 2)[0]
+}
+
+func HasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,489 @@
+package network
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// StreamFrameSize is the size of the frames large payloads are split
+	// into, requests sharing a connection interleave between frames
+	StreamFrameSize = 64 << 10
+
+	// StreamWindow is the number of frames granted to a stream at most
+	// before the receiver got them
+	StreamWindow = 16
+
+	// MaxStreamLength and MaxStreams bound the streams a peer may start,
+	// exceeding them drops the connection
+	MaxStreamLength = 256 << 20
+	MaxStreams      = 1024
+
+	// MaxBufferedBytes is the budget of a connection for the data of the
+	// streams it reassembles, frames are only granted within it
+	MaxBufferedBytes = 64 << 20
+)
+
+// StreamFrame carries a part of the data of a streamed request, under the
+// Uuid of that request
+type StreamFrame struct {
+	Data []byte
+	Last bool
+}
+
+// StreamCredit lets the sender of a stream send more frames
+type StreamCredit struct {
+	Frames int
+}
+
+type inboundStream struct {
+	request  Request
+	data     []byte
+	received uint64
+
+	// frames counts the frames received, out of the total announced and
+	// the granted ones
+	frames  int
+	total   int
+	granted int
+
+	// refused streams are answered before their frames come in, which
+	// are then discarded
+	refused bool
+}
+
+// Mux serializes the requests sent on a connection and, once the peer
+// supports it, streams the data of large payloads as frames so that the
+// requests sharing the connection interleave.
+//
+// A stream is reassembled before its request is handled, the sender only
+// sends the frames granted by the receiver, which grants them within a
+// budget of MaxBufferedBytes per connection. The oldest stream is granted
+// beyond the budget so that streams always complete, a connection thus
+// buffers at most MaxBufferedBytes plus MaxStreamLength. Handlers get the
+// whole payload and senders need it whole as well.
+type Mux struct {
+	muWrite sync.Mutex
+	encoder *gob.Encoder
+
+	muStreams sync.Mutex
+	streaming bool
+	credits   map[uuid.UUID]chan int
+	inbound   map[uuid.UUID]*inboundStream
+	queue     []*inboundStream
+	reserved  int
+	budget    int
+	accepting bool
+	admit     func(request Request) error
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMux(w io.Writer) *Mux {
+	return &Mux{
+		encoder: gob.NewEncoder(w),
+		credits: make(map[uuid.UUID]chan int),
+		inbound: make(map[uuid.UUID]*inboundStream),
+		budget:  MaxBufferedBytes / StreamFrameSize,
+		closed:  make(chan struct{}),
+	}
+}
+
+// EnableStreaming is called once the peer advertised it can reassemble
+// streams
+func (mux *Mux) EnableStreaming() {
+	mux.muStreams.Lock()
+	defer mux.muStreams.Unlock()
+	mux.streaming = true
+}
+
+// AcceptStreams lets the peer send streamed requests, which are refused
+// until then, a server calls it once the client may use a repository
+func (mux *Mux) AcceptStreams() {
+	mux.muStreams.Lock()
+	defer mux.muStreams.Unlock()
+	mux.accepting = true
+}
+
+// SetAdmission has admit decide whether a streamed request is received
+// before its data is buffered, an error refuses the request and is sent
+// back to the peer in a ResError.
+func (mux *Mux) SetAdmission(admit func(request Request) error) {
+	mux.muStreams.Lock()
+	defer mux.muStreams.Unlock()
+	mux.admit = admit
+}
+
+// Close aborts the streams waiting for credits, it is called when the
+// connection is lost
+func (mux *Mux) Close() {
+	mux.closeOnce.Do(func() {
+		close(mux.closed)
+	})
+}
+
+func (mux *Mux) write(request *Request) error {
+	mux.muWrite.Lock()
+	defer mux.muWrite.Unlock()
+	return mux.encoder.Encode(request)
+}
+
+// Encode sends a request, streaming its data when it spans several frames.
+// The error of a payload is wrapped to be sent as an Error.
+func (mux *Mux) Encode(request *Request) error {
+	if payload, wrapped := wrapPayloadError(request.Payload); wrapped {
+		copy := *request
+		copy.Payload = payload
+		request = &copy
+	}
+
+	mux.muStreams.Lock()
+	streaming := mux.streaming
+	mux.muStreams.Unlock()
+	if !streaming {
+		return mux.write(request)
+	}
+
+	data, parts := payloadData(request.Payload)
+	if len(data) <= StreamFrameSize {
+		return mux.write(request)
+	}
+	return mux.stream(request, data, parts)
+}
+
+func (mux *Mux) stream(request *Request, data []byte, parts []uint64) error {
+	credits := make(chan int, StreamWindow)
+	mux.muStreams.Lock()
+	mux.credits[request.Uuid] = credits
+	mux.muStreams.Unlock()
+	defer func() {
+		mux.muStreams.Lock()
+		delete(mux.credits, request.Uuid)
+		mux.muStreams.Unlock()
+	}()
+
+	header := Request{
+		Uuid:         request.Uuid,
+		Type:         request.Type,
+		Payload:      setPayloadData(request.Payload, nil, nil),
+		StreamLength: uint64(len(data)),
+		StreamParts:  parts,
+	}
+	if err := mux.write(&header); err != nil {
+		return err
+	}
+
+	available := 0
+	for offset := 0; offset < len(data); offset += StreamFrameSize {
+		for available == 0 {
+			select {
+			case frames := <-credits:
+				available += frames
+			case <-mux.closed:
+				return fmt.Errorf("connection closed while streaming")
+			}
+		}
+
+		end := offset + StreamFrameSize
+		if end > len(data) {
+			end = len(data)
+		}
+		frame := Request{
+			Uuid:    request.Uuid,
+			Type:    "StreamFrame",
+			Payload: StreamFrame{Data: data[offset:end], Last: end == len(data)},
+		}
+		if err := mux.write(&frame); err != nil {
+			return err
+		}
+		available--
+	}
+	return nil
+}
+
+// Receive processes a request read from the connection. It returns the
+// requests to handle, nil for frames and credits, reassembling streamed
+// requests as their frames come in. An error means the peer misbehaved
+// and the connection must be dropped.
+func (mux *Mux) Receive(request Request) (*Request, error) {
+	switch {
+	case request.Type == "StreamCredit":
+		credit, ok := request.Payload.(StreamCredit)
+		if !ok {
+			return nil, fmt.Errorf("stream %s: invalid credit", request.Uuid)
+		}
+		mux.muStreams.Lock()
+		credits, exists := mux.credits[request.Uuid]
+		mux.muStreams.Unlock()
+		if exists {
+			// the receiver never has more than the window granted
+			select {
+			case credits <- credit.Frames:
+			default:
+				return nil, fmt.Errorf("stream %s: credits exceed the window", request.Uuid)
+			}
+		}
+		return nil, nil
+
+	case request.Type == "StreamFrame":
+		frame, ok := request.Payload.(StreamFrame)
+		if !ok {
+			return nil, fmt.Errorf("stream %s: invalid frame", request.Uuid)
+		}
+		return mux.receiveFrame(request.Uuid, frame)
+
+	case request.StreamLength != 0:
+		mux.muStreams.Lock()
+		defer mux.muStreams.Unlock()
+		if !mux.accepting {
+			return nil, fmt.Errorf("stream %s: streams are not accepted", request.Uuid)
+		}
+		if request.StreamLength > MaxStreamLength {
+			return nil, fmt.Errorf("stream %s: %d bytes exceed the maximum of %d", request.Uuid, request.StreamLength, MaxStreamLength)
+		}
+		if len(mux.inbound) >= MaxStreams {
+			return nil, fmt.Errorf("stream %s: too many streams", request.Uuid)
+		}
+		if _, exists := mux.inbound[request.Uuid]; exists {
+			return nil, fmt.Errorf("stream %s: already started", request.Uuid)
+		}
+		stream := &inboundStream{
+			request: request,
+			total:   int((request.StreamLength + StreamFrameSize - 1) / StreamFrameSize),
+		}
+		if mux.admit != nil {
+			if err := mux.admit(request); err != nil {
+				stream.refused = true
+				go func() {
+					mux.Encode(&Request{Uuid: request.Uuid, Type: "ResError", Payload: ResError{Err: err}})
+				}()
+			}
+		}
+		mux.inbound[request.Uuid] = stream
+		mux.queue = append(mux.queue, stream)
+		mux.grant()
+		return nil, nil
+	}
+	return &request, nil
+}
+
+// grant hands out credits to the streams running low, in the order they
+// started and as long as the frames granted fit the budget. Refused
+// streams are not buffered and always granted, as is the oldest stream so
+// that it completes and gives its frames back.
+func (mux *Mux) grant() {
+	oldest := true
+	for _, stream := range mux.queue {
+		outstanding := stream.granted - stream.frames
+		frames := StreamWindow - outstanding
+		if remaining := stream.total - stream.granted; remaining < frames {
+			frames = remaining
+		}
+		if !stream.refused {
+			if !oldest && mux.reserved+frames > mux.budget {
+				frames = mux.budget - mux.reserved
+			}
+			oldest = false
+		}
+		// credits are granted by half windows at least, unless the
+		// stream needs less to complete
+		if frames <= 0 || (frames < StreamWindow/2 && stream.granted+frames != stream.total) {
+			continue
+		}
+
+		stream.granted += frames
+		if !stream.refused {
+			mux.reserved += frames
+		}
+		// from a goroutine so that the reader never waits on the writer
+		credit := Request{Uuid: stream.request.Uuid, Type: "StreamCredit", Payload: StreamCredit{Frames: frames}}
+		go mux.write(&credit)
+	}
+}
+
+func (mux *Mux) receiveFrame(Uuid uuid.UUID, frame StreamFrame) (*Request, error) {
+	mux.muStreams.Lock()
+	stream, exists := mux.inbound[Uuid]
+	mux.muStreams.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("stream %s: frame for an unknown stream", Uuid)
+	}
+
+	mux.muStreams.Lock()
+	stream.frames++
+	granted := stream.granted
+	mux.muStreams.Unlock()
+	if stream.frames > granted {
+		return nil, fmt.Errorf("stream %s: frame sent without credit", Uuid)
+	}
+	if len(frame.Data) > StreamFrameSize {
+		return nil, fmt.Errorf("stream %s: frame of %d bytes", Uuid, len(frame.Data))
+	}
+	if !stream.refused {
+		stream.data = append(stream.data, frame.Data...)
+	}
+	stream.received += uint64(len(frame.Data))
+	if stream.received > stream.request.StreamLength {
+		return nil, fmt.Errorf("stream %s: more data than announced", Uuid)
+	}
+
+	if !frame.Last {
+		mux.muStreams.Lock()
+		if stream.granted-stream.frames <= StreamWindow/2 {
+			mux.grant()
+		}
+		mux.muStreams.Unlock()
+		return nil, nil
+	}
+
+	// the frames of the stream are given back to the budget once its
+	// request is handed over
+	mux.muStreams.Lock()
+	delete(mux.inbound, Uuid)
+	for i, queued := range mux.queue {
+		if queued == stream {
+			mux.queue = append(mux.queue[:i], mux.queue[i+1:]...)
+			break
+		}
+	}
+	if !stream.refused {
+		mux.reserved -= stream.granted
+	}
+	mux.grant()
+	mux.muStreams.Unlock()
+	if stream.received != stream.request.StreamLength {
+		return nil, fmt.Errorf("stream %s: got %d bytes, expected %d", Uuid, stream.received, stream.request.StreamLength)
+	}
+	if stream.refused {
+		return nil, nil
+	}
+
+	request := stream.request
+	request.Payload = setPayloadData(request.Payload, stream.data, request.StreamParts)
+	if request.Payload == nil {
+		return nil, fmt.Errorf("stream %s: parts do not match the data", Uuid)
+	}
+	request.StreamLength = 0
+	request.StreamParts = nil
+	return &request, nil
+}
+
+// payloadData returns the data of the payloads that can be streamed, with
+// the lengths of its parts for payloads carrying a list of buffers
+func payloadData(payload interface{}) ([]byte, []uint64) {
+	switch payload := payload.(type) {
+	case ReqCommit:
+		return payload.Data, nil
+	case ReqPutSnapshot:
+		return payload.Data, nil
+	case ResGetSnapshot:
+		return payload.Data, nil
+	case ReqPutBlob:
+		return payload.Data, nil
+	case ResGetBlob:
+		return payload.Data, nil
+	case ReqPutIndex:
+		return payload.Data, nil
+	case ResGetIndex:
+		return payload.Data, nil
+	case ReqPutPackfile:
+		return payload.Data, nil
+	case ResGetPackfile:
+		return payload.Data, nil
+	case ResGetPackfileSubpart:
+		return payload.Data, nil
+	case ResGetBlobBatch:
+		return joinParts(payload.Data)
+	case ResGetPackfileSubpartBatch:
+		return joinParts(payload.Data)
+	}
+	return nil, nil
+}
+
+// setPayloadData sets the data of a payload, nil data clears it. It
+// returns nil when the data can't be split into parts.
+func setPayloadData(payload interface{}, data []byte, parts []uint64) interface{} {
+	switch payload := payload.(type) {
+	case ReqCommit:
+		payload.Data = data
+		return payload
+	case ReqPutSnapshot:
+		payload.Data = data
+		return payload
+	case ResGetSnapshot:
+		payload.Data = data
+		return payload
+	case ReqPutBlob:
+		payload.Data = data
+		return payload
+	case ResGetBlob:
+		payload.Data = data
+		return payload
+	case ReqPutIndex:
+		payload.Data = data
+		return payload
+	case ResGetIndex:
+		payload.Data = data
+		return payload
+	case ReqPutPackfile:
+		payload.Data = data
+		return payload
+	case ResGetPackfile:
+		payload.Data = data
+		return payload
+	case ResGetPackfileSubpart:
+		payload.Data = data
+		return payload
+	case ResGetBlobBatch:
+		if payload.Data = splitParts(data, parts); data != nil && payload.Data == nil {
+			return nil
+		}
+		return payload
+	case ResGetPackfileSubpartBatch:
+		if payload.Data = splitParts(data, parts); data != nil && payload.Data == nil {
+			return nil
+		}
+		return payload
+	}
+	return payload
+}
+
+func joinParts(buffers [][]byte) ([]byte, []uint64) {
+	size := 0
+	for _, buffer := range buffers {
+		size += len(buffer)
+	}
+	data := make([]byte, 0, size)
+	parts := make([]uint64, len(buffers))
+	for i, buffer := range buffers {
+		data = append(data, buffer...)
+		parts[i] = uint64(len(buffer))
+	}
+	return data, parts
+}
+
+// splitParts cuts data into buffers of the lengths of parts, it returns
+// nil when they don't add up to the data
+func splitParts(data []byte, parts []uint64) [][]byte {
+	if data == nil {
+		return nil
+	}
+	buffers := make([][]byte, len(parts))
+	offset := uint64(0)
+	for i, length := range parts {
+		if length > uint64(len(data))-offset {
+			return nil
+		}
+		buffers[i] = data[offset : offset+length]
+		offset += length
+	}
+	if offset != uint64(len(data)) {
+		return nil
+	}
+	return buffers
+}
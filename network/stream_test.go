@@ -0,0 +1,135 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	ProtocolRegister()
+	os.Exit(m.Run())
+}
+
+// pipe connects a sending mux to a receiving one, handled requests are
+// sent on the returned channel
+func pipe(t *testing.T, budget int) (*Mux, *Mux, <-chan Request, <-chan error) {
+	senderConn, receiverConn := net.Pipe()
+	t.Cleanup(func() {
+		senderConn.Close()
+		receiverConn.Close()
+	})
+
+	sender, receiver := NewMux(senderConn), NewMux(receiverConn)
+	sender.EnableStreaming()
+	receiver.AcceptStreams()
+	receiver.budget = budget
+
+	requests := make(chan Request, 16)
+	errs := make(chan error, 1)
+	go func() {
+		decoder := gob.NewDecoder(receiverConn)
+		for {
+			var request Request
+			if err := decoder.Decode(&request); err != nil {
+				return
+			}
+			received, err := receiver.Receive(request)
+			if err != nil {
+				errs <- err
+				receiverConn.Close()
+				return
+			}
+
+			// the frames granted fit the budget, but for the oldest stream
+			receiver.muStreams.Lock()
+			buffered := 0
+			for i, stream := range receiver.queue {
+				if i > 0 {
+					buffered += stream.granted
+				}
+			}
+			receiver.muStreams.Unlock()
+			if buffered > budget {
+				errs <- fmt.Errorf("%d frames granted over a budget of %d", buffered, budget)
+				receiverConn.Close()
+				return
+			}
+
+			if received != nil {
+				requests <- *received
+			}
+		}
+	}()
+	go func() {
+		decoder := gob.NewDecoder(senderConn)
+		for {
+			var request Request
+			if err := decoder.Decode(&request); err != nil {
+				sender.Close()
+				return
+			}
+			sender.Receive(request)
+		}
+	}()
+	return sender, receiver, requests, errs
+}
+
+func TestStreamBudget(t *testing.T) {
+	sender, _, requests, errs := pipe(t, StreamWindow)
+
+	// the streams exceed the budget together, they still all complete
+	payloads := make(map[uuid.UUID][]byte)
+	for i := 0; i < 4; i++ {
+		payloads[uuid.Must(uuid.NewRandom())] = bytes.Repeat([]byte{byte(i)}, StreamFrameSize*StreamWindow*2+i)
+	}
+	sent := make(chan error, len(payloads))
+	for Uuid, data := range payloads {
+		request := Request{Uuid: Uuid, Type: "ReqPutPackfile", Payload: ReqPutPackfile{Data: data}}
+		go func() {
+			sent <- sender.Encode(&request)
+		}()
+	}
+
+	for i := 0; i < len(payloads); i++ {
+		select {
+		case request := <-requests:
+			payload, ok := request.Payload.(ReqPutPackfile)
+			if !ok || !bytes.Equal(payload.Data, payloads[request.Uuid]) {
+				t.Errorf("stream %s reassembled incorrectly", request.Uuid)
+			}
+		case err := <-errs:
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < len(payloads); i++ {
+		if err := <-sent; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestStreamCredits(t *testing.T) {
+	_, receiver, _, _ := pipe(t, StreamWindow)
+
+	// the oldest stream takes the budget, frames of the next one are not
+	// granted and drop the connection
+	for i := 0; i < 2; i++ {
+		Uuid := uuid.Must(uuid.NewRandom())
+		if _, err := receiver.Receive(Request{Uuid: Uuid, Type: "ReqPutPackfile", Payload: ReqPutPackfile{}, StreamLength: StreamFrameSize * StreamWindow}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := receiver.Receive(Request{Uuid: Uuid, Type: "StreamFrame", Payload: StreamFrame{Data: make([]byte, StreamFrameSize)}})
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && err == nil {
+			t.Error("expected a frame without credit to be refused")
+		}
+	}
+}
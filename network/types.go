@@ -11,6 +11,33 @@ type Request struct {
 	Uuid    uuid.UUID
 	Type    string
 	Payload interface{}
+
+	// StreamLength is the length of the data of a payload sent as frames
+	// following the request, see Mux
+	StreamLength uint64
+
+	// StreamParts are the lengths of the buffers the data is split back
+	// into, for payloads carrying a list of buffers
+	StreamParts []uint64
+}
+
+// authentication happens before any other request when the server is
+// configured with tokens: the client asks for a nonce and answers with
+// AuthResponse.
+type ReqAuthChallenge struct {
+}
+
+type ResAuthChallenge struct {
+	Nonce []byte
+	Err   error
+}
+
+type ReqAuth struct {
+	Response []byte
+}
+
+type ResAuth struct {
+	Err error
 }
 
 type ReqCreate struct {
@@ -28,6 +55,7 @@ type ReqOpen struct {
 
 type ResOpen struct {
 	RepositoryConfig *storage.RepositoryConfig
+	Capabilities     []string
 	Err              error
 }
 
@@ -243,6 +271,18 @@ type ResDeletePackfile struct {
 
 func ProtocolRegister() {
 	gob.Register(Request{})
+	gob.Register(&Error{})
+
+	gob.Register(ReqHello{})
+	gob.Register(ResHello{})
+	gob.Register(ResUnknown{})
+	gob.Register(ResError{})
+
+	gob.Register(ReqAuthChallenge{})
+	gob.Register(ResAuthChallenge{})
+
+	gob.Register(ReqAuth{})
+	gob.Register(ResAuth{})
 
 	gob.Register(ReqCreate{})
 	gob.Register(ResCreate{})
@@ -327,4 +367,20 @@ func ProtocolRegister() {
 	gob.Register(ReqDeletePackfile{})
 	gob.Register(ResDeletePackfile{})
 
+	// batches
+	gob.Register(ReqCheckBlobBatch{})
+	gob.Register(ResCheckBlobBatch{})
+
+	gob.Register(ReqGetBlobBatch{})
+	gob.Register(ResGetBlobBatch{})
+
+	gob.Register(ReqGetPackfileSubpartBatch{})
+	gob.Register(ResGetPackfileSubpartBatch{})
+
+	gob.Register(ReqListPage{})
+	gob.Register(ResListPage{})
+
+	// streams
+	gob.Register(StreamFrame{})
+	gob.Register(StreamCredit{})
 }
@@ -4,9 +4,17 @@ type Object struct {
 	Checksum    [32]byte
 	Chunks      [][32]byte
 	ContentType string
+
+	// runs of zero bytes that are not stored as chunks, in file offsets
+	Holes []Hole `msgpack:",omitempty"`
 }
 
 type Chunk struct {
 	Checksum [32]byte
 	Length   uint32
 }
+
+type Hole struct {
+	Offset int64
+	Length int64
+}
@@ -0,0 +1,228 @@
+// Package api serves a versioned JSON API over the snapshots of a
+// repository, for the httpd server and the UI. It is described by the
+// OpenAPI document served at Prefix + "/openapi.yaml".
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PlakarLabs/plakar/snapshot"
+	"github.com/PlakarLabs/plakar/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Prefix is the path the routes of this version of the API live under,
+// incompatible changes go to a new version
+const Prefix = "/api/v1"
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+
+	// snapshotCacheSize is the number of loaded snapshots kept around,
+	// browsing a snapshot issues many requests for the same one
+	snapshotCacheSize = 8
+)
+
+//go:embed openapi.yaml
+var openapi []byte
+
+// Resolver returns the repository a request is for once it was allowed to
+// issue a request of the given type, or the HTTP status and error to reply
+type Resolver func(r *http.Request, requestType string) (*storage.Repository, int, error)
+
+type handler func(w http.ResponseWriter, r *http.Request, repository *storage.Repository)
+
+type API struct {
+	resolve Resolver
+
+	muCache sync.Mutex
+	cache   []*snapshot.Snapshot
+
+	muChecks sync.Mutex
+	checks   map[uuid.UUID]*check
+}
+
+func New(resolve Resolver) *API {
+	return &API{
+		resolve: resolve,
+		checks:  make(map[uuid.UUID]*check),
+	}
+}
+
+// Routes registers the routes of the API under Prefix
+func (api *API) Routes(r *mux.Router) {
+	s := r.PathPrefix(Prefix).Subrouter()
+	s.HandleFunc("/openapi.yaml", serveOpenAPI).Methods("GET")
+
+	s.HandleFunc("/snapshots", api.handle("ReqGetSnapshots", api.listSnapshots)).Methods("GET")
+	s.HandleFunc("/snapshots/{snapshot}", api.handle("ReqGetSnapshot", api.getSnapshot)).Methods("GET")
+	s.HandleFunc("/snapshots/{snapshot}/browse", api.handle("ReqGetSnapshot", api.browse)).Methods("GET")
+	s.HandleFunc("/snapshots/{snapshot}/stat", api.handle("ReqGetSnapshot", api.stat)).Methods("GET")
+	s.HandleFunc("/snapshots/{snapshot}/download", api.handle("ReqGetSnapshot", api.download)).Methods("GET")
+
+	s.HandleFunc("/diff", api.handle("ReqGetSnapshot", api.diff)).Methods("GET")
+
+	s.HandleFunc("/checks", api.handle("ReqGetSnapshot", api.startCheck)).Methods("POST")
+	s.HandleFunc("/checks/{check}", api.handle("ReqGetSnapshot", api.getCheck)).Methods("GET")
+}
+
+func (api *API) handle(requestType string, h handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		repository, status, err := api.resolve(r, requestType)
+		if err != nil {
+			writeError(w, status, err)
+			return
+		}
+		h(w, r, repository)
+	}
+}
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openapi)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// errorStatus is the status of an error returned by the repository
+func errorStatus(err error) int {
+	if errors.Is(err, fs.ErrNotExist) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// page parses the offset and limit of a paginated request
+func page(r *http.Request) (int, int, error) {
+	offset, limit := 0, defaultPageSize
+	if value := r.URL.Query().Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return 0, 0, fmt.Errorf("invalid offset: %s", value)
+		}
+		offset = parsed
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxPageSize {
+			return 0, 0, fmt.Errorf("invalid limit: %s, expected 1 to %d", value, maxPageSize)
+		}
+		limit = parsed
+	}
+	return offset, limit, nil
+}
+
+// bounds returns the slice bounds of a page of total items
+func bounds(total int, offset int, limit int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
+
+// parseTime accepts RFC 3339 timestamps and dates
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %s", value)
+	}
+	return t, nil
+}
+
+// lookupSnapshot resolves a snapshot identifier, a UUID or a prefix of one
+// designating a single snapshot
+func lookupSnapshot(repository *storage.Repository, id string) (uuid.UUID, int, error) {
+	if id == "" {
+		return uuid.Nil, http.StatusBadRequest, fmt.Errorf("missing snapshot")
+	}
+	if indexID, err := uuid.Parse(id); err == nil {
+		return indexID, 0, nil
+	}
+
+	indexIDs, err := snapshot.List(repository)
+	if err != nil {
+		return uuid.Nil, errorStatus(err), err
+	}
+	matches := make([]uuid.UUID, 0)
+	for _, indexID := range indexIDs {
+		if strings.HasPrefix(indexID.String(), id) {
+			matches = append(matches, indexID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return uuid.Nil, http.StatusNotFound, fmt.Errorf("unknown snapshot: %s", id)
+	case 1:
+		return matches[0], 0, nil
+	default:
+		return uuid.Nil, http.StatusBadRequest, fmt.Errorf("ambiguous snapshot: %s", id)
+	}
+}
+
+// loadSnapshot returns a snapshot from the cache or loads it
+func (api *API) loadSnapshot(repository *storage.Repository, id string) (*snapshot.Snapshot, int, error) {
+	indexID, status, err := lookupSnapshot(repository, id)
+	if err != nil {
+		return nil, status, err
+	}
+
+	api.muCache.Lock()
+	for i, snap := range api.cache {
+		if snap.Repository() == repository && snap.Header.IndexID == indexID {
+			copy(api.cache[1:i+1], api.cache[:i])
+			api.cache[0] = snap
+			api.muCache.Unlock()
+			return snap, 0, nil
+		}
+	}
+	api.muCache.Unlock()
+
+	snap, err := snapshot.Load(repository, indexID)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, http.StatusNotFound, fmt.Errorf("unknown snapshot: %s", id)
+		}
+		return nil, errorStatus(err), err
+	}
+
+	api.muCache.Lock()
+	defer api.muCache.Unlock()
+	api.cache = append([]*snapshot.Snapshot{snap}, api.cache...)
+	if len(api.cache) > snapshotCacheSize {
+		api.cache = api.cache[:snapshotCacheSize]
+	}
+	return snap, 0, nil
+}
@@ -0,0 +1,418 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/snapshot"
+	"github.com/PlakarLabs/plakar/storage"
+	_ "github.com/PlakarLabs/plakar/storage/backends/fs"
+	"github.com/PlakarLabs/plakar/storage/index"
+	_ "github.com/PlakarLabs/plakar/vfs/importer/fs"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
+)
+
+func TestMain(m *testing.M) {
+	// pushes and checks log their progress
+	logger.Start()
+	os.Exit(m.Run())
+}
+
+func createRepository(t *testing.T) *storage.Repository {
+	repository, err := storage.Create(filepath.Join(t.TempDir(), "repository"), storage.RepositoryConfig{
+		Version:        storage.VERSION,
+		RepositoryID:   uuid.Must(uuid.NewRandom()),
+		CreationTime:   time.Now(),
+		Hashing:        "sha256",
+		Chunking:       "fastcdc",
+		ChunkingMin:    64 << 10,
+		ChunkingNormal: 1 << 20,
+		ChunkingMax:    8 << 20,
+		PackfileSize:   20 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the repository is empty, its index starts empty as well
+	repository.SetRepositoryIndex(index.New())
+	return repository
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		pathname := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(pathname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(pathname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func push(t *testing.T, repository *storage.Repository, dir string, tag string) uuid.UUID {
+	snap, err := snapshot.New(repository, uuid.Must(uuid.NewRandom()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Header.Hostname = "host"
+	snap.Header.Tags = []string{tag}
+	if err := snap.Push(dir, &snapshot.PushOptions{MaxConcurrency: 4}); err != nil {
+		t.Fatal(err)
+	}
+	return snap.Header.IndexID
+}
+
+// fixture serves a repository holding two snapshots of dir, the second
+// one after a file was modified, one removed and one added
+type fixture struct {
+	server     *httptest.Server
+	api        *API
+	repository *storage.Repository
+	dir        string
+	first      uuid.UUID
+	second     uuid.UUID
+}
+
+func newFixture(t *testing.T) *fixture {
+	repository := createRepository(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt":     "alpha",
+		"b.txt":     "bravo",
+		"sub/c.txt": "charlie",
+	})
+	first := push(t, repository, dir, "first")
+
+	// creation times are compared to sort snapshots
+	time.Sleep(10 * time.Millisecond)
+	writeFiles(t, dir, map[string]string{
+		"a.txt":     "alpha, modified",
+		"sub/d.txt": "delta",
+	})
+	if err := os.Remove(filepath.Join(dir, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	second := push(t, repository, dir, "second")
+
+	r := mux.NewRouter()
+	api := New(func(r *http.Request, requestType string) (*storage.Repository, int, error) {
+		if r.Header.Get("Authorization") == "Bearer wrong" {
+			return nil, http.StatusUnauthorized, fmt.Errorf("authentication failed")
+		}
+		return repository, 0, nil
+	})
+	api.Routes(r)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	return &fixture{server: server, api: api, repository: repository, dir: dir, first: first, second: second}
+}
+
+func (f *fixture) get(t *testing.T, url string, status int, v interface{}) []byte {
+	t.Helper()
+	res, err := http.Get(f.server.URL + Prefix + url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != status {
+		t.Fatalf("GET %s: expected status %d, got %d: %s", url, status, res.StatusCode, body)
+	}
+	if v != nil {
+		if err := json.Unmarshal(body, v); err != nil {
+			t.Fatalf("GET %s: %s", url, err)
+		}
+	}
+	return body
+}
+
+func TestSnapshots(t *testing.T) {
+	f := newFixture(t)
+
+	var list SnapshotList
+	f.get(t, "/snapshots", http.StatusOK, &list)
+	if list.Total != 2 || len(list.Items) != 2 || list.Items[0].ID != f.second.String() || list.Items[1].ID != f.first.String() {
+		t.Fatalf("expected both snapshots, newest first, got %+v", list)
+	}
+	if list.Items[0].Hostname != "host" || list.Items[0].Tags[0] != "second" {
+		t.Errorf("unexpected snapshot %+v", list.Items[0])
+	}
+
+	f.get(t, "/snapshots?limit=1&offset=1", http.StatusOK, &list)
+	if list.Total != 2 || len(list.Items) != 1 || list.Items[0].ID != f.first.String() {
+		t.Errorf("expected the second page to hold the first snapshot, got %+v", list)
+	}
+
+	f.get(t, "/snapshots?tag=first", http.StatusOK, &list)
+	if list.Total != 1 || list.Items[0].ID != f.first.String() {
+		t.Errorf("expected the tag to select the first snapshot, got %+v", list)
+	}
+	f.get(t, "/snapshots?hostname=other", http.StatusOK, &list)
+	if list.Total != 0 || list.Items == nil {
+		t.Errorf("expected an empty list, got %+v", list)
+	}
+	f.get(t, "/snapshots?path="+filepath.ToSlash(filepath.Join(f.dir, "sub")), http.StatusOK, &list)
+	if list.Total != 2 {
+		t.Errorf("expected both snapshots to contain the path, got %+v", list)
+	}
+	f.get(t, "/snapshots?since=2000-01-01&until="+time.Now().Add(-time.Hour).UTC().Format(time.RFC3339), http.StatusOK, &list)
+	if list.Total != 0 {
+		t.Errorf("expected no snapshot in the past, got %+v", list)
+	}
+
+	f.get(t, "/snapshots?limit=0", http.StatusBadRequest, nil)
+	f.get(t, "/snapshots?since=yesterday", http.StatusBadRequest, nil)
+
+	var snap Snapshot
+	f.get(t, "/snapshots/"+f.first.String()[:8], http.StatusOK, &snap)
+	if snap.ID != f.first.String() || snap.FilesCount == 0 {
+		t.Errorf("unexpected snapshot %+v", snap)
+	}
+
+	var failure errorResponse
+	f.get(t, "/snapshots/"+uuid.Must(uuid.NewRandom()).String(), http.StatusNotFound, &failure)
+	if !strings.HasPrefix(failure.Error, "unknown snapshot") {
+		t.Errorf("unexpected error %q", failure.Error)
+	}
+}
+
+func TestBrowse(t *testing.T) {
+	f := newFixture(t)
+	dir := filepath.ToSlash(f.dir)
+
+	var list EntryList
+	f.get(t, fmt.Sprintf("/snapshots/%s/browse?path=%s", f.first, dir), http.StatusOK, &list)
+	names := make([]string, 0)
+	for _, entry := range list.Items {
+		names = append(names, entry.Name+":"+entry.Type)
+	}
+	if list.Total != 3 || strings.Join(names, ",") != "a.txt:file,b.txt:file,sub:directory" {
+		t.Fatalf("unexpected listing %v", names)
+	}
+
+	f.get(t, fmt.Sprintf("/snapshots/%s/browse?path=%s&offset=2&limit=5", f.first, dir), http.StatusOK, &list)
+	if list.Total != 3 || len(list.Items) != 1 || list.Items[0].Name != "sub" {
+		t.Errorf("unexpected page %+v", list)
+	}
+
+	var entry Entry
+	f.get(t, fmt.Sprintf("/snapshots/%s/stat?path=%s/a.txt", f.first, dir), http.StatusOK, &entry)
+	if entry.Type != "file" || entry.Size != 5 || entry.Path != dir+"/a.txt" || len(entry.Checksum) != 64 {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	f.get(t, fmt.Sprintf("/snapshots/%s/stat?path=%s/missing", f.first, dir), http.StatusNotFound, nil)
+	f.get(t, fmt.Sprintf("/snapshots/%s/browse?path=%s/a.txt", f.first, dir), http.StatusBadRequest, nil)
+}
+
+func TestDownload(t *testing.T) {
+	f := newFixture(t)
+	dir := filepath.ToSlash(f.dir)
+
+	body := f.get(t, fmt.Sprintf("/snapshots/%s/download?path=%s/sub/c.txt", f.first, dir), http.StatusOK, nil)
+	if string(body) != "charlie" {
+		t.Errorf("unexpected content %q", body)
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s/snapshots/%s/download?path=%s/sub/c.txt", f.server.URL, Prefix, f.first, dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=2-4")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent || string(body) != "arl" {
+		t.Errorf("expected a range of the file, got %d %q", res.StatusCode, body)
+	}
+
+	body = f.get(t, fmt.Sprintf("/snapshots/%s/download?path=%s", f.second, dir), http.StatusOK, nil)
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	members := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		members[header.Name] = string(content)
+	}
+	if members["a.txt"] != "alpha, modified" || members["sub/d.txt"] != "delta" || len(members) != 4 {
+		t.Errorf("unexpected archive members %v", members)
+	}
+
+	f.get(t, fmt.Sprintf("/snapshots/%s/download?path=%s&format=rar", f.second, dir), http.StatusBadRequest, nil)
+}
+
+func TestDiff(t *testing.T) {
+	f := newFixture(t)
+	dir := filepath.ToSlash(f.dir)
+
+	var diff Diff
+	f.get(t, fmt.Sprintf("/diff?from=%s&to=%s&path=%s", f.first, f.second, dir), http.StatusOK, &diff)
+	changes := make([]string, 0)
+	for _, change := range diff.Changes {
+		if change.Change == "modified" && change.From.Type == "directory" {
+			continue
+		}
+		changes = append(changes, change.Change+" "+strings.TrimPrefix(change.Path, dir))
+	}
+	sort.Strings(changes)
+	expected := "added /sub/d.txt,modified /a.txt,removed /b.txt"
+	if strings.Join(changes, ",") != expected {
+		t.Errorf("expected %s, got %v", expected, changes)
+	}
+
+	f.get(t, fmt.Sprintf("/diff?from=%s&to=%s&path=%s", f.first, f.first, dir), http.StatusOK, &diff)
+	if len(diff.Changes) != 0 {
+		t.Errorf("expected a snapshot not to differ from itself, got %+v", diff.Changes)
+	}
+
+	f.get(t, fmt.Sprintf("/diff?from=%s", f.first), http.StatusBadRequest, nil)
+	f.get(t, fmt.Sprintf("/diff?from=%s&to=%s&path=/missing", f.first, f.second), http.StatusNotFound, nil)
+}
+
+func TestCheck(t *testing.T) {
+	f := newFixture(t)
+
+	post := func(request CheckRequest, status int) (Check, string) {
+		data, _ := json.Marshal(request)
+		res, err := http.Post(f.server.URL+Prefix+"/checks", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != status {
+			body, _ := io.ReadAll(res.Body)
+			t.Fatalf("expected status %d, got %d: %s", status, res.StatusCode, body)
+		}
+		var started Check
+		json.NewDecoder(res.Body).Decode(&started)
+		return started, res.Header.Get("Location")
+	}
+
+	started, location := post(CheckRequest{Snapshot: f.second.String()}, http.StatusAccepted)
+	if location != Prefix+"/checks/"+started.ID {
+		t.Errorf("unexpected location %q", location)
+	}
+
+	wait := func(id string) Check {
+		var state Check
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			f.get(t, "/checks/"+id, http.StatusOK, &state)
+			if state.Status != CheckRunning {
+				break
+			}
+		}
+		return state
+	}
+	if state := wait(started.ID); state.Status != CheckPassed || state.Finished == nil {
+		t.Errorf("expected the check to pass, got %+v", state)
+	}
+
+	// files are read back and compared with their checksum
+	started, _ = post(CheckRequest{Snapshot: f.second.String(), Path: filepath.ToSlash(filepath.Join(f.dir, "a.txt"))}, http.StatusAccepted)
+	if state := wait(started.ID); state.Status != CheckPassed {
+		t.Errorf("expected the check of a.txt to pass, got %+v", state)
+	}
+
+	// a repository only runs a few checks at a time
+	f.api.muChecks.Lock()
+	for i := 0; i < maxRunningChecks; i++ {
+		f.api.checks[uuid.Must(uuid.NewRandom())] = &check{repository: f.repository, state: Check{Status: CheckRunning}}
+	}
+	f.api.muChecks.Unlock()
+	post(CheckRequest{Snapshot: f.second.String()}, http.StatusTooManyRequests)
+
+	post(CheckRequest{Snapshot: f.second.String(), Path: filepath.ToSlash(f.dir)}, http.StatusBadRequest)
+	post(CheckRequest{Snapshot: uuid.Must(uuid.NewRandom()).String()}, http.StatusNotFound)
+	f.get(t, "/checks/"+uuid.Must(uuid.NewRandom()).String(), http.StatusNotFound, nil)
+}
+
+func TestResolver(t *testing.T) {
+	f := newFixture(t)
+
+	req, _ := http.NewRequest("GET", f.server.URL+Prefix+"/snapshots", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var failure errorResponse
+	json.NewDecoder(res.Body).Decode(&failure)
+	if res.StatusCode != http.StatusUnauthorized || failure.Error != "authentication failed" {
+		t.Errorf("expected the resolver error, got %d %+v", res.StatusCode, failure)
+	}
+}
+
+// TestOpenAPI checks that the paths of the OpenAPI document are routed
+func TestOpenAPI(t *testing.T) {
+	f := newFixture(t)
+
+	var document struct {
+		Paths map[string]map[string]interface{} `yaml:"paths"`
+	}
+	if err := yaml.Unmarshal(f.get(t, "/openapi.yaml", http.StatusOK, nil), &document); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	New(nil).Routes(r)
+	parameter := regexp.MustCompile(`\{[^}]+\}`)
+	for pathname, operations := range document.Paths {
+		for method := range operations {
+			url := Prefix + parameter.ReplaceAllString(pathname, "x")
+			var match mux.RouteMatch
+			if !r.Match(httptest.NewRequest(strings.ToUpper(method), url, nil), &match) || match.MatchErr != nil {
+				t.Errorf("%s %s is documented but not routed", strings.ToUpper(method), pathname)
+			}
+		}
+	}
+
+	routed := 0
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if methods, err := route.GetMethods(); err == nil {
+			routed += len(methods)
+		}
+		return nil
+	})
+	documented := 0
+	for _, operations := range document.Paths {
+		documented += len(operations)
+	}
+	if routed != documented {
+		t.Errorf("%d operations routed, %d documented", routed, documented)
+	}
+}
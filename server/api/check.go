@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/PlakarLabs/plakar/storage"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// checkRetention is how long the result of a check is kept once finished
+const checkRetention = time.Hour
+
+// maxRunningChecks bounds the checks running on a repository, they read
+// all of the snapshot content
+const maxRunningChecks = 2
+
+// states of a check
+const (
+	CheckRunning = "running"
+	CheckPassed  = "passed"
+	CheckFailed  = "failed"
+)
+
+type CheckRequest struct {
+	Snapshot string `json:"snapshot"`
+	Path     string `json:"path"`
+	Fast     bool   `json:"fast"`
+}
+
+type Check struct {
+	ID       string     `json:"id"`
+	Snapshot string     `json:"snapshot"`
+	Path     string     `json:"path"`
+	Fast     bool       `json:"fast"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// check runs in the background, its state is polled by clients
+type check struct {
+	repository *storage.Repository
+
+	mu    sync.Mutex
+	state Check
+}
+
+func (c *check) get() Check {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// startCheck verifies a snapshot in the background, the check is then
+// polled at the URL in the Location header of the response
+func (api *API) startCheck(w http.ResponseWriter, r *http.Request, repository *storage.Repository) {
+	var request CheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	snap, status, err := api.loadSnapshot(repository, request.Snapshot)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	// snapshots check a file or all of their content
+	pathname := path.Clean("/" + request.Path)
+	if pathname != "/" {
+		fileinfo, exists := snap.Filesystem.LookupInode(pathname)
+		if !exists {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%s: no such file or directory", pathname))
+			return
+		}
+		if !fileinfo.Mode().IsRegular() {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s: only regular files or the whole snapshot can be checked", pathname))
+			return
+		}
+	}
+
+	c := &check{
+		repository: repository,
+		state: Check{
+			ID:       uuid.Must(uuid.NewRandom()).String(),
+			Snapshot: snap.Header.IndexID.String(),
+			Path:     pathname,
+			Fast:     request.Fast,
+			Status:   CheckRunning,
+			Started:  time.Now().UTC(),
+		},
+	}
+
+	api.muChecks.Lock()
+	running := 0
+	for id, other := range api.checks {
+		state := other.get()
+		if state.Finished != nil && time.Since(*state.Finished) > checkRetention {
+			delete(api.checks, id)
+		}
+		if state.Finished == nil && other.repository == repository {
+			running++
+		}
+	}
+	if running >= maxRunningChecks {
+		api.muChecks.Unlock()
+		writeError(w, http.StatusTooManyRequests, fmt.Errorf("%d checks already running on this repository", running))
+		return
+	}
+	api.checks[uuid.MustParse(c.state.ID)] = c
+	api.muChecks.Unlock()
+
+	go func() {
+		ok, err := snap.Check(pathname, request.Fast)
+		finished := time.Now().UTC()
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.state.Finished = &finished
+		c.state.Status = CheckPassed
+		if !ok || err != nil {
+			c.state.Status = CheckFailed
+		}
+		if err != nil {
+			c.state.Error = err.Error()
+		}
+	}()
+
+	w.Header().Set("Location", path.Join(r.URL.Path, c.state.ID))
+	writeJSON(w, http.StatusAccepted, c.get())
+}
+
+func (api *API) getCheck(w http.ResponseWriter, r *http.Request, repository *storage.Repository) {
+	id, err := uuid.Parse(mux.Vars(r)["check"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown check: %s", mux.Vars(r)["check"]))
+		return
+	}
+
+	api.muChecks.Lock()
+	c, exists := api.checks[id]
+	api.muChecks.Unlock()
+
+	// checks are only visible from the repository they run on
+	if !exists || c.repository != repository {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown check: %s", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, c.get())
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+
+	"github.com/PlakarLabs/plakar/snapshot"
+	"github.com/PlakarLabs/plakar/storage"
+	"github.com/PlakarLabs/plakar/vfs"
+)
+
+type Change struct {
+	Path   string `json:"path"`
+	Change string `json:"change"`
+	From   *Entry `json:"from,omitempty"`
+	To     *Entry `json:"to,omitempty"`
+}
+
+type Diff struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Path    string   `json:"path"`
+	Changes []Change `json:"changes"`
+}
+
+// walkSnapshot returns the pathnames of a snapshot under a path, none when
+// the path does not exist in the snapshot
+func walkSnapshot(snap *snapshot.Snapshot, pathname string) (map[string]vfs.FileInfo, error) {
+	entries := make(map[string]vfs.FileInfo)
+	err := snap.Filesystem.Walk(pathname, func(pathname string, fileinfo *vfs.FileInfo) error {
+		entries[pathname] = *fileinfo
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// diff lists the pathnames added, removed or modified from a snapshot to
+// another, files are modified when their metadata or content differ
+func (api *API) diff(w http.ResponseWriter, r *http.Request, repository *storage.Repository) {
+	query := r.URL.Query()
+	from, status, err := api.loadSnapshot(repository, query.Get("from"))
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	to, status, err := api.loadSnapshot(repository, query.Get("to"))
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	pathname := cleanPath(r)
+
+	fromEntries, err := walkSnapshot(from, pathname)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	toEntries, err := walkSnapshot(to, pathname)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	if len(fromEntries) == 0 && len(toEntries) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s: no such file or directory", pathname))
+		return
+	}
+
+	pathnames := make([]string, 0, len(fromEntries)+len(toEntries))
+	for pathname := range fromEntries {
+		pathnames = append(pathnames, pathname)
+	}
+	for pathname := range toEntries {
+		if _, exists := fromEntries[pathname]; !exists {
+			pathnames = append(pathnames, pathname)
+		}
+	}
+	sort.Strings(pathnames)
+
+	changes := make([]Change, 0)
+	for _, pathname := range pathnames {
+		fromInfo, inFrom := fromEntries[pathname]
+		toInfo, inTo := toEntries[pathname]
+
+		change := Change{Path: pathname}
+		if inFrom {
+			entry := newEntry(from, pathname, &fromInfo)
+			change.From = &entry
+		}
+		if inTo {
+			entry := newEntry(to, pathname, &toInfo)
+			change.To = &entry
+		}
+
+		switch {
+		case !inTo:
+			change.Change = "removed"
+		case !inFrom:
+			change.Change = "added"
+		case !fromInfo.Equal(toInfo) || change.From.Checksum != change.To.Checksum || change.From.Target != change.To.Target:
+			change.Change = "modified"
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+
+	writeJSON(w, http.StatusOK, Diff{
+		From:    from.Header.IndexID.String(),
+		To:      to.Header.IndexID.String(),
+		Path:    pathname,
+		Changes: changes,
+	})
+}
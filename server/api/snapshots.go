@@ -0,0 +1,430 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PlakarLabs/plakar/encryption"
+	"github.com/PlakarLabs/plakar/snapshot"
+	"github.com/PlakarLabs/plakar/snapshot/archive"
+	"github.com/PlakarLabs/plakar/snapshot/header"
+	"github.com/PlakarLabs/plakar/storage"
+	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/gorilla/mux"
+)
+
+type Snapshot struct {
+	ID               string    `json:"id"`
+	ShortID          string    `json:"shortId"`
+	CreationTime     time.Time `json:"creationTime"`
+	Hostname         string    `json:"hostname"`
+	Username         string    `json:"username"`
+	OperatingSystem  string    `json:"os"`
+	Tags             []string  `json:"tags"`
+	Directories      []string  `json:"directories"`
+	Size             uint64    `json:"size"`
+	FilesCount       uint64    `json:"filesCount"`
+	DirectoriesCount uint64    `json:"directoriesCount"`
+	ErrorsCount      uint64    `json:"errorsCount"`
+}
+
+type SnapshotList struct {
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Limit  int        `json:"limit"`
+	Items  []Snapshot `json:"items"`
+}
+
+type Entry struct {
+	Name             string    `json:"name"`
+	Path             string    `json:"path"`
+	Type             string    `json:"type"`
+	Mode             string    `json:"mode"`
+	Size             int64     `json:"size"`
+	ModificationTime time.Time `json:"modificationTime"`
+	Uid              uint64    `json:"uid"`
+	Gid              uint64    `json:"gid"`
+	Target           string    `json:"target,omitempty"`
+	Checksum         string    `json:"checksum,omitempty"`
+	MimeType         string    `json:"mimeType,omitempty"`
+}
+
+type EntryList struct {
+	Path   string  `json:"path"`
+	Total  int     `json:"total"`
+	Offset int     `json:"offset"`
+	Limit  int     `json:"limit"`
+	Items  []Entry `json:"items"`
+}
+
+func newSnapshot(header *header.Header) Snapshot {
+	tags := header.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	directories := header.ScannedDirectories
+	if directories == nil {
+		directories = []string{}
+	}
+	return Snapshot{
+		ID:               header.IndexID.String(),
+		ShortID:          header.GetIndexShortID(),
+		CreationTime:     header.CreationTime.UTC(),
+		Hostname:         header.Hostname,
+		Username:         header.Username,
+		OperatingSystem:  header.OperatingSystem,
+		Tags:             tags,
+		Directories:      directories,
+		Size:             header.ScanSize,
+		FilesCount:       header.FilesCount,
+		DirectoriesCount: header.DirectoriesCount,
+		ErrorsCount:      header.ErrorsCount,
+	}
+}
+
+func entryType(mode fs.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode.IsRegular():
+		return "file"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "other"
+	}
+}
+
+// newEntry describes a pathname of a snapshot, the object of regular files
+// gives their checksum and content type
+func newEntry(snap *snapshot.Snapshot, pathname string, fileinfo *vfs.FileInfo) Entry {
+	entry := Entry{
+		Name:             path.Base(pathname),
+		Path:             pathname,
+		Type:             entryType(fileinfo.Mode()),
+		Mode:             fileinfo.Mode().String(),
+		Size:             fileinfo.Size(),
+		ModificationTime: fileinfo.ModTime().UTC(),
+		Uid:              fileinfo.Uid(),
+		Gid:              fileinfo.Gid(),
+	}
+
+	switch entry.Type {
+	case "symlink":
+		entry.Target, _ = snap.Filesystem.LookupSymlink(pathname)
+	case "file":
+		if checksum, mimeType, ok := lookupObject(snap, pathname); ok {
+			entry.Checksum = fmt.Sprintf("%064x", checksum)
+			entry.MimeType = mimeType
+		}
+	}
+	return entry
+}
+
+// lookupObject returns the checksum and content type of a file
+func lookupObject(snap *snapshot.Snapshot, pathname string) ([32]byte, string, bool) {
+	hasher := encryption.GetHasher(snap.Repository().Configuration().Hashing)
+	hasher.Write([]byte(pathname))
+	var key [32]byte
+	copy(key[:], hasher.Sum(nil))
+
+	object := snap.Index.LookupObjectForPathnameChecksum(key)
+	if object == nil {
+		return [32]byte{}, "", false
+	}
+
+	mimeType, _ := snap.Metadata.LookupKeyForValue(object.Checksum)
+	mimeType = strings.Split(mimeType, ";")[0]
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(path.Ext(pathname))
+	}
+	return object.Checksum, mimeType, true
+}
+
+// cleanPath returns the absolute pathname of the path parameter
+func cleanPath(r *http.Request) string {
+	return path.Clean("/" + r.URL.Query().Get("path"))
+}
+
+// underPath tells whether a pathname is within a directory
+func underPath(pathname string, directory string) bool {
+	return directory == "/" || pathname == directory || strings.HasPrefix(pathname, directory+"/")
+}
+
+// listSnapshots lists snapshots, newest first, filtered by tag, hostname,
+// username, creation time and path: a snapshot matches the path when one of
+// its directories contains it or is within it
+func (api *API) listSnapshots(w http.ResponseWriter, r *http.Request, repository *storage.Repository) {
+	offset, limit, err := page(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	query := r.URL.Query()
+	var since, until time.Time
+	if value := query.Get("since"); value != "" {
+		if since, err = parseTime(value); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if value := query.Get("until"); value != "" {
+		if until, err = parseTime(value); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	indexIDs, err := snapshot.List(repository)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	matches := make([]Snapshot, 0)
+	for _, indexID := range indexIDs {
+		header, _, err := snapshot.GetSnapshot(repository, indexID)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+
+		if tag := query.Get("tag"); tag != "" && !contains(header.Tags, tag) {
+			continue
+		}
+		if hostname := query.Get("hostname"); hostname != "" && header.Hostname != hostname {
+			continue
+		}
+		if username := query.Get("username"); username != "" && header.Username != username {
+			continue
+		}
+		if !since.IsZero() && header.CreationTime.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !header.CreationTime.Before(until) {
+			continue
+		}
+		if query.Get("path") != "" {
+			pathname := cleanPath(r)
+			found := false
+			for _, directory := range header.ScannedDirectories {
+				if underPath(pathname, directory) || underPath(directory, pathname) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		matches = append(matches, newSnapshot(header))
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].CreationTime.After(matches[j].CreationTime)
+	})
+
+	start, end := bounds(len(matches), offset, limit)
+	writeJSON(w, http.StatusOK, SnapshotList{
+		Total:  len(matches),
+		Offset: offset,
+		Limit:  limit,
+		Items:  matches[start:end],
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (api *API) getSnapshot(w http.ResponseWriter, r *http.Request, repository *storage.Repository) {
+	indexID, status, err := lookupSnapshot(repository, mux.Vars(r)["snapshot"])
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	header, _, err := snapshot.GetSnapshot(repository, indexID)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown snapshot: %s", mux.Vars(r)["snapshot"]))
+			return
+		}
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSnapshot(header))
+}
+
+// lookupPath loads the snapshot of a request and the pathname it designates
+func (api *API) lookupPath(w http.ResponseWriter, r *http.Request, repository *storage.Repository) (*snapshot.Snapshot, string, *vfs.FileInfo, bool) {
+	snap, status, err := api.loadSnapshot(repository, mux.Vars(r)["snapshot"])
+	if err != nil {
+		writeError(w, status, err)
+		return nil, "", nil, false
+	}
+	pathname := cleanPath(r)
+	fileinfo, exists := snap.Filesystem.LookupInode(pathname)
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s: no such file or directory", pathname))
+		return nil, "", nil, false
+	}
+	return snap, pathname, fileinfo, true
+}
+
+func (api *API) stat(w http.ResponseWriter, r *http.Request, repository *storage.Repository) {
+	snap, pathname, fileinfo, ok := api.lookupPath(w, r, repository)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newEntry(snap, pathname, fileinfo))
+}
+
+// browse lists the entries of a directory sorted by name
+func (api *API) browse(w http.ResponseWriter, r *http.Request, repository *storage.Repository) {
+	offset, limit, err := page(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	snap, pathname, fileinfo, ok := api.lookupPath(w, r, repository)
+	if !ok {
+		return
+	}
+	if !fileinfo.Mode().IsDir() {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%s: not a directory", pathname))
+		return
+	}
+
+	children, err := snap.Filesystem.LookupChildren(pathname)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	sort.Strings(children)
+
+	start, end := bounds(len(children), offset, limit)
+	items := make([]Entry, 0, end-start)
+	for _, name := range children[start:end] {
+		child := path.Join(pathname, name)
+		childinfo, exists := snap.Filesystem.LookupInode(child)
+		if !exists {
+			continue
+		}
+		items = append(items, newEntry(snap, child, childinfo))
+	}
+
+	writeJSON(w, http.StatusOK, EntryList{
+		Path:   pathname,
+		Total:  len(children),
+		Offset: offset,
+		Limit:  limit,
+		Items:  items,
+	})
+}
+
+// download sends the content of a file, supporting ranges, or a directory
+// as an archive in the requested format and compression
+func (api *API) download(w http.ResponseWriter, r *http.Request, repository *storage.Repository) {
+	snap, pathname, fileinfo, ok := api.lookupPath(w, r, repository)
+	if !ok {
+		return
+	}
+
+	if fileinfo.Mode().IsDir() {
+		options := &archive.Options{
+			Format:      r.URL.Query().Get("format"),
+			Compression: r.URL.Query().Get("compression"),
+			Rebase:      true,
+		}
+		if options.Format == "" {
+			options.Format = "tar"
+		}
+		if options.Compression == "" {
+			options.Compression = "gzip"
+		}
+		filename, contentType, err := archiveName(pathname, options)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		archiver, err := archive.NewArchiver(w, options)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		// the status is sent with the first write, errors can only be
+		// reported by cutting the archive short
+		if err := archiver.AddSnapshot(snap, pathname); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		if err := archiver.Close(); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	if !fileinfo.Mode().IsRegular() {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%s: not a regular file", pathname))
+		return
+	}
+	rd, err := snapshot.NewReader(snap, pathname)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	if _, mimeType, ok := lookupObject(snap, pathname); ok && mimeType != "" {
+		w.Header().Set("Content-Type", mimeType)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(pathname)}))
+	http.ServeContent(w, r, path.Base(pathname), fileinfo.ModTime(), rd)
+}
+
+// archiveName returns the filename and content type of an archive
+func archiveName(pathname string, options *archive.Options) (string, string, error) {
+	name := path.Base(pathname)
+	if name == "/" {
+		name = "snapshot"
+	}
+
+	var contentType string
+	switch options.Format {
+	case "tar":
+		contentType = "application/x-tar"
+	case "cpio":
+		contentType = "application/x-cpio"
+	case "zip":
+		return name + ".zip", "application/zip", nil
+	default:
+		return "", "", fmt.Errorf("unsupported archive format %q", options.Format)
+	}
+
+	name += "." + options.Format
+	switch options.Compression {
+	case "none":
+	case "gzip":
+		name, contentType = name+".gz", "application/gzip"
+	case "zstd":
+		name, contentType = name+".zst", "application/zstd"
+	case "lz4":
+		name, contentType = name+".lz4", "application/x-lz4"
+	default:
+		return "", "", fmt.Errorf("unsupported compression %q", options.Compression)
+	}
+	return name, contentType, nil
+}
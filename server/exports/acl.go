@@ -0,0 +1,81 @@
+package exports
+
+import (
+	"fmt"
+	"strings"
+)
+
+// permissions granted in ACLs, request types can also be granted one by one
+const (
+	PermissionRead   = "read"
+	PermissionWrite  = "write"
+	PermissionDelete = "delete"
+	PermissionLock   = "lock"
+)
+
+// Anyone matches users who have no entry of their own in an ACL, including
+// anonymous ones
+const Anyone = "*"
+
+// permission returns the permission a request type requires
+func permission(requestType string) string {
+	switch {
+	case requestType == "ReqPutLock" || requestType == "ReqDeleteLock":
+		return PermissionLock
+	case strings.HasPrefix(requestType, "ReqPut") || requestType == "ReqCommit" || requestType == "ReqCreate":
+		return PermissionWrite
+	case strings.HasPrefix(requestType, "ReqDelete"):
+		return PermissionDelete
+	default:
+		return PermissionRead
+	}
+}
+
+func checkACL(acl map[string][]string) error {
+	for user, permissions := range acl {
+		for _, granted := range permissions {
+			switch granted {
+			case PermissionRead, PermissionWrite, PermissionDelete, PermissionLock:
+			default:
+				if !strings.HasPrefix(granted, "Req") {
+					return fmt.Errorf("user %s: unknown permission: %s", user, granted)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Permitted tells if the ACL of the export lets user send a request type,
+// the empty user is anonymous
+func (export *Export) Permitted(user string, requestType string) error {
+	if export.ACL == nil {
+		return nil
+	}
+
+	who := "anonymous user"
+	if user != "" {
+		who = "user " + user
+	}
+
+	permissions, exists := export.ACL[user]
+	if !exists {
+		permissions, exists = export.ACL[Anyone]
+	}
+	if !exists {
+		return denied("%s is not allowed to access %s", who, export)
+	}
+
+	// being listed is enough to open and close the repository
+	if requestType == "ReqOpen" || requestType == "ReqClose" {
+		return nil
+	}
+
+	required := permission(requestType)
+	for _, granted := range permissions {
+		if granted == required || granted == requestType {
+			return nil
+		}
+	}
+	return denied("%s lacks the %s permission on %s", who, required, export)
+}
@@ -0,0 +1,232 @@
+package exports
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/PlakarLabs/plakar/network"
+	"github.com/PlakarLabs/plakar/storage"
+	"github.com/dustin/go-humanize"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v2"
+)
+
+// Policy restricts the requests a server accepts for a repository
+type Policy string
+
+const (
+	PolicyReadWrite Policy = "read-write"
+	PolicyReadOnly  Policy = "read-only"
+	PolicyNoDelete  Policy = "no-delete"
+
+	// PolicyAppendOnly refuses deletions and the replacement of existing
+	// snapshots, content-addressed objects are written under their checksum
+	PolicyAppendOnly Policy = "append-only"
+)
+
+func parsePolicy(policy string) (Policy, error) {
+	switch Policy(policy) {
+	case "":
+		return PolicyReadWrite, nil
+	case PolicyReadWrite, PolicyReadOnly, PolicyNoDelete, PolicyAppendOnly:
+		return Policy(policy), nil
+	default:
+		return "", fmt.Errorf("unknown policy: %s", policy)
+	}
+}
+
+// Export is a repository served under a name
+type Export struct {
+	Name       string
+	Policy     Policy
+	Repository *storage.Repository
+
+	// ACL maps users to their permissions, anyone may access the
+	// repository when it is nil
+	ACL map[string][]string
+
+	// Quota limits the bytes used by packfiles and blobs, 0 disables it
+	Quota uint64
+
+	muUsage    sync.Mutex
+	usage      uint64
+	usageKnown bool
+	stored     map[Kind]map[[32]byte]struct{}
+}
+
+// Exports are the repositories a server exports, selected by the path of
+// the URL clients connect to.
+type Exports struct {
+	named    map[string]*Export
+	fallback *Export
+}
+
+type exportsFile struct {
+	Repositories map[string]struct {
+		Location string              `yaml:"location"`
+		Policy   string              `yaml:"policy"`
+		Quota    string              `yaml:"quota"`
+		ACL      map[string][]string `yaml:"acl"`
+	} `yaml:"repositories"`
+}
+
+// New exports repository alone, it is served whatever name clients ask for
+// unless other exports are added.
+func New(repository *storage.Repository, policy Policy) *Exports {
+	exports := &Exports{named: make(map[string]*Export)}
+	if repository != nil {
+		exports.fallback = &Export{Policy: policy, Repository: repository}
+	}
+	return exports
+}
+
+// Load opens the repositories listed in an exports file:
+//
+//	repositories:
+//	  alice:
+//	    location: /var/backups/alice
+//	    policy: append-only
+//	    quota: 100GB
+//	    acl:
+//	      alice: [read, write, lock]
+//	      backup-checker: [read]
+func (exports *Exports) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file exportsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	for name, entry := range file.Repositories {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("%s: invalid repository name: %q", path, name)
+		}
+		if _, exists := exports.named[name]; exists {
+			return fmt.Errorf("%s: repository %s exported twice", path, name)
+		}
+		if entry.Location == "" {
+			return fmt.Errorf("%s: repository %s has no location", path, name)
+		}
+		policy, err := parsePolicy(entry.Policy)
+		if err != nil {
+			return fmt.Errorf("%s: repository %s: %s", path, name, err)
+		}
+
+		quota := uint64(0)
+		if entry.Quota != "" {
+			quota, err = humanize.ParseBytes(entry.Quota)
+			if err != nil {
+				return fmt.Errorf("%s: repository %s: invalid quota: %s", path, name, err)
+			}
+		}
+		if err := checkACL(entry.ACL); err != nil {
+			return fmt.Errorf("%s: repository %s: %s", path, name, err)
+		}
+
+		repository, err := storage.Open(entry.Location)
+		if err != nil {
+			return fmt.Errorf("repository %s: %s", name, err)
+		}
+		if repository.Configuration().Version != storage.VERSION {
+			return fmt.Errorf("repository %s: incompatible repository version: %s != %s",
+				name, repository.Configuration().Version, storage.VERSION)
+		}
+		exports.named[name] = &Export{Name: name, Policy: policy, Repository: repository, ACL: entry.ACL, Quota: quota}
+	}
+	return nil
+}
+
+// Names returns the names of the exported repositories, sorted
+func (exports *Exports) Names() []string {
+	names := make([]string, 0, len(exports.named))
+	for name := range exports.named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the repository exported under name, the leading and
+// trailing slashes of an URL path are ignored.
+func (exports *Exports) Lookup(name string) (*Export, error) {
+	name = strings.Trim(name, "/")
+	if export, exists := exports.named[name]; exists {
+		return export, nil
+	}
+	if exports.fallback != nil && (name == "" || len(exports.named) == 0) {
+		return exports.fallback, nil
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no default repository, one of %s must be selected", strings.Join(exports.Names(), ", "))
+	}
+	return nil, fmt.Errorf("unknown repository: %s", name)
+}
+
+func (export *Export) String() string {
+	if export.Name == "" {
+		return "default repository"
+	}
+	return "repository " + export.Name
+}
+
+// denied errors are sent to clients as is
+func denied(format string, a ...interface{}) error {
+	return network.Errorf(network.CodePermission, format, a...)
+}
+
+// Allowed tells if the policy of the export accepts a request type
+func (export *Export) Allowed(requestType string) error {
+	write := strings.HasPrefix(requestType, "ReqPut") || requestType == "ReqCommit" || requestType == "ReqCreate"
+	remove := strings.HasPrefix(requestType, "ReqDelete")
+
+	switch export.Policy {
+	case PolicyReadOnly:
+		if write || remove {
+			return denied("%s is read-only", export)
+		}
+	case PolicyNoDelete, PolicyAppendOnly:
+		// locks are released by deleting them
+		if remove && requestType != "ReqDeleteLock" {
+			return denied("not allowed to delete")
+		}
+	}
+	return nil
+}
+
+// CheckOverwrite refuses to replace an existing snapshot in an append-only
+// repository.
+func (export *Export) CheckOverwrite(indexID uuid.UUID) error {
+	if export.Policy != PolicyAppendOnly {
+		return nil
+	}
+	snapshots, err := export.Repository.GetSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot == indexID {
+			return denied("snapshot %s already exists in append-only %s", indexID, export)
+		}
+	}
+	return nil
+}
+
+// Capabilities advertises the policy of the export to clients
+func (export *Export) Capabilities() []string {
+	switch export.Policy {
+	case PolicyReadOnly:
+		return []string{network.CapabilityReadOnly, network.CapabilityNoDelete}
+	case PolicyNoDelete:
+		return []string{network.CapabilityNoDelete}
+	case PolicyAppendOnly:
+		return []string{network.CapabilityNoDelete, network.CapabilityAppendOnly}
+	}
+	return []string{}
+}
@@ -0,0 +1,144 @@
+package exports
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PlakarLabs/plakar/storage"
+	_ "github.com/PlakarLabs/plakar/storage/backends/fs"
+	"github.com/google/uuid"
+)
+
+func TestPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy  Policy
+		allowed map[string]bool
+	}{
+		{PolicyReadWrite, map[string]bool{"ReqGetBlob": true, "ReqPutBlob": true, "ReqDeleteBlob": true, "ReqCommit": true}},
+		{PolicyReadOnly, map[string]bool{"ReqGetBlob": true, "ReqPutBlob": false, "ReqDeleteLock": false, "ReqCommit": false}},
+		{PolicyNoDelete, map[string]bool{"ReqPutBlob": true, "ReqDeleteBlob": false, "ReqDeleteLock": true}},
+		{PolicyAppendOnly, map[string]bool{"ReqPutSnapshot": true, "ReqDeleteSnapshot": false, "ReqDeleteLock": true}},
+	} {
+		export := &Export{Name: "test", Policy: test.policy}
+		for requestType, allowed := range test.allowed {
+			if err := export.Allowed(requestType); (err == nil) != allowed {
+				t.Errorf("%s: %s: expected allowed=%v, got %v", test.policy, requestType, allowed, err)
+			}
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	repository, err := storage.Create(filepath.Join(t.TempDir(), "repository"), storage.RepositoryConfig{
+		Version:      storage.VERSION,
+		RepositoryID: uuid.Must(uuid.NewRandom()),
+		CreationTime: time.Now(),
+		Hashing:      "sha256",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a single repository is served whatever the name, as before exports
+	exports := New(repository, PolicyAppendOnly)
+	if export, err := exports.Lookup("/some/path"); err != nil || export.Repository != repository {
+		t.Errorf("expected the default repository, got %v", err)
+	}
+
+	exports.named["alice"] = &Export{Name: "alice", Repository: repository}
+	if export, err := exports.Lookup("/alice/"); err != nil || export.Name != "alice" {
+		t.Errorf("expected alice, got %v", err)
+	}
+	if export, err := exports.Lookup("/"); err != nil || export.Name != "" {
+		t.Errorf("expected the default repository, got %v", err)
+	}
+	if _, err := exports.Lookup("bob"); err == nil {
+		t.Errorf("expected bob to be unknown")
+	}
+
+	indexID := uuid.Must(uuid.NewRandom())
+	export, _ := exports.Lookup("")
+	if err := export.CheckOverwrite(indexID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.PutSnapshot(indexID, []byte("snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	if err := export.CheckOverwrite(indexID); err == nil {
+		t.Errorf("expected the snapshot not to be replaced")
+	}
+}
+
+func TestACL(t *testing.T) {
+	export := &Export{Name: "test", ACL: map[string][]string{
+		"alice": {PermissionRead, PermissionWrite, PermissionLock},
+		"bob":   {"ReqGetSnapshots"},
+		Anyone:  {PermissionRead},
+	}}
+	for _, test := range []struct {
+		user        string
+		requestType string
+		permitted   bool
+	}{
+		{"alice", "ReqPutPackfile", true},
+		{"alice", "ReqDeleteLock", true},
+		{"alice", "ReqDeletePackfile", false},
+		{"bob", "ReqOpen", true},
+		{"bob", "ReqGetSnapshots", true},
+		{"bob", "ReqGetBlob", false},
+		{"carol", "ReqGetBlob", true},
+		{"", "ReqPutBlob", false},
+	} {
+		if err := export.Permitted(test.user, test.requestType); (err == nil) != test.permitted {
+			t.Errorf("%s: %s: expected permitted=%v, got %v", test.user, test.requestType, test.permitted, err)
+		}
+	}
+
+	delete(export.ACL, Anyone)
+	if err := export.Permitted("carol", "ReqOpen"); err == nil {
+		t.Errorf("carol should not be allowed to open the repository")
+	}
+	if err := checkACL(map[string][]string{"alice": {"admin"}}); err == nil {
+		t.Errorf("expected an unknown permission to be rejected")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	repository, err := storage.Create(filepath.Join(t.TempDir(), "repository"), storage.RepositoryConfig{
+		Version:      storage.VERSION,
+		RepositoryID: uuid.Must(uuid.NewRandom()),
+		CreationTime: time.Now(),
+		Hashing:      "sha256",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := sha256.Sum256([]byte("stored"))
+	if err := repository.PutPackfile(stored, make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+
+	export := &Export{Name: "test", Repository: repository, Quota: 1000}
+	if charged, err := export.Reserve(KindPackfile, stored, 600); err != nil || charged != 0 {
+		t.Errorf("expected a stored packfile not to be charged, got %d: %v", charged, err)
+	}
+
+	checksum := sha256.Sum256([]byte("new"))
+	if err := export.Check(KindBlob, checksum, 600); err == nil {
+		t.Errorf("expected the check to exceed the quota")
+	}
+	charged, err := export.Reserve(KindBlob, checksum, 300)
+	if err != nil || charged != 300 {
+		t.Fatalf("expected 300 bytes to be charged, got %d: %v", charged, err)
+	}
+	if charged, err := export.Reserve(KindBlob, checksum, 300); err != nil || charged != 0 {
+		t.Errorf("expected a reserved blob not to be charged twice, got %d: %v", charged, err)
+	}
+
+	export.Release(KindBlob, checksum, charged)
+	if err := export.Check(KindBlob, checksum, 400); err != nil {
+		t.Errorf("expected released bytes to be available: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package exports
+
+import (
+	"github.com/PlakarLabs/plakar/network"
+	"github.com/dustin/go-humanize"
+)
+
+// Kind tells blobs from packfiles, the quota charges each once
+type Kind int
+
+const (
+	KindBlob Kind = iota
+	KindPackfile
+)
+
+// load reads the usage and the objects stored in the repository, the
+// caller holds export.muUsage
+func (export *Export) load() error {
+	if export.usageKnown {
+		return nil
+	}
+
+	usage, err := export.Repository.Usage()
+	if err != nil {
+		return network.Errorf(network.CodeQuota, "cannot enforce the quota on %s: %s", export, err)
+	}
+	stored := map[Kind]map[[32]byte]struct{}{
+		KindBlob:     make(map[[32]byte]struct{}),
+		KindPackfile: make(map[[32]byte]struct{}),
+	}
+	for kind, list := range map[Kind]func() ([][32]byte, error){KindBlob: export.Repository.GetBlobs, KindPackfile: export.Repository.GetPackfiles} {
+		checksums, err := list()
+		if err != nil {
+			return network.Errorf(network.CodeQuota, "cannot enforce the quota on %s: %s", export, err)
+		}
+		for _, checksum := range checksums {
+			stored[kind][checksum] = struct{}{}
+		}
+	}
+
+	export.usage = usage
+	export.stored = stored
+	export.usageKnown = true
+	return nil
+}
+
+// check tells how many bytes writing an object would charge, none if it
+// is already stored, the caller holds export.muUsage
+func (export *Export) check(kind Kind, checksum [32]byte, size int) (int, error) {
+	if err := export.load(); err != nil {
+		return 0, err
+	}
+	if _, exists := export.stored[kind][checksum]; exists {
+		return 0, nil
+	}
+	if export.usage+uint64(size) > export.Quota {
+		return 0, network.Errorf(network.CodeQuota, "quota exceeded on %s: %s used of %s, %s more requested", export,
+			humanize.Bytes(export.usage), humanize.Bytes(export.Quota), humanize.Bytes(uint64(size)))
+	}
+	return size, nil
+}
+
+// Check fails when writing an object of size bytes would exceed the quota,
+// it lets a server refuse a write before receiving its data.
+func (export *Export) Check(kind Kind, checksum [32]byte, size int) error {
+	if export.Quota == 0 {
+		return nil
+	}
+
+	export.muUsage.Lock()
+	defer export.muUsage.Unlock()
+	_, err := export.check(kind, checksum, size)
+	return err
+}
+
+// Reserve accounts for an object about to be written, it fails when this
+// would exceed the quota. The usage is read from the repository the first
+// time, then tracked as data is written, objects already stored are not
+// charged again. It returns the bytes to release if the write fails.
+func (export *Export) Reserve(kind Kind, checksum [32]byte, size int) (int, error) {
+	if export.Quota == 0 {
+		return 0, nil
+	}
+
+	export.muUsage.Lock()
+	defer export.muUsage.Unlock()
+	charged, err := export.check(kind, checksum, size)
+	if err != nil || charged == 0 {
+		return 0, err
+	}
+	export.usage += uint64(charged)
+	export.stored[kind][checksum] = struct{}{}
+	return charged, nil
+}
+
+// Release gives back bytes reserved for a write that failed
+func (export *Export) Release(kind Kind, checksum [32]byte, size int) {
+	if export.Quota == 0 || size == 0 {
+		return
+	}
+
+	export.muUsage.Lock()
+	defer export.muUsage.Unlock()
+	if export.usageKnown && export.usage >= uint64(size) {
+		export.usage -= uint64(size)
+		delete(export.stored[kind], checksum)
+	}
+}
+
+// Invalidate makes the next reservation read the usage from the repository
+// again, deletions do not tell how many bytes they freed.
+func (export *Export) Invalidate() {
+	export.muUsage.Lock()
+	defer export.muUsage.Unlock()
+	export.usageKnown = false
+	export.stored = nil
+}
@@ -0,0 +1,109 @@
+package httpd
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/PlakarLabs/plakar/network"
+	"github.com/PlakarLabs/plakar/server/exports"
+)
+
+// batch handlers answer failures with a plain text error, as a JSON error
+// field cannot be decoded by clients
+
+func checkBlobBatch(w http.ResponseWriter, r *http.Request, export *exports.Export) {
+	var reqCheckBlobBatch network.ReqCheckBlobBatch
+	if err := json.NewDecoder(r.Body).Decode(&reqCheckBlobBatch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := network.CheckBatch(len(reqCheckBlobBatch.Checksums)); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var resCheckBlobBatch network.ResCheckBlobBatch
+	exists, err := export.Repository.CheckBlobBatch(reqCheckBlobBatch.Checksums)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resCheckBlobBatch.Exists = exists
+	if err := json.NewEncoder(w).Encode(resCheckBlobBatch); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func getBlobBatch(w http.ResponseWriter, r *http.Request, export *exports.Export) {
+	var reqGetBlobBatch network.ReqGetBlobBatch
+	if err := json.NewDecoder(r.Body).Decode(&reqGetBlobBatch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := network.CheckBatch(len(reqGetBlobBatch.Checksums)); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var resGetBlobBatch network.ResGetBlobBatch
+	data, err := export.Repository.GetBlobBatch(reqGetBlobBatch.Checksums)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resGetBlobBatch.Data = data
+	if err := json.NewEncoder(w).Encode(resGetBlobBatch); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func getPackfileSubpartBatch(w http.ResponseWriter, r *http.Request, export *exports.Export) {
+	var reqGetPackfileSubpartBatch network.ReqGetPackfileSubpartBatch
+	if err := json.NewDecoder(r.Body).Decode(&reqGetPackfileSubpartBatch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := network.CheckBatch(len(reqGetPackfileSubpartBatch.Subparts)); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var resGetPackfileSubpartBatch network.ResGetPackfileSubpartBatch
+	data, err := export.Repository.GetPackfileSubpartBatch(reqGetPackfileSubpartBatch.Checksum, reqGetPackfileSubpartBatch.Subparts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resGetPackfileSubpartBatch.Data = data
+	if err := json.NewEncoder(w).Encode(resGetPackfileSubpartBatch); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func listPage(w http.ResponseWriter, r *http.Request, export *exports.Export) {
+	var reqListPage network.ReqListPage
+	if err := json.NewDecoder(r.Body).Decode(&reqListPage); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := network.CheckBatch(reqListPage.Limit); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var resListPage network.ResListPage
+	checksums, more, err := export.Repository.ListPage(reqListPage.Resource, reqListPage.After, reqListPage.Limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resListPage.Checksums = checksums
+	resListPage.More = more
+	if err := json.NewEncoder(w).Encode(resListPage); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -1,29 +1,100 @@
 package httpd
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/PlakarLabs/plakar/network"
+	"github.com/PlakarLabs/plakar/server/api"
+	"github.com/PlakarLabs/plakar/server/exports"
 	"github.com/PlakarLabs/plakar/storage"
 	"github.com/gorilla/mux"
 )
 
-var lrepository *storage.Repository
-var lNoDelete bool
+var lexports *exports.Exports
+var ltokens []network.Token
 
-func openRepository(w http.ResponseWriter, r *http.Request) {
+type handler func(w http.ResponseWriter, r *http.Request, export *exports.Export)
+
+// authenticate returns the user of the bearer token a request carries, or
+// the common name of the certificate a TLS client presented
+func authenticate(r *http.Request) (string, error) {
+	if len(ltokens) == 0 {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+			return r.TLS.PeerCertificates[0].Subject.CommonName, nil
+		}
+		return "", nil
+	}
+	secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if secret == "" || secret == r.Header.Get("Authorization") {
+		return "", fmt.Errorf("authentication required")
+	}
+	for _, token := range ltokens {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(token.Secret)) == 1 {
+			return token.User, nil
+		}
+	}
+	return "", fmt.Errorf("authentication failed")
+}
+
+// resolve authenticates a request, resolves the repository it is for and
+// checks that its ACL and policy allow the request, returning the status to
+// reply otherwise
+func resolve(r *http.Request, requestType string) (*exports.Export, int, error) {
+	user, err := authenticate(r)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	export, err := lexports.Lookup(mux.Vars(r)["repository"])
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	if err := export.Permitted(user, requestType); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	if err := export.Allowed(requestType); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	return export, 0, nil
+}
+
+func handle(requestType string, h handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		export, status, err := resolve(r, requestType)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		h(w, r, export)
+	}
+}
+
+// resolveRepository is the resolver of the JSON API
+func resolveRepository(r *http.Request, requestType string) (*storage.Repository, int, error) {
+	export, status, err := resolve(r, requestType)
+	if err != nil {
+		return nil, status, err
+	}
+	return export.Repository, 0, nil
+}
+
+func openRepository(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqOpen network.ReqOpen
 	if err := json.NewDecoder(r.Body).Decode(&reqOpen); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	config := lrepository.Configuration()
+	config := export.Repository.Configuration()
 
 	var resOpen network.ResOpen
 	resOpen.RepositoryConfig = &config
+	resOpen.Capabilities = append(export.Capabilities(), network.CapabilityBatch)
 	resOpen.Err = nil
 	if err := json.NewEncoder(w).Encode(resOpen); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -31,14 +102,14 @@ func openRepository(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func closeRepository(w http.ResponseWriter, r *http.Request) {
+func closeRepository(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqClose network.ReqClose
 	if err := json.NewDecoder(r.Body).Decode(&reqClose); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if reqClose.Uuid != lrepository.Configuration().RepositoryID.String() {
+	if reqClose.Uuid != export.Repository.Configuration().RepositoryID.String() {
 		http.Error(w, "UUID mismatch", http.StatusBadRequest)
 		return
 	}
@@ -52,7 +123,7 @@ func closeRepository(w http.ResponseWriter, r *http.Request) {
 }
 
 // snapshots
-func getSnapshots(w http.ResponseWriter, r *http.Request) {
+func getSnapshots(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqGetSnapshots network.ReqGetSnapshots
 	if err := json.NewDecoder(r.Body).Decode(&reqGetSnapshots); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -60,7 +131,7 @@ func getSnapshots(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resGetSnapshots network.ResGetSnapshots
-	snapshots, err := lrepository.GetSnapshots()
+	snapshots, err := export.Repository.GetSnapshots()
 	if err != nil {
 		resGetSnapshots.Err = err
 	} else {
@@ -72,22 +143,27 @@ func getSnapshots(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func putSnapshot(w http.ResponseWriter, r *http.Request) {
+func putSnapshot(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqPutSnapshot network.ReqPutSnapshot
 	if err := json.NewDecoder(r.Body).Decode(&reqPutSnapshot); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	if err := export.CheckOverwrite(reqPutSnapshot.IndexID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	var resPutSnapshot network.ResPutSnapshot
-	resPutSnapshot.Err = lrepository.PutSnapshot(reqPutSnapshot.IndexID, reqPutSnapshot.Data)
+	resPutSnapshot.Err = export.Repository.PutSnapshot(reqPutSnapshot.IndexID, reqPutSnapshot.Data)
 	if err := json.NewEncoder(w).Encode(resPutSnapshot); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func getSnapshot(w http.ResponseWriter, r *http.Request) {
+func getSnapshot(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqGetSnapshot network.ReqGetSnapshot
 	if err := json.NewDecoder(r.Body).Decode(&reqGetSnapshot); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -95,7 +171,7 @@ func getSnapshot(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resGetSnapshot network.ResGetSnapshot
-	data, err := lrepository.GetSnapshot(reqGetSnapshot.IndexID)
+	data, err := export.Repository.GetSnapshot(reqGetSnapshot.IndexID)
 	if err != nil {
 		resGetSnapshot.Err = err
 	} else {
@@ -107,12 +183,7 @@ func getSnapshot(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func deleteSnapshot(w http.ResponseWriter, r *http.Request) {
-	if lNoDelete {
-		http.Error(w, fmt.Errorf("not allowed to delete").Error(), http.StatusForbidden)
-		return
-	}
-
+func deleteSnapshot(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqDeleteSnapshot network.ReqDeleteSnapshot
 	if err := json.NewDecoder(r.Body).Decode(&reqDeleteSnapshot); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -120,22 +191,27 @@ func deleteSnapshot(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resDeleteSnapshot network.ResDeleteSnapshot
-	resDeleteSnapshot.Err = lrepository.DeleteSnapshot(reqDeleteSnapshot.IndexID)
+	resDeleteSnapshot.Err = export.Repository.DeleteSnapshot(reqDeleteSnapshot.IndexID)
 	if err := json.NewEncoder(w).Encode(resDeleteSnapshot); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func commitSnapshot(w http.ResponseWriter, r *http.Request) {
+func commitSnapshot(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var ReqCommit network.ReqCommit
 	if err := json.NewDecoder(r.Body).Decode(&ReqCommit); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	if err := export.CheckOverwrite(ReqCommit.IndexID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	var ResCommit network.ResCommit
-	ResCommit.Err = lrepository.Commit(ReqCommit.IndexID, ReqCommit.Data)
+	ResCommit.Err = export.Repository.Commit(ReqCommit.IndexID, ReqCommit.Data)
 	if err := json.NewEncoder(w).Encode(ResCommit); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -143,7 +219,7 @@ func commitSnapshot(w http.ResponseWriter, r *http.Request) {
 }
 
 // locks
-func getLocks(w http.ResponseWriter, r *http.Request) {
+func getLocks(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqGetLocks network.ReqGetLocks
 	if err := json.NewDecoder(r.Body).Decode(&reqGetLocks); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -151,7 +227,7 @@ func getLocks(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resGetLocks network.ResGetLocks
-	locks, err := lrepository.GetLocks()
+	locks, err := export.Repository.GetLocks()
 	if err != nil {
 		resGetLocks.Err = err
 	} else {
@@ -163,7 +239,7 @@ func getLocks(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func putLock(w http.ResponseWriter, r *http.Request) {
+func putLock(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqPutLock network.ReqPutLock
 	if err := json.NewDecoder(r.Body).Decode(&reqPutLock); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -171,14 +247,14 @@ func putLock(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resPutLock network.ResPutLock
-	resPutLock.Err = lrepository.PutLock(reqPutLock.IndexID, reqPutLock.Data)
+	resPutLock.Err = export.Repository.PutLock(reqPutLock.IndexID, reqPutLock.Data)
 	if err := json.NewEncoder(w).Encode(resPutLock); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func getLock(w http.ResponseWriter, r *http.Request) {
+func getLock(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqGetLock network.ReqGetLock
 	if err := json.NewDecoder(r.Body).Decode(&reqGetLock); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -186,7 +262,7 @@ func getLock(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resGetLock network.ResGetLock
-	data, err := lrepository.GetLock(reqGetLock.IndexID)
+	data, err := export.Repository.GetLock(reqGetLock.IndexID)
 	if err != nil {
 		resGetLock.Err = err
 	} else {
@@ -198,7 +274,7 @@ func getLock(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func deleteLock(w http.ResponseWriter, r *http.Request) {
+func deleteLock(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqDeleteLock network.ReqDeleteLock
 	if err := json.NewDecoder(r.Body).Decode(&reqDeleteLock); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -206,7 +282,7 @@ func deleteLock(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resDeleteLock network.ResDeleteLock
-	resDeleteLock.Err = lrepository.DeleteLock(reqDeleteLock.IndexID)
+	resDeleteLock.Err = export.Repository.DeleteLock(reqDeleteLock.IndexID)
 	if err := json.NewEncoder(w).Encode(resDeleteLock); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -214,7 +290,7 @@ func deleteLock(w http.ResponseWriter, r *http.Request) {
 }
 
 // blobs
-func getBlobs(w http.ResponseWriter, r *http.Request) {
+func getBlobs(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqGetBlobs network.ReqGetBlobs
 	if err := json.NewDecoder(r.Body).Decode(&reqGetBlobs); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -222,7 +298,7 @@ func getBlobs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resGetBlobs network.ResGetBlobs
-	checksums, err := lrepository.GetBlobs()
+	checksums, err := export.Repository.GetBlobs()
 	if err != nil {
 		resGetBlobs.Err = err
 	} else {
@@ -234,22 +310,31 @@ func getBlobs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func putBlob(w http.ResponseWriter, r *http.Request) {
+func putBlob(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqPutBlob network.ReqPutBlob
 	if err := json.NewDecoder(r.Body).Decode(&reqPutBlob); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	charged, err := export.Reserve(exports.KindBlob, reqPutBlob.Checksum, len(reqPutBlob.Data))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
 	var resPutBlob network.ResPutBlob
-	resPutBlob.Err = lrepository.PutBlob(reqPutBlob.Checksum, reqPutBlob.Data)
+	resPutBlob.Err = export.Repository.PutBlob(reqPutBlob.Checksum, reqPutBlob.Data)
+	if resPutBlob.Err != nil {
+		export.Release(exports.KindBlob, reqPutBlob.Checksum, charged)
+	}
 	if err := json.NewEncoder(w).Encode(resPutBlob); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func checkBlob(w http.ResponseWriter, r *http.Request) {
+func checkBlob(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqCheckBlob network.ReqCheckBlob
 	if err := json.NewDecoder(r.Body).Decode(&reqCheckBlob); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -257,7 +342,7 @@ func checkBlob(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resCheckBlob network.ResCheckBlob
-	exists, err := lrepository.CheckBlob(reqCheckBlob.Checksum)
+	exists, err := export.Repository.CheckBlob(reqCheckBlob.Checksum)
 	if err != nil {
 		resCheckBlob.Err = err
 	} else {
@@ -269,7 +354,7 @@ func checkBlob(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getBlob(w http.ResponseWriter, r *http.Request) {
+func getBlob(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqGetBlob network.ReqGetBlob
 	if err := json.NewDecoder(r.Body).Decode(&reqGetBlob); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -277,7 +362,7 @@ func getBlob(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resGetBlob network.ResGetBlob
-	data, err := lrepository.GetBlob(reqGetBlob.Checksum)
+	data, err := export.Repository.GetBlob(reqGetBlob.Checksum)
 	if err != nil {
 		resGetBlob.Err = err
 	} else {
@@ -289,12 +374,7 @@ func getBlob(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func deleteBlob(w http.ResponseWriter, r *http.Request) {
-	if lNoDelete {
-		http.Error(w, fmt.Errorf("not allowed to delete").Error(), http.StatusForbidden)
-		return
-	}
-
+func deleteBlob(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqDeleteBlob network.ReqDeleteBlob
 	if err := json.NewDecoder(r.Body).Decode(&reqDeleteBlob); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -302,7 +382,8 @@ func deleteBlob(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resDeleteBlob network.ResDeleteBlob
-	resDeleteBlob.Err = lrepository.DeleteBlob(reqDeleteBlob.Checksum)
+	resDeleteBlob.Err = export.Repository.DeleteBlob(reqDeleteBlob.Checksum)
+	export.Invalidate()
 	if err := json.NewEncoder(w).Encode(resDeleteBlob); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -310,7 +391,7 @@ func deleteBlob(w http.ResponseWriter, r *http.Request) {
 }
 
 // indexes
-func getIndexes(w http.ResponseWriter, r *http.Request) {
+func getIndexes(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqGetIndexes network.ReqGetIndexes
 	if err := json.NewDecoder(r.Body).Decode(&reqGetIndexes); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -318,7 +399,7 @@ func getIndexes(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resGetIndexes network.ResGetIndexes
-	indexes, err := lrepository.GetIndexes()
+	indexes, err := export.Repository.GetIndexes()
 	if err != nil {
 		resGetIndexes.Err = err
 	} else {
@@ -330,7 +411,7 @@ func getIndexes(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func putIndex(w http.ResponseWriter, r *http.Request) {
+func putIndex(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqPutIndex network.ReqPutIndex
 	if err := json.NewDecoder(r.Body).Decode(&reqPutIndex); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -338,14 +419,14 @@ func putIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resPutIndex network.ResPutIndex
-	resPutIndex.Err = lrepository.PutIndex(reqPutIndex.Checksum, reqPutIndex.Data)
+	resPutIndex.Err = export.Repository.PutIndex(reqPutIndex.Checksum, reqPutIndex.Data)
 	if err := json.NewEncoder(w).Encode(resPutIndex); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func getIndex(w http.ResponseWriter, r *http.Request) {
+func getIndex(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqGetIndex network.ReqGetIndex
 	if err := json.NewDecoder(r.Body).Decode(&reqGetIndex); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -353,7 +434,7 @@ func getIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resGetIndex network.ResGetIndex
-	data, err := lrepository.GetIndex(reqGetIndex.Checksum)
+	data, err := export.Repository.GetIndex(reqGetIndex.Checksum)
 	if err != nil {
 		resGetIndex.Err = err
 	} else {
@@ -365,12 +446,7 @@ func getIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func deleteIndex(w http.ResponseWriter, r *http.Request) {
-	if lNoDelete {
-		http.Error(w, fmt.Errorf("not allowed to delete").Error(), http.StatusForbidden)
-		return
-	}
-
+func deleteIndex(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqDeleteIndex network.ReqDeleteIndex
 	if err := json.NewDecoder(r.Body).Decode(&reqDeleteIndex); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -378,7 +454,7 @@ func deleteIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resDeleteIndex network.ResDeleteIndex
-	resDeleteIndex.Err = lrepository.DeleteIndex(reqDeleteIndex.Checksum)
+	resDeleteIndex.Err = export.Repository.DeleteIndex(reqDeleteIndex.Checksum)
 	if err := json.NewEncoder(w).Encode(resDeleteIndex); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -386,7 +462,7 @@ func deleteIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 // packfiles
-func getPackfiles(w http.ResponseWriter, r *http.Request) {
+func getPackfiles(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqGetPackfiles network.ReqGetPackfiles
 	if err := json.NewDecoder(r.Body).Decode(&reqGetPackfiles); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -394,7 +470,7 @@ func getPackfiles(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resGetPackfiles network.ResGetPackfiles
-	packfiles, err := lrepository.GetPackfiles()
+	packfiles, err := export.Repository.GetPackfiles()
 	if err != nil {
 		resGetPackfiles.Err = err
 	} else {
@@ -406,22 +482,31 @@ func getPackfiles(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func putPackfile(w http.ResponseWriter, r *http.Request) {
+func putPackfile(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqPutPackfile network.ReqPutPackfile
 	if err := json.NewDecoder(r.Body).Decode(&reqPutPackfile); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	charged, err := export.Reserve(exports.KindPackfile, reqPutPackfile.Checksum, len(reqPutPackfile.Data))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
 	var resPutPackfile network.ResPutPackfile
-	resPutPackfile.Err = lrepository.PutPackfile(reqPutPackfile.Checksum, reqPutPackfile.Data)
+	resPutPackfile.Err = export.Repository.PutPackfile(reqPutPackfile.Checksum, reqPutPackfile.Data)
+	if resPutPackfile.Err != nil {
+		export.Release(exports.KindPackfile, reqPutPackfile.Checksum, charged)
+	}
 	if err := json.NewEncoder(w).Encode(resPutPackfile); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func getPackfile(w http.ResponseWriter, r *http.Request) {
+func getPackfile(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqGetPackfile network.ReqGetPackfile
 	if err := json.NewDecoder(r.Body).Decode(&reqGetPackfile); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -429,7 +514,7 @@ func getPackfile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resGetPackfile network.ResGetPackfile
-	data, err := lrepository.GetPackfile(reqGetPackfile.Checksum)
+	data, err := export.Repository.GetPackfile(reqGetPackfile.Checksum)
 	if err != nil {
 		resGetPackfile.Err = err
 	} else {
@@ -441,7 +526,7 @@ func getPackfile(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getPackfileSubpart(w http.ResponseWriter, r *http.Request) {
+func getPackfileSubpart(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqGetPackfileSubpart network.ReqGetPackfileSubpart
 	if err := json.NewDecoder(r.Body).Decode(&reqGetPackfileSubpart); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -449,7 +534,7 @@ func getPackfileSubpart(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resGetPackfileSubpart network.ResGetPackfileSubpart
-	data, err := lrepository.GetPackfileSubpart(reqGetPackfileSubpart.Checksum, reqGetPackfileSubpart.Offset, reqGetPackfileSubpart.Length)
+	data, err := export.Repository.GetPackfileSubpart(reqGetPackfileSubpart.Checksum, reqGetPackfileSubpart.Offset, reqGetPackfileSubpart.Length)
 	if err != nil {
 		resGetPackfileSubpart.Err = err
 	} else {
@@ -461,12 +546,7 @@ func getPackfileSubpart(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func deletePackfile(w http.ResponseWriter, r *http.Request) {
-	if lNoDelete {
-		http.Error(w, fmt.Errorf("not allowed to delete").Error(), http.StatusForbidden)
-		return
-	}
-
+func deletePackfile(w http.ResponseWriter, r *http.Request, export *exports.Export) {
 	var reqDeletePackfile network.ReqDeletePackfile
 	if err := json.NewDecoder(r.Body).Decode(&reqDeletePackfile); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -474,51 +554,86 @@ func deletePackfile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var resDeletePackfile network.ResDeletePackfile
-	resDeletePackfile.Err = lrepository.DeletePackfile(reqDeletePackfile.Checksum)
+	resDeletePackfile.Err = export.Repository.DeletePackfile(reqDeletePackfile.Checksum)
+	export.Invalidate()
 	if err := json.NewEncoder(w).Encode(resDeletePackfile); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func Server(repository *storage.Repository, addr string, noDelete bool) error {
-
-	lNoDelete = noDelete
+func routes(r *mux.Router) {
+	r.HandleFunc("/", handle("ReqOpen", openRepository)).Methods("GET")
+	r.HandleFunc("/", handle("ReqClose", closeRepository)).Methods("POST")
+
+	r.HandleFunc("/snapshots", handle("ReqGetSnapshots", getSnapshots)).Methods("GET")
+	r.HandleFunc("/snapshot", handle("ReqPutSnapshot", putSnapshot)).Methods("PUT")
+	r.HandleFunc("/snapshot", handle("ReqGetSnapshot", getSnapshot)).Methods("GET")
+	r.HandleFunc("/snapshot", handle("ReqDeleteSnapshot", deleteSnapshot)).Methods("DELETE")
+	r.HandleFunc("/snapshot", handle("ReqCommit", commitSnapshot)).Methods("POST")
+
+	r.HandleFunc("/locks", handle("ReqGetLocks", getLocks)).Methods("GET")
+	r.HandleFunc("/lock", handle("ReqPutLock", putLock)).Methods("PUT")
+	r.HandleFunc("/lock", handle("ReqGetLock", getLock)).Methods("GET")
+	r.HandleFunc("/lock", handle("ReqDeleteLock", deleteLock)).Methods("DELETE")
+
+	r.HandleFunc("/blobs", handle("ReqGetBlobs", getBlobs)).Methods("GET")
+	r.HandleFunc("/blob", handle("ReqPutBlob", putBlob)).Methods("PUT")
+	r.HandleFunc("/blob", handle("ReqGetBlob", getBlob)).Methods("GET")
+	r.HandleFunc("/blob/check", handle("ReqCheckBlob", checkBlob)).Methods("GET")
+	r.HandleFunc("/blob", handle("ReqDeleteBlob", deleteBlob)).Methods("DELETE")
+
+	r.HandleFunc("/indexes", handle("ReqGetIndexes", getIndexes)).Methods("GET")
+	r.HandleFunc("/index", handle("ReqPutIndex", putIndex)).Methods("PUT")
+	r.HandleFunc("/index", handle("ReqGetIndex", getIndex)).Methods("GET")
+	r.HandleFunc("/index", handle("ReqDeleteIndex", deleteIndex)).Methods("DELETE")
+
+	r.HandleFunc("/packfiles", handle("ReqGetPackfiles", getPackfiles)).Methods("GET")
+	r.HandleFunc("/packfile", handle("ReqPutPackfile", putPackfile)).Methods("PUT")
+	r.HandleFunc("/packfile", handle("ReqGetPackfile", getPackfile)).Methods("GET")
+	r.HandleFunc("/packfile/subpart", handle("ReqGetPackfileSubpart", getPackfileSubpart)).Methods("GET")
+	r.HandleFunc("/packfile", handle("ReqDeletePackfile", deletePackfile)).Methods("DELETE")
+
+	r.HandleFunc("/blobs/check", handle("ReqCheckBlobBatch", checkBlobBatch)).Methods("GET")
+	r.HandleFunc("/blobs/fetch", handle("ReqGetBlobBatch", getBlobBatch)).Methods("GET")
+	r.HandleFunc("/packfile/subparts", handle("ReqGetPackfileSubpartBatch", getPackfileSubpartBatch)).Methods("GET")
+	r.HandleFunc("/list", handle("ReqListPage", listPage)).Methods("GET")
+}
 
-	lrepository = repository
+// Handler serves exports over HTTP, clients must send one of tokens as a
+// bearer token when it is not empty
+func Handler(exports *exports.Exports, tokens []network.Token) http.Handler {
+	lexports = exports
+	ltokens = tokens
 	network.ProtocolRegister()
 
+	// the default repository is served at the root, named ones under
+	// their name, along with the JSON API
+	jsonAPI := api.New(resolveRepository)
 	r := mux.NewRouter()
-	r.HandleFunc("/", openRepository).Methods("GET")
-	r.HandleFunc("/", closeRepository).Methods("POST")
-
-	r.HandleFunc("/snapshots", getSnapshots).Methods("GET")
-	r.HandleFunc("/snapshot", putSnapshot).Methods("PUT")
-	r.HandleFunc("/snapshot", getSnapshot).Methods("GET")
-	r.HandleFunc("/snapshot", deleteSnapshot).Methods("DELETE")
-	r.HandleFunc("/snapshot", commitSnapshot).Methods("POST")
-
-	r.HandleFunc("/locks", getLocks).Methods("GET")
-	r.HandleFunc("/lock", putLock).Methods("PUT")
-	r.HandleFunc("/lock", getLock).Methods("GET")
-	r.HandleFunc("/lock", deleteLock).Methods("DELETE")
-
-	r.HandleFunc("/blobs", getBlobs).Methods("GET")
-	r.HandleFunc("/blob", putBlob).Methods("PUT")
-	r.HandleFunc("/blob", getBlob).Methods("GET")
-	r.HandleFunc("/blob/check", checkBlob).Methods("GET")
-	r.HandleFunc("/blob", deleteBlob).Methods("DELETE")
-
-	r.HandleFunc("/indexes", getIndexes).Methods("GET")
-	r.HandleFunc("/index", putIndex).Methods("PUT")
-	r.HandleFunc("/index", getIndex).Methods("GET")
-	r.HandleFunc("/index", deleteIndex).Methods("DELETE")
-
-	r.HandleFunc("/packfiles", getPackfiles).Methods("GET")
-	r.HandleFunc("/packfile", putPackfile).Methods("PUT")
-	r.HandleFunc("/packfile", getPackfile).Methods("GET")
-	r.HandleFunc("/packfile/subpart", getPackfileSubpart).Methods("GET")
-	r.HandleFunc("/packfile", deletePackfile).Methods("DELETE")
-
-	return http.ListenAndServe(addr, r)
+	jsonAPI.Routes(r)
+	routes(r)
+	named := r.PathPrefix("/{repository}").Subrouter()
+	jsonAPI.Routes(named)
+	routes(named)
+	return r
+}
+
+// Server serves exports over HTTPS when tlsConfig is set, bearer tokens are
+// refused over plain HTTP as they would be sent in clear
+func Server(exports *exports.Exports, addr string, tokens []network.Token, tlsConfig *tls.Config) error {
+	if len(tokens) != 0 && tlsConfig == nil {
+		return fmt.Errorf("tokens require TLS over http")
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	defer l.Close()
+
+	return http.Serve(l, Handler(exports, tokens))
 }
@@ -0,0 +1,151 @@
+package httpd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/network"
+	"github.com/PlakarLabs/plakar/server/exports"
+	"github.com/PlakarLabs/plakar/storage"
+	_ "github.com/PlakarLabs/plakar/storage/backends/fs"
+	_ "github.com/PlakarLabs/plakar/storage/backends/http"
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	logger.Start()
+	os.Exit(m.Run())
+}
+
+// issue writes a certificate and its key to dir, signed by parent or
+// self-signed when parent is nil.
+func issue(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issue(t, dir, "ca", nil, nil)
+	issue(t, dir, "server", ca, caKey)
+	issue(t, dir, "client", ca, caKey)
+
+	config := storage.RepositoryConfig{
+		Version:      storage.VERSION,
+		RepositoryID: uuid.Must(uuid.NewRandom()),
+		CreationTime: time.Now(),
+		Hashing:      "sha256",
+	}
+	repository, err := storage.Create(filepath.Join(dir, "repository"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := exports.New(repository, exports.PolicyReadWrite)
+	tokens := []network.Token{{Secret: "secret"}}
+
+	// tokens are not sent in clear
+	if err := Server(served, "127.0.0.1:0", tokens, nil); err == nil {
+		t.Fatal("expected tokens to be refused without TLS")
+	}
+
+	tlsConfig, err := network.LoadTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, Handler(served, tokens))
+
+	location := fmt.Sprintf("https://%s?tls_ca=%s&tls_cert=%s&tls_key=%s", l.Addr(),
+		filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+
+	t.Setenv("PLAKAR_TOKEN", "secret")
+	client, err := storage.Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Configuration().RepositoryID != config.RepositoryID {
+		t.Errorf("unexpected repository %s", client.Configuration().RepositoryID)
+	}
+
+	t.Setenv("PLAKAR_TOKEN", "wrong")
+	if _, err := storage.Open(location); err == nil {
+		t.Error("expected authentication to fail")
+	}
+
+	t.Setenv("PLAKAR_TOKEN", "secret")
+	if _, err := storage.Open(fmt.Sprintf("https://%s?tls_ca=%s", l.Addr(), filepath.Join(dir, "ca.pem"))); err == nil {
+		t.Error("expected a connection without client certificate to fail")
+	}
+}
+
+func TestCertificateUser(t *testing.T) {
+	ltokens = nil
+	certificate, _ := issue(t, t.TempDir(), "client", nil, nil)
+
+	// without tokens, TLS clients are known by their certificate
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}}
+	if user, err := authenticate(r); err != nil || user != "client" {
+		t.Errorf("unexpected user %q: %v", user, err)
+	}
+}
@@ -0,0 +1,105 @@
+package plakard
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"net"
+
+	"github.com/PlakarLabs/plakar/network"
+)
+
+// authenticator tracks the authentication state of a connection, a client
+// proves it knows one of the tokens by answering a random challenge.
+type authenticator struct {
+	tokens        []network.Token
+	nonce         []byte
+	authenticated bool
+
+	// user is the identity of the client, the user of its token or the
+	// common name of its certificate
+	user string
+}
+
+func newAuthenticator(tokens []network.Token, peer string) *authenticator {
+	return &authenticator{
+		tokens:        tokens,
+		authenticated: len(tokens) == 0,
+		user:          peer,
+	}
+}
+
+// handle answers an authentication request, or any request received before
+// authentication succeeded. It returns false when the connection must be
+// dropped.
+func (auth *authenticator) handle(request network.Request) (network.Request, bool) {
+	switch request.Type {
+	case "ReqAuthChallenge":
+		auth.nonce = make([]byte, 32)
+		if _, err := rand.Read(auth.nonce); err != nil {
+			return network.Request{
+				Uuid:    request.Uuid,
+				Type:    "ResAuthChallenge",
+				Payload: network.ResAuthChallenge{Err: &network.Error{Message: err.Error()}},
+			}, false
+		}
+		return network.Request{
+			Uuid:    request.Uuid,
+			Type:    "ResAuthChallenge",
+			Payload: network.ResAuthChallenge{Nonce: auth.nonce},
+		}, true
+
+	case "ReqAuth":
+		nonce := auth.nonce
+		auth.nonce = nil
+
+		payload, ok := request.Payload.(network.ReqAuth)
+		if !auth.authenticated && ok {
+			for _, token := range auth.tokens {
+				if nonce != nil && hmac.Equal(payload.Response, network.AuthResponse(token.Secret, nonce)) {
+					auth.authenticated = true
+					if token.User != "" {
+						auth.user = token.User
+					}
+					break
+				}
+			}
+		}
+		if !auth.authenticated || !ok {
+			return network.Request{
+				Uuid:    request.Uuid,
+				Type:    "ResAuth",
+				Payload: network.ResAuth{Err: network.Errorf(network.CodeAuthentication, "authentication failed")},
+			}, false
+		}
+		return network.Request{
+			Uuid:    request.Uuid,
+			Type:    "ResAuth",
+			Payload: network.ResAuth{},
+		}, true
+
+	default:
+		return network.Request{
+			Uuid:    request.Uuid,
+			Type:    "ResAuth",
+			Payload: network.ResAuth{Err: network.Errorf(network.CodeAuthentication, "authentication required")},
+		}, false
+	}
+}
+
+// peerName returns the common name of the certificate a TLS client
+// presented, the handshake is completed if needed.
+func peerName(c net.Conn) (string, error) {
+	conn, ok := c.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	certificates := conn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return "", nil
+	}
+	return certificates[0].Subject.CommonName, nil
+}
@@ -1,6 +1,7 @@
 package plakard
 
 import (
+	"crypto/tls"
 	"encoding/gob"
 	"fmt"
 	"io"
@@ -11,48 +12,113 @@ import (
 
 	"github.com/PlakarLabs/plakar/logger"
 	"github.com/PlakarLabs/plakar/network"
+	"github.com/PlakarLabs/plakar/server/exports"
 	"github.com/PlakarLabs/plakar/storage"
 	"github.com/google/uuid"
 )
 
-var lrepository *storage.Repository
+// ServerOptions configures how plakard accepts clients
+type ServerOptions struct {
+	// Exports are the repositories clients may open
+	Exports *exports.Exports
 
-func Server(repository *storage.Repository, addr string, noDelete bool) {
+	// TLSConfig enables TLS, clients must present a certificate when it
+	// sets ClientCAs
+	TLSConfig *tls.Config
 
-	lrepository = repository
+	// Tokens are shared with the clients allowed to connect, any client is
+	// accepted when empty
+	Tokens []network.Token
+}
+
+func Server(addr string, options *ServerOptions) {
 	network.ProtocolRegister()
 
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if options.TLSConfig != nil {
+		l = tls.NewListener(l, options.TLSConfig)
+	}
 	defer l.Close()
 
+	log.Fatal(serve(l, options))
+}
+
+func serve(l net.Listener, options *ServerOptions) error {
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		go handleConnection(c, c, noDelete)
+		go func() {
+			defer c.Close()
+			peer, err := peerName(c)
+			if err != nil {
+				logger.Warn("%s: %s", c.RemoteAddr(), err)
+				return
+			}
+			handleConnection(c, c, options, peer)
+		}()
 	}
 }
 
+// hello answers the handshake of a client, advertising what this server
+// supports. Policies are advertised when a repository is opened.
+func hello(request network.ReqHello, options *ServerOptions) network.ResHello {
+	response := network.ResHello{
+		Version:        network.VERSION,
+		StorageVersion: storage.VERSION,
+		Capabilities:   []string{network.CapabilityRangeReads, network.CapabilityBatch, network.CapabilityStreaming},
+	}
+	if len(options.Tokens) != 0 {
+		response.Capabilities = append(response.Capabilities, network.CapabilityAuthToken)
+	}
+	if !network.Compatible(request.Version) {
+		response.Err = &network.Error{Message: fmt.Sprintf("client speaks protocol %s, server speaks %s", request.Version, network.VERSION)}
+	}
+	return response
+}
+
 func Stdio(repository *storage.Repository, noDelete bool) error {
-	lrepository = repository
 	network.ProtocolRegister()
 
-	handleConnection(os.Stdin, os.Stdout, noDelete)
+	policy := exports.PolicyReadWrite
+	if noDelete {
+		policy = exports.PolicyNoDelete
+	}
+	handleConnection(os.Stdin, os.Stdout, &ServerOptions{Exports: exports.New(repository, policy)}, "")
 	return nil
 }
 
-func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
+// handleConnection serves a client, peer is the identity its TLS
+// certificate established
+func handleConnection(rd io.Reader, wr io.Writer, options *ServerOptions, peer string) {
 	decoder := gob.NewDecoder(rd)
-	encoder := gob.NewEncoder(wr)
+	mux := network.NewMux(wr)
 
 	var wg sync.WaitGroup
 	Uuid, _ := uuid.NewRandom()
 	clientUuid := Uuid.String()
 
+	auth := newAuthenticator(options.Tokens, peer)
+	var export *exports.Export
+
+	// writes over the quota are refused before their data is received
+	mux.SetAdmission(func(request network.Request) error {
+		if export == nil {
+			return nil
+		}
+		switch payload := request.Payload.(type) {
+		case network.ReqPutBlob:
+			return export.Check(exports.KindBlob, payload.Checksum, int(request.StreamLength))
+		case network.ReqPutPackfile:
+			return export.Check(exports.KindPackfile, payload.Checksum, int(request.StreamLength))
+		}
+		return nil
+	})
+
 	for {
 		request := network.Request{}
 		err := decoder.Decode(&request)
@@ -60,32 +126,116 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			break
 		}
 
-		switch request.Type {
-		case "ReqOpen":
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
+		// frames are reassembled into the request they belong to
+		received, err := mux.Receive(request)
+		if err != nil {
+			logger.Warn("%s: %s", clientUuid, err)
+			break
+		}
+		if received == nil {
+			continue
+		}
+		request = *received
+
+		if request.Type == "ReqHello" {
+			var response network.ResHello
+			if payload, ok := request.Payload.(network.ReqHello); !ok {
+				response = network.ResHello{Err: &network.Error{Message: "invalid hello request"}}
+			} else {
+				logger.Trace("server", "%s: Hello(%s)", clientUuid, payload.Version)
+				if network.HasCapability(payload.Capabilities, network.CapabilityStreaming) {
+					mux.EnableStreaming()
+				}
+				response = hello(payload, options)
+			}
+			result := network.Request{
+				Uuid:    request.Uuid,
+				Type:    "ResHello",
+				Payload: response,
+			}
+			if err := mux.Encode(&result); err != nil {
+				logger.Warn("%s", err)
+				break
+			}
+			continue
+		}
 
-				logger.Trace("server", "%s: Open()", clientUuid)
+		if !auth.authenticated || request.Type == "ReqAuthChallenge" || request.Type == "ReqAuth" {
+			logger.Trace("server", "%s: %s", clientUuid, request.Type)
+			result, ok := auth.handle(request)
+			if err := mux.Encode(&result); err != nil {
+				logger.Warn("%s", err)
+				break
+			}
+			if !ok {
+				logger.Warn("%s: authentication failed", clientUuid)
+				break
+			}
+			continue
+		}
 
-				config := lrepository.Configuration()
-				var payload network.ResOpen
-				if err != nil {
-					payload = network.ResOpen{RepositoryConfig: nil, Err: err}
-				} else {
-					payload = network.ResOpen{RepositoryConfig: &config, Err: nil}
-				}
-				result := network.Request{
-					Uuid:    request.Uuid,
-					Type:    "ResOpen",
-					Payload: payload,
-				}
-				err = encoder.Encode(&result)
-				if err != nil {
-					logger.Warn("%s", err)
-				}
-			}()
+		// the repository is selected before anything else is requested
+		if request.Type == "ReqOpen" {
+			open, ok := request.Payload.(network.ReqOpen)
+			logger.Trace("server", "%s: Open(%s)", clientUuid, open.Repository)
+
+			var payload network.ResOpen
+			if !ok {
+				payload = network.ResOpen{RepositoryConfig: nil, Err: &network.Error{Message: "invalid open request"}}
+			} else if opened, err := options.Exports.Lookup(open.Repository); err != nil {
+				payload = network.ResOpen{RepositoryConfig: nil, Err: network.Errorf(network.CodeNotFound, "%s", err)}
+			} else if err := opened.Permitted(auth.user, request.Type); err != nil {
+				logger.Warn("%s: %s", clientUuid, err)
+				payload = network.ResOpen{RepositoryConfig: nil, Err: err}
+			} else {
+				export = opened
+				mux.AcceptStreams()
+				config := export.Repository.Configuration()
+				payload = network.ResOpen{RepositoryConfig: &config, Capabilities: export.Capabilities(), Err: nil}
+			}
+			result := network.Request{
+				Uuid:    request.Uuid,
+				Type:    "ResOpen",
+				Payload: payload,
+			}
+			if err := mux.Encode(&result); err != nil {
+				logger.Warn("%s", err)
+				break
+			}
+			continue
+		}
+
+		if export == nil {
+			result := network.Request{
+				Uuid:    request.Uuid,
+				Type:    "ResError",
+				Payload: network.ResError{Err: &network.Error{Message: "no repository opened"}},
+			}
+			if err := mux.Encode(&result); err != nil {
+				logger.Warn("%s", err)
+				break
+			}
+			continue
+		}
+
+		if err := export.Permitted(auth.user, request.Type); err != nil {
+			logger.Warn("%s: %s", clientUuid, err)
+			result := network.Request{
+				Uuid:    request.Uuid,
+				Type:    "ResError",
+				Payload: network.ResError{Err: err},
+			}
+			if err := mux.Encode(&result); err != nil {
+				logger.Warn("%s", err)
+				break
+			}
+			continue
+		}
 
+		export := export
+		repository := export.Repository
+
+		switch request.Type {
 		case "ReqCommit":
 			wg.Add(1)
 			go func() {
@@ -94,7 +244,13 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 				logger.Trace("server", "%s: Commit()", clientUuid)
 				txUuid := request.Payload.(network.ReqCommit).IndexID
 				data := request.Payload.(network.ReqCommit).Data
-				err := lrepository.Commit(txUuid, data)
+				err := export.Allowed(request.Type)
+				if err == nil {
+					err = export.CheckOverwrite(txUuid)
+				}
+				if err == nil {
+					err = repository.Commit(txUuid, data)
+				}
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResCommit",
@@ -102,7 +258,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err: err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -121,7 +277,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err: nil,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -133,7 +289,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: GetSnapshots", clientUuid)
-				snapshots, err := lrepository.GetSnapshots()
+				snapshots, err := repository.GetSnapshots()
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResGetSnapshots",
@@ -142,7 +298,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err:       err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -153,7 +309,13 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: PutSnapshot()", clientUuid, request.Payload.(network.ReqPutSnapshot).IndexID)
-				err := lrepository.PutSnapshot(request.Payload.(network.ReqPutSnapshot).IndexID, request.Payload.(network.ReqPutSnapshot).Data)
+				err := export.Allowed(request.Type)
+				if err == nil {
+					err = export.CheckOverwrite(request.Payload.(network.ReqPutSnapshot).IndexID)
+				}
+				if err == nil {
+					err = repository.PutSnapshot(request.Payload.(network.ReqPutSnapshot).IndexID, request.Payload.(network.ReqPutSnapshot).Data)
+				}
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResPutSnapshot",
@@ -161,7 +323,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err: err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -172,7 +334,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: GetMetadata(%s)", clientUuid, request.Payload.(network.ReqGetSnapshot).IndexID)
-				data, err := lrepository.GetSnapshot(request.Payload.(network.ReqGetSnapshot).IndexID)
+				data, err := repository.GetSnapshot(request.Payload.(network.ReqGetSnapshot).IndexID)
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResGetSnapshot",
@@ -181,7 +343,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err:  err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -194,10 +356,8 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 
 				logger.Trace("server", "%s: DeleteSnapshot(%s)", clientUuid, request.Payload.(network.ReqDeleteSnapshot).IndexID)
 				var err error
-				if noDelete {
-					err = fmt.Errorf("not allowed to delete")
-				} else {
-					err = lrepository.DeleteSnapshot(request.Payload.(network.ReqDeleteSnapshot).IndexID)
+				if err = export.Allowed(request.Type); err == nil {
+					err = repository.DeleteSnapshot(request.Payload.(network.ReqDeleteSnapshot).IndexID)
 				}
 				result := network.Request{
 					Uuid: request.Uuid,
@@ -206,7 +366,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err: err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -218,7 +378,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: GetLocks", clientUuid)
-				locks, err := lrepository.GetLocks()
+				locks, err := repository.GetLocks()
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResGetLocks",
@@ -227,7 +387,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err:   err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -238,7 +398,10 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: PutLock()", clientUuid, request.Payload.(network.ReqPutLock).IndexID)
-				err := lrepository.PutLock(request.Payload.(network.ReqPutLock).IndexID, request.Payload.(network.ReqPutLock).Data)
+				err := export.Allowed(request.Type)
+				if err == nil {
+					err = repository.PutLock(request.Payload.(network.ReqPutLock).IndexID, request.Payload.(network.ReqPutLock).Data)
+				}
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResPutLock",
@@ -246,7 +409,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err: err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -257,7 +420,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: GetMetadata(%s)", clientUuid, request.Payload.(network.ReqGetLock).IndexID)
-				data, err := lrepository.GetLock(request.Payload.(network.ReqGetLock).IndexID)
+				data, err := repository.GetLock(request.Payload.(network.ReqGetLock).IndexID)
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResGetLock",
@@ -266,7 +429,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err:  err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -278,7 +441,10 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 				defer wg.Done()
 
 				logger.Trace("server", "%s: DeleteLock(%s)", clientUuid, request.Payload.(network.ReqDeleteLock).IndexID)
-				err := lrepository.DeleteLock(request.Payload.(network.ReqDeleteLock).IndexID)
+				err := export.Allowed(request.Type)
+				if err == nil {
+					err = repository.DeleteLock(request.Payload.(network.ReqDeleteLock).IndexID)
+				}
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResDeleteLock",
@@ -286,7 +452,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err: err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -298,7 +464,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: GetBlobs()", clientUuid)
-				checksums, err := lrepository.GetBlobs()
+				checksums, err := repository.GetBlobs()
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResGetBlobs",
@@ -307,7 +473,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err:       err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -318,7 +484,19 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: PutBlob(%016x)", clientUuid, request.Payload.(network.ReqPutBlob).Checksum)
-				err := lrepository.PutBlob(request.Payload.(network.ReqPutBlob).Checksum, request.Payload.(network.ReqPutBlob).Data)
+				checksum := request.Payload.(network.ReqPutBlob).Checksum
+				data := request.Payload.(network.ReqPutBlob).Data
+				var charged int
+				err := export.Allowed(request.Type)
+				if err == nil {
+					charged, err = export.Reserve(exports.KindBlob, checksum, len(data))
+				}
+				if err == nil {
+					err = repository.PutBlob(checksum, data)
+					if err != nil {
+						export.Release(exports.KindBlob, checksum, charged)
+					}
+				}
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResPutBlob",
@@ -326,7 +504,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err: err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -337,7 +515,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: CheckBlob(%016x)", clientUuid, request.Payload.(network.ReqCheckBlob).Checksum)
-				exists, err := lrepository.CheckBlob(request.Payload.(network.ReqCheckBlob).Checksum)
+				exists, err := repository.CheckBlob(request.Payload.(network.ReqCheckBlob).Checksum)
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResCheckBlob",
@@ -346,7 +524,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err:    err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -357,7 +535,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: GetBlob(%016x)", clientUuid, request.Payload.(network.ReqGetBlob).Checksum)
-				data, err := lrepository.GetBlob(request.Payload.(network.ReqGetBlob).Checksum)
+				data, err := repository.GetBlob(request.Payload.(network.ReqGetBlob).Checksum)
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResGetBlob",
@@ -366,7 +544,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err:  err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -380,10 +558,9 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 				logger.Trace("server", "%s: DeleteBlob(%s)", clientUuid, request.Payload.(network.ReqDeleteBlob).Checksum)
 
 				var err error
-				if noDelete {
-					err = fmt.Errorf("not allowed to delete")
-				} else {
-					err = lrepository.DeleteBlob(request.Payload.(network.ReqDeleteBlob).Checksum)
+				if err = export.Allowed(request.Type); err == nil {
+					err = repository.DeleteBlob(request.Payload.(network.ReqDeleteBlob).Checksum)
+					export.Invalidate()
 				}
 				result := network.Request{
 					Uuid: request.Uuid,
@@ -392,7 +569,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err: err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -404,7 +581,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: GetIndexes()", clientUuid)
-				checksums, err := lrepository.GetIndexes()
+				checksums, err := repository.GetIndexes()
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResGetIndexes",
@@ -413,7 +590,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err:       err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -424,7 +601,10 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: PutIndex(%016x)", clientUuid, request.Payload.(network.ReqPutIndex).Checksum)
-				err := lrepository.PutIndex(request.Payload.(network.ReqPutIndex).Checksum, request.Payload.(network.ReqPutIndex).Data)
+				err := export.Allowed(request.Type)
+				if err == nil {
+					err = repository.PutIndex(request.Payload.(network.ReqPutIndex).Checksum, request.Payload.(network.ReqPutIndex).Data)
+				}
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResPutIndex",
@@ -432,7 +612,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err: err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -443,7 +623,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: GetIndex(%016x)", clientUuid, request.Payload.(network.ReqGetIndex).Checksum)
-				data, err := lrepository.GetIndex(request.Payload.(network.ReqGetIndex).Checksum)
+				data, err := repository.GetIndex(request.Payload.(network.ReqGetIndex).Checksum)
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResGetIndex",
@@ -452,7 +632,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err:  err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -466,10 +646,8 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 				logger.Trace("server", "%s: DeleteIndex(%s)", clientUuid, request.Payload.(network.ReqDeleteIndex).Checksum)
 
 				var err error
-				if noDelete {
-					err = fmt.Errorf("not allowed to delete")
-				} else {
-					err = lrepository.DeleteIndex(request.Payload.(network.ReqDeleteIndex).Checksum)
+				if err = export.Allowed(request.Type); err == nil {
+					err = repository.DeleteIndex(request.Payload.(network.ReqDeleteIndex).Checksum)
 				}
 				result := network.Request{
 					Uuid: request.Uuid,
@@ -478,7 +656,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err: err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -490,7 +668,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: GetPackfiles()", clientUuid)
-				checksums, err := lrepository.GetPackfiles()
+				checksums, err := repository.GetPackfiles()
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResGetPackfiles",
@@ -499,7 +677,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err:       err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -510,7 +688,19 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: PutPackfile(%016x)", clientUuid, request.Payload.(network.ReqPutPackfile).Checksum)
-				err := lrepository.PutPackfile(request.Payload.(network.ReqPutPackfile).Checksum, request.Payload.(network.ReqPutPackfile).Data)
+				checksum := request.Payload.(network.ReqPutPackfile).Checksum
+				data := request.Payload.(network.ReqPutPackfile).Data
+				var charged int
+				err := export.Allowed(request.Type)
+				if err == nil {
+					charged, err = export.Reserve(exports.KindPackfile, checksum, len(data))
+				}
+				if err == nil {
+					err = repository.PutPackfile(checksum, data)
+					if err != nil {
+						export.Release(exports.KindPackfile, checksum, charged)
+					}
+				}
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResPutPackfile",
@@ -518,7 +708,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err: err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -529,7 +719,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 			go func() {
 				defer wg.Done()
 				logger.Trace("server", "%s: GetPackfile(%016x)", clientUuid, request.Payload.(network.ReqGetPackfile).Checksum)
-				data, err := lrepository.GetPackfile(request.Payload.(network.ReqGetPackfile).Checksum)
+				data, err := repository.GetPackfile(request.Payload.(network.ReqGetPackfile).Checksum)
 				result := network.Request{
 					Uuid: request.Uuid,
 					Type: "ResGetPackfile",
@@ -538,7 +728,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err:  err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -552,7 +742,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 					request.Payload.(network.ReqGetPackfileSubpart).Checksum,
 					request.Payload.(network.ReqGetPackfileSubpart).Offset,
 					request.Payload.(network.ReqGetPackfileSubpart).Length)
-				data, err := lrepository.GetPackfileSubpart(request.Payload.(network.ReqGetPackfile).Checksum,
+				data, err := repository.GetPackfileSubpart(request.Payload.(network.ReqGetPackfileSubpart).Checksum,
 					request.Payload.(network.ReqGetPackfileSubpart).Offset,
 					request.Payload.(network.ReqGetPackfileSubpart).Length)
 				result := network.Request{
@@ -563,7 +753,7 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err:  err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
@@ -577,10 +767,9 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 				logger.Trace("server", "%s: DeletePackfile(%s)", clientUuid, request.Payload.(network.ReqDeletePackfile).Checksum)
 
 				var err error
-				if noDelete {
-					err = fmt.Errorf("not allowed to delete")
-				} else {
-					err = lrepository.DeletePackfile(request.Payload.(network.ReqDeletePackfile).Checksum)
+				if err = export.Allowed(request.Type); err == nil {
+					err = repository.DeletePackfile(request.Payload.(network.ReqDeletePackfile).Checksum)
+					export.Invalidate()
 				}
 
 				result := network.Request{
@@ -590,15 +779,138 @@ func handleConnection(rd io.Reader, wr io.Writer, noDelete bool) {
 						Err: err,
 					},
 				}
-				err = encoder.Encode(&result)
+				err = mux.Encode(&result)
+				if err != nil {
+					logger.Warn("%s", err)
+				}
+			}()
+
+		// batches
+		case "ReqCheckBlobBatch":
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				checksums := request.Payload.(network.ReqCheckBlobBatch).Checksums
+				logger.Trace("server", "%s: CheckBlobBatch(%d)", clientUuid, len(checksums))
+
+				var exists []bool
+				err := network.CheckBatch(len(checksums))
+				if err == nil {
+					exists, err = repository.CheckBlobBatch(checksums)
+				}
+				result := network.Request{
+					Uuid: request.Uuid,
+					Type: "ResCheckBlobBatch",
+					Payload: network.ResCheckBlobBatch{
+						Exists: exists,
+						Err:    err,
+					},
+				}
+				err = mux.Encode(&result)
+				if err != nil {
+					logger.Warn("%s", err)
+				}
+			}()
+
+		case "ReqGetBlobBatch":
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				checksums := request.Payload.(network.ReqGetBlobBatch).Checksums
+				logger.Trace("server", "%s: GetBlobBatch(%d)", clientUuid, len(checksums))
+
+				var data [][]byte
+				err := network.CheckBatch(len(checksums))
+				if err == nil {
+					data, err = repository.GetBlobBatch(checksums)
+				}
+				result := network.Request{
+					Uuid: request.Uuid,
+					Type: "ResGetBlobBatch",
+					Payload: network.ResGetBlobBatch{
+						Data: data,
+						Err:  err,
+					},
+				}
+				err = mux.Encode(&result)
+				if err != nil {
+					logger.Warn("%s", err)
+				}
+			}()
+
+		case "ReqGetPackfileSubpartBatch":
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				payload := request.Payload.(network.ReqGetPackfileSubpartBatch)
+				logger.Trace("server", "%s: GetPackfileSubpartBatch(%016x, %d)", clientUuid, payload.Checksum, len(payload.Subparts))
+
+				var data [][]byte
+				err := network.CheckBatch(len(payload.Subparts))
+				if err == nil {
+					data, err = repository.GetPackfileSubpartBatch(payload.Checksum, payload.Subparts)
+				}
+				result := network.Request{
+					Uuid: request.Uuid,
+					Type: "ResGetPackfileSubpartBatch",
+					Payload: network.ResGetPackfileSubpartBatch{
+						Data: data,
+						Err:  err,
+					},
+				}
+				err = mux.Encode(&result)
+				if err != nil {
+					logger.Warn("%s", err)
+				}
+			}()
+
+		case "ReqListPage":
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				payload := request.Payload.(network.ReqListPage)
+				logger.Trace("server", "%s: ListPage(%s, %016x, %d)", clientUuid, payload.Resource, payload.After, payload.Limit)
+
+				var checksums [][32]byte
+				var more bool
+				err := network.CheckBatch(payload.Limit)
+				if err == nil {
+					checksums, more, err = repository.ListPage(payload.Resource, payload.After, payload.Limit)
+				}
+				result := network.Request{
+					Uuid: request.Uuid,
+					Type: "ResListPage",
+					Payload: network.ResListPage{
+						Checksums: checksums,
+						More:      more,
+						Err:       err,
+					},
+				}
+				err = mux.Encode(&result)
 				if err != nil {
 					logger.Warn("%s", err)
 				}
 			}()
 
 		default:
-			fmt.Println("Unknown request type", request.Type)
+			logger.Warn("%s: unknown request type %s", clientUuid, request.Type)
+			result := network.Request{
+				Uuid: request.Uuid,
+				Type: "ResUnknown",
+				Payload: network.ResUnknown{
+					Err: network.Errorf(network.CodeUnsupported, "unsupported request %s", request.Type),
+				},
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := mux.Encode(&result); err != nil {
+					logger.Warn("%s", err)
+				}
+			}()
 		}
 	}
+	// no more credits will be read, streams waiting for them are aborted
+	mux.Close()
 	wg.Wait()
 }
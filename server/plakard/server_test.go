@@ -0,0 +1,763 @@
+package plakard
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/network"
+	"github.com/PlakarLabs/plakar/server/exports"
+	"github.com/PlakarLabs/plakar/storage"
+	_ "github.com/PlakarLabs/plakar/storage/backends/fs"
+	_ "github.com/PlakarLabs/plakar/storage/backends/plakard"
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	// the server logs refused requests
+	logger.Start()
+	os.Exit(m.Run())
+}
+
+func createRepository(t *testing.T, location string) (*storage.Repository, storage.RepositoryConfig) {
+	config := storage.RepositoryConfig{
+		Version:      storage.VERSION,
+		RepositoryID: uuid.Must(uuid.NewRandom()),
+		CreationTime: time.Now(),
+		Hashing:      "sha256",
+	}
+	repository, err := storage.Create(location, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repository, config
+}
+
+// issue writes a certificate and its key to dir, signed by parent or
+// self-signed when parent is nil.
+func issue(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+func TestAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issue(t, dir, "ca", nil, nil)
+	issue(t, dir, "server", ca, caKey)
+	issue(t, dir, "client", ca, caKey)
+
+	repository, config := createRepository(t, filepath.Join(dir, "repository"))
+	tlsConfig, err := network.LoadTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serve(l, &ServerOptions{Exports: exports.New(repository, exports.PolicyReadWrite), Tokens: []network.Token{{Secret: "first"}, {Secret: "second"}}})
+
+	location := fmt.Sprintf("plakar://%s/?tls_ca=%s&tls_cert=%s&tls_key=%s", l.Addr(),
+		filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+
+	t.Setenv("PLAKAR_TOKEN", "second")
+	client, err := storage.Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Configuration().RepositoryID != config.RepositoryID {
+		t.Errorf("unexpected repository %s", client.Configuration().RepositoryID)
+	}
+
+	t.Setenv("PLAKAR_TOKEN", "wrong")
+	if _, err := storage.Open(location); !errors.Is(err, network.ErrAuthentication) || err.Error() != "authentication failed" {
+		t.Errorf("expected authentication to fail, got %v", err)
+	}
+
+	t.Setenv("PLAKAR_TOKEN", "")
+	if _, err := storage.Open(location); err == nil || !strings.Contains(err.Error(), "requires a token") {
+		t.Errorf("expected a token to be required, got %v", err)
+	}
+
+	t.Setenv("PLAKAR_TOKEN", "first")
+	location = fmt.Sprintf("plakar://%s/?tls_ca=%s", l.Addr(), filepath.Join(dir, "ca.pem"))
+	if _, err := storage.Open(location); err == nil {
+		t.Errorf("expected a connection without client certificate to fail")
+	}
+}
+
+// exchange sends a request over a raw connection and returns its result
+func exchange(t *testing.T, encoder *gob.Encoder, decoder *gob.Decoder, Type string, payload interface{}) network.Request {
+	t.Helper()
+	if err := encoder.Encode(&network.Request{Uuid: uuid.Must(uuid.NewRandom()), Type: Type, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	result := network.Request{}
+	if err := decoder.Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestMalformedRequests(t *testing.T) {
+	repository, _ := createRepository(t, filepath.Join(t.TempDir(), "repository"))
+
+	for _, tokens := range [][]network.Token{{{Secret: "secret"}}, nil} {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer server.Close()
+			handleConnection(server, server, &ServerOptions{Exports: exports.New(repository, exports.PolicyReadWrite), Tokens: tokens}, "")
+		}()
+		encoder, decoder := gob.NewEncoder(client), gob.NewDecoder(client)
+
+		if tokens != nil {
+			// payloads of the wrong type are refused and the connection dropped
+			exchange(t, encoder, decoder, "ReqAuthChallenge", network.ReqAuthChallenge{})
+			result := exchange(t, encoder, decoder, "ReqAuth", network.ReqHello{})
+			if payload, ok := result.Payload.(network.ResAuth); !ok || payload.Err == nil {
+				t.Errorf("expected authentication to fail, got %+v", result)
+			}
+		} else {
+			result := exchange(t, encoder, decoder, "ReqOpen", network.ReqHello{})
+			if payload, ok := result.Payload.(network.ResOpen); !ok || payload.Err == nil {
+				t.Errorf("expected open to fail, got %+v", result)
+			}
+
+			// streams are refused until a repository is opened
+			stream := network.Request{Uuid: uuid.Must(uuid.NewRandom()), Type: "ReqPutBlob", Payload: network.ReqPutBlob{}, StreamLength: 1 << 20}
+			if err := encoder.Encode(&stream); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the connection to be dropped")
+		}
+		client.Close()
+	}
+}
+
+func TestHello(t *testing.T) {
+	response := hello(network.ReqHello{Version: "2.0.0"}, &ServerOptions{})
+	if response.Err == nil {
+		t.Errorf("expected protocol 2.0.0 to be rejected")
+	}
+
+	dir := t.TempDir()
+	repository, _ := createRepository(t, filepath.Join(dir, "repository"))
+
+	data := []byte("0123456789")
+	checksum := sha256.Sum256(data)
+	if err := repository.PutPackfile(checksum, data); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serve(l, &ServerOptions{Exports: exports.New(repository, exports.PolicyNoDelete)})
+
+	client, err := storage.Open(fmt.Sprintf("plakar://%s/", l.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeletePackfile(checksum); !errors.Is(err, fs.ErrPermission) || err.Error() != "server does not allow deletions" {
+		t.Errorf("expected deletion to be refused, got %v", err)
+	}
+	subpart, err := client.GetPackfileSubpart(checksum, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(subpart) != "234" {
+		t.Errorf("unexpected subpart %q", subpart)
+	}
+}
+
+// serveLegacy serves clients like a server predating the hello exchange,
+// which fails to decode the hello and drops the connection
+func serveLegacy(l net.Listener, options *ServerOptions, hellos *int32) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+
+			var buf bytes.Buffer
+			request := network.Request{}
+			if err := gob.NewDecoder(io.TeeReader(c, &buf)).Decode(&request); err != nil {
+				return
+			}
+			if request.Type == "ReqHello" {
+				atomic.AddInt32(hellos, 1)
+				return
+			}
+			handleConnection(io.MultiReader(&buf, c), c, options, "")
+		}()
+	}
+}
+
+func TestLegacyServer(t *testing.T) {
+	repository, _ := createRepository(t, filepath.Join(t.TempDir(), "repository"))
+
+	data := []byte("0123456789")
+	checksum := sha256.Sum256(data)
+	if err := repository.PutPackfile(checksum, data); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var hellos int32
+	go serveLegacy(l, &ServerOptions{Exports: exports.New(repository, exports.PolicyReadWrite)}, &hellos)
+
+	client, err := storage.Open(fmt.Sprintf("plakar://%s/", l.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&hellos) != 1 {
+		t.Errorf("expected a single hello, got %d", hellos)
+	}
+	packfile, err := client.GetPackfile(checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packfile, data) {
+		t.Errorf("unexpected packfile %q", packfile)
+	}
+}
+
+func TestExports(t *testing.T) {
+	dir := t.TempDir()
+	_, alice := createRepository(t, filepath.Join(dir, "alice"))
+	_, bob := createRepository(t, filepath.Join(dir, "bob"))
+
+	file := filepath.Join(dir, "exports.yml")
+	if err := os.WriteFile(file, []byte(fmt.Sprintf(`
+repositories:
+  alice:
+    location: %s
+  bob:
+    location: %s
+    policy: read-only
+`, filepath.Join(dir, "alice"), filepath.Join(dir, "bob"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	served := exports.New(nil, exports.PolicyReadWrite)
+	if err := served.Load(file); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serve(l, &ServerOptions{Exports: served})
+
+	client, err := storage.Open(fmt.Sprintf("plakar://%s/alice", l.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Configuration().RepositoryID != alice.RepositoryID {
+		t.Errorf("opened the wrong repository")
+	}
+	if err := client.PutSnapshot(uuid.Must(uuid.NewRandom()), []byte("snapshot")); err != nil {
+		t.Error(err)
+	}
+
+	client, err = storage.Open(fmt.Sprintf("plakar://%s/bob", l.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Configuration().RepositoryID != bob.RepositoryID {
+		t.Errorf("opened the wrong repository")
+	}
+	if err := client.PutSnapshot(uuid.Must(uuid.NewRandom()), []byte("snapshot")); err == nil || err.Error() != "repository bob is read-only" {
+		t.Errorf("expected bob to be read-only, got %v", err)
+	}
+
+	if _, err := storage.Open(fmt.Sprintf("plakar://%s/carol", l.Addr())); !errors.Is(err, fs.ErrNotExist) || err.Error() != "unknown repository: carol" {
+		t.Errorf("expected carol to be unknown, got %v", err)
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	dir := t.TempDir()
+	createRepository(t, filepath.Join(dir, "shared"))
+
+	file := filepath.Join(dir, "exports.yml")
+	if err := os.WriteFile(file, []byte(fmt.Sprintf(`
+repositories:
+  shared:
+    location: %s
+    quota: 1kB
+    acl:
+      alice: [read, write]
+      bob: [read]
+`, filepath.Join(dir, "shared"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	served := exports.New(nil, exports.PolicyReadWrite)
+	if err := served.Load(file); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serve(l, &ServerOptions{Exports: served, Tokens: []network.Token{{User: "alice", Secret: "a"}, {User: "bob", Secret: "b"}, {Secret: "c"}}})
+	location := fmt.Sprintf("plakar://%s/shared", l.Addr())
+
+	t.Setenv("PLAKAR_TOKEN", "c")
+	if _, err := storage.Open(location); !errors.Is(err, fs.ErrPermission) || err.Error() != "anonymous user is not allowed to access repository shared" {
+		t.Errorf("expected anonymous access to be refused, got %v", err)
+	}
+
+	t.Setenv("PLAKAR_TOKEN", "b")
+	bob, err := storage.Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.GetSnapshots(); err != nil {
+		t.Error(err)
+	}
+	if err := bob.PutBlob(sha256.Sum256(nil), nil); err == nil || err.Error() != "user bob lacks the write permission on repository shared" {
+		t.Errorf("expected bob not to write, got %v", err)
+	}
+
+	t.Setenv("PLAKAR_TOKEN", "a")
+	alice, err := storage.Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 600)
+	if err := alice.PutPackfile(sha256.Sum256(data), data); err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 1
+	if err := alice.PutPackfile(sha256.Sum256(data), data); !errors.Is(err, network.ErrQuotaExceeded) || !strings.HasPrefix(err.Error(), "quota exceeded on repository shared") {
+		t.Errorf("expected the quota to be exceeded, got %v", err)
+	}
+
+	// objects already stored are not charged again
+	data[0] = 0
+	if err := alice.PutPackfile(sha256.Sum256(data), data); err != nil {
+		t.Errorf("expected an existing packfile not to be charged, got %v", err)
+	}
+
+	// streamed writes are refused before their data is buffered, the
+	// connection remains usable
+	large := make([]byte, 4*network.StreamFrameSize)
+	if err := alice.PutBlob(sha256.Sum256(large), large); !errors.Is(err, network.ErrQuotaExceeded) {
+		t.Errorf("expected the streamed blob to exceed the quota, got %v", err)
+	}
+	if _, err := alice.GetSnapshots(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	repository, _ := createRepository(t, filepath.Join(t.TempDir(), "repository"))
+
+	blobs := make([][32]byte, 0)
+	for i := 0; i < 5; i++ {
+		data := []byte(fmt.Sprintf("blob %d", i))
+		blobs = append(blobs, sha256.Sum256(data))
+		if err := repository.PutBlob(blobs[i], data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	packfile := []byte("0123456789")
+	if err := repository.PutPackfile(sha256.Sum256(packfile), packfile); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serve(l, &ServerOptions{Exports: exports.New(repository, exports.PolicyReadWrite)})
+
+	client, err := storage.Open(fmt.Sprintf("plakar://%s", l.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := client.CheckBlobBatch([][32]byte{blobs[3], sha256.Sum256(nil), blobs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(exists) != "[true false true]" {
+		t.Errorf("unexpected existence %v", exists)
+	}
+
+	data, err := client.GetBlobBatch([][32]byte{blobs[4], blobs[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[0]) != "blob 4" || string(data[1]) != "blob 1" {
+		t.Errorf("unexpected blobs %q", data)
+	}
+
+	subparts, err := client.GetPackfileSubpartBatch(sha256.Sum256(packfile), []storage.Subpart{{Offset: 7, Length: 3}, {Offset: 0, Length: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(subparts[0]) != "789" || string(subparts[1]) != "01" {
+		t.Errorf("unexpected subparts %q", subparts)
+	}
+
+	listed := make([][32]byte, 0)
+	pages := 0
+	err = client.ForEachPage(storage.ResourceBlobs, 2, func(checksums [][32]byte) error {
+		listed = append(listed, checksums...)
+		pages++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 5 || pages != 3 {
+		t.Errorf("expected 5 blobs in 3 pages, got %d in %d", len(listed), pages)
+	}
+	for i := 1; i < len(listed); i++ {
+		if string(listed[i-1][:]) >= string(listed[i][:]) {
+			t.Errorf("blobs are not listed in order")
+		}
+	}
+
+	// the fs backend is listed once when paging starts, the following
+	// pages come from that listing
+	count := func() int {
+		total := 0
+		page, more, err := client.ListPage(storage.ResourceBlobs, [32]byte{}, 2)
+		for ; err == nil; page, more, err = client.ListPage(storage.ResourceBlobs, page[len(page)-1], 2) {
+			total += len(page)
+			if total == 2 {
+				if err := repository.PutBlob(sha256.Sum256([]byte("blob 5")), []byte("blob 5")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !more {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+	if total := count(); total != 5 {
+		t.Errorf("expected the listing to hold 5 blobs, got %d", total)
+	}
+	if total := count(); total != 6 {
+		t.Errorf("expected a new listing to hold 6 blobs, got %d", total)
+	}
+
+	if _, _, err := client.ListPage("snapshots", [32]byte{}, 10); err == nil || err.Error() != "unknown resource: snapshots" {
+		t.Errorf("expected an unknown resource, got %v", err)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	repository, _ := createRepository(t, filepath.Join(t.TempDir(), "repository"))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serve(l, &ServerOptions{Exports: exports.New(repository, exports.PolicyReadWrite)})
+
+	client, err := storage.Open(fmt.Sprintf("plakar://%s", l.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// spans more frames than the window, in both directions
+	data := make([]byte, network.StreamFrameSize*network.StreamWindow*3+123)
+	rand.Read(data)
+	checksum := sha256.Sum256(data)
+	if err := client.PutPackfile(checksum, data); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := repository.GetPackfile(checksum); err != nil || sha256.Sum256(stored) != checksum {
+		t.Fatalf("packfile stored incorrectly: %v", err)
+	}
+
+	// small requests are served while large payloads stream
+	errs := make(chan error, 8)
+	for i := 0; i < 4; i++ {
+		go func() {
+			fetched, err := client.GetPackfile(checksum)
+			if err == nil && sha256.Sum256(fetched) != checksum {
+				err = fmt.Errorf("packfile fetched incorrectly")
+			}
+			errs <- err
+		}()
+		go func() {
+			_, err := client.GetSnapshots()
+			errs <- err
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// batches of buffers are streamed and split back
+	subparts, err := client.GetPackfileSubpartBatch(checksum, []storage.Subpart{{Offset: 10, Length: 200000}, {Offset: 0, Length: 0}, {Offset: 300000, Length: uint32(len(data) - 300000)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subparts) != 3 || !bytes.Equal(subparts[0], data[10:200010]) || len(subparts[1]) != 0 || !bytes.Equal(subparts[2], data[300000:]) {
+		t.Errorf("subparts fetched incorrectly")
+	}
+}
+
+// flakyListener lets tests drop the connections it accepted or stall the
+// responses sent on them
+type flakyListener struct {
+	net.Listener
+
+	mu    sync.Mutex
+	conns []net.Conn
+
+	// responses wait while the lock is held
+	stall sync.RWMutex
+
+	// each write of a response is delayed by throttle
+	throttle time.Duration
+}
+
+type flakyConn struct {
+	net.Conn
+	listener *flakyListener
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns = append(l.conns, conn)
+	return &flakyConn{Conn: conn, listener: l}, nil
+}
+
+func (l *flakyListener) drop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+func (conn *flakyConn) Write(data []byte) (int, error) {
+	conn.listener.stall.RLock()
+	defer conn.listener.stall.RUnlock()
+	time.Sleep(conn.listener.throttle)
+	return conn.Conn.Write(data)
+}
+
+func TestErrors(t *testing.T) {
+	repository, _ := createRepository(t, filepath.Join(t.TempDir(), "repository"))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serve(l, &ServerOptions{Exports: exports.New(repository, exports.PolicyReadOnly)})
+
+	client, err := storage.Open(fmt.Sprintf("plakar://%s", l.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetBlob(sha256.Sum256([]byte("missing"))); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing blob to be reported as such, got %v", err)
+	}
+	if err := client.PutBlob(sha256.Sum256([]byte("blob")), []byte("blob")); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected a write to be denied, got %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	repository, _ := createRepository(t, filepath.Join(t.TempDir(), "repository"))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &flakyListener{Listener: listener}
+	defer l.Close()
+	go serve(l, &ServerOptions{Exports: exports.New(repository, exports.PolicyReadWrite)})
+
+	client, err := storage.Open(fmt.Sprintf("plakar://%s", l.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("packfile")
+	checksum := sha256.Sum256(data)
+	if err := client.PutPackfile(checksum, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// idempotent requests are sent again on a new connection
+	l.drop()
+	if fetched, err := client.GetPackfile(checksum); err != nil || string(fetched) != "packfile" {
+		t.Fatalf("expected the packfile after reconnecting, got %q, %v", fetched, err)
+	}
+
+	// others fail, the connection is replaced for the requests to come
+	l.drop()
+	if err := client.PutLock(uuid.Must(uuid.NewRandom()), []byte("lock")); !errors.Is(err, network.ErrConnectionLost) {
+		t.Errorf("expected the lock to fail with the connection, got %v", err)
+	}
+	if _, err := client.GetSnapshots(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	repository, _ := createRepository(t, filepath.Join(t.TempDir(), "repository"))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &flakyListener{Listener: listener}
+	defer l.Close()
+	go serve(l, &ServerOptions{Exports: exports.New(repository, exports.PolicyReadWrite)})
+
+	client, err := storage.Open(fmt.Sprintf("plakar://%s?timeout=200ms", l.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.stall.Lock()
+	if _, err := client.GetSnapshots(); err != network.ErrTimeout {
+		t.Errorf("expected the request to time out, got %v", err)
+	}
+	l.stall.Unlock()
+
+	// the connection outlives requests that timed out
+	if _, err := client.GetSnapshots(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeadlineProgress(t *testing.T) {
+	repository, _ := createRepository(t, filepath.Join(t.TempDir(), "repository"))
+	data := make([]byte, network.StreamFrameSize*network.StreamWindow*2)
+	rand.Read(data)
+	checksum := sha256.Sum256(data)
+	if err := repository.PutPackfile(checksum, data); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &flakyListener{Listener: listener, throttle: 20 * time.Millisecond}
+	defer l.Close()
+	go serve(l, &ServerOptions{Exports: exports.New(repository, exports.PolicyReadWrite)})
+
+	client, err := storage.Open(fmt.Sprintf("plakar://%s?timeout=200ms", l.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the result takes longer than the timeout to stream, its frames keep
+	// the request alive
+	t0 := time.Now()
+	fetched, err := client.GetPackfile(checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha256.Sum256(fetched) != checksum {
+		t.Error("packfile fetched incorrectly")
+	}
+	if elapsed := time.Since(t0); elapsed < 200*time.Millisecond {
+		t.Errorf("expected the transfer to outlast the timeout, took %s", elapsed)
+	}
+}
@@ -0,0 +1,277 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/snapshot"
+	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+type Options struct {
+	Format      string // tar, cpio, zip or squashfs
+	Compression string // none, gzip, zstd or lz4
+	Rebase      bool
+}
+
+// Entry describes a single archive member, formats translate it into
+// their own header representation.
+type Entry struct {
+	Name     string
+	Info     vfs.FileInfo
+	Uname    string
+	Gname    string
+	Symlink  string // target of a symlink
+	Hardlink string // name of a previous entry sharing the same inode
+}
+
+type entryWriter interface {
+	WriteEntry(entry *Entry, rd io.Reader) error
+	Close() error
+}
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// Archiver streams the content of one or more snapshots as an archive.
+type Archiver struct {
+	options    *Options
+	compressor io.WriteCloser
+	writer     entryWriter
+	hardlinks  bool
+
+	links   map[inodeKey]string
+	skipped int
+	users   map[uint64]string
+	groups  map[uint64]string
+}
+
+func NewArchiver(w io.Writer, options *Options) (*Archiver, error) {
+	archiver := &Archiver{
+		options: options,
+		users:   make(map[uint64]string),
+		groups:  make(map[uint64]string),
+	}
+
+	// zip and squashfs compress their content themselves, other formats
+	// compress the stream
+	switch options.Format {
+	case "zip":
+		writer, err := newZipWriter(w, options.Compression)
+		if err != nil {
+			return nil, err
+		}
+		archiver.compressor = nopWriteCloser{w}
+		archiver.writer = writer
+		return archiver, nil
+	case "squashfs":
+		writer, err := newSquashfsWriter(w, options.Compression)
+		if err != nil {
+			return nil, err
+		}
+		archiver.compressor = nopWriteCloser{w}
+		archiver.writer = writer
+		archiver.hardlinks = true
+		return archiver, nil
+	}
+
+	compressor, err := newCompressor(w, options.Compression)
+	if err != nil {
+		return nil, err
+	}
+	archiver.compressor = compressor
+
+	switch options.Format {
+	case "tar":
+		archiver.writer = newTarWriter(compressor)
+		archiver.hardlinks = true
+	case "cpio":
+		archiver.writer = newCpioWriter(compressor)
+	default:
+		return nil, fmt.Errorf("unsupported archive format %q", options.Format)
+	}
+	return archiver, nil
+}
+
+// AddSnapshot writes every entry of snap found under prefix, files that
+// can't be read are logged, skipped and counted in Skipped, write errors
+// are fatal.
+func (archiver *Archiver) AddSnapshot(snap *snapshot.Snapshot, prefix string) error {
+	prefix = path.Clean("/" + prefix)
+
+	// inodes are only shared within a snapshot
+	archiver.links = make(map[inodeKey]string)
+
+	pathnames := make([]string, 0)
+	for _, pathname := range snap.Filesystem.ListStat() {
+		if prefix != "/" && pathname != prefix && !strings.HasPrefix(pathname, prefix+"/") {
+			continue
+		}
+		pathnames = append(pathnames, pathname)
+	}
+	sort.Strings(pathnames)
+
+	for _, pathname := range pathnames {
+		info, exists := snap.Filesystem.LookupInode(pathname)
+		if !exists {
+			continue
+		}
+
+		name := pathname
+		if archiver.options.Rebase && prefix != "/" {
+			name = strings.TrimPrefix(name, prefix)
+		}
+		name = strings.TrimPrefix(name, "/")
+		if name == "" {
+			continue
+		}
+
+		entry := &Entry{
+			Name:  name,
+			Info:  *info,
+			Uname: archiver.lookupUser(info.Uid()),
+			Gname: archiver.lookupGroup(info.Gid()),
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, exists := snap.Filesystem.LookupSymlink(pathname)
+			if !exists {
+				logger.Warn("%s: symlink target was not recorded, skipping", pathname)
+				continue
+			}
+			entry.Symlink = target
+		}
+
+		if !info.Mode().IsRegular() {
+			if err := archiver.writer.WriteEntry(entry, nil); err != nil {
+				return fmt.Errorf("%s: %w", pathname, err)
+			}
+			continue
+		}
+
+		linked := archiver.hardlinks && info.Ino() != 0
+		key := inodeKey{dev: info.Dev(), ino: info.Ino()}
+		if linkname, exists := archiver.links[key]; linked && exists {
+			entry.Hardlink = linkname
+			if err := archiver.writer.WriteEntry(entry, nil); err != nil {
+				return fmt.Errorf("%s: %w", pathname, err)
+			}
+			continue
+		}
+
+		rd, err := snap.NewReader(pathname)
+		if err != nil {
+			logger.Error("%s: could not read file: %s", pathname, err)
+			archiver.skipped++
+			continue
+		}
+		err = archiver.writer.WriteEntry(entry, rd)
+		rd.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", pathname, err)
+		}
+
+		// later paths of the inode link to the first one archived
+		if linked {
+			archiver.links[key] = name
+		}
+	}
+	return nil
+}
+
+// Skipped returns the number of files that could not be read
+func (archiver *Archiver) Skipped() int {
+	return archiver.skipped
+}
+
+func (archiver *Archiver) Close() error {
+	if err := archiver.writer.Close(); err != nil {
+		return err
+	}
+	return archiver.compressor.Close()
+}
+
+// lookupUser resolves uid on the local system, owner names are best
+// effort and left empty when the id is unknown.
+func (archiver *Archiver) lookupUser(uid uint64) string {
+	if name, exists := archiver.users[uid]; exists {
+		return name
+	}
+	name := ""
+	if u, err := user.LookupId(strconv.FormatUint(uid, 10)); err == nil {
+		name = u.Username
+	}
+	archiver.users[uid] = name
+	return name
+}
+
+func (archiver *Archiver) lookupGroup(gid uint64) string {
+	if name, exists := archiver.groups[gid]; exists {
+		return name
+	}
+	name := ""
+	if g, err := user.LookupGroupId(strconv.FormatUint(gid, 10)); err == nil {
+		name = g.Name
+	}
+	archiver.groups[gid] = name
+	return name
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "", "none":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "lz4":
+		return lz4.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression method %q", compression)
+	}
+}
+
+// devNumbers splits a device number using the Linux encoding, which is
+// what snapshots taken on Linux record in Rdev.
+func devNumbers(rdev uint64) (uint64, uint64) {
+	major := ((rdev >> 8) & 0x00000fff) | ((rdev >> 32) & 0xfffff000)
+	minor := (rdev & 0x000000ff) | ((rdev >> 12) & 0xffffff00)
+	return major, minor
+}
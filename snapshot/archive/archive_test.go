@@ -0,0 +1,381 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/snapshot"
+	sindex "github.com/PlakarLabs/plakar/snapshot/index"
+	"github.com/PlakarLabs/plakar/storage"
+	_ "github.com/PlakarLabs/plakar/storage/backends/fs"
+	"github.com/PlakarLabs/plakar/storage/index"
+	_ "github.com/PlakarLabs/plakar/vfs/importer/fs"
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+func TestMain(m *testing.M) {
+	// pushes log their progress
+	logger.Start()
+	os.Exit(m.Run())
+}
+
+// member is an archive entry as read back from an archive
+type member struct {
+	mode     os.FileMode
+	uid      int
+	linkname string
+	hardlink string
+	content  string
+}
+
+// snapshotTree pushes a tree holding a hardlinked file, a symlink and an
+// empty directory, and returns its snapshot and the pushed directory
+func snapshotTree(t *testing.T) (*snapshot.Snapshot, string) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello archive\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "a.txt"), filepath.Join(dir, "sub", "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../a.txt", filepath.Join(dir, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	repository, err := storage.Create(filepath.Join(t.TempDir(), "repository"), storage.RepositoryConfig{
+		Version:        storage.VERSION,
+		RepositoryID:   uuid.Must(uuid.NewRandom()),
+		CreationTime:   time.Now(),
+		Hashing:        "sha256",
+		Chunking:       "fastcdc",
+		ChunkingMin:    64 << 10,
+		ChunkingNormal: 1 << 20,
+		ChunkingMax:    8 << 20,
+		PackfileSize:   20 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repository.Close() })
+	repository.SetRepositoryIndex(index.New())
+
+	snap, err := snapshot.New(repository, uuid.Must(uuid.NewRandom()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Push(dir, &snapshot.PushOptions{MaxConcurrency: 2}); err != nil {
+		t.Fatal(err)
+	}
+	snap, err = snapshot.Load(repository, snap.Header.IndexID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snap, dir
+}
+
+// export archives the snapshot under prefix, times times over
+func export(t *testing.T, snap *snapshot.Snapshot, prefix string, options *Options, times int) []byte {
+	var buf bytes.Buffer
+	archiver, err := NewArchiver(&buf, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < times; i++ {
+		if err := archiver.AddSnapshot(snap, prefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archiver.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// checkTree checks the members read back from an archive of snapshotTree,
+// hardlink tells whether the format keeps hardlinks or stores copies
+func checkTree(t *testing.T, members map[string]member, hardlink bool) {
+	t.Helper()
+
+	a, exists := members["a.txt"]
+	if !exists || !a.mode.IsRegular() || a.mode.Perm() != 0640 || a.content != "hello archive\n" {
+		t.Errorf("unexpected a.txt %+v", a)
+	}
+	if a.uid != os.Getuid() {
+		t.Errorf("expected a.txt to be owned by %d, got %d", os.Getuid(), a.uid)
+	}
+
+	b := members["sub/b.txt"]
+	if hardlink {
+		if b.hardlink != "a.txt" {
+			t.Errorf("expected sub/b.txt to be a hardlink to a.txt, got %+v", b)
+		}
+	} else if !b.mode.IsRegular() || b.content != "hello archive\n" {
+		t.Errorf("expected sub/b.txt to be a copy of a.txt, got %+v", b)
+	}
+
+	if link := members["sub/link"]; link.mode&os.ModeSymlink == 0 || link.linkname != "../a.txt" {
+		t.Errorf("unexpected symlink %+v", link)
+	}
+	for _, name := range []string{"sub", "sub/empty"} {
+		if directory, exists := members[name]; !exists || !directory.mode.IsDir() {
+			t.Errorf("unexpected directory %s %+v", name, directory)
+		}
+	}
+	if len(members) != 5 {
+		t.Errorf("expected 5 members, got %v", members)
+	}
+}
+
+// readTar returns the members of a tar archive in their order
+func readTar(t *testing.T, rd io.Reader) ([]string, []member) {
+	names := make([]string, 0)
+	members := make([]member, 0)
+
+	tr := tar.NewReader(rd)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := member{mode: header.FileInfo().Mode(), uid: header.Uid, content: string(content)}
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			m.linkname = header.Linkname
+		case tar.TypeLink:
+			m.hardlink = header.Linkname
+		}
+		names = append(names, filepath.Clean(header.Name))
+		members = append(members, m)
+	}
+	return names, members
+}
+
+func memberMap(names []string, members []member) map[string]member {
+	ret := make(map[string]member)
+	for i, name := range names {
+		ret[name] = members[i]
+	}
+	return ret
+}
+
+func decompress(t *testing.T, data []byte, compression string) io.Reader {
+	var rd io.Reader = bytes.NewReader(data)
+	switch compression {
+	case "gzip":
+		zr, err := gzip.NewReader(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zr
+	case "zstd":
+		zr, err := zstd.NewReader(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zr
+	case "lz4":
+		return lz4.NewReader(rd)
+	}
+	return rd
+}
+
+func TestTar(t *testing.T) {
+	snap, dir := snapshotTree(t)
+
+	for _, compression := range []string{"none", "gzip", "zstd", "lz4"} {
+		t.Run(compression, func(t *testing.T) {
+			data := export(t, snap, dir, &Options{Format: "tar", Compression: compression, Rebase: true}, 1)
+			checkTree(t, memberMap(readTar(t, decompress(t, data, compression))), true)
+		})
+	}
+}
+
+func TestTarHardlinksPerSnapshot(t *testing.T) {
+	snap, dir := snapshotTree(t)
+
+	// hardlinks of the second snapshot must not point to members of the
+	// first one, which may even share their names
+	data := export(t, snap, dir, &Options{Format: "tar", Compression: "none", Rebase: true}, 2)
+	names, members := readTar(t, bytes.NewReader(data))
+	if len(names) != 10 {
+		t.Fatalf("expected 10 members, got %v", names)
+	}
+	checkTree(t, memberMap(names[:5], members[:5]), true)
+	checkTree(t, memberMap(names[5:], members[5:]), true)
+}
+
+func TestUnreadableHardlink(t *testing.T) {
+	snap, dir := snapshotTree(t)
+
+	// only sub/b.txt can be read, the first path of the inode
+	pathnameChecksum := func(pathname string) [32]byte {
+		return sha256.Sum256([]byte(pathname))
+	}
+	object := snap.Index.LookupObjectForPathnameChecksum(pathnameChecksum(filepath.Join(dir, "sub", "b.txt")))
+	if object == nil {
+		t.Fatal("expected an object for sub/b.txt")
+	}
+	idx := sindex.NewIndex()
+	for _, chunkChecksum := range object.Chunks {
+		idx.AddChunk(snap.Index.LookupChunk(chunkChecksum))
+	}
+	idx.AddObject(object)
+	idx.LinkPathnameToObject(pathnameChecksum(filepath.Join(dir, "sub", "b.txt")), object)
+	snap.Index = idx
+
+	var buf bytes.Buffer
+	archiver, err := NewArchiver(&buf, &Options{Format: "tar", Compression: "none", Rebase: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.AddSnapshot(snap, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiver.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if archiver.Skipped() != 1 {
+		t.Errorf("expected a.txt to be skipped, got %d skipped files", archiver.Skipped())
+	}
+
+	// sub/b.txt does not link to the missing member
+	members := memberMap(readTar(t, bytes.NewReader(buf.Bytes())))
+	if _, exists := members["a.txt"]; exists {
+		t.Error("expected a.txt to be left out")
+	}
+	if b := members["sub/b.txt"]; b.hardlink != "" || b.content != "hello archive\n" {
+		t.Errorf("expected sub/b.txt to be archived as a file, got %+v", b)
+	}
+}
+
+// readCpio parses a newc archive
+func readCpio(t *testing.T, data []byte) map[string]member {
+	members := make(map[string]member)
+
+	field := func(header []byte, i int) int {
+		value, err := strconv.ParseUint(string(header[6+i*8:6+(i+1)*8]), 16, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(value)
+	}
+	align := func(offset int) int {
+		return (offset + 3) &^ 3
+	}
+
+	offset := 0
+	for {
+		header := data[offset : offset+110]
+		if string(header[:6]) != cpioMagic {
+			t.Fatalf("unexpected magic %q at %d", header[:6], offset)
+		}
+		mode, uid, size, namesize := field(header, 1), field(header, 2), field(header, 6), field(header, 11)
+		name := string(data[offset+110 : offset+110+namesize-1])
+		offset = align(offset + 110 + namesize)
+		content := string(data[offset : offset+size])
+		offset = align(offset + size)
+
+		if name == cpioTrailer {
+			break
+		}
+
+		m := member{mode: os.FileMode(mode).Perm(), uid: uid}
+		switch mode &^ 07777 {
+		case cpioIFDIR:
+			m.mode |= os.ModeDir
+		case cpioIFLNK:
+			m.mode |= os.ModeSymlink
+			m.linkname = content
+		case cpioIFREG:
+			m.content = content
+		default:
+			t.Fatalf("%s: unexpected mode %o", name, mode)
+		}
+		members[name] = m
+	}
+	if len(data[offset:]) != 0 {
+		t.Errorf("unexpected %d bytes after the trailer", len(data[offset:]))
+	}
+	return members
+}
+
+func TestCpio(t *testing.T) {
+	snap, dir := snapshotTree(t)
+
+	data := export(t, snap, dir, &Options{Format: "cpio", Compression: "none", Rebase: true}, 1)
+	checkTree(t, readCpio(t, data), false)
+}
+
+func TestZip(t *testing.T) {
+	snap, dir := snapshotTree(t)
+
+	for _, compression := range []string{"none", "gzip"} {
+		t.Run(compression, func(t *testing.T) {
+			data := export(t, snap, dir, &Options{Format: "zip", Compression: compression, Rebase: true}, 1)
+
+			zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			members := make(map[string]member)
+			for _, file := range zr.File {
+				rd, err := file.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				content, err := io.ReadAll(rd)
+				rd.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// zip records no owner
+				m := member{mode: file.Mode(), uid: os.Getuid()}
+				if file.Mode()&os.ModeSymlink != 0 {
+					m.linkname = string(content)
+				} else {
+					m.content = string(content)
+				}
+				members[filepath.Clean(file.Name)] = m
+			}
+			checkTree(t, members, false)
+		})
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	for _, options := range []*Options{
+		{Format: "rar", Compression: "none"},
+		{Format: "tar", Compression: "bzip2"},
+		{Format: "zip", Compression: "lz4"},
+		{Format: "squashfs", Compression: "xz"},
+	} {
+		if _, err := NewArchiver(io.Discard, options); err == nil {
+			t.Errorf("%+v: expected an error", *options)
+		}
+	}
+}
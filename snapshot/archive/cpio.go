@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	cpioMagic   = "070701"
+	cpioTrailer = "TRAILER!!!"
+
+	cpioIFSOCK = 0140000
+	cpioIFLNK  = 0120000
+	cpioIFREG  = 0100000
+	cpioIFBLK  = 0060000
+	cpioIFDIR  = 0040000
+	cpioIFCHR  = 0020000
+	cpioIFIFO  = 0010000
+	cpioISUID  = 0004000
+	cpioISGID  = 0002000
+	cpioISVTX  = 0001000
+)
+
+// cpioWriter produces the SVR4 "newc" format without checksums. Every
+// member gets its own inode number, hardlinks are stored as copies.
+type cpioWriter struct {
+	w   io.Writer
+	ino uint32
+}
+
+func newCpioWriter(w io.Writer) *cpioWriter {
+	return &cpioWriter{w: w}
+}
+
+func cpioMode(mode os.FileMode) uint32 {
+	ret := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		ret |= cpioIFDIR
+	case mode&os.ModeSymlink != 0:
+		ret |= cpioIFLNK
+	case mode&os.ModeNamedPipe != 0:
+		ret |= cpioIFIFO
+	case mode&os.ModeSocket != 0:
+		ret |= cpioIFSOCK
+	case mode&os.ModeCharDevice != 0:
+		ret |= cpioIFCHR
+	case mode&os.ModeDevice != 0:
+		ret |= cpioIFBLK
+	default:
+		ret |= cpioIFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		ret |= cpioISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		ret |= cpioISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		ret |= cpioISVTX
+	}
+	return ret
+}
+
+func (writer *cpioWriter) writeHeader(name string, mode uint32, uid, gid, nlink uint32, mtime int64, size int64, rdev uint64) error {
+	if size > 0xffffffff {
+		return fmt.Errorf("file too large for cpio: %d bytes", size)
+	}
+	writer.ino++
+
+	major, minor := devNumbers(rdev)
+	header := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		cpioMagic, writer.ino, mode, uid, gid, nlink, uint32(mtime), uint32(size),
+		0, 0, uint32(major), uint32(minor), len(name)+1, 0)
+
+	if _, err := io.WriteString(writer.w, header+name+"\x00"); err != nil {
+		return err
+	}
+	return writer.pad(int64(len(header) + len(name) + 1))
+}
+
+// pad aligns the stream on 4 bytes after a header or data area of size n
+func (writer *cpioWriter) pad(n int64) error {
+	if n%4 == 0 {
+		return nil
+	}
+	_, err := writer.w.Write(make([]byte, 4-n%4))
+	return err
+}
+
+func (writer *cpioWriter) WriteEntry(entry *Entry, rd io.Reader) error {
+	info := entry.Info
+	mode := info.Mode()
+
+	var size int64
+	switch {
+	case mode.IsRegular():
+		size = info.Size()
+	case mode&os.ModeSymlink != 0:
+		size = int64(len(entry.Symlink))
+	}
+
+	nlink := uint32(1)
+	if mode.IsDir() {
+		nlink = 2
+	}
+
+	name := strings.TrimSuffix(entry.Name, "/")
+	if err := writer.writeHeader(name, cpioMode(mode), uint32(info.Uid()), uint32(info.Gid()), nlink, info.ModTime().Unix(), size, info.Rdev()); err != nil {
+		return err
+	}
+
+	switch {
+	case mode&os.ModeSymlink != 0:
+		if _, err := io.WriteString(writer.w, entry.Symlink); err != nil {
+			return err
+		}
+	case mode.IsRegular() && rd != nil:
+		n, err := io.CopyN(writer.w, rd, size)
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return io.ErrUnexpectedEOF
+		}
+	default:
+		return nil
+	}
+	return writer.pad(size)
+}
+
+func (writer *cpioWriter) Close() error {
+	return writer.writeHeader(cpioTrailer, 0, 0, 0, 1, 0, 0, 0)
+}
@@ -0,0 +1,722 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package archive
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	squashfsMagic        = 0x73717368
+	squashfsBlockLog     = 17
+	squashfsBlockSize    = 1 << squashfsBlockLog
+	squashfsMetadataSize = 8192
+	squashfsPadding      = 4096
+
+	squashfsInvalid      = 0xffffffffffffffff
+	squashfsNoFragment   = 0xffffffff
+	squashfsNoXattr      = 0xffffffff
+	squashfsUncompressed = 1 << 24 // data block stored as is
+	squashfsMetadataRaw  = 1 << 15 // metadata block stored as is
+
+	squashfsCompressionZlib = 1
+	squashfsCompressionLz4  = 5
+	squashfsCompressionZstd = 6
+
+	// superblock flags
+	squashfsFlagUncompressedInodes    = 0x0001
+	squashfsFlagUncompressedData      = 0x0002
+	squashfsFlagUncompressedFragments = 0x0008
+	squashfsFlagNoFragments           = 0x0010
+	squashfsFlagNoXattrs              = 0x0200
+	squashfsFlagCompressorOptions     = 0x0400
+	squashfsFlagUncompressedIds       = 0x0800
+
+	// inode types, extended ones follow the basic ones
+	squashfsTypeDir     = 1
+	squashfsTypeFile    = 2
+	squashfsTypeSymlink = 3
+	squashfsTypeBlock   = 4
+	squashfsTypeChar    = 5
+	squashfsTypeFifo    = 6
+	squashfsTypeSocket  = 7
+	squashfsTypeLDir    = 8
+	squashfsTypeLFile   = 9
+)
+
+// squashfsNode is an inode of the image, hardlinks share one node
+type squashfsNode struct {
+	mode    os.FileMode
+	uid     uint32
+	gid     uint32
+	mtime   int64
+	rdev    uint64
+	symlink string
+	nlink   uint32
+
+	children map[string]*squashfsNode
+
+	blocksStart uint64
+	blockSizes  []uint32
+	size        uint64
+	sparse      uint64
+
+	ino     uint32
+	ref     uint64
+	written bool
+}
+
+// squashfsWriter produces squashfs 4.0 images. File data is written as it
+// is received, one block at a time, and the tree is kept in memory until
+// Close writes the inode, directory and id tables. Blocks of zeros are
+// stored as sparse blocks and files get no fragments, so a file always
+// starts on a block of its own. Extended attributes are not stored.
+//
+// The superblock comes first and is only known once every table has been
+// written: seekable outputs are rewound to fill it in, other outputs get
+// the image spooled to a temporary file first.
+type squashfsWriter struct {
+	w      io.WriteSeeker
+	start  int64
+	offset uint64
+
+	out   io.Writer
+	spool *os.File
+
+	compression uint16
+	compress    func(data []byte) ([]byte, error)
+	options     []byte
+	block       []byte
+
+	root    *squashfsNode
+	count   uint32
+	ids     []uint32
+	idIndex map[uint32]uint16
+	mtime   time.Time
+}
+
+// squashfsMetadata buffers a metadata table, cut into blocks of 8KiB
+// compressed individually
+type squashfsMetadata struct {
+	compress func(data []byte) ([]byte, error)
+	blocks   bytes.Buffer
+	pending  []byte
+}
+
+func newSquashfsWriter(w io.Writer, compression string) (*squashfsWriter, error) {
+	writer := &squashfsWriter{
+		block:   make([]byte, squashfsBlockSize),
+		idIndex: make(map[uint32]uint16),
+		mtime:   time.Now(),
+	}
+	writer.root = writer.newDirectory()
+
+	switch compression {
+	case "none":
+		writer.compression = squashfsCompressionZlib
+	case "", "gzip":
+		// the squashfs gzip compressor produces zlib streams
+		writer.compression = squashfsCompressionZlib
+		writer.compress = func(data []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			zw := zlib.NewWriter(&buf)
+			if _, err := zw.Write(data); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		}
+	case "zstd":
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		writer.compression = squashfsCompressionZstd
+		writer.compress = func(data []byte) ([]byte, error) {
+			return encoder.EncodeAll(data, nil), nil
+		}
+	case "lz4":
+		// readers expect the options of the legacy lz4 format
+		writer.compression = squashfsCompressionLz4
+		writer.options = []byte{1, 0, 0, 0, 0, 0, 0, 0}
+		writer.compress = func(data []byte) ([]byte, error) {
+			buf := make([]byte, lz4.CompressBlockBound(len(data)))
+			n, err := lz4.CompressBlock(data, buf, nil)
+			if err != nil || n == 0 {
+				return nil, err
+			}
+			return buf[:n], nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression method %q for squashfs", compression)
+	}
+
+	if ws, ok := w.(io.WriteSeeker); ok {
+		if start, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			writer.w = ws
+			writer.start = start
+		}
+	}
+	if writer.w == nil {
+		spool, err := os.CreateTemp("", "plakar-squashfs-")
+		if err != nil {
+			return nil, err
+		}
+		writer.w = spool
+		writer.spool = spool
+		writer.out = w
+	}
+
+	// room for the superblock, filled in by Close
+	if err := writer.write(make([]byte, 96)); err != nil {
+		writer.removeSpool()
+		return nil, err
+	}
+	if writer.options != nil {
+		header := make([]byte, 2)
+		binary.LittleEndian.PutUint16(header, uint16(len(writer.options))|squashfsMetadataRaw)
+		if err := writer.write(append(header, writer.options...)); err != nil {
+			writer.removeSpool()
+			return nil, err
+		}
+	}
+	return writer, nil
+}
+
+func (writer *squashfsWriter) newDirectory() *squashfsNode {
+	return &squashfsNode{
+		mode:     os.ModeDir | 0755,
+		mtime:    writer.mtime.Unix(),
+		nlink:    1,
+		children: make(map[string]*squashfsNode),
+	}
+}
+
+func (writer *squashfsWriter) write(data []byte) error {
+	n, err := writer.w.Write(data)
+	writer.offset += uint64(n)
+	return err
+}
+
+func (writer *squashfsWriter) removeSpool() {
+	if writer.spool != nil {
+		writer.spool.Close()
+		os.Remove(writer.spool.Name())
+	}
+}
+
+// lookup returns the node at pathname, creating missing directories
+// along the way when mkdir is set
+func (writer *squashfsWriter) lookup(pathname string, mkdir bool) *squashfsNode {
+	node := writer.root
+	for _, atom := range strings.Split(pathname, "/") {
+		if atom == "" || atom == "." {
+			continue
+		}
+		child, exists := node.children[atom]
+		if !exists {
+			if !mkdir {
+				return nil
+			}
+			child = writer.newDirectory()
+			node.children[atom] = child
+		}
+		if child.children == nil {
+			return nil
+		}
+		node = child
+	}
+	return node
+}
+
+func (writer *squashfsWriter) WriteEntry(entry *Entry, rd io.Reader) error {
+	name := strings.Trim(path.Clean("/"+entry.Name), "/")
+	if name == "" {
+		return nil
+	}
+
+	parent := writer.lookup(path.Dir(name), true)
+	if parent == nil {
+		return fmt.Errorf("parent of %s is not a directory", name)
+	}
+	base := path.Base(name)
+	previous := parent.children[base]
+
+	var node *squashfsNode
+	if entry.Hardlink != "" {
+		linkname := strings.Trim(path.Clean("/"+entry.Hardlink), "/")
+		directory := writer.lookup(path.Dir(linkname), false)
+		if directory != nil {
+			node = directory.children[path.Base(linkname)]
+		}
+		if node == nil || node.children != nil {
+			return fmt.Errorf("hardlink target %s not found", entry.Hardlink)
+		}
+		if node == previous {
+			return nil
+		}
+		node.nlink++
+	} else {
+		info := entry.Info
+		node = &squashfsNode{
+			mode:    info.Mode(),
+			uid:     uint32(info.Uid()),
+			gid:     uint32(info.Gid()),
+			mtime:   info.ModTime().Unix(),
+			rdev:    info.Rdev(),
+			symlink: entry.Symlink,
+			nlink:   1,
+		}
+
+		if info.IsDir() {
+			// a directory met again keeps its content
+			if previous != nil && previous.children != nil {
+				node.children = previous.children
+			} else {
+				node.children = make(map[string]*squashfsNode)
+			}
+		} else if info.Mode().IsRegular() && rd != nil {
+			if err := writer.writeData(node, rd); err != nil {
+				return err
+			}
+		}
+	}
+
+	if previous != nil {
+		previous.nlink--
+	}
+	parent.children[base] = node
+	return nil
+}
+
+// writeData stores the content of a file as a sequence of blocks
+func (writer *squashfsWriter) writeData(node *squashfsNode, rd io.Reader) error {
+	node.blocksStart = writer.offset
+	for {
+		n, err := io.ReadFull(rd, writer.block)
+		if n > 0 {
+			data := writer.block[:n]
+			node.size += uint64(n)
+
+			size := uint32(0)
+			if isZeros(data) {
+				node.sparse += uint64(n)
+			} else {
+				written, err := writer.writeBlock(data)
+				if err != nil {
+					return err
+				}
+				size = written
+			}
+			node.blockSizes = append(node.blockSizes, size)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeBlock writes a data block and returns its size as recorded in the
+// inode, blocks that don't shrink are stored uncompressed
+func (writer *squashfsWriter) writeBlock(data []byte) (uint32, error) {
+	if writer.compress != nil {
+		compressed, err := writer.compress(data)
+		if err != nil {
+			return 0, err
+		}
+		if compressed != nil && len(compressed) < len(data) {
+			return uint32(len(compressed)), writer.write(compressed)
+		}
+	}
+	return uint32(len(data)) | squashfsUncompressed, writer.write(data)
+}
+
+// writeFields writes fixed size fields in little endian order
+func writeFields(w io.Writer, fields ...interface{}) error {
+	for _, field := range fields {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isZeros(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// position returns the reference of the next byte written to the table:
+// the offset of its block within the table and its offset within the block
+func (metadata *squashfsMetadata) position() uint64 {
+	return uint64(metadata.blocks.Len())<<16 | uint64(len(metadata.pending))
+}
+
+func (metadata *squashfsMetadata) Write(data []byte) (int, error) {
+	metadata.pending = append(metadata.pending, data...)
+	for len(metadata.pending) >= squashfsMetadataSize {
+		if err := metadata.flush(metadata.pending[:squashfsMetadataSize]); err != nil {
+			return 0, err
+		}
+		metadata.pending = metadata.pending[squashfsMetadataSize:]
+	}
+	return len(data), nil
+}
+
+func (metadata *squashfsMetadata) flush(block []byte) error {
+	header := uint16(len(block)) | squashfsMetadataRaw
+	if metadata.compress != nil {
+		compressed, err := metadata.compress(block)
+		if err != nil {
+			return err
+		}
+		if compressed != nil && len(compressed) < len(block) {
+			header = uint16(len(compressed))
+			block = compressed
+		}
+	}
+	binary.Write(&metadata.blocks, binary.LittleEndian, header)
+	metadata.blocks.Write(block)
+	return nil
+}
+
+// Bytes flushes the last block and returns the table
+func (metadata *squashfsMetadata) Bytes() ([]byte, error) {
+	if len(metadata.pending) != 0 {
+		if err := metadata.flush(metadata.pending); err != nil {
+			return nil, err
+		}
+		metadata.pending = nil
+	}
+	return metadata.blocks.Bytes(), nil
+}
+
+// number assigns inode numbers, children before their directory so the
+// root gets the last one
+func (writer *squashfsWriter) number(node *squashfsNode) {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := node.children[name]
+		if child.ino != 0 {
+			continue
+		}
+		if child.children != nil {
+			writer.number(child)
+		} else {
+			writer.count++
+			child.ino = writer.count
+		}
+	}
+	writer.count++
+	node.ino = writer.count
+}
+
+func (writer *squashfsWriter) id(value uint32) (uint16, error) {
+	if index, exists := writer.idIndex[value]; exists {
+		return index, nil
+	}
+	if len(writer.ids) > 0xffff {
+		return 0, fmt.Errorf("too many distinct uids and gids for squashfs")
+	}
+	index := uint16(len(writer.ids))
+	writer.ids = append(writer.ids, value)
+	writer.idIndex[value] = index
+	return index, nil
+}
+
+func squashfsMode(mode os.FileMode) uint16 {
+	ret := uint16(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		ret |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		ret |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		ret |= 01000
+	}
+	return ret
+}
+
+// squashfsType returns the basic type of a node, as found in directory
+// entries
+func squashfsType(node *squashfsNode) uint16 {
+	switch mode := node.mode; {
+	case node.children != nil:
+		return squashfsTypeDir
+	case mode&os.ModeSymlink != 0:
+		return squashfsTypeSymlink
+	case mode&os.ModeNamedPipe != 0:
+		return squashfsTypeFifo
+	case mode&os.ModeSocket != 0:
+		return squashfsTypeSocket
+	case mode&os.ModeCharDevice != 0:
+		return squashfsTypeChar
+	case mode&os.ModeDevice != 0:
+		return squashfsTypeBlock
+	default:
+		return squashfsTypeFile
+	}
+}
+
+// writeInode appends the inode of a node to the inode table, directories
+// pass the reference of their listing and their parent inode number
+func (writer *squashfsWriter) writeInode(inodes *squashfsMetadata, node *squashfsNode, listing uint64, listingSize uint32, parent uint32) error {
+	uidIndex, err := writer.id(node.uid)
+	if err != nil {
+		return err
+	}
+	gidIndex, err := writer.id(node.gid)
+	if err != nil {
+		return err
+	}
+
+	mtime := node.mtime
+	if mtime < 0 {
+		mtime = 0
+	} else if mtime > 0xffffffff {
+		mtime = 0xffffffff
+	}
+
+	inodeType := squashfsType(node)
+	var body []interface{}
+	switch inodeType {
+	case squashfsTypeDir:
+		if listingSize+3 <= 0xffff {
+			body = []interface{}{uint32(listing >> 16), node.nlink, uint16(listingSize + 3), uint16(listing), parent}
+		} else {
+			inodeType = squashfsTypeLDir
+			body = []interface{}{node.nlink, listingSize + 3, uint32(listing >> 16), parent, uint16(0), uint16(listing), uint32(squashfsNoXattr)}
+		}
+	case squashfsTypeFile:
+		if node.nlink == 1 && node.blocksStart <= 0xffffffff && node.size <= 0xffffffff {
+			body = []interface{}{uint32(node.blocksStart), uint32(squashfsNoFragment), uint32(0), uint32(node.size), node.blockSizes}
+		} else {
+			inodeType = squashfsTypeLFile
+			body = []interface{}{node.blocksStart, node.size, node.sparse, node.nlink, uint32(squashfsNoFragment), uint32(0), uint32(squashfsNoXattr), node.blockSizes}
+		}
+	case squashfsTypeSymlink:
+		body = []interface{}{node.nlink, uint32(len(node.symlink)), []byte(node.symlink)}
+	case squashfsTypeBlock, squashfsTypeChar:
+		major, minor := devNumbers(node.rdev)
+		body = []interface{}{node.nlink, uint32((minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12))}
+	default:
+		body = []interface{}{node.nlink}
+	}
+
+	node.ref = inodes.position()
+	header := []interface{}{inodeType, squashfsMode(node.mode), uidIndex, gidIndex, uint32(mtime), node.ino}
+	if err := writeFields(inodes, append(header, body...)...); err != nil {
+		return err
+	}
+	node.written = true
+	return nil
+}
+
+// writeDirectory writes the inodes below a directory, then its listing
+// and finally its own inode
+func (writer *squashfsWriter) writeDirectory(inodes *squashfsMetadata, directories *squashfsMetadata, node *squashfsNode, parent uint32) error {
+	node.nlink = 2
+	names := make([]string, 0, len(node.children))
+	for name, child := range node.children {
+		names = append(names, name)
+		if child.children != nil {
+			node.nlink++
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := node.children[name]
+		if child.written {
+			continue
+		}
+		var err error
+		if child.children != nil {
+			err = writer.writeDirectory(inodes, directories, child, node.ino)
+		} else {
+			err = writer.writeInode(inodes, child, 0, 0, 0)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// entries are grouped under headers sharing the block of their inodes
+	// and an inode number close enough to encode a delta
+	listing := directories.position()
+	var buf bytes.Buffer
+	for i := 0; i < len(names); {
+		first := node.children[names[i]]
+		j := i + 1
+		for ; j < len(names) && j-i < 256; j++ {
+			child := node.children[names[j]]
+			delta := int64(child.ino) - int64(first.ino)
+			if child.ref>>16 != first.ref>>16 || delta < -32768 || delta > 32767 {
+				break
+			}
+		}
+
+		writeFields(&buf, uint32(j-i-1), uint32(first.ref>>16), first.ino)
+		for _, name := range names[i:j] {
+			child := node.children[name]
+			writeFields(&buf, uint16(child.ref), int16(int64(child.ino)-int64(first.ino)), squashfsType(child), uint16(len(name)-1))
+			buf.WriteString(name)
+		}
+		i = j
+	}
+	if _, err := directories.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	return writer.writeInode(inodes, node, listing, uint32(buf.Len()), parent)
+}
+
+func (writer *squashfsWriter) Close() error {
+	defer writer.removeSpool()
+
+	inodes := &squashfsMetadata{compress: writer.compress}
+	directories := &squashfsMetadata{compress: writer.compress}
+	writer.number(writer.root)
+	if err := writer.writeDirectory(inodes, directories, writer.root, writer.count+1); err != nil {
+		return err
+	}
+
+	inodeTable, err := inodes.Bytes()
+	if err != nil {
+		return err
+	}
+	inodeTableStart := writer.offset
+	if err := writer.write(inodeTable); err != nil {
+		return err
+	}
+
+	directoryTable, err := directories.Bytes()
+	if err != nil {
+		return err
+	}
+	directoryTableStart := writer.offset
+	if err := writer.write(directoryTable); err != nil {
+		return err
+	}
+
+	// the id table is followed by the locations of its blocks
+	fragmentTableStart := writer.offset
+	locations := make([]uint64, 0)
+	for i := 0; i < len(writer.ids); i += squashfsMetadataSize / 4 {
+		j := i + squashfsMetadataSize/4
+		if j > len(writer.ids) {
+			j = len(writer.ids)
+		}
+		ids := &squashfsMetadata{compress: writer.compress}
+		binary.Write(ids, binary.LittleEndian, writer.ids[i:j])
+		data, err := ids.Bytes()
+		if err != nil {
+			return err
+		}
+		locations = append(locations, writer.offset)
+		if err := writer.write(data); err != nil {
+			return err
+		}
+	}
+	idTableStart := writer.offset
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, locations)
+	if err := writer.write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	bytesUsed := writer.offset
+	if pad := (squashfsPadding - bytesUsed%squashfsPadding) % squashfsPadding; pad != 0 {
+		if err := writer.write(make([]byte, pad)); err != nil {
+			return err
+		}
+	}
+
+	flags := uint16(squashfsFlagNoFragments | squashfsFlagNoXattrs)
+	if writer.compress == nil {
+		flags |= squashfsFlagUncompressedInodes | squashfsFlagUncompressedData | squashfsFlagUncompressedFragments | squashfsFlagUncompressedIds
+	}
+	if writer.options != nil {
+		flags |= squashfsFlagCompressorOptions
+	}
+
+	buf.Reset()
+	writeFields(&buf,
+		uint32(squashfsMagic),
+		writer.count,
+		uint32(writer.mtime.Unix()),
+		uint32(squashfsBlockSize),
+		uint32(0), // fragments
+		writer.compression,
+		uint16(squashfsBlockLog),
+		flags,
+		uint16(len(writer.ids)),
+		uint16(4), uint16(0), // version
+		writer.root.ref,
+		bytesUsed,
+		idTableStart,
+		uint64(squashfsInvalid), // xattr table
+		inodeTableStart,
+		directoryTableStart,
+		fragmentTableStart,
+		uint64(squashfsInvalid), // export table
+	)
+
+	if _, err := writer.w.Seek(writer.start, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := writer.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	if writer.spool != nil {
+		if _, err := writer.spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.Copy(writer.out, writer.spool)
+		return err
+	}
+	_, err = writer.w.Seek(writer.start+int64(writer.offset), io.SeekStart)
+	return err
+}
@@ -0,0 +1,254 @@
+package archive
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/PlakarLabs/plakar/vfs"
+)
+
+// squashfsImage reads back the subset of squashfs produced by the writer,
+// with uncompressed or zlib blocks
+type squashfsImage struct {
+	t    *testing.T
+	data []byte
+
+	blockSize   uint32
+	inodes      []byte
+	inodeBlocks map[uint32]int
+	directories []byte
+	dirBlocks   map[uint32]int
+	ids         []uint32
+}
+
+func (image *squashfsImage) u16(data []byte, offset int) uint16 {
+	return binary.LittleEndian.Uint16(data[offset:])
+}
+
+func (image *squashfsImage) u32(data []byte, offset int) uint32 {
+	return binary.LittleEndian.Uint32(data[offset:])
+}
+
+func (image *squashfsImage) u64(data []byte, offset int) uint64 {
+	return binary.LittleEndian.Uint64(data[offset:])
+}
+
+func (image *squashfsImage) inflate(data []byte) []byte {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		image.t.Fatal(err)
+	}
+	ret, err := io.ReadAll(zr)
+	if err != nil {
+		image.t.Fatal(err)
+	}
+	return ret
+}
+
+// metadata returns the content of the metadata blocks found between start
+// and end, along with the offset of each block within that content
+func (image *squashfsImage) metadata(start uint64, end uint64) ([]byte, map[uint32]int) {
+	ret := make([]byte, 0)
+	blocks := make(map[uint32]int)
+	for offset := start; offset < end; {
+		header := image.u16(image.data, int(offset))
+		size := uint64(header &^ squashfsMetadataRaw)
+		block := image.data[offset+2 : offset+2+size]
+		if header&squashfsMetadataRaw == 0 {
+			block = image.inflate(block)
+		}
+		blocks[uint32(offset-start)] = len(ret)
+		ret = append(ret, block...)
+		offset += 2 + size
+	}
+	return ret, blocks
+}
+
+func readSquashfs(t *testing.T, data []byte) *squashfsImage {
+	image := &squashfsImage{t: t, data: data}
+	if image.u32(data, 0) != squashfsMagic || image.u16(data, 28) != 4 {
+		t.Fatalf("unexpected superblock %x", data[:32])
+	}
+	if bytesUsed := image.u64(data, 40); len(data) < int(bytesUsed) || len(data)%squashfsPadding != 0 {
+		t.Fatalf("unexpected image of %d bytes for %d used", len(data), bytesUsed)
+	}
+	image.blockSize = image.u32(data, 12)
+
+	image.inodes, image.inodeBlocks = image.metadata(image.u64(data, 64), image.u64(data, 72))
+	image.directories, image.dirBlocks = image.metadata(image.u64(data, 72), image.u64(data, 80))
+
+	idTable := image.u64(data, 48)
+	for i := 0; i < int(image.u16(data, 26)); i += squashfsMetadataSize / 4 {
+		location := image.u64(data, int(idTable)+i/(squashfsMetadataSize/4)*8)
+		ids, _ := image.metadata(location, location+2+uint64(image.u16(data, int(location))&^squashfsMetadataRaw))
+		for j := 0; j < len(ids); j += 4 {
+			image.ids = append(image.ids, image.u32(ids, j))
+		}
+	}
+	return image
+}
+
+// inode returns the type, permissions, uid, inode number and body of the
+// inode at ref
+func (image *squashfsImage) inode(ref uint64) (uint16, os.FileMode, uint32, uint32, []byte) {
+	offset := image.inodeBlocks[uint32(ref>>16)] + int(ref&0xffff)
+	inode := image.inodes[offset:]
+	return image.u16(inode, 0), os.FileMode(image.u16(inode, 2) & 0777), image.ids[image.u16(inode, 4)], image.u32(inode, 12), inode[16:]
+}
+
+// walk reads the tree below the directory at ref into members, hardlinks
+// are reported as links to the first name met for their inode
+func (image *squashfsImage) walk(ref uint64, prefix string, members map[string]member, names map[uint32]string) {
+	inodeType, _, _, _, body := image.inode(ref)
+
+	var block uint32
+	var offset, size int
+	switch inodeType {
+	case squashfsTypeDir:
+		block, size, offset = image.u32(body, 0), int(image.u16(body, 8)), int(image.u16(body, 10))
+	case squashfsTypeLDir:
+		size, block, offset = int(image.u32(body, 4)), image.u32(body, 8), int(image.u16(body, 18))
+	default:
+		image.t.Fatalf("%s: unexpected directory type %d", prefix, inodeType)
+	}
+
+	listing := image.directories[image.dirBlocks[block]+offset:]
+	listing = listing[:size-3]
+	for len(listing) != 0 {
+		count, start, base := image.u32(listing, 0), image.u32(listing, 4), image.u32(listing, 8)
+		listing = listing[12:]
+		for i := uint32(0); i <= count; i++ {
+			entryOffset, delta, entryType := image.u16(listing, 0), int16(image.u16(listing, 2)), image.u16(listing, 4)
+			name := string(listing[8 : 8+int(image.u16(listing, 6))+1])
+			listing = listing[8+len(name):]
+
+			childRef := uint64(start)<<16 | uint64(entryOffset)
+			childType, mode, uid, ino, childBody := image.inode(childRef)
+			if ino != uint32(int64(base)+int64(delta)) || (childType != entryType && childType != entryType+7) {
+				image.t.Fatalf("%s: entry mismatches its inode", name)
+			}
+
+			pathname := path.Join(prefix, name)
+			m := member{mode: mode, uid: int(uid)}
+			if first, exists := names[ino]; exists {
+				m.hardlink = first
+				members[pathname] = m
+				continue
+			}
+			names[ino] = pathname
+
+			switch entryType {
+			case squashfsTypeDir:
+				m.mode |= os.ModeDir
+				image.walk(childRef, pathname, members, names)
+			case squashfsTypeSymlink:
+				m.mode |= os.ModeSymlink
+				m.linkname = string(childBody[8 : 8+image.u32(childBody, 4)])
+			case squashfsTypeFile:
+				m.content = string(image.content(childType, childBody))
+			}
+			members[pathname] = m
+		}
+	}
+}
+
+func (image *squashfsImage) content(inodeType uint16, body []byte) []byte {
+	var start, size uint64
+	var blockSizes []byte
+	if inodeType == squashfsTypeFile {
+		start, size, blockSizes = uint64(image.u32(body, 0)), uint64(image.u32(body, 12)), body[16:]
+	} else {
+		start, size, blockSizes = image.u64(body, 0), image.u64(body, 8), body[40:]
+	}
+
+	ret := make([]byte, 0, size)
+	for i := 0; uint64(len(ret)) < size; i++ {
+		blockSize := image.u32(blockSizes, i*4)
+		length := uint64(image.blockSize)
+		if remaining := size - uint64(len(ret)); remaining < length {
+			length = remaining
+		}
+		if blockSize == 0 {
+			ret = append(ret, make([]byte, length)...)
+			continue
+		}
+
+		block := image.data[start : start+uint64(blockSize&^squashfsUncompressed)]
+		start += uint64(len(block))
+		if blockSize&squashfsUncompressed == 0 {
+			block = image.inflate(block)
+		}
+		if uint64(len(block)) != length {
+			image.t.Fatalf("unexpected block of %d bytes, expected %d", len(block), length)
+		}
+		ret = append(ret, block...)
+	}
+	return ret
+}
+
+func (image *squashfsImage) members() map[string]member {
+	members := make(map[string]member)
+	image.walk(image.u64(image.data, 32), "", members, make(map[uint32]string))
+	return members
+}
+
+func TestSquashfs(t *testing.T) {
+	snap, dir := snapshotTree(t)
+
+	for _, compression := range []string{"none", "gzip"} {
+		t.Run(compression, func(t *testing.T) {
+			data := export(t, snap, dir, &Options{Format: "squashfs", Compression: compression, Rebase: true}, 1)
+			checkTree(t, readSquashfs(t, data).members(), true)
+		})
+	}
+}
+
+func TestSquashfsBlocks(t *testing.T) {
+	random := make([]byte, squashfsBlockSize+1000)
+	for i := range random {
+		random[i] = byte(i * 7919 >> 3)
+	}
+	sparse := append(make([]byte, 2*squashfsBlockSize), []byte("tail")...)
+	text := bytes.Repeat([]byte("plakar "), squashfsBlockSize/3)
+
+	// no seeking on a buffer, the image is spooled
+	var buf bytes.Buffer
+	writer, err := newSquashfsWriter(&buf, "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{"random": random, "sparse": sparse, "text": text, "d/empty": {}} {
+		entry := &Entry{
+			Name: name,
+			Info: vfs.FileInfo{Lname: path.Base(name), Lsize: int64(len(content)), Lmode: 0600, LmodTime: time.Now(), Luid: 1000, Lgid: 1000},
+		}
+		if err := writer.WriteEntry(entry, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	image := readSquashfs(t, buf.Bytes())
+	members := image.members()
+	for name, content := range map[string][]byte{"random": random, "sparse": sparse, "text": text, "d/empty": {}} {
+		if m := members[name]; m.content != string(content) || m.uid != 1000 || m.mode != 0600 {
+			t.Errorf("%s: unexpected member of %d bytes, mode %s, uid %d", name, len(m.content), m.mode, m.uid)
+		}
+	}
+	if directory := members["d"]; !directory.mode.IsDir() {
+		t.Errorf("expected a directory to be created for d/empty, got %+v", directory)
+	}
+
+	// runs of zeros take no room in the image
+	if len(buf.Bytes()) > len(random)+len(text)/2 {
+		t.Errorf("unexpected image of %d bytes", len(buf.Bytes()))
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+)
+
+type tarWriter struct {
+	tw *tar.Writer
+}
+
+func newTarWriter(w io.Writer) *tarWriter {
+	return &tarWriter{tw: tar.NewWriter(w)}
+}
+
+func (writer *tarWriter) WriteEntry(entry *Entry, rd io.Reader) error {
+	header, err := tar.FileInfoHeader(entry.Info, entry.Symlink)
+	if err != nil {
+		return err
+	}
+
+	header.Format = tar.FormatPAX
+	header.Name = entry.Name
+	if entry.Info.IsDir() {
+		header.Name += "/"
+	}
+	header.Uid = int(entry.Info.Uid())
+	header.Gid = int(entry.Info.Gid())
+	header.Uname = entry.Uname
+	header.Gname = entry.Gname
+	header.ModTime = entry.Info.ModTime()
+
+	if entry.Info.Mode()&os.ModeDevice != 0 {
+		major, minor := devNumbers(entry.Info.Rdev())
+		header.Devmajor = int64(major)
+		header.Devminor = int64(minor)
+	}
+
+	if entry.Hardlink != "" {
+		header.Typeflag = tar.TypeLink
+		header.Linkname = entry.Hardlink
+		header.Size = 0
+	}
+
+	if len(entry.Info.Xattrs()) != 0 {
+		header.PAXRecords = make(map[string]string)
+		for name, value := range entry.Info.Xattrs() {
+			header.PAXRecords["SCHILY.xattr."+name] = string(value)
+		}
+	}
+
+	if err := writer.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if rd != nil && header.Typeflag == tar.TypeReg {
+		if _, err := io.Copy(writer.tw, rd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (writer *tarWriter) Close() error {
+	return writer.tw.Close()
+}
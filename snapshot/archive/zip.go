@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package archive
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zipZstd is the method id assigned to zstd by the zip specification
+const zipZstd uint16 = 93
+
+// zipWriter emits members with data descriptors so the archive can be
+// streamed to a non-seekable output. Zip has no representation for
+// hardlinks, devices, fifos or sockets: hardlinks are stored as copies
+// and the others are skipped.
+type zipWriter struct {
+	zw     *zip.Writer
+	method uint16
+}
+
+func newZipWriter(w io.Writer, compression string) (*zipWriter, error) {
+	writer := &zipWriter{zw: zip.NewWriter(w)}
+
+	switch compression {
+	case "none":
+		writer.method = zip.Store
+	case "", "gzip":
+		writer.method = zip.Deflate
+	case "zstd":
+		writer.method = zipZstd
+		writer.zw.RegisterCompressor(zipZstd, func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		})
+	default:
+		return nil, fmt.Errorf("unsupported compression method %q for zip", compression)
+	}
+	return writer, nil
+}
+
+func (writer *zipWriter) WriteEntry(entry *Entry, rd io.Reader) error {
+	mode := entry.Info.Mode()
+	if !mode.IsDir() && !mode.IsRegular() && mode&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	header, err := zip.FileInfoHeader(entry.Info)
+	if err != nil {
+		return err
+	}
+	header.Name = entry.Name
+	header.Modified = entry.Info.ModTime()
+	header.Method = writer.method
+
+	switch {
+	case mode.IsDir():
+		header.Name = strings.TrimSuffix(header.Name, "/") + "/"
+		header.Method = zip.Store
+	case mode&os.ModeSymlink != 0:
+		header.Method = zip.Store
+	}
+
+	w, err := writer.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case mode&os.ModeSymlink != 0:
+		_, err = io.WriteString(w, entry.Symlink)
+	case rd != nil:
+		_, err = io.Copy(w, rd)
+	}
+	return err
+}
+
+func (writer *zipWriter) Close() error {
+	return writer.zw.Close()
+}
@@ -0,0 +1,46 @@
+package snapshot
+
+import (
+	"fmt"
+
+	"github.com/PlakarLabs/plakar/encryption"
+	"github.com/PlakarLabs/plakar/storage"
+)
+
+// blobStore gives the vfs access to the blobs of a repository, a snapshot
+// filesystem is stored as a blob per directory. It is read-only when it is
+// not bound to a snapshot.
+type blobStore struct {
+	repository *storage.Repository
+	snapshot   *Snapshot
+}
+
+func (store blobStore) Checksum(data []byte) [32]byte {
+	hasher := encryption.GetHasher(store.repository.Configuration().Hashing)
+	hasher.Write(data)
+	checksum := hasher.Sum(nil)
+
+	checksum32 := [32]byte{}
+	copy(checksum32[:], checksum[:])
+	return checksum32
+}
+
+func (store blobStore) CheckBlob(checksum [32]byte) (bool, error) {
+	return store.repository.CheckBlob(checksum)
+}
+
+func (store blobStore) CheckBlobBatch(checksums [][32]byte) ([]bool, error) {
+	return store.repository.CheckBlobBatch(checksums)
+}
+
+func (store blobStore) GetBlob(checksum [32]byte) ([]byte, error) {
+	return GetBlob(store.repository, checksum)
+}
+
+func (store blobStore) PutBlob(checksum [32]byte, data []byte) error {
+	if store.snapshot == nil {
+		return fmt.Errorf("cannot write blob %064x: store is read-only", checksum)
+	}
+	_, err := store.snapshot.PutBlob(checksum, data)
+	return err
+}
@@ -17,6 +17,7 @@ type CachedObject struct {
 	Checksum    [32]byte
 	Chunks      []*objects.Chunk
 	ContentType string
+	Holes       []objects.Hole `msgpack:",omitempty"`
 	Info        vfs.FileInfo
 }
 
@@ -67,6 +68,7 @@ func (snapshot *Snapshot) PutCachedObject(pathname string, object objects.Object
 	}
 
 	cacheObject.ContentType = object.ContentType
+	cacheObject.Holes = object.Holes
 	cacheObject.Info = fi
 
 	jobject, err := msgpack.Marshal(cacheObject)
@@ -78,3 +80,17 @@ func (snapshot *Snapshot) PutCachedObject(pathname string, object objects.Object
 	cache.PutPath(snapshot.repository.Configuration().RepositoryID.String(), hashedPath, jobject)
 	return nil
 }
+
+// importerState exposes the repository cache to importers that keep state
+// between runs, keys are scoped to the repository.
+type importerState struct {
+	snapshot *Snapshot
+}
+
+func (state importerState) GetState(key string) ([]byte, error) {
+	return state.snapshot.repository.GetCache().GetState(state.snapshot.repository.Configuration().RepositoryID.String(), key)
+}
+
+func (state importerState) PutState(key string, data []byte) error {
+	return state.snapshot.repository.GetCache().PutState(state.snapshot.repository.Configuration().RepositoryID.String(), key, data)
+}
@@ -3,9 +3,11 @@ package snapshot
 import (
 	"bytes"
 	"hash"
+	"io"
 
 	"github.com/PlakarLabs/plakar/encryption"
 	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/objects"
 )
 
 func snapshotCheckChunk(snapshot *Snapshot, chunkChecksum [32]byte, hasher hash.Hash, fast bool) (bool, error) {
@@ -28,37 +30,44 @@ func snapshotCheckObject(snapshot *Snapshot, checksum [32]byte, fast bool) (bool
 		return false, nil
 	}
 
-	if fast {
-		exists := snapshot.CheckObject(checksum)
-		if !exists {
-			return false, nil
-		}
-	} else {
-		tmp := snapshot.Index.LookupObject(checksum)
-		if tmp != nil {
-			return false, nil
-		}
-		object = tmp
+	if !fast {
+		return snapshotCheckContent(snapshot, object), nil
 	}
 
-	ret := true
+	exists := snapshot.CheckObject(checksum)
+	if !exists {
+		return false, nil
+	}
 
-	objectHasher := encryption.GetHasher(snapshot.repository.Configuration().Hashing)
 	for _, chunkChecksum := range object.Chunks {
-		_, err := snapshotCheckChunk(snapshot, chunkChecksum, objectHasher, fast)
+		_, err := snapshotCheckChunk(snapshot, chunkChecksum, nil, fast)
 		if err != nil {
 			logger.Warn("%s: chunk %064x: %s", snapshot.Header.GetIndexShortID(), chunkChecksum, err)
 			continue
 		}
 	}
+	return true, nil
+}
+
+// snapshotCheckContent reads an object through its layout, as pull restores
+// it, and compares the content with its checksum
+func snapshotCheckContent(snapshot *Snapshot, object *objects.Object) bool {
+	rd, err := newObjectReader(snapshot, object)
+	if err != nil {
+		logger.Warn("%s: object %064x: %s", snapshot.Header.GetIndexShortID(), object.Checksum, err)
+		return false
+	}
 
-	if !fast {
-		if !bytes.Equal(objectHasher.Sum(nil), checksum[:]) {
-			logger.Warn("%s: corrupted object %064x", snapshot.Header.GetIndexShortID(), checksum)
-			ret = false
-		}
+	objectHasher := encryption.GetHasher(snapshot.repository.Configuration().Hashing)
+	if _, err := io.Copy(objectHasher, rd); err != nil {
+		logger.Warn("%s: object %064x: %s", snapshot.Header.GetIndexShortID(), object.Checksum, err)
+		return false
 	}
-	return ret, nil
+	if !bytes.Equal(objectHasher.Sum(nil), object.Checksum[:]) {
+		logger.Warn("%s: corrupted object %064x", snapshot.Header.GetIndexShortID(), object.Checksum)
+		return false
+	}
+	return true
 }
 
 func snapshotCheckResource(snapshot *Snapshot, resource string, fast bool) (bool, error) {
@@ -117,25 +126,12 @@ func snapshotCheckFull(snapshot *Snapshot, fast bool) (bool, error) {
 			}
 		} else {
 			object := snapshot.Index.LookupObject(checksum)
-			objectHasher := encryption.GetHasher(snapshot.repository.Configuration().Hashing)
-			for _, chunkChecksum := range object.Chunks {
-				indexChunk := snapshot.Index.LookupChunk(chunkChecksum)
-				if indexChunk == nil {
-					logger.Warn("%s: unlisted chunk %064x", snapshot.Header.GetIndexShortID(), chunkChecksum)
-					ret = false
-					continue
-				}
-
-				data, err := snapshot.GetChunk(chunkChecksum)
-				if err != nil {
-					logger.Warn("%s: missing chunk %064x", snapshot.Header.GetIndexShortID(), chunkChecksum)
-					ret = false
-					continue
-				}
-				objectHasher.Write(data)
+			if object == nil {
+				logger.Warn("%s: unlisted object %064x", snapshot.Header.GetIndexShortID(), checksum)
+				ret = false
+				continue
 			}
-			if !bytes.Equal(objectHasher.Sum(nil), checksum[:]) {
-				logger.Warn("%s: corrupted object %064x", snapshot.Header.GetIndexShortID(), checksum)
+			if !snapshotCheckContent(snapshot, object) {
 				ret = false
 				continue
 			}
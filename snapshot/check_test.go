@@ -0,0 +1,69 @@
+package snapshot
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSparseFile(t *testing.T) {
+	repository := createRepository(t)
+	defer repository.Close()
+
+	dir := t.TempDir()
+	pathname := filepath.Join(dir, "sparse")
+	fp, err := os.Create(pathname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("plakar"), 1000)
+	if _, err := fp.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt(data, 4<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.Truncate(8 << 20); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	snap := push(t, repository, dir)
+
+	object := snap.lookupObjectForPathname(pathname)
+	if object == nil {
+		t.Fatal("expected the file to be in the snapshot")
+	}
+	if len(object.Holes) == 0 {
+		t.Skip("the filesystem does not report holes")
+	}
+
+	for _, fast := range []bool{true, false} {
+		if ok, err := snap.Check("/", fast); err != nil || !ok {
+			t.Errorf("fast=%v: expected the check to succeed: %v", fast, err)
+		}
+	}
+	for _, fast := range []bool{true, false} {
+		if ok, err := snap.Check(pathname, fast); err != nil || !ok {
+			t.Errorf("%s: fast=%v: expected the check to succeed: %v", pathname, fast, err)
+		}
+	}
+
+	rd, err := snap.NewReader(pathname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile(pathname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Errorf("unexpected content of %d bytes", len(content))
+	}
+}
@@ -49,6 +49,7 @@ type Header struct {
 	DirectoriesCount uint64
 	NonRegularCount  uint64
 	PathnamesCount   uint64
+	ErrorsCount      uint64
 
 	ObjectsTransferCount uint64
 	ObjectsTransferSize  uint64
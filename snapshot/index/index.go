@@ -31,6 +31,9 @@ type Index struct {
 	ObjectsList         [][]uint32
 	ObjectsChecksumList [][32]byte
 
+	// Object checksum -> holes, for sparse objects only
+	ObjectsHoles map[[32]byte][]objects.Hole `msgpack:",omitempty"`
+
 	// Chunk checksum -> length
 	muChunks           sync.Mutex
 	chunksChecksumsMap map[[32]byte]uint32
@@ -51,6 +54,7 @@ func NewIndex() *Index {
 		//inverseObjectsChecksumsMap: make(map[uint32][32]byte),
 		objectsMap:          make(map[uint32][]uint32),
 		ObjectsChecksumList: make([][32]byte, 0),
+		ObjectsHoles:        make(map[[32]byte][]objects.Hole),
 
 		chunksChecksumsMap: make(map[[32]byte]uint32),
 		//inverseChunksChecksumsMap: make(map[uint32][32]byte),
@@ -130,6 +134,10 @@ func NewIndexFromBytes(serialized []byte) (*Index, error) {
 
 	wg.Wait()
 
+	if index.ObjectsHoles == nil {
+		index.ObjectsHoles = make(map[[32]byte][]objects.Hole)
+	}
+
 	return &index, nil
 }
 
@@ -149,6 +157,8 @@ func (index *Index) Serialize() ([]byte, error) {
 
 		PathnamesChecksumList: make([][32]byte, len(index.PathnamesChecksumList)),
 		pathnamesChecksumsMap: make(map[[32]byte]uint32),
+
+		ObjectsHoles: index.ObjectsHoles,
 	}
 
 	//newChunksChecksumsList := make([][32]byte, len(index.chunksChecksumsMap))
@@ -309,6 +319,9 @@ func (index *Index) AddObject(object *objects.Object) {
 			index.muChunks.Unlock()
 			index.objectsMap[checksumID][offset] = chunkID
 		}
+		if len(object.Holes) != 0 {
+			index.ObjectsHoles[object.Checksum] = object.Holes
+		}
 	}
 }
 
@@ -389,6 +402,7 @@ func (index *Index) LookupObject(checksum [32]byte) *objects.Object {
 	return &objects.Object{
 		Checksum: checksum,
 		Chunks:   chunks,
+		Holes:    index.ObjectsHoles[checksum],
 	}
 }
 
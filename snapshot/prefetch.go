@@ -0,0 +1,494 @@
+package snapshot
+
+import (
+	"container/list"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/profiler"
+	"github.com/PlakarLabs/plakar/storage"
+)
+
+const (
+	// subparts closer than this within a packfile are fetched as one range
+	prefetchMaxGap = 64 << 10
+
+	// upper bound on the size of a single coalesced range read
+	prefetchMaxRange = 8 << 20
+
+	// upper bound on the decoded size of the chunks fetched ahead of the
+	// writers, it must stay below chunkCacheSize for prefetched chunks to
+	// remain cached until they are consumed
+	prefetchWindow = 64 << 20
+
+	// upper bounds on the ranges of a packfile fetched in a single batch
+	// request, saving a round-trip per range on remote repositories
+	prefetchBatchRanges = 64
+	prefetchBatchSize   = 16 << 20
+
+	// upper bound on the decoded size of the chunks kept in memory
+	chunkCacheSize = 128 << 20
+)
+
+type chunkCacheEntry struct {
+	checksum [32]byte
+	data     []byte
+}
+
+// chunkCache is a bounded LRU of decoded chunks, so chunks shared by
+// several files are only fetched once as long as they remain in memory.
+type chunkCache struct {
+	mu      sync.Mutex
+	maxSize uint64
+	size    uint64
+	lru     *list.List
+	entries map[[32]byte]*list.Element
+}
+
+func newChunkCache(maxSize uint64) *chunkCache {
+	return &chunkCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[[32]byte]*list.Element),
+	}
+}
+
+func (cache *chunkCache) Get(checksum [32]byte) ([]byte, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	elem, exists := cache.entries[checksum]
+	if !exists {
+		return nil, false
+	}
+	cache.lru.MoveToFront(elem)
+	return elem.Value.(*chunkCacheEntry).data, true
+}
+
+func (cache *chunkCache) Put(checksum [32]byte, data []byte) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if _, exists := cache.entries[checksum]; exists {
+		return
+	}
+	if uint64(len(data)) > cache.maxSize {
+		return
+	}
+
+	cache.entries[checksum] = cache.lru.PushFront(&chunkCacheEntry{checksum: checksum, data: data})
+	cache.size += uint64(len(data))
+
+	for cache.size > cache.maxSize {
+		elem := cache.lru.Back()
+		entry := elem.Value.(*chunkCacheEntry)
+		cache.lru.Remove(elem)
+		delete(cache.entries, entry.checksum)
+		cache.size -= uint64(len(entry.data))
+	}
+}
+
+type rangeChunk struct {
+	Checksum [32]byte
+	Offset   uint32
+	Length   uint32
+}
+
+// readRange is a contiguous area of a packfile covering one or more
+// chunk subparts, fetched with a single GetPackfileSubpart call.
+type readRange struct {
+	Packfile [32]byte
+	Offset   uint32
+	Length   uint32
+	Chunks   []rangeChunk
+
+	// decoded size of the chunks, accounted in the prefetch window
+	size uint64
+
+	// position of the first file needing a chunk from this range
+	order int
+
+	once     sync.Once
+	err      error
+	errs     map[[32]byte]error
+	pending  int
+	acquired bool
+}
+
+// planReads groups the chunks needed by a list of objects by packfile,
+// sorts them by offset and coalesces neighbouring subparts into larger
+// range reads. Ranges are returned in the order they are first needed.
+func (snapshot *Snapshot) planReads(chunkLists [][][32]byte) ([]*readRange, map[[32]byte]*readRange) {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("snapshot.planReads", time.Since(t0))
+	}()
+
+	type subpart struct {
+		checksum [32]byte
+		offset   uint32
+		length   uint32
+		size     uint64
+		order    int
+	}
+
+	seen := make(map[[32]byte]struct{})
+	packfiles := make(map[[32]byte][]subpart)
+	for order, chunks := range chunkLists {
+		for _, chunkChecksum := range chunks {
+			if _, exists := seen[chunkChecksum]; exists {
+				continue
+			}
+			seen[chunkChecksum] = struct{}{}
+
+			packfileChecksum, offset, length, exists := snapshot.Repository().GetRepositoryIndex().GetSubpartForChunk(chunkChecksum)
+			if !exists {
+				continue
+			}
+			// the encoded length stands for chunks the index does not know
+			size := uint64(length)
+			if snapshot.Index != nil {
+				if chunkLength, exists := snapshot.Index.GetChunkLength(chunkChecksum); exists {
+					size = uint64(chunkLength)
+				}
+			}
+			packfiles[packfileChecksum] = append(packfiles[packfileChecksum], subpart{
+				checksum: chunkChecksum,
+				offset:   offset,
+				length:   length,
+				size:     size,
+				order:    order,
+			})
+		}
+	}
+
+	ranges := make([]*readRange, 0)
+	for packfileChecksum, subparts := range packfiles {
+		sort.Slice(subparts, func(i, j int) bool {
+			return subparts[i].offset < subparts[j].offset
+		})
+
+		var current *readRange
+		for _, sp := range subparts {
+			if current != nil {
+				end := current.Offset + current.Length
+				if sp.offset <= end+prefetchMaxGap && sp.offset+sp.length-current.Offset <= prefetchMaxRange {
+					if sp.offset+sp.length > end {
+						current.Length = sp.offset + sp.length - current.Offset
+					}
+					current.Chunks = append(current.Chunks, rangeChunk{Checksum: sp.checksum, Offset: sp.offset - current.Offset, Length: sp.length})
+					current.size += sp.size
+					if sp.order < current.order {
+						current.order = sp.order
+					}
+					continue
+				}
+			}
+			current = &readRange{
+				Packfile: packfileChecksum,
+				Offset:   sp.offset,
+				Length:   sp.length,
+				Chunks:   []rangeChunk{{Checksum: sp.checksum, Offset: 0, Length: sp.length}},
+				size:     sp.size,
+				order:    sp.order,
+			}
+			ranges = append(ranges, current)
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].order != ranges[j].order {
+			return ranges[i].order < ranges[j].order
+		}
+		if ranges[i].Packfile != ranges[j].Packfile {
+			return string(ranges[i].Packfile[:]) < string(ranges[j].Packfile[:])
+		}
+		return ranges[i].Offset < ranges[j].Offset
+	})
+
+	chunkRanges := make(map[[32]byte]*readRange)
+	for _, r := range ranges {
+		r.pending = len(r.Chunks)
+		for _, chunk := range r.Chunks {
+			chunkRanges[chunk.Checksum] = r
+		}
+	}
+	return ranges, chunkRanges
+}
+
+// chunkFetcher serves chunks to the restore writers, prefetching the
+// planned ranges ahead of them and keeping decoded chunks in a cache.
+type chunkFetcher struct {
+	snapshot *Snapshot
+	cache    *chunkCache
+
+	ranges      []*readRange
+	chunkRanges map[[32]byte]*readRange
+
+	muConsumed sync.Mutex
+	consumed   map[[32]byte]struct{}
+
+	muWindow   sync.Mutex
+	condWindow *sync.Cond
+	inflight   uint64
+
+	done chan struct{}
+}
+
+func newChunkFetcher(snapshot *Snapshot, chunkLists [][][32]byte) *chunkFetcher {
+	ranges, chunkRanges := snapshot.planReads(chunkLists)
+
+	fetcher := &chunkFetcher{
+		snapshot:    snapshot,
+		cache:       newChunkCache(chunkCacheSize),
+		ranges:      ranges,
+		chunkRanges: chunkRanges,
+		consumed:    make(map[[32]byte]struct{}),
+		done:        make(chan struct{}),
+	}
+	fetcher.condWindow = sync.NewCond(&fetcher.muWindow)
+
+	logger.Trace("snapshot", "%s: planned %d range reads for %d chunks", snapshot.Header.GetIndexShortID(), len(ranges), len(chunkRanges))
+	return fetcher
+}
+
+// Start launches the prefetch workers, they stop once every range has
+// been fetched or when Close is called.
+func (fetcher *chunkFetcher) Start() {
+	rangesChan := make(chan []*readRange)
+
+	go func() {
+		defer close(rangesChan)
+		for i := 0; i < len(fetcher.ranges); {
+			r := fetcher.ranges[i]
+			i++
+			if fetcher.isConsumed(r) {
+				continue
+			}
+
+			// the ranges that follow in the same packfile are batched
+			group := []*readRange{r}
+			length, size := uint64(r.Length), r.size
+			for i < len(fetcher.ranges) && len(group) < prefetchBatchRanges {
+				next := fetcher.ranges[i]
+				if next.Packfile != r.Packfile || length+uint64(next.Length) > prefetchBatchSize {
+					break
+				}
+				if !fetcher.isConsumed(next) {
+					group = append(group, next)
+					length += uint64(next.Length)
+					size += next.size
+				}
+				i++
+			}
+			if !fetcher.acquireWindow(size) {
+				return
+			}
+
+			// writers may have consumed ranges while we were waiting
+			pending := make([]*readRange, 0, len(group))
+			fetcher.muConsumed.Lock()
+			for _, r := range group {
+				if r.pending == 0 {
+					fetcher.releaseWindow(r.size)
+					continue
+				}
+				r.acquired = true
+				pending = append(pending, r)
+			}
+			fetcher.muConsumed.Unlock()
+			if len(pending) == 0 {
+				continue
+			}
+
+			select {
+			case rangesChan <- pending:
+			case <-fetcher.done:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < runtime.NumCPU()+1; i++ {
+		go func() {
+			for group := range rangesChan {
+				fetcher.fetchRanges(group)
+			}
+		}()
+	}
+}
+
+func (fetcher *chunkFetcher) Close() {
+	close(fetcher.done)
+	fetcher.muWindow.Lock()
+	fetcher.condWindow.Broadcast()
+	fetcher.muWindow.Unlock()
+}
+
+func (fetcher *chunkFetcher) acquireWindow(size uint64) bool {
+	fetcher.muWindow.Lock()
+	defer fetcher.muWindow.Unlock()
+
+	for fetcher.inflight != 0 && fetcher.inflight+size > prefetchWindow {
+		select {
+		case <-fetcher.done:
+			return false
+		default:
+		}
+		fetcher.condWindow.Wait()
+	}
+	fetcher.inflight += size
+	return true
+}
+
+func (fetcher *chunkFetcher) releaseWindow(size uint64) {
+	fetcher.muWindow.Lock()
+	defer fetcher.muWindow.Unlock()
+
+	fetcher.inflight -= size
+	fetcher.condWindow.Broadcast()
+}
+
+// fetchRange reads a range from its packfile and populates the cache, it
+// is safe to call concurrently: the first caller fetches, others wait.
+func (fetcher *chunkFetcher) fetchRange(r *readRange) {
+	r.once.Do(func() {
+		t0 := time.Now()
+		defer func() {
+			profiler.RecordEvent("snapshot.fetchRange", time.Since(t0))
+		}()
+
+		buffer, err := fetcher.snapshot.repository.GetPackfileSubpart(r.Packfile, r.Offset, r.Length)
+		fetcher.fill(r, buffer, err)
+	})
+}
+
+// fetchRanges reads ranges of a same packfile in a single request. Ranges a
+// writer fetched in the meantime are left as they are.
+func (fetcher *chunkFetcher) fetchRanges(group []*readRange) {
+	if len(group) == 1 {
+		fetcher.fetchRange(group[0])
+		return
+	}
+
+	group[0].once.Do(func() {
+		t0 := time.Now()
+		defer func() {
+			profiler.RecordEvent("snapshot.fetchRanges", time.Since(t0))
+		}()
+
+		subparts := make([]storage.Subpart, 0, len(group))
+		for _, r := range group {
+			subparts = append(subparts, storage.Subpart{Offset: r.Offset, Length: r.Length})
+		}
+		buffers, err := fetcher.snapshot.repository.GetPackfileSubpartBatch(group[0].Packfile, subparts)
+
+		for i, r := range group {
+			var buffer []byte
+			if err == nil {
+				buffer = buffers[i]
+			}
+			if i == 0 {
+				fetcher.fill(r, buffer, err)
+			} else {
+				r.once.Do(func() { fetcher.fill(r, buffer, err) })
+			}
+		}
+	})
+}
+
+// fill decodes the chunks of a fetched range into the cache
+func (fetcher *chunkFetcher) fill(r *readRange, buffer []byte, err error) {
+	if err != nil {
+		r.err = err
+		return
+	}
+	if uint32(len(buffer)) != r.Length {
+		r.err = fmt.Errorf("short read on packfile %064x: got=%d, expected=%d", r.Packfile, len(buffer), r.Length)
+		return
+	}
+
+	for _, chunk := range r.Chunks {
+		data, err := fetcher.snapshot.decodeChunk(buffer[chunk.Offset : chunk.Offset+chunk.Length])
+		if err != nil {
+			if r.errs == nil {
+				r.errs = make(map[[32]byte]error)
+			}
+			r.errs[chunk.Checksum] = err
+			continue
+		}
+		fetcher.cache.Put(chunk.Checksum, data)
+	}
+}
+
+func (fetcher *chunkFetcher) isConsumed(r *readRange) bool {
+	fetcher.muConsumed.Lock()
+	defer fetcher.muConsumed.Unlock()
+	return r.pending == 0
+}
+
+func (fetcher *chunkFetcher) consume(checksum [32]byte, r *readRange) {
+	fetcher.muConsumed.Lock()
+	defer fetcher.muConsumed.Unlock()
+
+	if _, exists := fetcher.consumed[checksum]; exists {
+		return
+	}
+	fetcher.consumed[checksum] = struct{}{}
+
+	r.pending--
+	if r.pending == 0 && r.acquired {
+		fetcher.releaseWindow(r.size)
+	}
+}
+
+// Drop marks the chunks of a file as consumed once the file is done with,
+// so the ranges a writer gave up on stop holding the prefetch window.
+func (fetcher *chunkFetcher) Drop(chunks [][32]byte) {
+	for _, checksum := range chunks {
+		if r, exists := fetcher.chunkRanges[checksum]; exists {
+			fetcher.consume(checksum, r)
+		}
+	}
+}
+
+// GetChunk returns the decoded chunk, from the cache if it was prefetched
+// or fetched by another writer, falling back to a direct fetch otherwise.
+func (fetcher *chunkFetcher) GetChunk(checksum [32]byte) ([]byte, error) {
+	if data, exists := fetcher.cache.Get(checksum); exists {
+		if r, exists := fetcher.chunkRanges[checksum]; exists {
+			fetcher.consume(checksum, r)
+		}
+		return data, nil
+	}
+
+	r, exists := fetcher.chunkRanges[checksum]
+	if !exists {
+		return fetcher.snapshot.GetChunk(checksum)
+	}
+
+	// either waits for the prefetcher or steals the range from it
+	fetcher.fetchRange(r)
+	fetcher.consume(checksum, r)
+	if err, exists := r.errs[checksum]; exists {
+		return nil, err
+	}
+
+	if r.err == nil {
+		if data, exists := fetcher.cache.Get(checksum); exists {
+			return data, nil
+		}
+	}
+
+	// range read failed or chunk evicted before we got to it
+	data, err := fetcher.snapshot.GetChunk(checksum)
+	if err != nil {
+		return nil, err
+	}
+	fetcher.cache.Put(checksum, data)
+	return data, nil
+}
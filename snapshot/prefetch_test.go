@@ -0,0 +1,180 @@
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/PlakarLabs/plakar/objects"
+	"github.com/PlakarLabs/plakar/snapshot/header"
+	sindex "github.com/PlakarLabs/plakar/snapshot/index"
+	"github.com/PlakarLabs/plakar/storage"
+	"github.com/PlakarLabs/plakar/storage/index"
+)
+
+func TestChunkCache(t *testing.T) {
+	cache := newChunkCache(10)
+
+	cache.Put([32]byte{1}, []byte("aaaa"))
+	cache.Put([32]byte{2}, []byte("bbbb"))
+	cache.Put([32]byte{2}, []byte("bbbb"))
+	if cache.size != 8 {
+		t.Fatalf("expected a size of 8, got %d", cache.size)
+	}
+
+	// the first chunk is the most recently used, the second one goes
+	if _, exists := cache.Get([32]byte{1}); !exists {
+		t.Fatal("expected the first chunk to be cached")
+	}
+	cache.Put([32]byte{3}, []byte("cccc"))
+	if _, exists := cache.Get([32]byte{2}); exists {
+		t.Error("expected the least recently used chunk to be evicted")
+	}
+	if data, exists := cache.Get([32]byte{1}); !exists || string(data) != "aaaa" {
+		t.Errorf("unexpected chunk %q", data)
+	}
+	if cache.size != 8 || cache.lru.Len() != 2 {
+		t.Errorf("unexpected cache of %d bytes in %d chunks", cache.size, cache.lru.Len())
+	}
+
+	cache.Put([32]byte{4}, make([]byte, 11))
+	if _, exists := cache.Get([32]byte{4}); exists {
+		t.Error("expected a chunk larger than the cache not to be cached")
+	}
+}
+
+// plannedSnapshot returns a snapshot whose repository index locates chunks
+// at the given subparts
+func plannedSnapshot(subparts map[[32]byte]rangeChunk, packfiles map[[32]byte][32]byte) *Snapshot {
+	repositoryIndex := index.New()
+	for checksum, subpart := range subparts {
+		repositoryIndex.SetPackfileForChunk(packfiles[checksum], checksum, subpart.Offset, subpart.Length)
+	}
+	repository := &storage.Repository{}
+	repository.SetRepositoryIndex(repositoryIndex)
+	return &Snapshot{repository: repository, Header: &header.Header{}}
+}
+
+func TestPlanReads(t *testing.T) {
+	packfileA := [32]byte{0xa}
+	packfileB := [32]byte{0xb}
+
+	subparts := map[[32]byte]rangeChunk{
+		{1}: {Offset: 0, Length: 100},
+		{2}: {Offset: 150, Length: 100},
+		{3}: {Offset: 1 << 20, Length: 100},
+		{4}: {Offset: 0, Length: prefetchMaxRange - 50},
+		{5}: {Offset: prefetchMaxRange - 50, Length: 100},
+	}
+	packfiles := map[[32]byte][32]byte{
+		{1}: packfileA,
+		{2}: packfileA,
+		{3}: packfileA,
+		{4}: packfileB,
+		{5}: packfileB,
+	}
+	snap := plannedSnapshot(subparts, packfiles)
+
+	ranges, chunkRanges := snap.planReads([][][32]byte{
+		{{4}},
+		{{2}, {1}, {9}},
+		{{1}, {3}, {5}},
+	})
+
+	// neighbouring subparts are merged unless the range grows too large,
+	// ranges come in the order of the first file needing them
+	expected := []struct {
+		packfile [32]byte
+		offset   uint32
+		length   uint32
+		chunks   int
+	}{
+		{packfileB, 0, prefetchMaxRange - 50, 1},
+		{packfileA, 0, 250, 2},
+		{packfileA, 1 << 20, 100, 1},
+		{packfileB, prefetchMaxRange - 50, 100, 1},
+	}
+	if len(ranges) != len(expected) {
+		t.Fatalf("expected %d ranges, got %d", len(expected), len(ranges))
+	}
+	for i, r := range ranges {
+		if r.Packfile != expected[i].packfile || r.Offset != expected[i].offset || r.Length != expected[i].length || len(r.Chunks) != expected[i].chunks {
+			t.Errorf("range %d: unexpected %064x at %d+%d with %d chunks", i, r.Packfile, r.Offset, r.Length, len(r.Chunks))
+		}
+		if r.pending != len(r.Chunks) {
+			t.Errorf("range %d: expected %d pending chunks, got %d", i, len(r.Chunks), r.pending)
+		}
+	}
+
+	if chunk := ranges[1].Chunks[1]; chunk.Checksum != [32]byte{2} || chunk.Offset != 150 || chunk.Length != 100 {
+		t.Errorf("unexpected chunk within range %+v", chunk)
+	}
+	if len(chunkRanges) != 5 {
+		t.Errorf("expected the unlisted chunk to be left out, got %d chunks", len(chunkRanges))
+	}
+	if chunkRanges[[32]byte{2}] != ranges[1] {
+		t.Error("expected chunks to map to the range holding them")
+	}
+}
+
+func TestPlanReadsSize(t *testing.T) {
+	subparts := map[[32]byte]rangeChunk{
+		{1}: {Offset: 0, Length: 100},
+		{2}: {Offset: 100, Length: 100},
+	}
+	packfiles := map[[32]byte][32]byte{
+		{1}: {0xa},
+		{2}: {0xa},
+	}
+	snap := plannedSnapshot(subparts, packfiles)
+	snap.Index = sindex.NewIndex()
+	snap.Index.AddChunk(&objects.Chunk{Checksum: [32]byte{1}, Length: 400})
+
+	// ranges weigh the decoded size of their chunks in the window, as the
+	// cache does, the encoded length standing for unknown chunks
+	ranges, _ := snap.planReads([][][32]byte{{{1}, {2}}})
+	if len(ranges) != 1 || ranges[0].Length != 200 {
+		t.Fatalf("unexpected ranges %+v", ranges)
+	}
+	if ranges[0].size != 500 {
+		t.Errorf("expected a decoded size of 500, got %d", ranges[0].size)
+	}
+}
+
+func TestFetcherDrop(t *testing.T) {
+	subparts := map[[32]byte]rangeChunk{
+		{1}: {Offset: 0, Length: 100},
+		{2}: {Offset: 100, Length: 100},
+	}
+	packfiles := map[[32]byte][32]byte{
+		{1}: {0xa},
+		{2}: {0xa},
+	}
+	snap := plannedSnapshot(subparts, packfiles)
+
+	fetcher := newChunkFetcher(snap, [][][32]byte{{{1}, {2}}})
+	if len(fetcher.ranges) != 1 {
+		t.Fatalf("expected a single range, got %d", len(fetcher.ranges))
+	}
+	r := fetcher.ranges[0]
+
+	// as the prefetcher does before handing the range to a worker
+	if !fetcher.acquireWindow(r.size) {
+		t.Fatal("expected the window to be acquired")
+	}
+	r.acquired = true
+
+	fetcher.consume([32]byte{1}, r)
+	if fetcher.inflight != r.size {
+		t.Fatalf("expected the window to be held by a partly consumed range, got %d", fetcher.inflight)
+	}
+
+	// a writer giving up on its file releases what it did not read
+	fetcher.Drop([][32]byte{{1}, {2}})
+	if fetcher.inflight != 0 || r.pending != 0 {
+		t.Errorf("expected the window to be released, got %d bytes and %d pending chunks", fetcher.inflight, r.pending)
+	}
+
+	fetcher.Drop([][32]byte{{1}, {2}})
+	if fetcher.inflight != 0 {
+		t.Errorf("expected dropping twice to be harmless, got %d bytes", fetcher.inflight)
+	}
+}
@@ -3,22 +3,85 @@ package snapshot
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/PlakarLabs/plakar/encryption"
 	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/objects"
 )
 
-func (snapshot *Snapshot) Pull(root string, rebase bool, pattern string) {
+type PullOptions struct {
+	Rebase bool
+	Verify bool
+}
+
+type PullReportEntry struct {
+	Pathname string
+	Error    string
+}
+
+type PullReport struct {
+	Snapshot string
+	Root     string
+	Restored []string
+	Skipped  []PullReportEntry
+	Failed   []PullReportEntry
+
+	mu sync.Mutex
+}
+
+func (report *PullReport) restored(pathname string) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.Restored = append(report.Restored, pathname)
+}
+
+func (report *PullReport) skipped(pathname string, reason string) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.Skipped = append(report.Skipped, PullReportEntry{Pathname: pathname, Error: reason})
+}
+
+func (report *PullReport) failed(pathname string, err error) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.Failed = append(report.Failed, PullReportEntry{Pathname: pathname, Error: err.Error()})
+}
+
+func (report *PullReport) sort() {
+	sort.Strings(report.Restored)
+	sort.Slice(report.Skipped, func(i, j int) bool {
+		return report.Skipped[i].Pathname < report.Skipped[j].Pathname
+	})
+	sort.Slice(report.Failed, func(i, j int) bool {
+		return report.Failed[i].Pathname < report.Failed[j].Pathname
+	})
+}
+
+func (report *PullReport) HasFailures() bool {
+	return len(report.Failed) != 0
+}
+
+func (snapshot *Snapshot) Pull(root string, pattern string, options *PullOptions) *PullReport {
 	var wg sync.WaitGroup
 	maxDirectoriesConcurrency := make(chan bool, runtime.NumCPU()*8+1)
 	maxFilesConcurrency := make(chan bool, runtime.NumCPU()*8+1)
 
+	report := &PullReport{
+		Snapshot: snapshot.Header.GetIndexID().String(),
+		Root:     root,
+		Restored: make([]string, 0),
+		Skipped:  make([]PullReportEntry, 0),
+		Failed:   make([]PullReportEntry, 0),
+	}
+
 	dpattern := path.Clean(pattern)
 	fpattern := path.Clean(pattern)
 
@@ -38,7 +101,6 @@ func (snapshot *Snapshot) Pull(root string, rebase bool, pattern string) {
 		}
 	}
 
-	directoriesCount := 0
 	for _, directory := range snapshot.Filesystem.ListDirectories() {
 		if dpattern != "" {
 			if directory != dpattern &&
@@ -57,7 +119,7 @@ func (snapshot *Snapshot) Pull(root string, rebase bool, pattern string) {
 
 			fi, _ := snapshot.Filesystem.LookupInodeForDirectory(directory)
 			rel := path.Clean(filepath.Join(".", directory))
-			if rebase && strings.HasPrefix(directory, dpattern) {
+			if options.Rebase && strings.HasPrefix(directory, dpattern) {
 				dest = filepath.Join(root, directory[len(dpattern):])
 			} else {
 				dest = filepath.Join(root, directory)
@@ -67,16 +129,18 @@ func (snapshot *Snapshot) Pull(root string, rebase bool, pattern string) {
 
 			dest = filepath.FromSlash(dest)
 
-			os.MkdirAll(dest, 0700)
+			if err := os.MkdirAll(dest, 0700); err != nil {
+				logger.Warn("failed to create restored directory %s: %s", dest, err)
+				report.failed(directory, err)
+				return
+			}
 			os.Chmod(dest, fi.Mode())
 			os.Chown(dest, int(fi.Uid()), int(fi.Gid()))
-			directoriesCount++
 		}(directory)
 	}
 	wg.Wait()
 
-	filesCount := 0
-	var filesSize uint64 = 0
+	filenames := make([]string, 0)
 	for _, filename := range snapshot.Filesystem.ListFiles() {
 		if fpattern != "" {
 			if filename != fpattern &&
@@ -84,6 +148,23 @@ func (snapshot *Snapshot) Pull(root string, rebase bool, pattern string) {
 				continue
 			}
 		}
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	// plan packfile reads in the order files will be restored so the
+	// prefetcher can run ahead of the writers
+	chunkLists := make([][][32]byte, 0, len(filenames))
+	for _, filename := range filenames {
+		if object := snapshot.lookupObjectForPathname(filename); object != nil {
+			chunkLists = append(chunkLists, object.Chunks)
+		}
+	}
+	fetcher := newChunkFetcher(snapshot, chunkLists)
+	fetcher.Start()
+	defer fetcher.Close()
+
+	for _, filename := range filenames {
 		maxFilesConcurrency <- true
 		wg.Add(1)
 		go func(file string) {
@@ -94,73 +175,32 @@ func (snapshot *Snapshot) Pull(root string, rebase bool, pattern string) {
 
 			fi, _ := snapshot.Filesystem.LookupInodeForFile(file)
 			rel := path.Clean(filepath.Join(".", file))
-			if rebase && strings.HasPrefix(file, dpattern) {
+			if options.Rebase && strings.HasPrefix(file, dpattern) {
 				dest = filepath.Join(root, file[len(dpattern):])
 			} else {
 				dest = filepath.Join(root, file)
 			}
 			dest = filepath.Clean(dest)
 
-			hasher := encryption.GetHasher(snapshot.repository.Configuration().Hashing)
-			hasher.Write([]byte(file))
-			pathnameChecksum := hasher.Sum(nil)
-			key := [32]byte{}
-			copy(key[:], pathnameChecksum)
-			object := snapshot.Index.LookupObjectForPathnameChecksum(key)
+			object := snapshot.lookupObjectForPathname(file)
 			if object == nil {
 				logger.Warn("skipping %s", rel)
+				report.skipped(file, "no object for pathname")
 				return
 			}
+			// chunks left unread on failure must not stall the prefetcher
+			defer fetcher.Drop(object.Chunks)
 
 			logger.Trace("snapshot", "snapshot %s: create %s, mode=%s, uid=%d, gid=%d", snapshot.Header.GetIndexShortID(), rel, fi.Mode().String(), fi.Uid, fi.Gid)
 
 			dest = filepath.FromSlash(dest)
 
-			f, err := os.Create(dest)
-			if err != nil {
-				logger.Warn("failed to create restored file %s: %s", dest, err)
+			if err := snapshot.restoreFile(fetcher, object, dest, options.Verify); err != nil {
+				logger.Warn("failed to restore %s: %s", dest, err)
+				report.failed(file, err)
 				return
 			}
 
-			objectHasher := encryption.GetHasher(snapshot.repository.Configuration().Hashing)
-			for _, chunkChecksum := range object.Chunks {
-				data, err := snapshot.GetChunk(chunkChecksum)
-				if err != nil {
-					logger.Warn("failed to obtain chunk %064x for %s: %s", chunkChecksum, dest, err)
-					f.Close()
-					continue
-				}
-
-				chunk := snapshot.Index.LookupChunk(chunkChecksum)
-
-				if len(data) != int(chunk.Length) {
-					logger.Warn("chunk length mismatch: got=%d, expected=%d", len(data), int(chunk.Length))
-					f.Close()
-					continue
-				} else {
-					chunkHasher := encryption.GetHasher(snapshot.repository.Configuration().Hashing)
-					chunkHasher.Write(data)
-					if !bytes.Equal(chunk.Checksum[:], chunkHasher.Sum(nil)) {
-						logger.Warn("chunk checksums mismatch: got=%064x, expected=%064x", chunkHasher.Sum(nil), chunk.Checksum[:])
-						f.Close()
-						continue
-					}
-				}
-				objectHasher.Write(data)
-				f.Write(data)
-				filesSize += uint64(len(data))
-			}
-			if !bytes.Equal(object.Checksum[:], objectHasher.Sum(nil)) {
-				logger.Warn("object checksum mismatches: got=%064x, expected=%064x",
-					objectHasher.Sum(nil), object.Checksum[:])
-			}
-
-			if err := f.Sync(); err != nil {
-				logger.Warn("sync failure: %s: %s", dest, err)
-			}
-			if err := f.Close(); err != nil {
-				logger.Warn("close failure: %s: %s", dest, err)
-			}
 			if err := os.Chmod(dest, fi.Mode()); err != nil {
 				logger.Warn("chmod failure: %s: %s", dest, err)
 			}
@@ -169,8 +209,143 @@ func (snapshot *Snapshot) Pull(root string, rebase bool, pattern string) {
 					logger.Warn("chown failure: %s: %s", dest, err)
 				}
 			}
-			filesCount++
+			report.restored(file)
 		}(filename)
 	}
 	wg.Wait()
+
+	report.sort()
+	return report
+}
+
+// restoreFile writes the content of object to a temporary file next to
+// dest and only renames it over dest once complete and, if asked for,
+// verified: a failed restore leaves an existing dest untouched.
+func (snapshot *Snapshot) restoreFile(fetcher *chunkFetcher, object *objects.Object, dest string, verify bool) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	err = snapshot.writeObject(fetcher, object, f)
+	if err == nil && verify {
+		err = snapshot.verifyFile(object, tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+			logger.Warn("failed to remove partial file %s: %s", tmp, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// writeObject writes the content of object to f, syncs and closes it
+func (snapshot *Snapshot) writeObject(fetcher *chunkFetcher, object *objects.Object, f *os.File) error {
+	defer f.Close()
+
+	chunksLengths := make([]uint32, 0, len(object.Chunks))
+	for _, chunkChecksum := range object.Chunks {
+		chunk := snapshot.Index.LookupChunk(chunkChecksum)
+		if chunk == nil {
+			return fmt.Errorf("unlisted chunk %064x", chunkChecksum)
+		}
+		chunksLengths = append(chunksLengths, chunk.Length)
+	}
+
+	segments, size, err := objectLayout(object, chunksLengths)
+	if err != nil {
+		return err
+	}
+
+	objectHasher := encryption.GetHasher(snapshot.repository.Configuration().Hashing)
+	var data []byte
+	currentChunk := -1
+	for _, segment := range segments {
+		// holes are skipped over so the filesystem leaves them unallocated
+		if segment.Hole {
+			if err := writeZeros(objectHasher, segment.Length); err != nil {
+				return err
+			}
+			if _, err := f.Seek(segment.Length, io.SeekCurrent); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if segment.ChunkIndex != currentChunk {
+			chunkChecksum := object.Chunks[segment.ChunkIndex]
+			data, err = fetcher.GetChunk(chunkChecksum)
+			if err != nil {
+				return fmt.Errorf("failed to obtain chunk %064x: %s", chunkChecksum, err)
+			}
+
+			if len(data) != int(chunksLengths[segment.ChunkIndex]) {
+				return fmt.Errorf("chunk length mismatch: got=%d, expected=%d", len(data), int(chunksLengths[segment.ChunkIndex]))
+			}
+
+			chunkHasher := encryption.GetHasher(snapshot.repository.Configuration().Hashing)
+			chunkHasher.Write(data)
+			if !bytes.Equal(chunkChecksum[:], chunkHasher.Sum(nil)) {
+				return fmt.Errorf("chunk checksums mismatch: got=%064x, expected=%064x", chunkHasher.Sum(nil), chunkChecksum[:])
+			}
+			currentChunk = segment.ChunkIndex
+		}
+
+		piece := data[segment.ChunkOffset : segment.ChunkOffset+segment.Length]
+		objectHasher.Write(piece)
+		if _, err := f.Write(piece); err != nil {
+			return err
+		}
+	}
+
+	// a trailing hole is only materialized by setting the file size
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(object.Checksum[:], objectHasher.Sum(nil)) {
+		return fmt.Errorf("object checksum mismatches: got=%064x, expected=%064x", objectHasher.Sum(nil), object.Checksum[:])
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// verifyFile re-reads a restored file from disk and checks it hashes to
+// the checksum of the object it was restored from.
+func (snapshot *Snapshot) verifyFile(object *objects.Object, dest string) error {
+	f, err := os.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher := encryption.GetHasher(snapshot.repository.Configuration().Hashing)
+	if _, err := io.Copy(hasher, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(object.Checksum[:], hasher.Sum(nil)) {
+		return fmt.Errorf("restored file checksum mismatches: got=%064x, expected=%064x", hasher.Sum(nil), object.Checksum[:])
+	}
+	return nil
+}
+
+func (snapshot *Snapshot) lookupObjectForPathname(pathname string) *objects.Object {
+	hasher := encryption.GetHasher(snapshot.repository.Configuration().Hashing)
+	hasher.Write([]byte(pathname))
+	pathnameChecksum := hasher.Sum(nil)
+	key := [32]byte{}
+	copy(key[:], pathnameChecksum)
+	return snapshot.Index.LookupObjectForPathnameChecksum(key)
 }
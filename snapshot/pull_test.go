@@ -0,0 +1,127 @@
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPull(t *testing.T) {
+	repository := createRepository(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt":     "alpha",
+		"b.txt":     "bravo",
+		"sub/c.txt": "charlie",
+	})
+	snap := push(t, repository, dir)
+
+	root := t.TempDir()
+	report := snap.Pull(root, dir, &PullOptions{Rebase: true, Verify: true})
+	if report.HasFailures() || len(report.Skipped) != 0 {
+		t.Fatalf("unexpected failures %+v, skipped %+v", report.Failed, report.Skipped)
+	}
+
+	expected := []string{
+		filepath.Join(dir, "a.txt"),
+		filepath.Join(dir, "b.txt"),
+		filepath.Join(dir, "sub", "c.txt"),
+	}
+	if !reflect.DeepEqual(report.Restored, expected) {
+		t.Errorf("expected %v to be restored, got %v", expected, report.Restored)
+	}
+	if report.Snapshot != snap.Header.GetIndexID().String() || report.Root != root {
+		t.Errorf("unexpected report for %s in %s", report.Snapshot, report.Root)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "sub", "c.txt")); err != nil || string(data) != "charlie" {
+		t.Errorf("unexpected content %q: %v", data, err)
+	}
+}
+
+func TestPullFailure(t *testing.T) {
+	repository := createRepository(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "alpha",
+		"b.txt": "bravo",
+	})
+	snap := push(t, repository, dir)
+
+	// a directory where a file is restored makes that file fail, it is
+	// not the restore's to remove
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "a.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	report := snap.Pull(root, dir, &PullOptions{Rebase: true})
+	if !report.HasFailures() || len(report.Failed) != 1 || report.Failed[0].Pathname != filepath.Join(dir, "a.txt") || report.Failed[0].Error == "" {
+		t.Fatalf("expected a.txt to fail, got %+v", report.Failed)
+	}
+	if len(report.Restored) != 1 || report.Restored[0] != filepath.Join(dir, "b.txt") {
+		t.Errorf("expected b.txt to be restored, got %v", report.Restored)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "a.txt")); err != nil || !fi.IsDir() {
+		t.Errorf("expected the existing directory to be left alone: %v", err)
+	}
+}
+
+func TestPullMissingChunk(t *testing.T) {
+	repository := createRepository(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "alpha",
+	})
+	snap := push(t, repository, dir)
+
+	packfiles, err := repository.GetPackfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, packfile := range packfiles {
+		if err := repository.DeletePackfile(packfile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the file already there is only replaced by a complete restore
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "previous content"})
+
+	report := snap.Pull(root, dir, &PullOptions{Rebase: true})
+	if len(report.Failed) != 1 || report.Failed[0].Pathname != filepath.Join(dir, "a.txt") {
+		t.Fatalf("expected a.txt to fail, got %+v", report.Failed)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "a.txt")); err != nil || string(data) != "previous content" {
+		t.Errorf("expected the existing file to be left alone, got %q: %v", data, err)
+	}
+	if entries, err := os.ReadDir(root); err != nil || len(entries) != 1 {
+		t.Errorf("expected no temporary file left behind, got %v: %v", entries, err)
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	repository := createRepository(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "alpha",
+	})
+	snap := push(t, repository, dir)
+
+	object := snap.lookupObjectForPathname(filepath.Join(dir, "a.txt"))
+	if object == nil {
+		t.Fatal("expected an object for a.txt")
+	}
+
+	restored := filepath.Join(t.TempDir(), "a.txt")
+	writeFiles(t, filepath.Dir(restored), map[string]string{"a.txt": "alpha"})
+	if err := snap.verifyFile(object, restored); err != nil {
+		t.Errorf("expected the file to verify: %v", err)
+	}
+
+	writeFiles(t, filepath.Dir(restored), map[string]string{"a.txt": "alpha, altered"})
+	if err := snap.verifyFile(object, restored); err == nil {
+		t.Error("expected an altered file to fail verification")
+	}
+}
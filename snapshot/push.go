@@ -19,6 +19,7 @@ import (
 	"github.com/PlakarLabs/plakar/logger"
 	"github.com/PlakarLabs/plakar/objects"
 	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/PlakarLabs/plakar/vfs/importer"
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/gobwas/glob"
 )
@@ -26,6 +27,12 @@ import (
 type PushOptions struct {
 	MaxConcurrency uint64
 	Excludes       []glob.Glob
+
+	// Strict fails the push instead of committing a snapshot with errors
+	Strict bool
+
+	// Importer tunes how the importer walks the source
+	Importer importer.Options
 }
 
 func pathnameCached(snapshot *Snapshot, fi vfs.FileInfo, pathname string) (*objects.Object, error) {
@@ -40,7 +47,7 @@ func pathnameCached(snapshot *Snapshot, fi vfs.FileInfo, pathname string) (*obje
 		return nil, nil
 	}
 
-	if cachedObject.Info.Mode() != fi.Mode() || cachedObject.Info.Dev() != fi.Dev() || cachedObject.Info.Size() != fi.Size() || cachedObject.Info.ModTime() != fi.ModTime() {
+	if cachedObject.Info.Mode() != fi.Mode() || cachedObject.Info.Dev() != fi.Dev() || cachedObject.Info.Size() != fi.Size() || !cachedObject.Info.ModTime().Equal(fi.ModTime()) {
 		return nil, nil
 	}
 
@@ -51,6 +58,7 @@ func pathnameCached(snapshot *Snapshot, fi vfs.FileInfo, pathname string) (*obje
 		object.Chunks = append(object.Chunks, chunk.Checksum)
 	}
 	object.ContentType = cachedObject.ContentType
+	object.Holes = cachedObject.Holes
 
 	for offset := range object.Chunks {
 		chunk := cachedObject.Chunks[offset]
@@ -74,7 +82,8 @@ func chunkify(snapshot *Snapshot, pathname string, fi *vfs.FileInfo) (*objects.O
 	object.ContentType = mime.TypeByExtension(filepath.Ext(pathname))
 	objectHasher := encryption.GetHasher(snapshot.repository.Configuration().Hashing)
 
-	if fi.Size() < int64(snapshot.repository.Configuration().ChunkingMin) {
+	// streams of unknown size are always chunked, they may be large
+	if fi.Size() >= 0 && fi.Size() < int64(snapshot.repository.Configuration().ChunkingMin) {
 		var t32 [32]byte
 
 		buf, err := io.ReadAll(rd)
@@ -115,7 +124,23 @@ func chunkify(snapshot *Snapshot, pathname string, fi *vfs.FileInfo) (*objects.O
 	chunkingNormalSize := snapshot.repository.Configuration().ChunkingNormal
 	chunkingMaxSize := snapshot.repository.Configuration().ChunkingMax
 
-	chk, err := chunkers.NewChunker(chunkingAlgorithm, rd, &chunkers.ChunkerOpts{
+	// sparse files are chunked without their holes, which are recorded
+	// in the object and replayed as zeros when computing its checksum
+	var dataRd io.Reader = rd
+	var fileHoles []objects.Hole
+	if fp, ok := rd.(*os.File); ok {
+		fileHoles, err = detectHoles(fp, fi.Size())
+		if err != nil {
+			return nil, err
+		}
+		if len(fileHoles) != 0 {
+			dataRd = newDataReader(fp, fileHoles, fi.Size())
+		}
+	}
+	mapper := newHoleMapper(fileHoles)
+	holes := make([]objects.Hole, 0)
+
+	chk, err := chunkers.NewChunker(chunkingAlgorithm, dataRd, &chunkers.ChunkerOpts{
 		MinSize:    chunkingMinSize,
 		NormalSize: chunkingNormalSize,
 		MaxSize:    chunkingMaxSize,
@@ -142,7 +167,30 @@ func chunkify(snapshot *Snapshot, pathname string, fi *vfs.FileInfo) (*objects.O
 				firstChunk = false
 			}
 
-			objectHasher.Write(cdcChunk)
+			zeroChunk := isZero(cdcChunk)
+			merr := mapper.Advance(int64(len(cdcChunk)), func(extent objects.Hole, isHole bool, dataOffset int64) error {
+				if isHole {
+					holes = append(holes, extent)
+					return writeZeros(objectHasher, extent.Length)
+				}
+				if zeroChunk {
+					holes = append(holes, extent)
+				}
+				_, err := objectHasher.Write(cdcChunk[dataOffset : dataOffset+extent.Length])
+				return err
+			})
+			if merr != nil {
+				return nil, merr
+			}
+			cdcOffset += uint64(len(cdcChunk))
+
+			// all-zero chunks are recorded as holes and never stored
+			if zeroChunk {
+				if err == io.EOF {
+					break
+				}
+				continue
+			}
 
 			if !firstChunk {
 				chunkHasher.Reset()
@@ -156,7 +204,6 @@ func chunkify(snapshot *Snapshot, pathname string, fi *vfs.FileInfo) (*objects.O
 			chunk.Checksum = t32
 			chunk.Length = uint32(len(cdcChunk))
 			object.Chunks = append(object.Chunks, chunk.Checksum)
-			cdcOffset += uint64(len(cdcChunk))
 
 			indexChunk := snapshot.Index.LookupChunk(chunk.Checksum)
 			if indexChunk == nil {
@@ -176,6 +223,24 @@ func chunkify(snapshot *Snapshot, pathname string, fi *vfs.FileInfo) (*objects.O
 		}
 
 	}
+
+	_, err = mapper.Finish(func(extent objects.Hole, isHole bool, dataOffset int64) error {
+		holes = append(holes, extent)
+		return writeZeros(objectHasher, extent.Length)
+	})
+	if err != nil {
+		return nil, err
+	}
+	object.Holes = mergeHoles(holes)
+
+	// fi is the caller's copy of the inode, it is updated as well
+	if fi.Size() < 0 {
+		fi.Lsize = int64(cdcOffset)
+		if err := snapshot.Filesystem.SetSize(pathname, fi.Lsize); err != nil {
+			return nil, err
+		}
+	}
+
 	var t32 [32]byte
 	copy(t32[:], objectHasher.Sum(nil))
 	object.Checksum = t32
@@ -233,9 +298,14 @@ func (snapshot *Snapshot) Push(scanDir string, options *PushOptions) error {
 
 	snapshot.Header.ScannedDirectories = make([]string, 0)
 
-	fs, err := vfs.NewFilesystemFromScan(snapshot.repository.Location, scanDir, options.Excludes)
+	var state importer.StateStore
+	if cache != nil {
+		state = importerState{snapshot: snapshot}
+	}
+
+	fs, err := vfs.NewFilesystemFromScan(snapshot.repository.Location, scanDir, options.Excludes, &options.Importer, state)
 	if err != nil {
-		logger.Warn("%s", err)
+		return err
 	}
 	snapshot.Filesystem = fs
 
@@ -248,7 +318,13 @@ func (snapshot *Snapshot) Push(scanDir string, options *PushOptions) error {
 	}
 	snapshot.Header.ScannedDirectories = append(snapshot.Header.ScannedDirectories, filepath.ToSlash(scanDir))
 
-	for _, filename := range snapshot.Filesystem.ListFiles() {
+	filenames := snapshot.Filesystem.ListFiles()
+	if snapshot.Filesystem.ImporterOrder(filenames) {
+		// sequential importers start over when opened out of order
+		maxConcurrency = make(chan struct{}, 1)
+	}
+
+	for _, filename := range filenames {
 		maxConcurrency <- struct{}{}
 		wg.Add(1)
 		go func(_filename string) {
@@ -258,9 +334,13 @@ func (snapshot *Snapshot) Push(scanDir string, options *PushOptions) error {
 			fileinfo, exists := snapshot.Filesystem.LookupInodeForFile(_filename)
 			if !exists {
 				logger.Warn("%s: failed to find file informations", _filename)
+				snapshot.Filesystem.RecordError(_filename, os.ErrNotExist)
 				return
 			}
-			atomic.AddUint64(&snapshot.Header.ScanSize, uint64(fileinfo.Size()))
+			sizeKnown := fileinfo.Size() >= 0
+			if sizeKnown {
+				atomic.AddUint64(&snapshot.Header.ScanSize, uint64(fileinfo.Size()))
+			}
 
 			var object *objects.Object
 			object, err := pathnameCached(snapshot, *fileinfo, _filename)
@@ -279,6 +359,7 @@ func (snapshot *Snapshot) Push(scanDir string, options *PushOptions) error {
 				object, err = chunkify(snapshot, _filename, fileinfo)
 				if err != nil {
 					logger.Warn("%s: could not chunkify: %s", _filename, err)
+					snapshot.Filesystem.RecordError(_filename, err)
 					return
 				}
 				if cache != nil {
@@ -291,12 +372,16 @@ func (snapshot *Snapshot) Push(scanDir string, options *PushOptions) error {
 						err := snapshot.PutObject(object)
 						if err != nil {
 							logger.Warn("%s: failed to store object: %s", _filename, err)
+							snapshot.Filesystem.RecordError(_filename, err)
 							return
 						}
 						atomic.AddUint64(&snapshot.Header.ObjectsTransferCount, uint64(1))
 					}
 				}
 			}
+			if !sizeKnown {
+				atomic.AddUint64(&snapshot.Header.ScanSize, uint64(fileinfo.Size()))
+			}
 			snapshot.Index.AddObject(object)
 			snapshot.Metadata.AddMetadata(object.ContentType, object.Checksum)
 
@@ -313,6 +398,11 @@ func (snapshot *Snapshot) Push(scanDir string, options *PushOptions) error {
 	wg.Wait()
 	snapshot.Filesystem.ImporterEnd()
 
+	snapshot.Header.ErrorsCount = snapshot.Filesystem.NErrors()
+	if options.Strict && snapshot.Header.ErrorsCount != 0 {
+		return fmt.Errorf("%d pathnames could not be saved", snapshot.Header.ErrorsCount)
+	}
+
 	snapshot.Header.ChunksCount = uint64(len(snapshot.Index.ListChunks()))
 	snapshot.Header.ObjectsCount = uint64(len(snapshot.Index.ListObjects()))
 	snapshot.Header.FilesCount = uint64(len(snapshot.Filesystem.ListFiles()))
@@ -0,0 +1,184 @@
+package snapshot
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PlakarLabs/plakar/cache"
+	_ "github.com/PlakarLabs/plakar/vfs/importer/archive"
+	_ "github.com/PlakarLabs/plakar/vfs/importer/stdin"
+	"github.com/gobwas/glob"
+	"github.com/google/uuid"
+)
+
+func TestPushBeginError(t *testing.T) {
+	repository := createRepository(t)
+	defer repository.Close()
+
+	snap, err := New(repository, uuid.Must(uuid.NewRandom()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the importer cannot begin, the push fails rather than go on without
+	// a filesystem
+	location := "tar://" + filepath.Join(t.TempDir(), "missing.tar")
+	if err := snap.Push(location, &PushOptions{MaxConcurrency: 4}); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the importer error, got %v", err)
+	}
+	if locks, err := repository.GetLocks(); err != nil || len(locks) != 0 {
+		t.Errorf("expected the failed push to release its lock, got %v: %v", locks, err)
+	}
+	if snapshots, err := List(repository); err != nil || len(snapshots) != 0 {
+		t.Errorf("expected no snapshot, got %v: %v", snapshots, err)
+	}
+}
+
+func TestPushStdin(t *testing.T) {
+	repository := createRepository(t)
+	defer repository.Close()
+
+	localCache := cache.New(t.TempDir())
+	if localCache == nil {
+		t.Fatal("could not open the cache")
+	}
+	defer localCache.Commit()
+	repository.SetCache(localCache)
+
+	data := bytes.Repeat([]byte("plakar"), 100000)
+	stdin := filepath.Join(t.TempDir(), "stdin")
+	if err := os.WriteFile(stdin, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := os.Open(stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	saved := os.Stdin
+	os.Stdin = fp
+	defer func() { os.Stdin = saved }()
+
+	snap, err := New(repository, uuid.Must(uuid.NewRandom()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Push("stdin://dump.sql", &PushOptions{MaxConcurrency: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the size is only known once stdin has been read
+	size := uint64(len(data))
+	if snap.Header.ScanSize != size || snap.Header.ScanProcessedSize != size {
+		t.Errorf("expected sizes of %d, got %d scanned and %d processed", size, snap.Header.ScanSize, snap.Header.ScanProcessedSize)
+	}
+	if fileinfo, exists := snap.Filesystem.LookupInodeForFile("/dump.sql"); !exists || fileinfo.Size() != int64(size) {
+		t.Errorf("unexpected inode %+v", fileinfo)
+	}
+
+	cached, err := snap.GetCachedObject("/dump.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.Info.Size() != int64(size) {
+		t.Errorf("expected the cache to record a size of %d, got %d", size, cached.Info.Size())
+	}
+}
+
+func TestPushErrors(t *testing.T) {
+	repository := createRepository(t)
+	defer repository.Close()
+
+	// a member whose content no longer matches its checksum can't be read
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{"ok.txt": "readable", "bad.txt": "unreadable"} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := bytes.Replace(buf.Bytes(), []byte("unreadable"), []byte("UNREADABLE"), 1)
+	location := filepath.Join(t.TempDir(), "archive.zip")
+	if err := os.WriteFile(location, archive, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := New(repository, uuid.Must(uuid.NewRandom()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Push("zip://"+location, &PushOptions{MaxConcurrency: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the error is counted in the header and kept with the filesystem
+	snap, err = Load(repository, snap.Header.IndexID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Header.ErrorsCount != 1 {
+		t.Errorf("expected 1 error, got %d", snap.Header.ErrorsCount)
+	}
+	entries := snap.Filesystem.ListErrors()
+	if len(entries) != 1 || entries[0].Pathname != "/bad.txt" || !strings.Contains(entries[0].Error, zip.ErrChecksum.Error()) {
+		t.Errorf("unexpected errors %+v", entries)
+	}
+	if ok, err := snap.Check("/ok.txt", false); err != nil || !ok {
+		t.Errorf("expected ok.txt to be saved: %v", err)
+	}
+
+	// strict pushes fail and commit nothing
+	snap, err = New(repository, uuid.Must(uuid.NewRandom()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Push("zip://"+location, &PushOptions{MaxConcurrency: 4, Strict: true}); err == nil {
+		t.Error("expected a strict push to fail")
+	}
+	if snapshots, err := List(repository); err != nil || len(snapshots) != 1 {
+		t.Errorf("expected the strict push not to commit, got %v: %v", snapshots, err)
+	}
+}
+
+func TestPushExcludedDirectory(t *testing.T) {
+	repository := createRepository(t)
+	defer repository.Close()
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"kept.txt":           "kept\n",
+		"excluded/file.txt":  "excluded\n",
+		"excluded/sub/a.txt": "excluded\n",
+	})
+
+	snap, err := New(repository, uuid.Must(uuid.NewRandom()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the content of an excluded directory is excluded with it
+	excludes := []glob.Glob{glob.MustCompile(filepath.Join(dir, "excluded"))}
+	if err := snap.Push(dir, &PushOptions{MaxConcurrency: 4, Excludes: excludes}); err != nil {
+		t.Fatal(err)
+	}
+	snap, err = Load(repository, snap.Header.IndexID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := snap.Filesystem.ListFiles(); len(files) != 1 || files[0] != filepath.Join(dir, "kept.txt") {
+		t.Errorf("unexpected files %v", files)
+	}
+	if _, exists := snap.Filesystem.LookupInode(filepath.Join(dir, "excluded")); exists {
+		t.Error("expected the excluded directory to be left out")
+	}
+}
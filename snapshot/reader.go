@@ -1,10 +1,10 @@
 package snapshot
 
 import (
-	"bytes"
 	"io"
 	"os"
 	"path"
+	"sort"
 
 	"github.com/PlakarLabs/plakar/encryption"
 	"github.com/PlakarLabs/plakar/objects"
@@ -13,11 +13,13 @@ import (
 type Reader struct {
 	snapshot *Snapshot
 	object   *objects.Object
-	obuf     *bytes.Buffer
+	segments []layoutSegment
 
-	chunksLengths []uint32
-	offset        int64
-	size          int64
+	chunkIndex int
+	chunkData  []byte
+
+	offset int64
+	size   int64
 }
 
 func (reader *Reader) GetContentType() string {
@@ -25,51 +27,49 @@ func (reader *Reader) GetContentType() string {
 }
 
 func (reader *Reader) Read(buf []byte) (int, error) {
-	if reader.offset == reader.size {
+	if reader.offset >= reader.size {
 		return 0, io.EOF
 	}
 
-	readSize := uint(len(buf))
-	chunkStart := int64(0)
-	for chunkOffset, chunkLength := range reader.chunksLengths {
-		// reader offset is past this chunk, skip
-		if reader.offset > chunkStart+int64(chunkLength) {
-			chunkStart += int64(chunkLength)
-			continue
+	// find the segment holding the current offset
+	idx := sort.Search(len(reader.segments), func(i int) bool {
+		return reader.segments[i].Offset+reader.segments[i].Length > reader.offset
+	})
+
+	nbytes := 0
+	for nbytes < len(buf) && idx < len(reader.segments) {
+		segment := reader.segments[idx]
+		within := reader.offset - segment.Offset
+		available := segment.Length - within
+		if available > int64(len(buf)-nbytes) {
+			available = int64(len(buf) - nbytes)
 		}
 
-		// we have data to read from this chunk, fetch content
-		data, err := reader.snapshot.GetChunk(reader.object.Chunks[chunkOffset])
-		if err != nil {
-			return -1, err
+		if segment.Hole {
+			for i := int64(0); i < available; i++ {
+				buf[nbytes+int(i)] = 0
+			}
+		} else {
+			if reader.chunkData == nil || reader.chunkIndex != segment.ChunkIndex {
+				data, err := reader.snapshot.GetChunk(reader.object.Chunks[segment.ChunkIndex])
+				if err != nil {
+					return nbytes, err
+				}
+				reader.chunkIndex = segment.ChunkIndex
+				reader.chunkData = data
+			}
+			beg := segment.ChunkOffset + within
+			copy(buf[nbytes:], reader.chunkData[beg:beg+available])
 		}
 
-		// compute how much we can read from this one
-		endOffset := chunkStart + int64(chunkLength)
-		available := endOffset - int64(reader.offset)
-		chunkStart += int64(chunkLength)
-
-		// find beginning and ending offsets in current chunk
-		beg := int64(chunkLength) - available
-		end := beg + available
-		if available >= int64(readSize) {
-			end = beg + int64(readSize)
-		}
-
-		nbytes, err := reader.obuf.Write(data[beg:end])
-		if err != nil {
-			return -1, err
-		}
-
-		// update offset and remaining buffer capacity, possibly exiting loop
-		reader.offset += int64(nbytes)
-		readSize -= uint(nbytes)
-		if reader.offset == reader.size || readSize == 0 {
-			break
+		nbytes += int(available)
+		reader.offset += available
+		if within+available == segment.Length {
+			idx++
 		}
 	}
 
-	return reader.obuf.Read(buf)
+	return nbytes, nil
 }
 
 func (reader *Reader) Seek(offset int64, whence int) (int64, error) {
@@ -111,17 +111,25 @@ func NewReader(snapshot *Snapshot, pathname string) (*Reader, error) {
 	if object == nil {
 		return nil, os.ErrNotExist
 	}
+	return newObjectReader(snapshot, object)
+}
 
+// newObjectReader reads the content of an object as laid out in the
+// snapshot, holes included
+func newObjectReader(snapshot *Snapshot, object *objects.Object) (*Reader, error) {
 	chunksLengths := make([]uint32, 0)
-	size := int64(0)
 	for _, chunkChecksum := range object.Chunks {
 		chunkLength, exists := snapshot.Index.GetChunkLength(chunkChecksum)
 		if !exists {
 			return nil, os.ErrNotExist
 		}
 		chunksLengths = append(chunksLengths, chunkLength)
-		size += int64(chunkLength)
 	}
 
-	return &Reader{snapshot: snapshot, object: object, chunksLengths: chunksLengths, obuf: bytes.NewBuffer([]byte("")), offset: 0, size: size}, nil
+	segments, size, err := objectLayout(object, chunksLengths)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{snapshot: snapshot, object: object, segments: segments, chunkIndex: -1, offset: 0, size: size}, nil
 }
@@ -451,7 +451,7 @@ func GetFilesystem(repository *storage.Repository, checksum [32]byte) (*vfs.File
 		return nil, [32]byte{}, err
 	}
 
-	filesystem, err := vfs.NewFilesystemFromBytes(buffer)
+	filesystem, err := vfs.NewFilesystemFromBytes(buffer, blobStore{repository: repository})
 	if err != nil {
 		return nil, [32]byte{}, err
 	}
@@ -626,7 +626,7 @@ func (snapshot *Snapshot) PutPackfile(pack *packfile.PackFile, objects [][32]byt
 	logger.Trace("snapshot", "%s: PutPackfile(%016x, ...)", snapshot.Header.GetIndexShortID(), checksum32)
 	err = snapshot.repository.PutPackfile(checksum32, serializedPackfile)
 	if err != nil {
-		panic("could not write pack file")
+		return err
 	}
 
 	for _, chunkChecksum := range chunks {
@@ -784,6 +784,50 @@ func (snapshot *Snapshot) GetChunk(checksum [32]byte) ([]byte, error) {
 		return nil, err
 	}
 
+	return snapshot.decodeChunk(buffer)
+}
+
+// GetChunkBatch returns the decoded chunks in the order they are listed,
+// fetching those of a same packfile in a single request.
+func (snapshot *Snapshot) GetChunkBatch(checksums [][32]byte) ([][]byte, error) {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("snapshot.GetChunkBatch", time.Since(t0))
+	}()
+	logger.Trace("snapshot", "%s: GetChunkBatch(%d)", snapshot.Header.GetIndexShortID(), len(checksums))
+
+	packfiles := make([][32]byte, 0)
+	subparts := make(map[[32]byte][]storage.Subpart)
+	positions := make(map[[32]byte][]int)
+	for i, checksum := range checksums {
+		packfileChecksum, offset, length, exists := snapshot.Repository().GetRepositoryIndex().GetSubpartForChunk(checksum)
+		if !exists {
+			return nil, fmt.Errorf("packfile not found")
+		}
+		if _, exists := subparts[packfileChecksum]; !exists {
+			packfiles = append(packfiles, packfileChecksum)
+		}
+		subparts[packfileChecksum] = append(subparts[packfileChecksum], storage.Subpart{Offset: offset, Length: length})
+		positions[packfileChecksum] = append(positions[packfileChecksum], i)
+	}
+
+	chunks := make([][]byte, len(checksums))
+	for _, packfileChecksum := range packfiles {
+		buffers, err := snapshot.repository.GetPackfileSubpartBatch(packfileChecksum, subparts[packfileChecksum])
+		if err != nil {
+			return nil, err
+		}
+		for i, buffer := range buffers {
+			chunks[positions[packfileChecksum][i]], err = snapshot.decodeChunk(buffer)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return chunks, nil
+}
+
+func (snapshot *Snapshot) decodeChunk(buffer []byte) ([]byte, error) {
 	repository := snapshot.repository
 
 	secret := repository.GetSecret()
@@ -985,7 +1029,7 @@ func (snapshot *Snapshot) Commit() error {
 		defer wg.Done()
 
 		var err error
-		serializedFilesystem, err = snapshot.Filesystem.Serialize()
+		serializedFilesystem, err = snapshot.Filesystem.Store(blobStore{repository: snapshot.repository, snapshot: snapshot})
 		if err != nil {
 			errc <- err
 			return
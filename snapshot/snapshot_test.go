@@ -0,0 +1,70 @@
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/storage"
+	_ "github.com/PlakarLabs/plakar/storage/backends/fs"
+	"github.com/PlakarLabs/plakar/storage/index"
+	_ "github.com/PlakarLabs/plakar/vfs/importer/fs"
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	// pushes, pulls and checks log their progress
+	logger.Start()
+	os.Exit(m.Run())
+}
+
+func createRepository(t *testing.T) *storage.Repository {
+	repository, err := storage.Create(filepath.Join(t.TempDir(), "repository"), storage.RepositoryConfig{
+		Version:        storage.VERSION,
+		RepositoryID:   uuid.Must(uuid.NewRandom()),
+		CreationTime:   time.Now(),
+		Hashing:        "sha256",
+		Chunking:       "fastcdc",
+		ChunkingMin:    64 << 10,
+		ChunkingNormal: 1 << 20,
+		ChunkingMax:    8 << 20,
+		PackfileSize:   20 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the repository is empty, its index starts empty as well
+	repository.SetRepositoryIndex(index.New())
+	return repository
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		pathname := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(pathname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(pathname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// push snapshots dir and returns the snapshot as loaded from the repository
+func push(t *testing.T, repository *storage.Repository, dir string) *Snapshot {
+	snap, err := New(repository, uuid.Must(uuid.NewRandom()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Push(dir, &PushOptions{MaxConcurrency: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err = Load(repository, snap.Header.IndexID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snap
+}
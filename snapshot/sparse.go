@@ -0,0 +1,201 @@
+package snapshot
+
+import (
+	"io"
+	"os"
+
+	"github.com/PlakarLabs/plakar/objects"
+)
+
+// holeMapper walks the logical layout of a sparse file: data is consumed
+// in the order it appears in chunks, and holes are emitted whenever the
+// logical offset reaches one.
+type holeMapper struct {
+	holes   []objects.Hole
+	next    int
+	logical int64
+}
+
+func newHoleMapper(holes []objects.Hole) *holeMapper {
+	return &holeMapper{holes: holes}
+}
+
+// Advance consumes length bytes of data, calling fn for each hole and data
+// extent crossed in logical order. Data extents carry the offset relative
+// to the beginning of the consumed data.
+func (mapper *holeMapper) Advance(length int64, fn func(extent objects.Hole, isHole bool, dataOffset int64) error) error {
+	dataOffset := int64(0)
+	for {
+		if err := mapper.flushHoles(fn); err != nil {
+			return err
+		}
+		if length == 0 {
+			return nil
+		}
+
+		n := length
+		if mapper.next < len(mapper.holes) && mapper.logical+n > mapper.holes[mapper.next].Offset {
+			n = mapper.holes[mapper.next].Offset - mapper.logical
+		}
+		if err := fn(objects.Hole{Offset: mapper.logical, Length: n}, false, dataOffset); err != nil {
+			return err
+		}
+		mapper.logical += n
+		dataOffset += n
+		length -= n
+	}
+}
+
+// Finish emits the trailing holes, if any, and returns the logical size.
+func (mapper *holeMapper) Finish(fn func(extent objects.Hole, isHole bool, dataOffset int64) error) (int64, error) {
+	if err := mapper.flushHoles(fn); err != nil {
+		return 0, err
+	}
+	for ; mapper.next < len(mapper.holes); mapper.next++ {
+		hole := mapper.holes[mapper.next]
+		if err := fn(hole, true, 0); err != nil {
+			return 0, err
+		}
+		mapper.logical = hole.Offset + hole.Length
+	}
+	return mapper.logical, nil
+}
+
+func (mapper *holeMapper) flushHoles(fn func(extent objects.Hole, isHole bool, dataOffset int64) error) error {
+	for mapper.next < len(mapper.holes) && mapper.holes[mapper.next].Offset <= mapper.logical {
+		hole := mapper.holes[mapper.next]
+		if err := fn(hole, true, 0); err != nil {
+			return err
+		}
+		mapper.logical = hole.Offset + hole.Length
+		mapper.next++
+	}
+	return nil
+}
+
+// mergeHoles coalesces adjacent holes, it expects them sorted by offset.
+func mergeHoles(holes []objects.Hole) []objects.Hole {
+	if len(holes) == 0 {
+		return nil
+	}
+	ret := []objects.Hole{holes[0]}
+	for _, hole := range holes[1:] {
+		last := &ret[len(ret)-1]
+		if last.Offset+last.Length == hole.Offset {
+			last.Length += hole.Length
+		} else {
+			ret = append(ret, hole)
+		}
+	}
+	return ret
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// layoutSegment maps a logical area of an object either to a hole or to
+// a slice of one of its chunks.
+type layoutSegment struct {
+	Offset      int64
+	Length      int64
+	Hole        bool
+	ChunkIndex  int
+	ChunkOffset int64
+}
+
+// objectLayout returns the segments making up an object and its logical
+// size, given the length of each of its chunks.
+func objectLayout(object *objects.Object, chunksLengths []uint32) ([]layoutSegment, int64, error) {
+	segments := make([]layoutSegment, 0, len(chunksLengths)+len(object.Holes))
+	mapper := newHoleMapper(object.Holes)
+
+	chunkIndex := 0
+	emit := func(extent objects.Hole, isHole bool, dataOffset int64) error {
+		if extent.Length == 0 {
+			return nil
+		}
+		segments = append(segments, layoutSegment{
+			Offset:      extent.Offset,
+			Length:      extent.Length,
+			Hole:        isHole,
+			ChunkIndex:  chunkIndex,
+			ChunkOffset: dataOffset,
+		})
+		return nil
+	}
+
+	for i, length := range chunksLengths {
+		chunkIndex = i
+		if err := mapper.Advance(int64(length), emit); err != nil {
+			return nil, 0, err
+		}
+	}
+	size, err := mapper.Finish(emit)
+	if err != nil {
+		return nil, 0, err
+	}
+	return segments, size, nil
+}
+
+var zeroBuffer = make([]byte, 64<<10)
+
+func writeZeros(w io.Writer, length int64) error {
+	for length > 0 {
+		n := int64(len(zeroBuffer))
+		if length < n {
+			n = length
+		}
+		if _, err := w.Write(zeroBuffer[:n]); err != nil {
+			return err
+		}
+		length -= n
+	}
+	return nil
+}
+
+// dataReader reads the data areas of a sparse file, skipping its holes.
+type dataReader struct {
+	fp     *os.File
+	holes  []objects.Hole
+	next   int
+	offset int64
+	size   int64
+}
+
+func newDataReader(fp *os.File, holes []objects.Hole, size int64) *dataReader {
+	return &dataReader{fp: fp, holes: holes, size: size}
+}
+
+func (reader *dataReader) Read(buf []byte) (int, error) {
+	for reader.next < len(reader.holes) && reader.holes[reader.next].Offset <= reader.offset {
+		hole := reader.holes[reader.next]
+		if hole.Offset+hole.Length > reader.offset {
+			reader.offset = hole.Offset + hole.Length
+		}
+		reader.next++
+	}
+	if reader.offset >= reader.size {
+		return 0, io.EOF
+	}
+
+	limit := reader.size
+	if reader.next < len(reader.holes) {
+		limit = reader.holes[reader.next].Offset
+	}
+	if int64(len(buf)) > limit-reader.offset {
+		buf = buf[:limit-reader.offset]
+	}
+
+	n, err := reader.fp.ReadAt(buf, reader.offset)
+	reader.offset += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return n, err
+}
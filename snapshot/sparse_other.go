@@ -0,0 +1,14 @@
+//go:build !linux && !freebsd && !darwin
+// +build !linux,!freebsd,!darwin
+
+package snapshot
+
+import (
+	"os"
+
+	"github.com/PlakarLabs/plakar/objects"
+)
+
+func detectHoles(fp *os.File, size int64) ([]objects.Hole, error) {
+	return nil, nil
+}
@@ -0,0 +1,54 @@
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/PlakarLabs/plakar/objects"
+)
+
+func TestObjectLayout(t *testing.T) {
+	// 10 bytes of data, 20 bytes hole, 5 bytes data, trailing 15 bytes hole
+	// with a first chunk spanning the first hole
+	object := &objects.Object{
+		Chunks: [][32]byte{{1}, {2}},
+		Holes: []objects.Hole{
+			{Offset: 10, Length: 20},
+			{Offset: 35, Length: 15},
+		},
+	}
+
+	segments, size, err := objectLayout(object, []uint32{12, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 50 {
+		t.Fatalf("Expected size 50 but got %d", size)
+	}
+
+	expected := []layoutSegment{
+		{Offset: 0, Length: 10, ChunkIndex: 0, ChunkOffset: 0},
+		{Offset: 10, Length: 20, Hole: true, ChunkIndex: 0},
+		{Offset: 30, Length: 2, ChunkIndex: 0, ChunkOffset: 10},
+		{Offset: 32, Length: 3, ChunkIndex: 1, ChunkOffset: 0},
+		{Offset: 35, Length: 15, Hole: true, ChunkIndex: 1},
+	}
+	if len(segments) != len(expected) {
+		t.Fatalf("Expected %d segments but got %d: %v", len(expected), len(segments), segments)
+	}
+	for i := range expected {
+		if segments[i] != expected[i] {
+			t.Fatalf("segment %d: expected %v but got %v", i, expected[i], segments[i])
+		}
+	}
+}
+
+func TestMergeHoles(t *testing.T) {
+	holes := mergeHoles([]objects.Hole{
+		{Offset: 0, Length: 10},
+		{Offset: 10, Length: 5},
+		{Offset: 20, Length: 5},
+	})
+	if len(holes) != 2 || holes[0].Length != 15 || holes[1].Offset != 20 {
+		t.Fatalf("unexpected merge result: %v", holes)
+	}
+}
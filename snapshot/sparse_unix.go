@@ -0,0 +1,63 @@
+//go:build linux || freebsd || darwin
+// +build linux freebsd darwin
+
+package snapshot
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/PlakarLabs/plakar/objects"
+	"golang.org/x/sys/unix"
+)
+
+// detectHoles returns the holes of a sparse file using SEEK_DATA and
+// SEEK_HOLE, files that have all their blocks allocated are skipped.
+func detectHoles(fp *os.File, size int64) ([]objects.Hole, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); !ok || int64(stat.Blocks)*512 >= size {
+		return nil, nil
+	}
+
+	holes := make([]objects.Hole, 0)
+	offset := int64(0)
+	for offset < size {
+		data, err := fp.Seek(offset, unix.SEEK_DATA)
+		if err != nil {
+			if errors.Is(err, syscall.ENXIO) {
+				// no data past offset, the file ends with a hole
+				holes = append(holes, objects.Hole{Offset: offset, Length: size - offset})
+				break
+			}
+			if errors.Is(err, syscall.EINVAL) {
+				// filesystem does not support hole detection
+				holes = nil
+				break
+			}
+			return nil, err
+		}
+		if data >= size {
+			holes = append(holes, objects.Hole{Offset: offset, Length: size - offset})
+			break
+		}
+		if data > offset {
+			holes = append(holes, objects.Hole{Offset: offset, Length: data - offset})
+		}
+
+		hole, err := fp.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		offset = hole
+	}
+
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return holes, nil
+}
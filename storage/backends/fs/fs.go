@@ -217,6 +217,25 @@ func (repository *Repository) GetBlobs() ([][32]byte, error) {
 	return ret, nil
 }
 
+func (repository *Repository) Usage() (uint64, error) {
+	usage := uint64(0)
+	for _, pathname := range []string{repository.PathPackfiles(), repository.PathBlobs()} {
+		err := filepath.Walk(pathname, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				usage += uint64(info.Size())
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return usage, nil
+}
+
 func (repository *Repository) GetPackfiles() ([][32]byte, error) {
 	ret := make([][32]byte, 0)
 
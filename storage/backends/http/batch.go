@@ -0,0 +1,121 @@
+package http
+
+import (
+	"encoding/json"
+
+	"github.com/PlakarLabs/plakar/network"
+	"github.com/PlakarLabs/plakar/storage"
+)
+
+func (repository *Repository) CheckBlobBatch(checksums [][32]byte) ([]bool, error) {
+	if !network.HasCapability(repository.capabilities, network.CapabilityBatch) {
+		return nil, storage.ErrBatchUnsupported
+	}
+
+	exists := make([]bool, 0, len(checksums))
+	for start := 0; start < len(checksums); start += network.MaxBatchItems {
+		end := start + network.MaxBatchItems
+		if end > len(checksums) {
+			end = len(checksums)
+		}
+		r, err := repository.sendRequest("GET", repository.Repository, "/blobs/check", network.ReqCheckBlobBatch{
+			Checksums: checksums[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var resCheckBlobBatch network.ResCheckBlobBatch
+		err = json.NewDecoder(r.Body).Decode(&resCheckBlobBatch)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		exists = append(exists, resCheckBlobBatch.Exists...)
+	}
+	return exists, nil
+}
+
+func (repository *Repository) GetBlobBatch(checksums [][32]byte) ([][]byte, error) {
+	if !network.HasCapability(repository.capabilities, network.CapabilityBatch) {
+		return nil, storage.ErrBatchUnsupported
+	}
+
+	blobs := make([][]byte, 0, len(checksums))
+	for start := 0; start < len(checksums); start += network.MaxBatchItems {
+		end := start + network.MaxBatchItems
+		if end > len(checksums) {
+			end = len(checksums)
+		}
+		r, err := repository.sendRequest("GET", repository.Repository, "/blobs/fetch", network.ReqGetBlobBatch{
+			Checksums: checksums[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var resGetBlobBatch network.ResGetBlobBatch
+		err = json.NewDecoder(r.Body).Decode(&resGetBlobBatch)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, resGetBlobBatch.Data...)
+	}
+	return blobs, nil
+}
+
+func (repository *Repository) GetPackfileSubpartBatch(checksum [32]byte, subparts []storage.Subpart) ([][]byte, error) {
+	if !network.HasCapability(repository.capabilities, network.CapabilityBatch) {
+		return nil, storage.ErrBatchUnsupported
+	}
+
+	data := make([][]byte, 0, len(subparts))
+	for start := 0; start < len(subparts); start += network.MaxBatchItems {
+		end := start + network.MaxBatchItems
+		if end > len(subparts) {
+			end = len(subparts)
+		}
+		r, err := repository.sendRequest("GET", repository.Repository, "/packfile/subparts", network.ReqGetPackfileSubpartBatch{
+			Checksum: checksum,
+			Subparts: subparts[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var resGetPackfileSubpartBatch network.ResGetPackfileSubpartBatch
+		err = json.NewDecoder(r.Body).Decode(&resGetPackfileSubpartBatch)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, resGetPackfileSubpartBatch.Data...)
+	}
+	return data, nil
+}
+
+func (repository *Repository) ListPage(resource string, after [32]byte, limit int) ([][32]byte, bool, error) {
+	if !network.HasCapability(repository.capabilities, network.CapabilityBatch) {
+		return nil, false, storage.ErrBatchUnsupported
+	}
+
+	if limit > network.MaxBatchItems {
+		limit = network.MaxBatchItems
+	}
+	r, err := repository.sendRequest("GET", repository.Repository, "/list", network.ReqListPage{
+		Resource: resource,
+		After:    after,
+		Limit:    limit,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Body.Close()
+
+	var resListPage network.ResListPage
+	if err := json.NewDecoder(r.Body).Decode(&resListPage); err != nil {
+		return nil, false, err
+	}
+	return resListPage.Checksums, resListPage.More, nil
+}
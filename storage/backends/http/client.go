@@ -19,7 +19,11 @@ package http
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/PlakarLabs/plakar/network"
 	"github.com/PlakarLabs/plakar/storage"
@@ -29,6 +33,10 @@ import (
 type Repository struct {
 	config     storage.RepositoryConfig
 	Repository string
+	token      string
+	client     *http.Client
+
+	capabilities []string
 }
 
 func init() {
@@ -50,8 +58,24 @@ func (r *Repository) sendRequest(method string, url string, requestType string,
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	return client.Do(req)
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// requests refused by the server are answered with a plain text error
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		message, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s", strings.TrimSpace(string(message)))
+	}
+	return res, nil
 }
 
 func (repository *Repository) Create(location string, config storage.RepositoryConfig) error {
@@ -59,8 +83,30 @@ func (repository *Repository) Create(location string, config storage.RepositoryC
 }
 
 func (repository *Repository) Open(location string) error {
-	repository.Repository = location
-	r, err := repository.sendRequest("GET", location, "/", network.ReqOpen{
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	repository.token, err = network.ClientToken(parsed)
+	if err != nil {
+		return err
+	}
+
+	// https locations take the tls_* parameters of plakar:// ones
+	repository.client = &http.Client{}
+	if parsed.Scheme == "https" {
+		tlsConfig, err := network.ClientTLSConfig(parsed)
+		if err != nil {
+			return err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		repository.client.Transport = transport
+	}
+	parsed.RawQuery = ""
+	repository.Repository = strings.TrimSuffix(parsed.String(), "/")
+
+	r, err := repository.sendRequest("GET", repository.Repository, "/", network.ReqOpen{
 		Repository: "",
 	})
 	if err != nil {
@@ -76,6 +122,7 @@ func (repository *Repository) Open(location string) error {
 	}
 
 	repository.config = *resOpen.RepositoryConfig
+	repository.capabilities = resOpen.Capabilities
 	return nil
 }
 
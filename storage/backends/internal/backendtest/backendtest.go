@@ -0,0 +1,227 @@
+// Package backendtest holds the conformance tests of the backends storing
+// repositories with the layout of the fs backend on remote filesystems.
+package backendtest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PlakarLabs/plakar/snapshot"
+	"github.com/PlakarLabs/plakar/storage"
+	fsBackend "github.com/PlakarLabs/plakar/storage/backends/fs"
+	"github.com/PlakarLabs/plakar/storage/index"
+	_ "github.com/PlakarLabs/plakar/vfs/importer/fs"
+	"github.com/google/uuid"
+)
+
+// Config returns the configuration of a new repository
+func Config() storage.RepositoryConfig {
+	return storage.RepositoryConfig{
+		Version:        storage.VERSION,
+		RepositoryID:   uuid.Must(uuid.NewRandom()),
+		CreationTime:   time.Now(),
+		Hashing:        "sha256",
+		Chunking:       "fastcdc",
+		ChunkingMin:    64 << 10,
+		ChunkingNormal: 1 << 20,
+		ChunkingMax:    8 << 20,
+		PackfileSize:   20 << 20,
+	}
+}
+
+// TestBackend exercises a backend on a repository it creates at location,
+// which must be stored under root on the local filesystem
+func TestBackend(t *testing.T, newRepository func() storage.RepositoryBackend, location string, root string) {
+	config := Config()
+
+	repository := newRepository()
+	if err := repository.Create(location, config); err != nil {
+		t.Fatal(err)
+	}
+	defer repository.Close()
+
+	if err := newRepository().Create(location, config); err == nil {
+		t.Error("expected creating over an existing repository to fail")
+	}
+
+	blob := []byte("blob")
+	blobChecksum := sha256.Sum256(blob)
+	if exists, err := repository.CheckBlob(blobChecksum); err != nil || exists {
+		t.Fatalf("unexpected blob before it was put: %v %v", exists, err)
+	}
+	if err := repository.PutBlob(blobChecksum, blob); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := repository.CheckBlob(blobChecksum); err != nil || !exists {
+		t.Fatalf("expected the blob to exist: %v %v", exists, err)
+	}
+	if data, err := repository.GetBlob(blobChecksum); err != nil || !bytes.Equal(data, blob) {
+		t.Fatalf("unexpected blob %q: %v", data, err)
+	}
+
+	packfile := bytes.Repeat([]byte("0123456789"), 100000)
+	packfileChecksum := sha256.Sum256(packfile)
+	if err := repository.PutPackfile(packfileChecksum, packfile); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := repository.GetPackfile(packfileChecksum); err != nil || !bytes.Equal(data, packfile) {
+		t.Fatalf("unexpected packfile of %d bytes: %v", len(data), err)
+	}
+	if data, err := repository.GetPackfileSubpart(packfileChecksum, 123457, 30); err != nil || !bytes.Equal(data, packfile[123457:123487]) {
+		t.Fatalf("unexpected packfile subpart %q: %v", data, err)
+	}
+	if _, err := repository.GetPackfileSubpart(packfileChecksum, uint32(len(packfile))-10, 20); err == nil {
+		t.Error("expected a subpart past the end of the packfile to fail")
+	}
+
+	indexChecksum := sha256.Sum256([]byte("index"))
+	if err := repository.PutIndex(indexChecksum, []byte("index")); err != nil {
+		t.Fatal(err)
+	}
+
+	indexID := uuid.Must(uuid.NewRandom())
+	if err := repository.PutLock(indexID, []byte("lock")); err != nil {
+		t.Fatal(err)
+	}
+	if locks, err := repository.GetLocks(); err != nil || len(locks) != 1 || locks[0] != indexID {
+		t.Fatalf("unexpected locks %v: %v", locks, err)
+	}
+	if err := repository.Commit(indexID, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	// commits replace a snapshot left by an interrupted one
+	if err := repository.Commit(indexID, []byte("snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.DeleteLock(indexID); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := repository.GetSnapshot(indexID); err != nil || string(data) != "snapshot" {
+		t.Fatalf("unexpected snapshot %q: %v", data, err)
+	}
+	if entries, err := os.ReadDir(filepath.Join(root, "tmp")); err != nil || len(entries) != 0 {
+		t.Errorf("expected commits to leave no temporary file, got %v: %v", entries, err)
+	}
+
+	if usage, err := repository.(storage.UsageBackend).Usage(); err != nil || usage != uint64(len(blob)+len(packfile)) {
+		t.Errorf("unexpected usage %d: %v", usage, err)
+	}
+
+	// the layout is the one of the fs backend
+	local := fsBackend.NewRepository()
+	if err := local.Open(root); err != nil {
+		t.Fatal(err)
+	}
+	if local.Configuration().RepositoryID != config.RepositoryID {
+		t.Errorf("unexpected configuration %+v", local.Configuration())
+	}
+	if data, err := local.GetPackfile(packfileChecksum); err != nil || !bytes.Equal(data, packfile) {
+		t.Errorf("unexpected packfile of %d bytes: %v", len(data), err)
+	}
+	if snapshots, err := local.GetSnapshots(); err != nil || len(snapshots) != 1 || snapshots[0] != indexID {
+		t.Errorf("unexpected snapshots %v: %v", snapshots, err)
+	}
+	if indexes, err := local.GetIndexes(); err != nil || len(indexes) != 1 || indexes[0] != indexChecksum {
+		t.Errorf("unexpected indexes %v: %v", indexes, err)
+	}
+	if locks, err := local.GetLocks(); err != nil || len(locks) != 0 {
+		t.Errorf("unexpected locks %v: %v", locks, err)
+	}
+
+	if blobs, err := repository.GetBlobs(); err != nil || len(blobs) != 1 || blobs[0] != blobChecksum {
+		t.Fatalf("unexpected blobs %v: %v", blobs, err)
+	}
+	if err := repository.DeleteBlob(blobChecksum); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.DeletePackfile(packfileChecksum); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repository.GetPackfile(packfileChecksum); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a deleted packfile to be missing, got %v", err)
+	}
+	if err := repository.DeleteSnapshot(indexID); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots, err := repository.GetSnapshots(); err != nil || len(snapshots) != 0 {
+		t.Errorf("unexpected snapshots %v: %v", snapshots, err)
+	}
+	if entries, err := os.ReadDir(filepath.Join(root, "purge")); err != nil || len(entries) != 0 {
+		t.Errorf("expected deletions to leave nothing in purge, got %v: %v", entries, err)
+	}
+}
+
+// TestPushPull pushes a snapshot to a repository it creates at location and
+// reads it back from a new session
+func TestPushPull(t *testing.T, location string) {
+	repository, err := storage.Create(location, Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository.SetRepositoryIndex(index.New())
+
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("plakar over a remote filesystem\n"), 100000)
+	if err := os.WriteFile(filepath.Join(dir, "file"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := snapshot.New(repository, uuid.Must(uuid.NewRandom()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Push(dir, &snapshot.PushOptions{MaxConcurrency: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	repository, err = storage.Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repository.Close()
+
+	// chunks are located through the indexes of the repository
+	indexes, err := repository.GetIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repositoryIndex := index.New()
+	for _, indexChecksum := range indexes {
+		idx, err := snapshot.GetRepositoryIndex(repository, indexChecksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repositoryIndex.Merge(indexChecksum, idx)
+	}
+	repository.SetRepositoryIndex(repositoryIndex)
+
+	snapshots, err := snapshot.List(repository)
+	if err != nil || len(snapshots) != 1 || snapshots[0] != snap.Header.IndexID {
+		t.Fatalf("unexpected snapshots %v: %v", snapshots, err)
+	}
+	snap, err = snapshot.Load(repository, snapshots[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, err := snapshot.NewReader(snap, filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("unexpected content of %d bytes", len(data))
+	}
+}
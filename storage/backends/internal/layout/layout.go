@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package layout locates the files of a repository laid out as by the fs
+// backend, for the backends reaching it with slash-separated paths.
+package layout
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/google/uuid"
+)
+
+// Layout is embedded by backends to provide the pathnames under Root
+type Layout struct {
+	Root string
+}
+
+func (layout *Layout) PathTmp() string {
+	return path.Join(layout.Root, "tmp")
+}
+
+func (layout *Layout) PathPurge() string {
+	return path.Join(layout.Root, "purge")
+}
+
+func (layout *Layout) PathChunks() string {
+	return path.Join(layout.Root, "chunks")
+}
+
+func (layout *Layout) PathObjects() string {
+	return path.Join(layout.Root, "objects")
+}
+
+func (layout *Layout) PathBlobs() string {
+	return path.Join(layout.Root, "blobs")
+}
+
+func (layout *Layout) PathIndexes() string {
+	return path.Join(layout.Root, "indexes")
+}
+
+func (layout *Layout) PathPackfiles() string {
+	return path.Join(layout.Root, "packfiles")
+}
+
+func (layout *Layout) PathLocks() string {
+	return path.Join(layout.Root, "locks")
+}
+
+func (layout *Layout) PathSnapshots() string {
+	return path.Join(layout.Root, "snapshots")
+}
+
+func (layout *Layout) PathChunkBucket(checksum [32]byte) string {
+	return path.Join(layout.Root, "chunks", fmt.Sprintf("%02x", checksum[0]))
+}
+
+func (layout *Layout) PathObjectBucket(checksum [32]byte) string {
+	return path.Join(layout.Root, "objects", fmt.Sprintf("%02x", checksum[0]))
+}
+
+func (layout *Layout) PathBlobBucket(checksum [32]byte) string {
+	return path.Join(layout.Root, "blobs", fmt.Sprintf("%02x", checksum[0]))
+}
+
+func (layout *Layout) PathIndexBucket(checksum [32]byte) string {
+	return path.Join(layout.Root, "indexes", fmt.Sprintf("%02x", checksum[0]))
+}
+
+func (layout *Layout) PathPackfileBucket(checksum [32]byte) string {
+	return path.Join(layout.Root, "packfiles", fmt.Sprintf("%02x", checksum[0]))
+}
+
+func (layout *Layout) PathSnapshotBucket(indexID uuid.UUID) string {
+	return path.Join(layout.Root, "snapshots", indexID.String()[:2])
+}
+
+func (layout *Layout) PathChunk(checksum [32]byte) string {
+	return path.Join(layout.PathChunkBucket(checksum), fmt.Sprintf("%064x", checksum))
+}
+
+func (layout *Layout) PathObject(checksum [32]byte) string {
+	return path.Join(layout.PathObjectBucket(checksum), fmt.Sprintf("%064x", checksum))
+}
+
+func (layout *Layout) PathBlob(checksum [32]byte) string {
+	return path.Join(layout.PathBlobBucket(checksum), fmt.Sprintf("%064x", checksum))
+}
+
+func (layout *Layout) PathIndex(checksum [32]byte) string {
+	return path.Join(layout.PathIndexBucket(checksum), fmt.Sprintf("%064x", checksum))
+}
+
+func (layout *Layout) PathPackfile(checksum [32]byte) string {
+	return path.Join(layout.PathPackfileBucket(checksum), fmt.Sprintf("%064x", checksum))
+}
+
+func (layout *Layout) PathLock(indexID uuid.UUID) string {
+	return path.Join(layout.PathLocks(), indexID.String())
+}
+
+func (layout *Layout) PathSnapshot(indexID uuid.UUID) string {
+	return path.Join(layout.PathSnapshotBucket(indexID), indexID.String())
+}
@@ -0,0 +1,102 @@
+package plakard
+
+import (
+	"github.com/PlakarLabs/plakar/network"
+	"github.com/PlakarLabs/plakar/storage"
+)
+
+func (repository *Repository) CheckBlobBatch(checksums [][32]byte) ([]bool, error) {
+	if !repository.hasCapability(network.CapabilityBatch) {
+		return nil, storage.ErrBatchUnsupported
+	}
+
+	exists := make([]bool, 0, len(checksums))
+	for start := 0; start < len(checksums); start += network.MaxBatchItems {
+		end := start + network.MaxBatchItems
+		if end > len(checksums) {
+			end = len(checksums)
+		}
+		result, err := repository.sendRequest("ReqCheckBlobBatch", network.ReqCheckBlobBatch{
+			Checksums: checksums[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := result.Payload.(network.ResCheckBlobBatch).Err; err != nil {
+			return nil, err
+		}
+		exists = append(exists, result.Payload.(network.ResCheckBlobBatch).Exists...)
+	}
+	return exists, nil
+}
+
+func (repository *Repository) GetBlobBatch(checksums [][32]byte) ([][]byte, error) {
+	if !repository.hasCapability(network.CapabilityBatch) {
+		return nil, storage.ErrBatchUnsupported
+	}
+
+	blobs := make([][]byte, 0, len(checksums))
+	for start := 0; start < len(checksums); start += network.MaxBatchItems {
+		end := start + network.MaxBatchItems
+		if end > len(checksums) {
+			end = len(checksums)
+		}
+		result, err := repository.sendRequest("ReqGetBlobBatch", network.ReqGetBlobBatch{
+			Checksums: checksums[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := result.Payload.(network.ResGetBlobBatch).Err; err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, result.Payload.(network.ResGetBlobBatch).Data...)
+	}
+	return blobs, nil
+}
+
+func (repository *Repository) GetPackfileSubpartBatch(checksum [32]byte, subparts []storage.Subpart) ([][]byte, error) {
+	if !repository.hasCapability(network.CapabilityBatch) {
+		return nil, storage.ErrBatchUnsupported
+	}
+
+	data := make([][]byte, 0, len(subparts))
+	for start := 0; start < len(subparts); start += network.MaxBatchItems {
+		end := start + network.MaxBatchItems
+		if end > len(subparts) {
+			end = len(subparts)
+		}
+		result, err := repository.sendRequest("ReqGetPackfileSubpartBatch", network.ReqGetPackfileSubpartBatch{
+			Checksum: checksum,
+			Subparts: subparts[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := result.Payload.(network.ResGetPackfileSubpartBatch).Err; err != nil {
+			return nil, err
+		}
+		data = append(data, result.Payload.(network.ResGetPackfileSubpartBatch).Data...)
+	}
+	return data, nil
+}
+
+func (repository *Repository) ListPage(resource string, after [32]byte, limit int) ([][32]byte, bool, error) {
+	if !repository.hasCapability(network.CapabilityBatch) {
+		return nil, false, storage.ErrBatchUnsupported
+	}
+
+	if limit > network.MaxBatchItems {
+		limit = network.MaxBatchItems
+	}
+	result, err := repository.sendRequest("ReqListPage", network.ReqListPage{
+		Resource: resource,
+		After:    after,
+		Limit:    limit,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	page := result.Payload.(network.ResListPage)
+	return page.Checksums, page.More, page.Err
+}
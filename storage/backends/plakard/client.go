@@ -17,14 +17,17 @@
 package plakard
 
 import (
-	"encoding/gob"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/url"
 	"os"
 	"os/exec"
+	"strings"
+	"time"
 
+	"github.com/PlakarLabs/plakar/logger"
 	"github.com/PlakarLabs/plakar/network"
 	"github.com/PlakarLabs/plakar/storage"
 	"github.com/google/uuid"
@@ -39,16 +42,41 @@ type Repository struct {
 
 	Cache *cache.Cache
 
-	encoder *gob.Encoder
-	decoder *gob.Decoder
-	mu      sync.Mutex
-
 	Repository string
 
-	inflightRequests map[uuid.UUID]chan network.Request
-	notifications    chan network.Request
+	location *url.URL
+	timeout  time.Duration
+
+	// the connection is replaced when it is lost, opened tells whether
+	// the repository must be opened again on the new one
+	muConn sync.Mutex
+	conn   *connection
+	opened bool
+
+	muReconnect sync.Mutex
+
+	// capabilities advertised by the server and the opened repository, none
+	// for servers predating the hello exchange
+	capabilities []string
 }
 
+const (
+	// helloTimeout bounds the wait for a hello response, servers predating
+	// the hello exchange fail to decode it and drop the connection, or
+	// never answer it.
+	helloTimeout = 5 * time.Second
+
+	// requestTimeout is the default time requests wait without receiving
+	// any part of their result, it is set by the timeout parameter of the
+	// location and 0 disables it
+	requestTimeout = 5 * time.Minute
+
+	// reconnectAttempts bounds the attempts to reconnect to a server before
+	// failing a request, they are spaced by a doubling delay
+	reconnectAttempts = 3
+	reconnectDelay    = time.Second
+)
+
 func init() {
 	network.ProtocolRegister()
 	storage.Register("plakard", NewRepository)
@@ -59,128 +87,218 @@ func NewRepository() storage.RepositoryBackend {
 }
 
 func (repository *Repository) connect(location *url.URL) error {
+	repository.timeout = requestTimeout
+	if value := location.Query().Get("timeout"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("invalid timeout: %s", value)
+		}
+		repository.timeout = timeout
+	}
+
+	conn, capabilities, err := repository.dial(location)
+	if err != nil {
+		return err
+	}
+
+	repository.muConn.Lock()
+	repository.location = location
+	repository.conn = conn
+	repository.capabilities = capabilities
+	repository.muConn.Unlock()
+	return nil
+}
+
+// dial connects to the server of a location and goes through the hello
+// exchange and authentication, returning the capabilities of the server
+func (repository *Repository) dial(location *url.URL) (*connection, []string, error) {
 	scheme := location.Scheme
-	switch scheme {
-	case "plakar":
-		err := repository.connectTCP(location)
-		if err != nil {
-			return err
+	conn, err := connectLocation(location)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	capabilities, err := repository.hello(conn)
+	if err == errLegacyServer {
+		// the connection is unusable once the server failed on the hello
+		logger.Warn("server does not support the hello exchange, assuming an older server")
+		conn.close()
+		if conn, err = connectLocation(location); err != nil {
+			return nil, nil, err
 		}
-	case "ssh":
-		err := repository.connectSSH(location)
+		capabilities = nil
+	} else if err != nil {
+		conn.close()
+		return nil, nil, err
+	}
+
+	if scheme == "plakar" {
+		token, err := network.ClientToken(location)
 		if err != nil {
-			return err
+			conn.close()
+			return nil, nil, err
 		}
-	case "stdio":
-		err := repository.connectStdio(location)
-		if err != nil {
-			return err
+		if token == "" && network.HasCapability(capabilities, network.CapabilityAuthToken) {
+			conn.close()
+			return nil, nil, fmt.Errorf("server requires a token, set PLAKAR_TOKEN or the token_file parameter")
+		}
+		if token != "" {
+			if !network.HasCapability(capabilities, network.CapabilityAuthToken) {
+				logger.Warn("server does not require authentication, not sending token")
+			} else if err := repository.authenticate(conn, token); err != nil {
+				conn.close()
+				return nil, nil, err
+			}
 		}
-	default:
-		return fmt.Errorf("unsupported protocol")
 	}
+	return conn, capabilities, nil
+}
 
+func connectLocation(location *url.URL) (*connection, error) {
+	switch location.Scheme {
+	case "plakar":
+		return connectTCP(location)
+	case "ssh":
+		return connectSSH(location)
+	case "stdio":
+		return connectStdio(location)
+	}
+	return nil, fmt.Errorf("unsupported protocol")
+}
+
+// errLegacyServer is returned by hello for servers predating the exchange
+var errLegacyServer = errors.New("server does not support the hello exchange")
+
+// hello exchanges protocol versions and capabilities with the server
+func (repository *Repository) hello(conn *connection) ([]string, error) {
+	result, err := conn.send("ReqHello", network.ReqHello{
+		Version:      network.VERSION,
+		Capabilities: []string{network.CapabilityStreaming},
+	}, helloTimeout)
+	if err == network.ErrTimeout || err == network.ErrConnectionLost {
+		return nil, errLegacyServer
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hello, ok := result.Payload.(network.ResHello)
+	if !ok {
+		return nil, fmt.Errorf("unexpected hello payload %T", result.Payload)
+	}
+	if hello.Err != nil {
+		return nil, hello.Err
+	}
+	if !network.Compatible(hello.Version) {
+		return nil, fmt.Errorf("server speaks protocol %s, client speaks %s", hello.Version, network.VERSION)
+	}
+	if hello.StorageVersion != storage.VERSION {
+		logger.Warn("server storage version %s differs from client storage version %s", hello.StorageVersion, storage.VERSION)
+	}
+	logger.Trace("plakard", "server protocol %s, capabilities: %s", hello.Version, strings.Join(hello.Capabilities, ", "))
+	if network.HasCapability(hello.Capabilities, network.CapabilityStreaming) {
+		conn.mux.EnableStreaming()
+	}
+	return hello.Capabilities, nil
+}
+
+func (repository *Repository) hasCapability(capability string) bool {
+	repository.muConn.Lock()
+	defer repository.muConn.Unlock()
+	return network.HasCapability(repository.capabilities, capability)
+}
+
+// checkDelete fails early when the server advertised it refuses deletions,
+// locks are still released
+func (repository *Repository) checkDelete() error {
+	if repository.hasCapability(network.CapabilityNoDelete) {
+		return network.Errorf(network.CodePermission, "server does not allow deletions")
+	}
 	return nil
 }
 
-func (repository *Repository) connectTCP(location *url.URL) error {
+// clientTLSConfig builds the TLS configuration of a plakar:// location,
+// TLS is enabled by tls=true or any of the tls_* parameters described by
+// network.ClientTLSConfig
+func clientTLSConfig(location *url.URL) (*tls.Config, error) {
+	query := location.Query()
+	if query.Get("tls") != "true" && query.Get("tls_ca") == "" && query.Get("tls_cert") == "" && query.Get("tls_insecure") != "true" {
+		return nil, nil
+	}
+	return network.ClientTLSConfig(location)
+}
+
+func connectTCP(location *url.URL) (*connection, error) {
 	port := location.Port()
 	if port == "" {
 		port = "9876"
 	}
+	address := net.JoinHostPort(location.Hostname(), port)
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", location.Hostname()+":"+port)
+	tlsConfig, err := clientTLSConfig(location)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	var conn net.Conn
+	if tlsConfig != nil {
+		conn, err = tls.Dial("tcp", address, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", address)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	repository.encoder = gob.NewEncoder(conn)
-	repository.decoder = gob.NewDecoder(conn)
-
-	repository.inflightRequests = make(map[uuid.UUID]chan network.Request)
-	repository.notifications = make(chan network.Request)
-
-	//repository.maxConcurrentRequest = make(chan bool, 1024)
+	return newConnection(conn, conn, func() {
+		conn.Close()
+	}), nil
+}
 
-	go func() {
-		for m := range repository.notifications {
-			repository.mu.Lock()
-			notify := repository.inflightRequests[m.Uuid]
-			repository.mu.Unlock()
-			notify <- m
-		}
-	}()
-
-	go func() {
-		for {
-			result := network.Request{}
-			err = repository.decoder.Decode(&result)
-			if err != nil {
-				conn.Close()
-				return
-			}
-			repository.notifications <- result
-		}
-	}()
+func (repository *Repository) authenticate(conn *connection, token string) error {
+	result, err := conn.send("ReqAuthChallenge", network.ReqAuthChallenge{}, repository.timeout)
+	if err != nil {
+		return err
+	}
+	challenge := result.Payload.(network.ResAuthChallenge)
+	if challenge.Err != nil {
+		return challenge.Err
+	}
 
-	return err
+	result, err = conn.send("ReqAuth", network.ReqAuth{
+		Response: network.AuthResponse(token, challenge.Nonce),
+	}, repository.timeout)
+	if err != nil {
+		return err
+	}
+	return result.Payload.(network.ResAuth).Err
 }
 
-func (repository *Repository) connectStdio(location *url.URL) error {
+func connectStdio(location *url.URL) (*connection, error) {
 	subProcess := exec.Command("plakar", "-no-cache", "stdio")
 
 	stdin, err := subProcess.StdinPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	stdout, err := subProcess.StdoutPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	subProcess.Stderr = os.Stderr
 
-	repository.encoder = gob.NewEncoder(stdin)
-	repository.decoder = gob.NewDecoder(stdout)
-
 	if err = subProcess.Start(); err != nil {
-		return err
+		return nil, err
 	}
 
-	repository.inflightRequests = make(map[uuid.UUID]chan network.Request)
-	repository.notifications = make(chan network.Request)
-
-	go func() {
-		for m := range repository.notifications {
-			repository.mu.Lock()
-			notify := repository.inflightRequests[m.Uuid]
-			repository.mu.Unlock()
-			notify <- m
-		}
-	}()
-
-	go func() {
-		for {
-			result := network.Request{}
-			err = repository.decoder.Decode(&result)
-			if err != nil {
-				stdin.Close()
-				subProcess.Wait()
-				return
-			}
-			repository.notifications <- result
-		}
-	}()
-
-	return nil
+	return newConnection(stdin, stdout, func() {
+		stdin.Close()
+		subProcess.Wait()
+	}), nil
 }
 
-func (repository *Repository) connectSSH(location *url.URL) error {
+func connectSSH(location *url.URL) (*connection, error) {
 	connectUrl := "ssh://"
 	if location.User != nil {
 		connectUrl += location.User.Username() + "@"
@@ -194,81 +312,108 @@ func (repository *Repository) connectSSH(location *url.URL) error {
 
 	stdin, err := subProcess.StdinPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	stdout, err := subProcess.StdoutPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	subProcess.Stderr = os.Stderr
 
-	repository.encoder = gob.NewEncoder(stdin)
-	repository.decoder = gob.NewDecoder(stdout)
-
 	if err = subProcess.Start(); err != nil {
-		return err
+		return nil, err
 	}
 
-	repository.inflightRequests = make(map[uuid.UUID]chan network.Request)
-	repository.notifications = make(chan network.Request)
+	return newConnection(stdin, stdout, func() {
+		stdin.Close()
+		subProcess.Wait()
+	}), nil
+}
 
-	go func() {
-		for m := range repository.notifications {
-			repository.mu.Lock()
-			notify := repository.inflightRequests[m.Uuid]
-			repository.mu.Unlock()
-			notify <- m
+func (repository *Repository) sendRequest(Type string, Payload interface{}) (*network.Request, error) {
+	return repository.sendRequestTimeout(Type, Payload, repository.timeout)
+}
+
+// sendRequestTimeout sends a request on the current connection. When the
+// connection is lost, the client reconnects for the requests to come and
+// idempotent requests are sent again, others fail as the server may have
+// processed them.
+func (repository *Repository) sendRequestTimeout(Type string, Payload interface{}, timeout time.Duration) (*network.Request, error) {
+	delay := reconnectDelay
+	for attempt := 1; ; attempt++ {
+		repository.muConn.Lock()
+		conn := repository.conn
+		repository.muConn.Unlock()
+
+		result, err := conn.send(Type, Payload, timeout)
+		if err != network.ErrConnectionLost {
+			return result, err
 		}
-	}()
-
-	go func() {
-		for {
-			result := network.Request{}
-			err = repository.decoder.Decode(&result)
-			if err != nil {
-				stdin.Close()
-				subProcess.Wait()
-				return
+		if !idempotent(Type) || attempt > reconnectAttempts {
+			if err := repository.reconnect(conn); err != nil {
+				logger.Warn("could not reconnect: %s", err)
 			}
-			repository.notifications <- result
+			return nil, err
 		}
-	}()
 
-	return nil
+		logger.Warn("connection to server lost, reconnecting (attempt %d/%d)", attempt, reconnectAttempts)
+		if err := repository.reconnect(conn); err != nil {
+			logger.Warn("could not reconnect: %s", err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
 }
 
-func (repository *Repository) sendRequest(Type string, Payload interface{}) (*network.Request, error) {
-	Uuid, err := uuid.NewRandom()
-	if err != nil {
-		return nil, err
+// idempotent tells whether a request may be sent again without knowing if
+// the server processed it, blobs, indexes and packfiles being addressed by
+// their checksum
+func idempotent(Type string) bool {
+	switch Type {
+	case "ReqPutBlob", "ReqPutIndex", "ReqPutPackfile":
+		return true
 	}
+	return strings.HasPrefix(Type, "ReqGet") || strings.HasPrefix(Type, "ReqCheck") || strings.HasPrefix(Type, "ReqList")
+}
 
-	request := network.Request{
-		Uuid:    Uuid,
-		Type:    Type,
-		Payload: Payload,
-	}
+// reconnect replaces a lost connection, unless another request already did
+func (repository *Repository) reconnect(failed *connection) error {
+	repository.muReconnect.Lock()
+	defer repository.muReconnect.Unlock()
 
-	notify := make(chan network.Request)
-	repository.mu.Lock()
-	repository.inflightRequests[request.Uuid] = notify
-	repository.mu.Unlock()
+	repository.muConn.Lock()
+	current, location, opened := repository.conn, repository.location, repository.opened
+	repository.muConn.Unlock()
+	if current != failed {
+		return nil
+	}
 
-	err = repository.encoder.Encode(&request)
+	conn, capabilities, err := repository.dial(location)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	result := <-notify
-
-	repository.mu.Lock()
-	delete(repository.inflightRequests, request.Uuid)
-	repository.mu.Unlock()
-	close(notify)
+	if opened {
+		result, err := conn.send("ReqOpen", network.ReqOpen{
+			Repository: location.Path,
+		}, repository.timeout)
+		if err == nil {
+			err = result.Payload.(network.ResOpen).Err
+		}
+		if err != nil {
+			conn.close()
+			return err
+		}
+		capabilities = append(capabilities, result.Payload.(network.ResOpen).Capabilities...)
+	}
 
-	return &result, nil
+	repository.muConn.Lock()
+	repository.conn = conn
+	repository.capabilities = capabilities
+	repository.muConn.Unlock()
+	return nil
 }
 
 func (repository *Repository) Create(location string, config storage.RepositoryConfig) error {
@@ -321,11 +466,19 @@ func (repository *Repository) Open(location string) error {
 	}
 
 	repository.config = *result.Payload.(network.ResOpen).RepositoryConfig
+	repository.muConn.Lock()
+	repository.opened = true
+	repository.capabilities = append(repository.capabilities, result.Payload.(network.ResOpen).Capabilities...)
+	repository.muConn.Unlock()
 	return nil
 }
 
 func (repository *Repository) Close() error {
 	result, err := repository.sendRequest("ReqClose", network.ReqClose{})
+	repository.muConn.Lock()
+	conn := repository.conn
+	repository.muConn.Unlock()
+	conn.close()
 	if err != nil {
 		return err
 	}
@@ -368,6 +521,10 @@ func (repository *Repository) GetSnapshot(indexID uuid.UUID) ([]byte, error) {
 }
 
 func (repository *Repository) DeleteSnapshot(indexID uuid.UUID) error {
+	if err := repository.checkDelete(); err != nil {
+		return err
+	}
+
 	result, err := repository.sendRequest("ReqDeleteSnapshot", network.ReqDeleteSnapshot{
 		IndexID: indexID,
 	})
@@ -460,6 +617,10 @@ func (repository *Repository) GetBlob(checksum [32]byte) ([]byte, error) {
 }
 
 func (repository *Repository) DeleteBlob(checksum [32]byte) error {
+	if err := repository.checkDelete(); err != nil {
+		return err
+	}
+
 	result, err := repository.sendRequest("ReqDeleteBlob", network.ReqDeleteBlob{
 		Checksum: checksum,
 	})
@@ -500,6 +661,10 @@ func (repository *Repository) GetIndex(checksum [32]byte) ([]byte, error) {
 }
 
 func (repository *Repository) DeleteIndex(checksum [32]byte) error {
+	if err := repository.checkDelete(); err != nil {
+		return err
+	}
+
 	result, err := repository.sendRequest("ReqDeleteIndex", network.ReqDeleteIndex{
 		Checksum: checksum,
 	})
@@ -540,6 +705,18 @@ func (repository *Repository) GetPackfile(checksum [32]byte) ([]byte, error) {
 }
 
 func (repository *Repository) GetPackfileSubpart(checksum [32]byte, offset uint32, length uint32) ([]byte, error) {
+	// older servers can only send packfiles as a whole
+	if !repository.hasCapability(network.CapabilityRangeReads) {
+		data, err := repository.GetPackfile(checksum)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(offset)+uint64(length) > uint64(len(data)) {
+			return nil, fmt.Errorf("packfile %064x: range out of bounds", checksum)
+		}
+		return data[offset : offset+length], nil
+	}
+
 	result, err := repository.sendRequest("ReqGetPackfileSubpart", network.ReqGetPackfileSubpart{
 		Checksum: checksum,
 		Offset:   offset,
@@ -551,6 +728,10 @@ func (repository *Repository) GetPackfileSubpart(checksum [32]byte, offset uint3
 	return result.Payload.(network.ResGetPackfileSubpart).Data, result.Payload.(network.ResGetPackfileSubpart).Err
 }
 func (repository *Repository) DeletePackfile(checksum [32]byte) error {
+	if err := repository.checkDelete(); err != nil {
+		return err
+	}
+
 	result, err := repository.sendRequest("ReqDeletePackfile", network.ReqDeletePackfile{
 		Checksum: checksum,
 	})
@@ -0,0 +1,217 @@
+package plakard
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/network"
+	"github.com/google/uuid"
+)
+
+// connection multiplexes the requests of a client over a connection to a
+// server, whether a socket or the pipes of a subprocess.
+type connection struct {
+	mux *network.Mux
+
+	muInflight sync.Mutex
+	inflight   map[uuid.UUID]*pending
+
+	notifications chan network.Request
+	closed        chan struct{}
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	cleanup   func()
+}
+
+// pending is a request waiting for its result, progress is signaled for
+// each frame of a streamed result
+type pending struct {
+	result   chan network.Request
+	progress chan struct{}
+}
+
+// newConnection reads the results sent by the server until the connection
+// is lost, cleanup is then called to release it
+func newConnection(w io.Writer, r io.Reader, cleanup func()) *connection {
+	conn := &connection{
+		mux:           network.NewMux(w),
+		inflight:      make(map[uuid.UUID]*pending),
+		notifications: make(chan network.Request),
+		closed:        make(chan struct{}),
+		closing:       make(chan struct{}),
+		cleanup:       cleanup,
+	}
+
+	// the server streams results once the hello told it they are reassembled
+	conn.mux.AcceptStreams()
+	go conn.dispatch()
+
+	decoder := gob.NewDecoder(r)
+	go func() {
+		defer close(conn.notifications)
+		defer conn.mux.Close()
+		defer conn.close()
+		for {
+			result := network.Request{}
+			if err := decoder.Decode(&result); err != nil {
+				select {
+				case <-conn.closing:
+				default:
+					if err != io.EOF {
+						logger.Warn("connection to server: %s", err)
+					}
+				}
+				return
+			}
+
+			// frames are reassembled into the result they belong to
+			received, err := conn.mux.Receive(result)
+			if err != nil {
+				logger.Warn("connection to server: %s", err)
+				return
+			}
+			if received != nil {
+				conn.notifications <- *received
+			} else {
+				conn.progress(result.Uuid)
+			}
+		}
+	}()
+	return conn
+}
+
+// close releases the connection, the requests pending on it fail
+func (conn *connection) close() {
+	conn.closeOnce.Do(func() {
+		close(conn.closing)
+		conn.cleanup()
+	})
+}
+
+// progress tells the request a frame of its result was received
+func (conn *connection) progress(Uuid uuid.UUID) {
+	conn.muInflight.Lock()
+	request, exists := conn.inflight[Uuid]
+	conn.muInflight.Unlock()
+	if exists {
+		select {
+		case request.progress <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dispatch hands the results read from the server to the requests waiting
+// for them, until the connection is closed.
+func (conn *connection) dispatch() {
+	defer close(conn.closed)
+	for m := range conn.notifications {
+		conn.muInflight.Lock()
+		request, exists := conn.inflight[m.Uuid]
+		conn.muInflight.Unlock()
+		if exists {
+			request.result <- m
+		}
+	}
+}
+
+// send issues a request and waits for its result as long as parts of it
+// keep arriving, it times out after timeout without any, never when
+// timeout is 0
+func (conn *connection) send(Type string, Payload interface{}, timeout time.Duration) (*network.Request, error) {
+	Uuid, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	request := network.Request{
+		Uuid:    Uuid,
+		Type:    Type,
+		Payload: Payload,
+	}
+
+	notify := &pending{
+		result:   make(chan network.Request, 1),
+		progress: make(chan struct{}, 1),
+	}
+	conn.muInflight.Lock()
+	conn.inflight[request.Uuid] = notify
+	conn.muInflight.Unlock()
+	defer func() {
+		conn.muInflight.Lock()
+		delete(conn.inflight, request.Uuid)
+		conn.muInflight.Unlock()
+	}()
+
+	select {
+	case <-conn.closed:
+		return nil, network.ErrConnectionLost
+	default:
+	}
+
+	if err := conn.mux.Encode(&request); err != nil {
+		// a failed write leaves the stream in an unknown state
+		logger.Warn("connection to server: %s", err)
+		conn.close()
+		return nil, network.ErrConnectionLost
+	}
+
+	var timer *time.Timer
+	var expired <-chan time.Time
+	if timeout != 0 {
+		timer = time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var result network.Request
+	for received := false; !received; {
+		select {
+		case result = <-notify.result:
+			received = true
+		case <-notify.progress:
+			if timer != nil {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(timeout)
+			}
+		case <-expired:
+			return nil, network.ErrTimeout
+		case <-conn.closed:
+			select {
+			case result = <-notify.result:
+				received = true
+			default:
+				return nil, network.ErrConnectionLost
+			}
+		}
+	}
+
+	if result.Type == "ResUnknown" {
+		return nil, result.Payload.(network.ResUnknown).Err
+	}
+	if result.Type == "ResError" {
+		return nil, result.Payload.(network.ResError).Err
+	}
+
+	// a server requiring authentication answers anything else with an error
+	if result.Type == "ResAuth" && Type != "ReqAuth" {
+		if err := result.Payload.(network.ResAuth).Err; err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unexpected authentication response")
+	}
+
+	// results are checked here so that callers can assert their type
+	if expected := "Res" + strings.TrimPrefix(Type, "Req"); result.Type != expected {
+		return nil, fmt.Errorf("unexpected result %s to %s", result.Type, Type)
+	}
+	return &result, nil
+}
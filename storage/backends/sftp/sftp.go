@@ -0,0 +1,522 @@
+// Package sftp stores repositories on hosts reachable over SSH, with the
+// same layout as the fs backend. It runs the ssh client with the sftp
+// subsystem, so the remote host needs no plakar binary and the usual ssh
+// configuration, agent and known hosts apply.
+package sftp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+
+	"github.com/PlakarLabs/plakar/compression"
+	"github.com/PlakarLabs/plakar/storage"
+	"github.com/PlakarLabs/plakar/storage/backends/internal/layout"
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// mkdirConcurrency bounds the directories created at once with a
+// repository, each of them costs a round-trip
+const mkdirConcurrency = 32
+
+type Repository struct {
+	config storage.RepositoryConfig
+
+	layout.Layout
+	client  *sftp.Client
+	cleanup func()
+}
+
+// dial starts an SFTP session with the host of a location
+var dial = dialSSH
+
+func init() {
+	storage.Register("sftp", NewRepository)
+}
+
+func NewRepository() storage.RepositoryBackend {
+	return &Repository{}
+}
+
+func dialSSH(location *url.URL) (*sftp.Client, func(), error) {
+	connectUrl := "ssh://"
+	if location.User != nil {
+		connectUrl += location.User.Username() + "@"
+	}
+	connectUrl += location.Hostname()
+	if location.Port() != "" {
+		connectUrl += ":" + location.Port()
+	}
+
+	subProcess := exec.Command("ssh", "-s", connectUrl, "sftp")
+
+	stdin, err := subProcess.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stdout, err := subProcess.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	subProcess.Stderr = os.Stderr
+
+	if err = subProcess.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	// closing the client closes stdin, which ends the ssh session
+	client, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		stdin.Close()
+		subProcess.Wait()
+		return nil, nil, err
+	}
+	return client, func() {
+		subProcess.Wait()
+	}, nil
+}
+
+func (repository *Repository) connect(location string) error {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "sftp" {
+		return fmt.Errorf("unsupported location: %s", location)
+	}
+	if parsed.Hostname() == "" {
+		return fmt.Errorf("missing host: %s", location)
+	}
+	if parsed.Path == "" || parsed.Path == "/" {
+		return fmt.Errorf("missing path: %s", location)
+	}
+
+	client, cleanup, err := dial(parsed)
+	if err != nil {
+		return err
+	}
+
+	repository.Root = path.Clean(parsed.Path)
+	repository.client = client
+	repository.cleanup = cleanup
+	return nil
+}
+
+func (repository *Repository) Create(location string, config storage.RepositoryConfig) error {
+	if err := repository.connect(location); err != nil {
+		return err
+	}
+
+	if err := repository.client.Mkdir(repository.Root); err != nil {
+		return err
+	}
+
+	directories := []string{
+		repository.PathIndexes(),
+		repository.PathLocks(),
+		repository.PathBlobs(),
+		repository.PathPackfiles(),
+		repository.PathSnapshots(),
+		repository.PathTmp(),
+		repository.PathPurge(),
+	}
+	for _, directory := range directories {
+		if err := repository.client.Mkdir(directory); err != nil {
+			return err
+		}
+	}
+
+	buckets := make([]string, 0, 4*256)
+	for _, directory := range []string{repository.PathIndexes(), repository.PathBlobs(), repository.PathPackfiles(), repository.PathSnapshots()} {
+		for i := 0; i < 256; i++ {
+			buckets = append(buckets, path.Join(directory, fmt.Sprintf("%02x", i)))
+		}
+	}
+	if err := repository.mkdirs(buckets); err != nil {
+		return err
+	}
+
+	jconfig, err := msgpack.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	compressedConfig, err := compression.Deflate("gzip", jconfig)
+	if err != nil {
+		return err
+	}
+
+	if err := repository.writeFile(path.Join(repository.Root, "CONFIG"), compressedConfig); err != nil {
+		return err
+	}
+
+	repository.config = config
+
+	return nil
+}
+
+// mkdirs creates directories concurrently as the client pipelines requests
+func (repository *Repository) mkdirs(directories []string) error {
+	var wg sync.WaitGroup
+	var muErr sync.Mutex
+	var firstErr error
+
+	concurrency := make(chan struct{}, mkdirConcurrency)
+	for _, directory := range directories {
+		concurrency <- struct{}{}
+		wg.Add(1)
+		go func(directory string) {
+			defer wg.Done()
+			defer func() { <-concurrency }()
+			if err := repository.client.Mkdir(directory); err != nil {
+				muErr.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %w", directory, err)
+				}
+				muErr.Unlock()
+			}
+		}(directory)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (repository *Repository) Open(location string) error {
+	if err := repository.connect(location); err != nil {
+		return err
+	}
+
+	compressed, err := repository.readFile(path.Join(repository.Root, "CONFIG"))
+	if err != nil {
+		return err
+	}
+
+	jconfig, err := compression.Inflate("gzip", compressed)
+	if err != nil {
+		return err
+	}
+
+	config := storage.RepositoryConfig{}
+	err = msgpack.Unmarshal(jconfig, &config)
+	if err != nil {
+		return err
+	}
+
+	repository.config = config
+
+	return nil
+}
+
+func (repository *Repository) Configuration() storage.RepositoryConfig {
+	return repository.config
+}
+
+func (repository *Repository) Close() error {
+	if repository.client == nil {
+		return nil
+	}
+	err := repository.client.Close()
+	repository.cleanup()
+	return err
+}
+
+func (repository *Repository) readFile(pathname string) ([]byte, error) {
+	fp, err := repository.client.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var buffer bytes.Buffer
+	if _, err := fp.WriteTo(&buffer); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// writeFile uploads data to tmp/ and renames it to pathname, so that an
+// interrupted upload never leaves a partial file in the repository
+func (repository *Repository) writeFile(pathname string, data []byte) error {
+	tmp := path.Join(repository.PathTmp(), fmt.Sprintf("%s.%s", path.Base(pathname), uuid.Must(uuid.NewRandom())))
+	fp, err := repository.client.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fp.ReadFrom(bytes.NewReader(data)); err != nil {
+		fp.Close()
+		repository.client.Remove(tmp)
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		repository.client.Remove(tmp)
+		return err
+	}
+
+	if err := repository.rename(tmp, pathname); err != nil {
+		repository.client.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (repository *Repository) exists(pathname string) (bool, error) {
+	if _, err := repository.client.Stat(pathname); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// listBuckets returns the names of the files within the buckets of a
+// directory
+func (repository *Repository) listBuckets(pathname string) ([]string, error) {
+	ret := make([]string, 0)
+
+	buckets, err := repository.client.ReadDir(pathname)
+	if err != nil {
+		return ret, err
+	}
+
+	for _, bucket := range buckets {
+		if !bucket.IsDir() {
+			continue
+		}
+		entries, err := repository.client.ReadDir(path.Join(pathname, bucket.Name()))
+		if err != nil {
+			return ret, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			ret = append(ret, entry.Name())
+		}
+	}
+	return ret, nil
+}
+
+func (repository *Repository) listChecksums(pathname string) ([][32]byte, error) {
+	ret := make([][32]byte, 0)
+
+	names, err := repository.listBuckets(pathname)
+	if err != nil {
+		return ret, err
+	}
+
+	for _, name := range names {
+		t, err := hex.DecodeString(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(t) != 32 {
+			continue
+		}
+		var t32 [32]byte
+		copy(t32[:], t)
+		ret = append(ret, t32)
+	}
+	return ret, nil
+}
+
+/* Snapshots */
+func (repository *Repository) GetSnapshots() ([]uuid.UUID, error) {
+	ret := make([]uuid.UUID, 0)
+
+	names, err := repository.listBuckets(repository.PathSnapshots())
+	if err != nil {
+		return ret, err
+	}
+
+	for _, name := range names {
+		indexID, err := uuid.Parse(name)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, indexID)
+	}
+	return ret, nil
+}
+
+func (repository *Repository) PutSnapshot(indexID uuid.UUID, data []byte) error {
+	return repository.writeFile(repository.PathSnapshot(indexID), data)
+}
+
+func (repository *Repository) GetSnapshot(indexID uuid.UUID) ([]byte, error) {
+	return repository.readFile(repository.PathSnapshot(indexID))
+}
+
+func (repository *Repository) DeleteSnapshot(indexID uuid.UUID) error {
+	return repository.purge(repository.PathSnapshot(indexID), indexID.String())
+}
+
+// rename replaces newname atomically when the server supports the OpenSSH
+// extension. A plain SFTP rename fails when newname exists, it is removed
+// first on other servers.
+func (repository *Repository) rename(oldname, newname string) error {
+	if _, ok := repository.client.HasExtension("posix-rename@openssh.com"); ok {
+		return repository.client.PosixRename(oldname, newname)
+	}
+	err := repository.client.Rename(oldname, newname)
+	if err == nil {
+		return nil
+	}
+	if exists, _ := repository.exists(newname); !exists {
+		return err
+	}
+	if err := repository.client.Remove(newname); err != nil {
+		return err
+	}
+	return repository.client.Rename(oldname, newname)
+}
+
+// purge moves a file to purge/ before removing it, as the fs backend does,
+// so that it leaves its listing at once
+func (repository *Repository) purge(pathname string, name string) error {
+	dest := path.Join(repository.PathPurge(), fmt.Sprintf("%s.%s", name, uuid.Must(uuid.NewRandom())))
+	if err := repository.rename(pathname, dest); err != nil {
+		return err
+	}
+	return repository.client.Remove(dest)
+}
+
+func (repository *Repository) Commit(indexID uuid.UUID, data []byte) error {
+	// the snapshot only shows once complete
+	return repository.writeFile(repository.PathSnapshot(indexID), data)
+}
+
+/* Locks */
+func (repository *Repository) GetLocks() ([]uuid.UUID, error) {
+	ret := make([]uuid.UUID, 0)
+
+	locks, err := repository.client.ReadDir(repository.PathLocks())
+	if err != nil {
+		return ret, err
+	}
+
+	for _, lock := range locks {
+		if lock.IsDir() {
+			continue
+		}
+		indexID, err := uuid.Parse(lock.Name())
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, indexID)
+	}
+	return ret, nil
+}
+
+func (repository *Repository) PutLock(indexID uuid.UUID, data []byte) error {
+	return repository.writeFile(repository.PathLock(indexID), data)
+}
+
+func (repository *Repository) GetLock(indexID uuid.UUID) ([]byte, error) {
+	return repository.readFile(repository.PathLock(indexID))
+}
+
+func (repository *Repository) DeleteLock(indexID uuid.UUID) error {
+	return repository.purge(repository.PathLock(indexID), indexID.String())
+}
+
+/* Blobs */
+func (repository *Repository) GetBlobs() ([][32]byte, error) {
+	return repository.listChecksums(repository.PathBlobs())
+}
+
+func (repository *Repository) PutBlob(checksum [32]byte, data []byte) error {
+	return repository.writeFile(repository.PathBlob(checksum), data)
+}
+
+func (repository *Repository) CheckBlob(checksum [32]byte) (bool, error) {
+	return repository.exists(repository.PathBlob(checksum))
+}
+
+func (repository *Repository) GetBlob(checksum [32]byte) ([]byte, error) {
+	return repository.readFile(repository.PathBlob(checksum))
+}
+
+func (repository *Repository) DeleteBlob(checksum [32]byte) error {
+	return repository.client.Remove(repository.PathBlob(checksum))
+}
+
+/* Indexes */
+func (repository *Repository) GetIndexes() ([][32]byte, error) {
+	return repository.listChecksums(repository.PathIndexes())
+}
+
+func (repository *Repository) PutIndex(checksum [32]byte, data []byte) error {
+	return repository.writeFile(repository.PathIndex(checksum), data)
+}
+
+func (repository *Repository) GetIndex(checksum [32]byte) ([]byte, error) {
+	return repository.readFile(repository.PathIndex(checksum))
+}
+
+func (repository *Repository) DeleteIndex(checksum [32]byte) error {
+	return repository.client.Remove(repository.PathIndex(checksum))
+}
+
+/* Packfiles */
+func (repository *Repository) GetPackfiles() ([][32]byte, error) {
+	return repository.listChecksums(repository.PathPackfiles())
+}
+
+func (repository *Repository) PutPackfile(checksum [32]byte, data []byte) error {
+	return repository.writeFile(repository.PathPackfile(checksum), data)
+}
+
+func (repository *Repository) GetPackfile(checksum [32]byte) ([]byte, error) {
+	return repository.readFile(repository.PathPackfile(checksum))
+}
+
+func (repository *Repository) GetPackfileSubpart(checksum [32]byte, offset uint32, length uint32) ([]byte, error) {
+	fp, err := repository.client.Open(repository.PathPackfile(checksum))
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	data := make([]byte, length)
+	n, err := fp.ReadAt(data, int64(offset))
+	if n != len(data) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (repository *Repository) DeletePackfile(checksum [32]byte) error {
+	return repository.client.Remove(repository.PathPackfile(checksum))
+}
+
+// Usage walks the packfiles and blobs, only their metadata is read
+func (repository *Repository) Usage() (uint64, error) {
+	usage := uint64(0)
+	for _, pathname := range []string{repository.PathPackfiles(), repository.PathBlobs()} {
+		walker := repository.client.Walk(pathname)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				return 0, err
+			}
+			if walker.Stat().Mode().IsRegular() {
+				usage += uint64(walker.Stat().Size())
+			}
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,143 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/storage/backends/internal/backendtest"
+	"github.com/pkg/sftp"
+)
+
+func TestMain(m *testing.M) {
+	// pushes log their progress
+	logger.Start()
+	os.Exit(m.Run())
+}
+
+// serve replaces ssh with an in-process SFTP server on the local
+// filesystem for the duration of a test
+func serve(t *testing.T) {
+	dialSSH := dial
+	dial = func(location *url.URL) (*sftp.Client, func(), error) {
+		serverConn, clientConn := net.Pipe()
+		server, err := sftp.NewServer(serverConn)
+		if err != nil {
+			return nil, nil, err
+		}
+		go server.Serve()
+
+		client, err := sftp.NewClientPipe(clientConn, clientConn)
+		if err != nil {
+			server.Close()
+			return nil, nil, err
+		}
+		return client, func() {
+			server.Close()
+		}, nil
+	}
+	t.Cleanup(func() {
+		dial = dialSSH
+	})
+}
+
+func TestLocation(t *testing.T) {
+	serve(t)
+
+	for _, location := range []string{
+		"sftp://host",
+		"sftp://host/",
+		"sftp:///repository",
+		"ssh://host/repository",
+	} {
+		if err := NewRepository().Open(location); err == nil {
+			t.Errorf("%s: expected an error", location)
+		}
+	}
+
+	if err := NewRepository().Open("sftp://host" + filepath.Join(t.TempDir(), "missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing repository, got %v", err)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	serve(t)
+
+	root := filepath.Join(t.TempDir(), "repository")
+	backendtest.TestBackend(t, NewRepository, "sftp://user@host:2222"+root, root)
+}
+
+func TestPushPull(t *testing.T) {
+	serve(t)
+
+	backendtest.TestPushPull(t, "sftp://host"+filepath.Join(t.TempDir(), "repository"))
+}
+
+// cutConn fails writes once limit bytes were written
+type cutConn struct {
+	net.Conn
+	limit int
+}
+
+func (conn *cutConn) Write(data []byte) (int, error) {
+	if len(data) > conn.limit {
+		conn.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	conn.limit -= len(data)
+	return conn.Conn.Write(data)
+}
+
+func TestWriteFailure(t *testing.T) {
+	serve(t)
+
+	root := filepath.Join(t.TempDir(), "repository")
+	repository := NewRepository()
+	if err := repository.Create("sftp://host"+root, backendtest.Config()); err != nil {
+		t.Fatal(err)
+	}
+	defer repository.Close()
+
+	// files are replaced rather than truncated in place
+	checksum := sha256.Sum256([]byte("blob"))
+	for _, data := range []string{"first blob", "blob"} {
+		if err := repository.PutBlob(checksum, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, err := repository.GetBlob(checksum); err != nil || string(data) != "blob" {
+		t.Errorf("unexpected blob %q: %v", data, err)
+	}
+
+	// the connection is lost in the middle of an upload
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Close()
+	client, err := sftp.NewClientPipe(clientConn, &cutConn{Conn: clientConn, limit: 256 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository.(*Repository).client = client
+
+	packfile := bytes.Repeat([]byte("packfile"), 1<<17)
+	packfileChecksum := sha256.Sum256(packfile)
+	if err := repository.PutPackfile(packfileChecksum, packfile); err == nil {
+		t.Fatal("expected the upload to fail with the connection")
+	}
+	pathname := filepath.Join(root, "packfiles", fmt.Sprintf("%02x", packfileChecksum[0]), fmt.Sprintf("%064x", packfileChecksum))
+	if _, err := os.Stat(pathname); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected no partial packfile, got %v", err)
+	}
+}
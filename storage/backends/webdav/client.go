@@ -0,0 +1,247 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// propfind requests the properties needed to list collections
+const propfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/></D:prop></D:propfind>`
+
+// errConflict is returned when the parent collection of a resource is missing
+var errConflict = errors.New("409 Conflict")
+
+// client speaks the subset of WebDAV used by the backend
+type client struct {
+	httpClient *http.Client
+	endpoint   url.URL
+	username   string
+	password   string
+}
+
+// entry is a member of a collection
+type entry struct {
+	name  string
+	isDir bool
+	size  int64
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength int64 `xml:"getcontentlength"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func newClient(location *url.URL, username string, password string) *client {
+	c := &client{
+		httpClient: &http.Client{},
+		endpoint: url.URL{
+			Scheme: "http",
+			Host:   location.Host,
+		},
+		username: username,
+		password: password,
+	}
+	if location.Scheme == "webdavs" {
+		c.endpoint.Scheme = "https"
+	}
+	return c
+}
+
+func (c *client) url(pathname string) string {
+	u := c.endpoint
+	u.Path = pathname
+	return u.String()
+}
+
+func (c *client) request(method string, pathname string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url(pathname), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if c.username != "" || c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return c.httpClient.Do(req)
+}
+
+// do sends a request without a body in return and fails unless the server
+// replies with one of the expected statuses
+func (c *client) do(method string, pathname string, body io.Reader, header http.Header, expected ...int) (int, error) {
+	resp, err := c.request(method, pathname, body, header)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode, checkStatus(method, pathname, resp, expected...)
+}
+
+// checkStatus maps unexpected statuses to errors, missing resources and
+// denied accesses are reported as their fs counterparts
+func checkStatus(method string, pathname string, resp *http.Response, expected ...int) error {
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("%s %s: %w", method, pathname, fs.ErrNotExist)
+	case http.StatusConflict:
+		return fmt.Errorf("%s %s: %w", method, pathname, errConflict)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%s %s: %s: %w", method, pathname, resp.Status, fs.ErrPermission)
+	default:
+		return fmt.Errorf("%s %s: %s", method, pathname, resp.Status)
+	}
+}
+
+func (c *client) get(pathname string) ([]byte, error) {
+	resp, err := c.request("GET", pathname, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("GET", pathname, resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// getRange reads length bytes at offset, servers ignoring ranges send the
+// whole resource and the range is cut from it
+func (c *client) getRange(pathname string, offset uint32, length uint32) ([]byte, error) {
+	if length == 0 {
+		return []byte{}, nil
+	}
+
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, uint64(offset)+uint64(length)-1))
+
+	resp, err := c.request("GET", pathname, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("GET", pathname, resp, http.StatusOK, http.StatusPartialContent); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		if _, err := io.CopyN(io.Discard, resp.Body, int64(offset)); err != nil {
+			return nil, err
+		}
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *client) exists(pathname string) (bool, error) {
+	status, err := c.do("HEAD", pathname, nil, nil, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return false, err
+	}
+	return status == http.StatusOK, nil
+}
+
+func (c *client) put(pathname string, data []byte) error {
+	_, err := c.do("PUT", pathname, bytes.NewReader(data), nil, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	return err
+}
+
+func (c *client) delete(pathname string) error {
+	_, err := c.do("DELETE", pathname, nil, nil, http.StatusOK, http.StatusNoContent)
+	return err
+}
+
+func (c *client) mkcol(pathname string) (int, error) {
+	return c.do("MKCOL", pathname, nil, nil, http.StatusCreated)
+}
+
+func (c *client) move(source string, destination string) error {
+	header := http.Header{}
+	header.Set("Destination", c.url(destination))
+	header.Set("Overwrite", "T")
+	_, err := c.do("MOVE", source, nil, header, http.StatusCreated, http.StatusNoContent)
+	return err
+}
+
+// list returns the members of a collection
+func (c *client) list(pathname string) ([]entry, error) {
+	header := http.Header{}
+	header.Set("Depth", "1")
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := c.request("PROPFIND", pathname, strings.NewReader(propfind), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("PROPFIND", pathname, resp, http.StatusMultiStatus); err != nil {
+		return nil, err
+	}
+
+	var result multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("PROPFIND %s: %w", pathname, err)
+	}
+
+	ret := make([]entry, 0, len(result.Responses))
+	for _, response := range result.Responses {
+		// hrefs are either absolute URLs or absolute paths
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, fmt.Errorf("PROPFIND %s: %w", pathname, err)
+		}
+		member := path.Clean(href.Path)
+		if member == path.Clean(pathname) {
+			continue
+		}
+
+		e := entry{name: path.Base(member)}
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			if propstat.Prop.ResourceType.Collection != nil {
+				e.isDir = true
+			}
+			e.size = propstat.Prop.ContentLength
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+func (c *client) close() {
+	c.httpClient.CloseIdleConnections()
+}
@@ -0,0 +1,398 @@
+// Package webdav stores repositories on WebDAV servers, with the same
+// layout as the fs backend. webdav:// locations are reached over HTTP and
+// webdavs:// ones over HTTPS. The user of the location is sent with basic
+// authentication, along with the password read from the file named by the
+// password_file parameter or from PLAKAR_WEBDAV_PASSWORD.
+package webdav
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/PlakarLabs/plakar/compression"
+	"github.com/PlakarLabs/plakar/storage"
+	"github.com/PlakarLabs/plakar/storage/backends/internal/layout"
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type Repository struct {
+	config storage.RepositoryConfig
+
+	layout.Layout
+	client *client
+}
+
+func init() {
+	storage.Register("webdav", NewRepository)
+}
+
+func NewRepository() storage.RepositoryBackend {
+	return &Repository{}
+}
+
+// readPassword returns the password to authenticate with, read from the file
+// named by the password_file parameter or from PLAKAR_WEBDAV_PASSWORD.
+// Passwords are not accepted in the location itself as it ends up in logs.
+func readPassword(location *url.URL) (string, error) {
+	if _, ok := location.User.Password(); ok {
+		return "", fmt.Errorf("%s: password in location, use password_file or PLAKAR_WEBDAV_PASSWORD", location.Redacted())
+	}
+	if passwordFile := location.Query().Get("password_file"); passwordFile != "" {
+		data, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return os.Getenv("PLAKAR_WEBDAV_PASSWORD"), nil
+}
+
+func (repository *Repository) connect(location string) error {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "webdav" && parsed.Scheme != "webdavs" {
+		return fmt.Errorf("unsupported location: %s", parsed.Redacted())
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("missing host: %s", parsed.Redacted())
+	}
+	if parsed.Path == "" || parsed.Path == "/" {
+		return fmt.Errorf("missing path: %s", parsed.Redacted())
+	}
+
+	username := ""
+	if parsed.User != nil {
+		username = parsed.User.Username()
+	}
+	password, err := readPassword(parsed)
+	if err != nil {
+		return err
+	}
+
+	repository.Root = path.Clean(parsed.Path)
+	repository.client = newClient(parsed, username, password)
+	return nil
+}
+
+func (repository *Repository) Create(location string, config storage.RepositoryConfig) error {
+	if err := repository.connect(location); err != nil {
+		return err
+	}
+
+	// buckets are created as they are written to
+	directories := []string{
+		repository.Root,
+		repository.PathIndexes(),
+		repository.PathLocks(),
+		repository.PathBlobs(),
+		repository.PathPackfiles(),
+		repository.PathSnapshots(),
+		repository.PathTmp(),
+		repository.PathPurge(),
+	}
+	for _, directory := range directories {
+		if _, err := repository.client.mkcol(directory); err != nil {
+			return err
+		}
+	}
+
+	jconfig, err := msgpack.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	compressedConfig, err := compression.Deflate("gzip", jconfig)
+	if err != nil {
+		return err
+	}
+
+	if err := repository.client.put(path.Join(repository.Root, "CONFIG"), compressedConfig); err != nil {
+		return err
+	}
+
+	repository.config = config
+
+	return nil
+}
+
+func (repository *Repository) Open(location string) error {
+	if err := repository.connect(location); err != nil {
+		return err
+	}
+
+	compressed, err := repository.client.get(path.Join(repository.Root, "CONFIG"))
+	if err != nil {
+		return err
+	}
+
+	jconfig, err := compression.Inflate("gzip", compressed)
+	if err != nil {
+		return err
+	}
+
+	config := storage.RepositoryConfig{}
+	err = msgpack.Unmarshal(jconfig, &config)
+	if err != nil {
+		return err
+	}
+
+	repository.config = config
+
+	return nil
+}
+
+func (repository *Repository) Configuration() storage.RepositoryConfig {
+	return repository.config
+}
+
+func (repository *Repository) Close() error {
+	if repository.client != nil {
+		repository.client.close()
+	}
+	return nil
+}
+
+// mkbucket creates the bucket of a pathname unless it exists already
+func (repository *Repository) mkbucket(pathname string) error {
+	status, err := repository.client.mkcol(path.Dir(pathname))
+	if err != nil && status != http.StatusMethodNotAllowed {
+		return err
+	}
+	return nil
+}
+
+// writeFile uploads to a pathname, creating its bucket if missing
+func (repository *Repository) writeFile(pathname string, data []byte) error {
+	err := repository.client.put(pathname, data)
+	if err == nil {
+		return nil
+	}
+
+	// servers report a missing parent collection as a conflict or, for
+	// some of them, as a missing resource
+	if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, errConflict) {
+		return err
+	}
+	if err := repository.mkbucket(pathname); err != nil {
+		return err
+	}
+	return repository.client.put(pathname, data)
+}
+
+// listBuckets returns the members of the buckets of a directory
+func (repository *Repository) listBuckets(pathname string) ([]entry, error) {
+	ret := make([]entry, 0)
+
+	buckets, err := repository.client.list(pathname)
+	if err != nil {
+		return ret, err
+	}
+
+	for _, bucket := range buckets {
+		if !bucket.isDir {
+			continue
+		}
+		entries, err := repository.client.list(path.Join(pathname, bucket.name))
+		if err != nil {
+			return ret, err
+		}
+		for _, entry := range entries {
+			if entry.isDir {
+				continue
+			}
+			ret = append(ret, entry)
+		}
+	}
+	return ret, nil
+}
+
+func (repository *Repository) listChecksums(pathname string) ([][32]byte, error) {
+	ret := make([][32]byte, 0)
+
+	entries, err := repository.listBuckets(pathname)
+	if err != nil {
+		return ret, err
+	}
+
+	for _, entry := range entries {
+		t, err := hex.DecodeString(entry.name)
+		if err != nil {
+			return nil, err
+		}
+		if len(t) != 32 {
+			continue
+		}
+		var t32 [32]byte
+		copy(t32[:], t)
+		ret = append(ret, t32)
+	}
+	return ret, nil
+}
+
+/* Snapshots */
+func (repository *Repository) GetSnapshots() ([]uuid.UUID, error) {
+	ret := make([]uuid.UUID, 0)
+
+	entries, err := repository.listBuckets(repository.PathSnapshots())
+	if err != nil {
+		return ret, err
+	}
+
+	for _, entry := range entries {
+		indexID, err := uuid.Parse(entry.name)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, indexID)
+	}
+	return ret, nil
+}
+
+func (repository *Repository) PutSnapshot(indexID uuid.UUID, data []byte) error {
+	return repository.writeFile(repository.PathSnapshot(indexID), data)
+}
+
+func (repository *Repository) GetSnapshot(indexID uuid.UUID) ([]byte, error) {
+	return repository.client.get(repository.PathSnapshot(indexID))
+}
+
+func (repository *Repository) DeleteSnapshot(indexID uuid.UUID) error {
+	return repository.client.delete(repository.PathSnapshot(indexID))
+}
+
+func (repository *Repository) Commit(indexID uuid.UUID, data []byte) error {
+	// the snapshot is uploaded aside and only shows once complete
+	tmp := path.Join(repository.PathTmp(), fmt.Sprintf("%s.%s", indexID, uuid.Must(uuid.NewRandom())))
+	if err := repository.client.put(tmp, data); err != nil {
+		return err
+	}
+
+	pathname := repository.PathSnapshot(indexID)
+	if err := repository.mkbucket(pathname); err != nil {
+		repository.client.delete(tmp)
+		return err
+	}
+	if err := repository.client.move(tmp, pathname); err != nil {
+		repository.client.delete(tmp)
+		return err
+	}
+	return nil
+}
+
+/* Locks */
+func (repository *Repository) GetLocks() ([]uuid.UUID, error) {
+	ret := make([]uuid.UUID, 0)
+
+	locks, err := repository.client.list(repository.PathLocks())
+	if err != nil {
+		return ret, err
+	}
+
+	for _, lock := range locks {
+		if lock.isDir {
+			continue
+		}
+		indexID, err := uuid.Parse(lock.name)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, indexID)
+	}
+	return ret, nil
+}
+
+func (repository *Repository) PutLock(indexID uuid.UUID, data []byte) error {
+	return repository.client.put(repository.PathLock(indexID), data)
+}
+
+func (repository *Repository) GetLock(indexID uuid.UUID) ([]byte, error) {
+	return repository.client.get(repository.PathLock(indexID))
+}
+
+func (repository *Repository) DeleteLock(indexID uuid.UUID) error {
+	return repository.client.delete(repository.PathLock(indexID))
+}
+
+/* Blobs */
+func (repository *Repository) GetBlobs() ([][32]byte, error) {
+	return repository.listChecksums(repository.PathBlobs())
+}
+
+func (repository *Repository) PutBlob(checksum [32]byte, data []byte) error {
+	return repository.writeFile(repository.PathBlob(checksum), data)
+}
+
+func (repository *Repository) CheckBlob(checksum [32]byte) (bool, error) {
+	return repository.client.exists(repository.PathBlob(checksum))
+}
+
+func (repository *Repository) GetBlob(checksum [32]byte) ([]byte, error) {
+	return repository.client.get(repository.PathBlob(checksum))
+}
+
+func (repository *Repository) DeleteBlob(checksum [32]byte) error {
+	return repository.client.delete(repository.PathBlob(checksum))
+}
+
+/* Indexes */
+func (repository *Repository) GetIndexes() ([][32]byte, error) {
+	return repository.listChecksums(repository.PathIndexes())
+}
+
+func (repository *Repository) PutIndex(checksum [32]byte, data []byte) error {
+	return repository.writeFile(repository.PathIndex(checksum), data)
+}
+
+func (repository *Repository) GetIndex(checksum [32]byte) ([]byte, error) {
+	return repository.client.get(repository.PathIndex(checksum))
+}
+
+func (repository *Repository) DeleteIndex(checksum [32]byte) error {
+	return repository.client.delete(repository.PathIndex(checksum))
+}
+
+/* Packfiles */
+func (repository *Repository) GetPackfiles() ([][32]byte, error) {
+	return repository.listChecksums(repository.PathPackfiles())
+}
+
+func (repository *Repository) PutPackfile(checksum [32]byte, data []byte) error {
+	return repository.writeFile(repository.PathPackfile(checksum), data)
+}
+
+func (repository *Repository) GetPackfile(checksum [32]byte) ([]byte, error) {
+	return repository.client.get(repository.PathPackfile(checksum))
+}
+
+func (repository *Repository) GetPackfileSubpart(checksum [32]byte, offset uint32, length uint32) ([]byte, error) {
+	return repository.client.getRange(repository.PathPackfile(checksum), offset, length)
+}
+
+func (repository *Repository) DeletePackfile(checksum [32]byte) error {
+	return repository.client.delete(repository.PathPackfile(checksum))
+}
+
+// Usage sums the sizes listed for packfiles and blobs
+func (repository *Repository) Usage() (uint64, error) {
+	usage := uint64(0)
+	for _, pathname := range []string{repository.PathPackfiles(), repository.PathBlobs()} {
+		entries, err := repository.listBuckets(pathname)
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			usage += uint64(entry.size)
+		}
+	}
+	return usage, nil
+}
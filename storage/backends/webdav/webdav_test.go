@@ -0,0 +1,174 @@
+package webdav
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/storage/backends/internal/backendtest"
+	davserver "golang.org/x/net/webdav"
+)
+
+func TestMain(m *testing.M) {
+	// pushes log their progress
+	logger.Start()
+	os.Exit(m.Run())
+}
+
+// server serves a directory over WebDAV under /dav, with basic
+// authentication, and records the ranges it was asked for
+type server struct {
+	*httptest.Server
+	dir string
+
+	ignoreRanges bool
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func serve(t *testing.T) *server {
+	t.Setenv("PLAKAR_WEBDAV_PASSWORD", "secret")
+
+	s := &server{dir: t.TempDir()}
+	handler := &davserver.Handler{
+		Prefix:     "/dav",
+		FileSystem: davserver.Dir(s.dir),
+		LockSystem: davserver.NewMemLS(),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="plakar"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			s.mu.Lock()
+			s.ranges = append(s.ranges, rng)
+			s.mu.Unlock()
+			if s.ignoreRanges {
+				r.Header.Del("Range")
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// location returns the location of a repository on the server
+func (s *server) location(name string) string {
+	return "webdav://user@" + strings.TrimPrefix(s.URL, "http://") + "/dav/" + name
+}
+
+func TestLocation(t *testing.T) {
+	s := serve(t)
+
+	for _, location := range []string{
+		"webdav://host",
+		"webdav://host/",
+		"webdav:///repository",
+		"http://host/repository",
+	} {
+		if err := NewRepository().Open(location); err == nil {
+			t.Errorf("%s: expected an error", location)
+		}
+	}
+
+	if err := NewRepository().Open(s.location("missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing repository, got %v", err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	s := serve(t)
+
+	// passwords in locations are refused without being echoed
+	location := strings.Replace(s.location("repository"), "user@", "user:secret@", 1)
+	if err := NewRepository().Create(location, backendtest.Config()); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected the location to be refused without its password, got %v", err)
+	}
+
+	t.Setenv("PLAKAR_WEBDAV_PASSWORD", "wrong")
+	if err := NewRepository().Create(s.location("repository"), backendtest.Config()); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected a denied access, got %v", err)
+	}
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRepository().Create(s.location("repository")+"?password_file="+passwordFile, backendtest.Config()); err != nil {
+		t.Errorf("expected the password file to be used, got %v", err)
+	}
+	if err := NewRepository().Open(s.location("repository") + "?password_file=" + filepath.Join(t.TempDir(), "missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing password file, got %v", err)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	s := serve(t)
+
+	backendtest.TestBackend(t, NewRepository, s.location("repository"), filepath.Join(s.dir, "repository"))
+	if len(s.ranges) == 0 || s.ranges[0] != "bytes=123457-123486" {
+		t.Errorf("expected the subpart to be read with a range request, got %v", s.ranges)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	s := serve(t)
+
+	repository := NewRepository()
+	if err := repository.Create(s.location("repository"), backendtest.Config()); err != nil {
+		t.Fatal(err)
+	}
+	defer repository.Close()
+
+	// buckets are only created when written to
+	pathname := filepath.Join(s.dir, "repository", "packfiles")
+	if entries, err := os.ReadDir(pathname); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no bucket yet, got %v: %v", entries, err)
+	}
+	checksum := sha256.Sum256([]byte("packfile"))
+	if err := repository.PutPackfile(checksum, []byte("packfile")); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(pathname); err != nil || len(entries) != 1 {
+		t.Fatalf("expected a bucket, got %v: %v", entries, err)
+	}
+}
+
+func TestIgnoredRanges(t *testing.T) {
+	s := serve(t)
+	s.ignoreRanges = true
+
+	repository := NewRepository()
+	if err := repository.Create(s.location("repository"), backendtest.Config()); err != nil {
+		t.Fatal(err)
+	}
+	defer repository.Close()
+
+	packfile := bytes.Repeat([]byte("0123456789"), 1000)
+	packfileChecksum := sha256.Sum256(packfile)
+	if err := repository.PutPackfile(packfileChecksum, packfile); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := repository.GetPackfileSubpart(packfileChecksum, 4321, 100); err != nil || !bytes.Equal(data, packfile[4321:4421]) {
+		t.Fatalf("unexpected packfile subpart %q: %v", data, err)
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	s := serve(t)
+
+	backendtest.TestPushPull(t, s.location("repository"))
+}
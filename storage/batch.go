@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/profiler"
+)
+
+// resources that can be listed page by page
+const (
+	ResourceBlobs     = "blobs"
+	ResourceIndexes   = "indexes"
+	ResourcePackfiles = "packfiles"
+)
+
+// ErrBatchUnsupported is returned by batch backends talking to a server
+// that does not know batch requests, items are then requested one by one.
+var ErrBatchUnsupported = errors.New("batch requests not supported")
+
+// Subpart is an area of a packfile
+type Subpart struct {
+	Offset uint32
+	Length uint32
+}
+
+// BatchBackend is implemented by backends for which each request costs a
+// round-trip, they transfer several items per request.
+type BatchBackend interface {
+	CheckBlobBatch(checksums [][32]byte) ([]bool, error)
+	GetBlobBatch(checksums [][32]byte) ([][]byte, error)
+	GetPackfileSubpartBatch(checksum [32]byte, subparts []Subpart) ([][]byte, error)
+
+	// ListPage returns up to limit checksums of a resource sorted after
+	// the given one, and whether more follow
+	ListPage(resource string, after [32]byte, limit int) ([][32]byte, bool, error)
+}
+
+func (repository *Repository) batchBackend() (BatchBackend, bool) {
+	backend, ok := repository.backend.(BatchBackend)
+	return backend, ok
+}
+
+func (repository *Repository) CheckBlobBatch(checksums [][32]byte) ([]bool, error) {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("storage.CheckBlobBatch", time.Since(t0))
+		logger.Trace("storage", "CheckBlobBatch(%d): %s", len(checksums), time.Since(t0))
+	}()
+
+	if backend, ok := repository.batchBackend(); ok {
+		repository.readSharedLock.Lock()
+		exists, err := backend.CheckBlobBatch(checksums)
+		repository.readSharedLock.Unlock()
+		if err != ErrBatchUnsupported {
+			return exists, err
+		}
+	}
+
+	exists := make([]bool, len(checksums))
+	for i, checksum := range checksums {
+		var err error
+		exists[i], err = repository.CheckBlob(checksum)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return exists, nil
+}
+
+func (repository *Repository) GetBlobBatch(checksums [][32]byte) ([][]byte, error) {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("storage.GetBlobBatch", time.Since(t0))
+		logger.Trace("storage", "GetBlobBatch(%d): %s", len(checksums), time.Since(t0))
+	}()
+
+	if backend, ok := repository.batchBackend(); ok {
+		repository.readSharedLock.Lock()
+		blobs, err := backend.GetBlobBatch(checksums)
+		repository.readSharedLock.Unlock()
+		if err != ErrBatchUnsupported {
+			if err == nil {
+				for _, data := range blobs {
+					atomic.AddUint64(&repository.rBytes, uint64(len(data)))
+				}
+			}
+			return blobs, err
+		}
+	}
+
+	blobs := make([][]byte, len(checksums))
+	for i, checksum := range checksums {
+		var err error
+		blobs[i], err = repository.GetBlob(checksum)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blobs, nil
+}
+
+func (repository *Repository) GetPackfileSubpartBatch(checksum [32]byte, subparts []Subpart) ([][]byte, error) {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("storage.GetPackfileSubpartBatch", time.Since(t0))
+		logger.Trace("storage", "GetPackfileSubpartBatch(%016x, %d): %s", checksum, len(subparts), time.Since(t0))
+	}()
+
+	if backend, ok := repository.batchBackend(); ok {
+		repository.readSharedLock.Lock()
+		data, err := backend.GetPackfileSubpartBatch(checksum, subparts)
+		repository.readSharedLock.Unlock()
+		if err != ErrBatchUnsupported {
+			if err == nil {
+				if len(data) != len(subparts) {
+					return nil, fmt.Errorf("packfile %064x: got %d subparts, expected %d", checksum, len(data), len(subparts))
+				}
+				for _, buffer := range data {
+					atomic.AddUint64(&repository.rBytes, uint64(len(buffer)))
+				}
+			}
+			return data, err
+		}
+	}
+
+	data := make([][]byte, len(subparts))
+	for i, subpart := range subparts {
+		var err error
+		data[i], err = repository.GetPackfileSubpart(checksum, subpart.Offset, subpart.Length)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// listings are the sorted listings of backends without pagination being
+// paged through, they are read again when paging starts over
+type listings struct {
+	mu        sync.Mutex
+	resources map[string][][32]byte
+}
+
+// ListPage returns up to limit checksums of a resource sorted after the
+// given one, and whether more follow. Backends without pagination list the
+// whole resource when paging starts, the following pages are read from
+// that listing until the last one is returned.
+func (repository *Repository) ListPage(resource string, after [32]byte, limit int) ([][32]byte, bool, error) {
+	checksums, more, err := repository.listPage(resource, after, limit)
+	if err != ErrBatchUnsupported {
+		return checksums, more, err
+	}
+
+	repository.listings.mu.Lock()
+	checksums, exists := repository.listings.resources[resource]
+	repository.listings.mu.Unlock()
+	if !exists || after == ([32]byte{}) {
+		checksums, err = repository.list(resource)
+		if err != nil {
+			return nil, false, err
+		}
+		sortChecksums(checksums)
+	}
+
+	page, more, err := paginate(checksums, after, limit)
+	if err != nil {
+		return nil, false, err
+	}
+
+	repository.listings.mu.Lock()
+	defer repository.listings.mu.Unlock()
+	if more {
+		repository.listings.resources[resource] = checksums
+	} else {
+		delete(repository.listings.resources, resource)
+	}
+	return page, more, nil
+}
+
+func (repository *Repository) listPage(resource string, after [32]byte, limit int) ([][32]byte, bool, error) {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("storage.ListPage", time.Since(t0))
+		logger.Trace("storage", "ListPage(%s, %016x, %d): %s", resource, after, limit, time.Since(t0))
+	}()
+
+	backend, ok := repository.batchBackend()
+	if !ok {
+		return nil, false, ErrBatchUnsupported
+	}
+	repository.readSharedLock.Lock()
+	defer repository.readSharedLock.Unlock()
+	return backend.ListPage(resource, after, limit)
+}
+
+// ForEachPage calls fn with the checksums of a resource, limit at a time,
+// as they are listed. Backends without pagination are listed once.
+func (repository *Repository) ForEachPage(resource string, limit int, fn func(checksums [][32]byte) error) error {
+	var listed [][32]byte
+	paginated := true
+	for after := [32]byte{}; ; {
+		var page [][32]byte
+		var more bool
+		err := ErrBatchUnsupported
+		if paginated {
+			page, more, err = repository.listPage(resource, after, limit)
+		}
+		if err == ErrBatchUnsupported {
+			if paginated {
+				paginated = false
+				listed, err = repository.list(resource)
+				if err != nil {
+					return err
+				}
+				sortChecksums(listed)
+			}
+			page, more, err = paginate(listed, after, limit)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(page) != 0 {
+			if err := fn(page); err != nil {
+				return err
+			}
+			after = page[len(page)-1]
+		}
+		if !more || len(page) == 0 {
+			return nil
+		}
+	}
+}
+
+func (repository *Repository) list(resource string) ([][32]byte, error) {
+	switch resource {
+	case ResourceBlobs:
+		return repository.GetBlobs()
+	case ResourceIndexes:
+		return repository.GetIndexes()
+	case ResourcePackfiles:
+		return repository.GetPackfiles()
+	default:
+		return nil, fmt.Errorf("unknown resource: %s", resource)
+	}
+}
+
+// Paginate returns the page of checksums sorted after the given one, the
+// zero checksum starts from the beginning.
+func Paginate(checksums [][32]byte, after [32]byte, limit int) ([][32]byte, bool, error) {
+	sortChecksums(checksums)
+	return paginate(checksums, after, limit)
+}
+
+func sortChecksums(checksums [][32]byte) {
+	sort.Slice(checksums, func(i, j int) bool {
+		return bytes.Compare(checksums[i][:], checksums[j][:]) < 0
+	})
+}
+
+// paginate returns a page of checksums already sorted
+func paginate(checksums [][32]byte, after [32]byte, limit int) ([][32]byte, bool, error) {
+	if limit <= 0 {
+		return nil, false, fmt.Errorf("invalid page size: %d", limit)
+	}
+
+	start := 0
+	if after != ([32]byte{}) {
+		start = sort.Search(len(checksums), func(i int) bool {
+			return bytes.Compare(checksums[i][:], after[:]) > 0
+		})
+	}
+
+	end := start + limit
+	if end >= len(checksums) {
+		return checksums[start:], false, nil
+	}
+	return checksums[start:end], true, nil
+}
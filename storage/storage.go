@@ -97,6 +97,12 @@ type RepositoryBackend interface {
 	Close() error
 }
 
+// UsageBackend is implemented by backends able to tell how many bytes
+// their packfiles and blobs use without reading them
+type UsageBackend interface {
+	Usage() (uint64, error)
+}
+
 var muBackends sync.Mutex
 var backends map[string]func() RepositoryBackend = make(map[string]func() RepositoryBackend)
 
@@ -121,6 +127,8 @@ type Repository struct {
 	readSharedLock  *locking.SharedLock
 
 	bufferedPackfiles chan struct{}
+
+	listings *listings
 }
 
 func Register(name string, backend func() RepositoryBackend) {
@@ -161,6 +169,10 @@ func New(location string) (*Repository, error) {
 			backendName = "database"
 		} else if strings.HasPrefix(location, "s3://") {
 			backendName = "s3"
+		} else if strings.HasPrefix(location, "sftp://") {
+			backendName = "sftp"
+		} else if strings.HasPrefix(location, "webdav://") || strings.HasPrefix(location, "webdavs://") {
+			backendName = "webdav"
 		} else if strings.HasPrefix(location, "null://") {
 			backendName = "null"
 		} else if strings.HasPrefix(location, "fs://") {
@@ -195,6 +207,7 @@ func New(location string) (*Repository, error) {
 		repository.writeSharedLock = locking.NewSharedLock("storage.write", runtime.NumCPU()*8+1)
 		repository.readSharedLock = locking.NewSharedLock("storage.read", runtime.NumCPU()*8+1)
 		repository.bufferedPackfiles = make(chan struct{}, runtime.NumCPU()*2+1)
+		repository.listings = &listings{resources: make(map[string][][32]byte)}
 		return repository, nil
 	}
 }
@@ -247,6 +260,21 @@ func Create(location string, configuration RepositoryConfig) (*Repository, error
 	return repository, nil
 }
 
+// Usage returns the number of bytes used by packfiles and blobs
+func (repository *Repository) Usage() (uint64, error) {
+	backend, ok := repository.backend.(UsageBackend)
+	if !ok {
+		return 0, fmt.Errorf("%s: backend cannot report its usage", repository.Location)
+	}
+
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("storage.Usage", time.Since(t0))
+		logger.Trace("storage", "Usage(): %s", time.Since(t0))
+	}()
+	return backend.Usage()
+}
+
 func (repository *Repository) GetRBytes() uint64 {
 	return atomic.LoadUint64(&repository.rBytes)
 }
@@ -20,6 +20,7 @@ import (
 	_ "embed"
 	"fmt"
 	"html/template"
+	"io"
 	"math"
 	"math/rand"
 	"mime"
@@ -464,21 +465,24 @@ func raw(w http.ResponseWriter, r *http.Request) {
 		if download != "" {
 			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filepath.Base(path)))
 		}
-		for _, chunkChecksum := range object.Chunks {
-			data, err := snap.GetChunk(chunkChecksum)
-			if err != nil {
-			}
-			w.Write(data)
+		rd, err := snap.NewReader(path)
+		if err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
 		}
+		io.Copy(w, rd)
 		return
 	}
 
-	content := []byte("")
-	for _, chunkChecksum := range object.Chunks {
-		data, err := snap.GetChunk(chunkChecksum)
-		if err != nil {
-		}
-		content = append(content, data...)
+	rd, err := snap.NewReader(path)
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	content, err := io.ReadAll(rd)
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
 	}
 
 	lexer := lexers.Match(path)
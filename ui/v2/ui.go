@@ -35,6 +35,7 @@ import (
 	"time"
 
 	"github.com/PlakarLabs/plakar/network"
+	"github.com/PlakarLabs/plakar/server/api"
 	"github.com/PlakarLabs/plakar/snapshot"
 	"github.com/PlakarLabs/plakar/snapshot/header"
 	"github.com/PlakarLabs/plakar/storage"
@@ -451,6 +452,10 @@ func Ui(repository *storage.Repository, addr string, spawn bool) error {
 
 	r := mux.NewRouter()
 
+	api.New(func(r *http.Request, requestType string) (*storage.Repository, int, error) {
+		return lrepository, 0, nil
+	}).Routes(r)
+
 	r.PathPrefix("/api/config").HandlerFunc(getConfigHandler).Methods("GET")
 	r.PathPrefix("/api/snapshots").HandlerFunc(getSnapshotsHandler).Methods("GET")
 	r.PathPrefix("/api/snapshot/{snapshot}:{path:.+}/").HandlerFunc(getSnapshotHandler).Methods("GET")
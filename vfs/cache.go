@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package vfs
+
+import (
+	"container/list"
+	"sync"
+)
+
+// upper bound on the size of the directory blobs kept decoded in memory,
+// measured as the size of the blobs read from the store
+const directoryCacheSize = 16 << 20
+
+type blobCacheEntry struct {
+	checksum [32]byte
+	value    interface{}
+	size     uint64
+}
+
+// blobCache is a bounded LRU of decoded directory blobs, so listings walking
+// the tree one after the other do not read and decode every blob again.
+type blobCache struct {
+	mu      sync.Mutex
+	maxSize uint64
+	size    uint64
+	lru     *list.List
+	entries map[[32]byte]*list.Element
+}
+
+func newBlobCache(maxSize uint64) *blobCache {
+	return &blobCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[[32]byte]*list.Element),
+	}
+}
+
+func (cache *blobCache) Get(checksum [32]byte) (interface{}, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	elem, exists := cache.entries[checksum]
+	if !exists {
+		return nil, false
+	}
+	cache.lru.MoveToFront(elem)
+	return elem.Value.(*blobCacheEntry).value, true
+}
+
+func (cache *blobCache) Put(checksum [32]byte, value interface{}, size uint64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if _, exists := cache.entries[checksum]; exists {
+		return
+	}
+	if size > cache.maxSize {
+		return
+	}
+
+	cache.entries[checksum] = cache.lru.PushFront(&blobCacheEntry{checksum: checksum, value: value, size: size})
+	cache.size += size
+
+	for cache.size > cache.maxSize {
+		elem := cache.lru.Back()
+		entry := elem.Value.(*blobCacheEntry)
+		cache.lru.Remove(elem)
+		delete(cache.entries, entry.checksum)
+		cache.size -= entry.size
+	}
+}
@@ -20,6 +20,7 @@
 package vfs
 
 import (
+	"bytes"
 	"os"
 	"syscall"
 	"time"
@@ -29,14 +30,16 @@ import (
 )
 
 type FileInfo struct {
-	Lname    string      `json:"Name" msgpack:"Name"`
-	Lsize    int64       `json:"Size" msgpack:"Size"`
-	Lmode    os.FileMode `json:"Mode" msgpack:"Mode"`
-	LmodTime time.Time   `json:"ModTime" msgpack:"ModTime"`
-	Ldev     uint64      `json:"Dev" msgpack:"Dev"`
-	Lino     uint64      `json:"Ino" msgpack:"Ino"`
-	Luid     uint64      `json:"Uid" msgpack:"Uid"`
-	Lgid     uint64      `json:"Gid" msgpack:"Gid"`
+	Lname    string            `json:"Name" msgpack:"Name"`
+	Lsize    int64             `json:"Size" msgpack:"Size"`
+	Lmode    os.FileMode       `json:"Mode" msgpack:"Mode"`
+	LmodTime time.Time         `json:"ModTime" msgpack:"ModTime"`
+	Ldev     uint64            `json:"Dev" msgpack:"Dev"`
+	Lino     uint64            `json:"Ino" msgpack:"Ino"`
+	Luid     uint64            `json:"Uid" msgpack:"Uid"`
+	Lgid     uint64            `json:"Gid" msgpack:"Gid"`
+	Lrdev    uint64            `json:"Rdev,omitempty" msgpack:"Rdev,omitempty"`
+	Lxattrs  map[string][]byte `json:"Xattrs,omitempty" msgpack:"Xattrs,omitempty"`
 }
 
 func (f FileInfo) Name() string {
@@ -71,6 +74,37 @@ func (f FileInfo) Gid() uint64 {
 	return f.Lgid
 }
 
+func (f FileInfo) Rdev() uint64 {
+	return f.Lrdev
+}
+
+func (f FileInfo) Xattrs() map[string][]byte {
+	return f.Lxattrs
+}
+
+// Equal reports whether both entries describe the same inode state,
+// FileInfo holds a map and cannot be compared with ==.
+func (f FileInfo) Equal(other FileInfo) bool {
+	if len(f.Lxattrs) != len(other.Lxattrs) {
+		return false
+	}
+	for name, value := range f.Lxattrs {
+		otherValue, exists := other.Lxattrs[name]
+		if !exists || !bytes.Equal(value, otherValue) {
+			return false
+		}
+	}
+	return f.Lname == other.Lname &&
+		f.Lsize == other.Lsize &&
+		f.Lmode == other.Lmode &&
+		f.LmodTime.Equal(other.LmodTime) &&
+		f.Ldev == other.Ldev &&
+		f.Lino == other.Lino &&
+		f.Luid == other.Luid &&
+		f.Lgid == other.Lgid &&
+		f.Lrdev == other.Lrdev
+}
+
 func (f FileInfo) IsDir() bool {
 	return f.Lmode.IsDir()
 }
@@ -89,6 +123,7 @@ func FileInfoFromStat(stat os.FileInfo) FileInfo {
 		Lino:     uint64(stat.Sys().(*syscall.Stat_t).Ino),
 		Luid:     uint64(stat.Sys().(*syscall.Stat_t).Uid),
 		Lgid:     uint64(stat.Sys().(*syscall.Stat_t).Gid),
+		Lrdev:    uint64(stat.Sys().(*syscall.Stat_t).Rdev),
 	}
 }
 
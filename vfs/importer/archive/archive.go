@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package archive
+
+import (
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/PlakarLabs/plakar/vfs/importer"
+)
+
+type entry struct {
+	info   vfs.FileInfo
+	target string
+}
+
+// tree collects archive members keyed by their cleaned absolute pathname
+// and synthesizes the directories that archives are allowed to omit.
+type tree struct {
+	entries map[string]*entry
+	ino     uint64
+}
+
+func newTree() *tree {
+	return &tree{entries: make(map[string]*entry)}
+}
+
+func cleanPathname(name string) string {
+	return path.Clean("/" + strings.TrimPrefix(name, "./"))
+}
+
+func (t *tree) add(pathname string, info vfs.FileInfo, target string) {
+	t.ino++
+	info.Lino = t.ino
+	t.entries[pathname] = &entry{info: info, target: target}
+
+	for dir := path.Dir(pathname); ; dir = path.Dir(dir) {
+		if _, exists := t.entries[dir]; !exists {
+			t.ino++
+			name := path.Base(dir)
+			t.entries[dir] = &entry{info: vfs.NewFileInfo(name, 0, 0700|fs.ModeDir, time.Now(), 0, t.ino, 0, 0)}
+		}
+		if dir == "/" {
+			break
+		}
+	}
+}
+
+// emit sends directories before their content, as the filesystem
+// expects parents to be known when a pathname is inserted.
+func (t *tree) emit(c chan<- importer.ImporterRecord) {
+	pathnames := make([]string, 0, len(t.entries))
+	for pathname := range t.entries {
+		pathnames = append(pathnames, pathname)
+	}
+	sort.Slice(pathnames, func(i, j int) bool {
+		di, dj := strings.Count(pathnames[i], "/"), strings.Count(pathnames[j], "/")
+		if pathnames[i] == "/" || pathnames[j] == "/" {
+			return pathnames[i] == "/" && pathnames[j] != "/"
+		}
+		if di != dj {
+			return di < dj
+		}
+		return pathnames[i] < pathnames[j]
+	})
+
+	for _, pathname := range pathnames {
+		e := t.entries[pathname]
+		c <- importer.ImporterRecord{Pathname: pathname, Stat: e.info, Target: e.target}
+	}
+}
+
+// makedev encodes a device number the way Linux reports it in st_rdev
+func makedev(major, minor uint64) uint64 {
+	return (minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32)
+}
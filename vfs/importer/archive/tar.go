@@ -0,0 +1,340 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/PlakarLabs/plakar/vfs/importer"
+	"github.com/klauspost/compress/zstd"
+)
+
+// tarMember locates the content of a regular file within the archive,
+// sparse members and members of compressed archives can't be read in
+// place and are located by their index.
+type tarMember struct {
+	index  int
+	offset int64
+	size   int64
+	sparse bool
+}
+
+// TarImporter reads plain tar archives in place. Compressed archives
+// can't be read at random offsets, Scan records the index of members as
+// it decompresses the headers and Open reads them from a single stream
+// that only starts over when a member is opened out of the archive order,
+// which Order provides. Hardlinks to a member already read start over.
+type TarImporter struct {
+	importer.ImporterBackend
+
+	location   string
+	archive    string
+	compressed bool
+	members    map[string]*tarMember
+	stream     tarStream
+}
+
+func init() {
+	importer.Register("tar", NewTarImporter)
+}
+
+func NewTarImporter() importer.ImporterBackend {
+	return &TarImporter{}
+}
+
+func (p *TarImporter) Begin(location string) error {
+	p.location = location
+	p.archive = strings.TrimPrefix(location, "tar://")
+	p.members = make(map[string]*tarMember)
+	return nil
+}
+
+// decompress returns a reader over the uncompressed stream of fp if it
+// starts with a known compression magic, or nil for a plain tar.
+func decompress(fp *os.File) (io.Reader, error) {
+	magic, err := bufio.NewReader(fp).Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(fp)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		decoder, err := zstd.NewReader(fp)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(fp), nil
+	}
+	return nil, nil
+}
+
+func isSparse(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *TarImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, error) {
+	fp, err := os.Open(p.archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	zr, err := decompress(fp)
+	if err != nil {
+		fp.Close()
+		return nil, nil, err
+	}
+	p.compressed = zr != nil
+
+	var rd io.Reader = fp
+	if p.compressed {
+		rd = zr
+	}
+
+	c := make(chan importer.ImporterRecord)
+	cerr := make(chan error)
+
+	go func() {
+		defer fp.Close()
+		if closer, ok := zr.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		t := newTree()
+		tr := tar.NewReader(rd)
+		for index := 0; ; index++ {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				cerr <- fmt.Errorf("%s: %w", p.archive, err)
+				break
+			}
+
+			pathname := cleanPathname(header.Name)
+			fi := header.FileInfo()
+			info := vfs.NewFileInfo(fi.Name(), header.Size, fi.Mode(), header.ModTime, 0, 0, uint64(header.Uid), uint64(header.Gid))
+			if pathname == "/" {
+				info.Lname = "/"
+			}
+
+			switch header.Typeflag {
+			case tar.TypeReg, tar.TypeGNUSparse:
+				member := &tarMember{index: index, size: header.Size, sparse: isSparse(header)}
+				if !p.compressed {
+					member.offset, err = fp.Seek(0, io.SeekCurrent)
+					if err != nil {
+						cerr <- err
+						continue
+					}
+				}
+				p.members[pathname] = member
+
+			case tar.TypeLink:
+				// hardlinks share the content of a previous member
+				linked, exists := p.members[cleanPathname(header.Linkname)]
+				if !exists {
+					cerr <- fmt.Errorf("%s: %s: unknown hardlink target %s", p.archive, header.Name, header.Linkname)
+					continue
+				}
+				p.members[pathname] = linked
+				info.Lsize = linked.size
+
+			case tar.TypeChar, tar.TypeBlock:
+				info.Lrdev = makedev(uint64(header.Devmajor), uint64(header.Devminor))
+			}
+
+			for key, value := range header.PAXRecords {
+				if strings.HasPrefix(key, "SCHILY.xattr.") {
+					if info.Lxattrs == nil {
+						info.Lxattrs = make(map[string][]byte)
+					}
+					info.Lxattrs[strings.TrimPrefix(key, "SCHILY.xattr.")] = []byte(value)
+				}
+			}
+
+			target := ""
+			if header.Typeflag == tar.TypeSymlink {
+				target = header.Linkname
+			}
+			t.add(pathname, info, target)
+		}
+
+		t.emit(c)
+		close(cerr)
+		close(c)
+	}()
+	return c, cerr, nil
+}
+
+type memberReader struct {
+	io.Reader
+	fp *os.File
+}
+
+func (rd *memberReader) Close() error {
+	return rd.fp.Close()
+}
+
+// tarStream is the decompressed stream of an archive, it is held by the
+// reader of a member until closed.
+type tarStream struct {
+	mu   sync.Mutex
+	fp   *os.File
+	zr   io.Reader
+	tr   *tar.Reader
+	next int
+}
+
+func (stream *tarStream) reset() {
+	if closer, ok := stream.zr.(io.Closer); ok {
+		closer.Close()
+	}
+	if stream.fp != nil {
+		stream.fp.Close()
+	}
+	stream.fp, stream.zr, stream.tr, stream.next = nil, nil, nil, 0
+}
+
+// seek positions the stream at the content of the member at index, the
+// caller holds stream.mu
+func (stream *tarStream) seek(archive string, index int) error {
+	if stream.tr == nil || index < stream.next {
+		stream.reset()
+
+		fp, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		zr, err := decompress(fp)
+		if err != nil {
+			fp.Close()
+			return err
+		}
+		if zr == nil {
+			fp.Close()
+			return fmt.Errorf("%s: archive is no longer compressed", archive)
+		}
+		stream.fp, stream.zr, stream.tr = fp, zr, tar.NewReader(zr)
+	}
+
+	for ; stream.next <= index; stream.next++ {
+		if _, err := stream.tr.Next(); err != nil {
+			stream.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+type streamReader struct {
+	io.Reader
+	stream *tarStream
+	once   sync.Once
+}
+
+func (rd *streamReader) Close() error {
+	rd.once.Do(rd.stream.mu.Unlock)
+	return nil
+}
+
+func (p *TarImporter) Open(pathname string) (io.ReadCloser, error) {
+	member, exists := p.members[cleanPathname(pathname)]
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+
+	if p.compressed {
+		p.stream.mu.Lock()
+		if err := p.stream.seek(p.archive, member.index); err != nil {
+			p.stream.mu.Unlock()
+			return nil, err
+		}
+		return &streamReader{Reader: p.stream.tr, stream: &p.stream}, nil
+	}
+
+	fp, err := os.Open(p.archive)
+	if err != nil {
+		return nil, err
+	}
+
+	if !member.sparse {
+		return &memberReader{Reader: io.NewSectionReader(fp, member.offset, member.size), fp: fp}, nil
+	}
+
+	// headers are parsed again up to the member, content is seeked over
+	tr := tar.NewReader(fp)
+	for i := 0; i <= member.index; i++ {
+		if _, err := tr.Next(); err != nil {
+			fp.Close()
+			return nil, err
+		}
+	}
+	return &memberReader{Reader: tr, fp: fp}, nil
+}
+
+// Order returns the regular members of compressed archives in the order
+// they are stored, plain archives are read in any order.
+func (p *TarImporter) Order() []string {
+	if !p.compressed {
+		return nil
+	}
+	pathnames := make([]string, 0, len(p.members))
+	for pathname := range p.members {
+		pathnames = append(pathnames, pathname)
+	}
+	sort.Slice(pathnames, func(i, j int) bool {
+		mi, mj := p.members[pathnames[i]], p.members[pathnames[j]]
+		if mi.index != mj.index {
+			return mi.index < mj.index
+		}
+		return pathnames[i] < pathnames[j]
+	})
+	return pathnames
+}
+
+func (p *TarImporter) End() error {
+	p.stream.mu.Lock()
+	defer p.stream.mu.Unlock()
+	p.stream.reset()
+	return nil
+}
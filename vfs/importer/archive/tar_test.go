@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestTarImporterGzip(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "test.tar.gz")
+	fp, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(fp)
+	tw := tar.NewWriter(gz)
+	mtime := time.Unix(1700000000, 0)
+	tw.WriteHeader(&tar.Header{Name: "dir/file", Mode: 0640, Size: 5, Uid: 1000, Gid: 100, ModTime: mtime, Typeflag: tar.TypeReg})
+	tw.Write([]byte("hello"))
+	tw.WriteHeader(&tar.Header{Name: "dir/link", Linkname: "file", Mode: 0777, ModTime: mtime, Typeflag: tar.TypeSymlink})
+	tw.Close()
+	gz.Close()
+	fp.Close()
+
+	imp := NewTarImporter()
+	if err := imp.Begin("tar://" + archive); err != nil {
+		t.Fatal(err)
+	}
+	defer imp.End()
+
+	records, errs, err := imp.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for err := range errs {
+			t.Error(err)
+		}
+	}()
+
+	seen := make(map[string]string)
+	for record := range records {
+		info := record.Stat.(vfs.FileInfo)
+		seen[record.Pathname] = record.Target
+		if record.Pathname == "/dir/file" {
+			if info.Size() != 5 || info.Uid() != 1000 || info.Gid() != 100 || !info.ModTime().Equal(mtime) {
+				t.Errorf("unexpected stat for /dir/file: %+v", info)
+			}
+		}
+	}
+
+	for _, pathname := range []string{"/", "/dir", "/dir/file", "/dir/link"} {
+		if _, exists := seen[pathname]; !exists {
+			t.Errorf("missing record for %s", pathname)
+		}
+	}
+	if seen["/dir/link"] != "file" {
+		t.Errorf("unexpected symlink target %q", seen["/dir/link"])
+	}
+
+	rd, err := imp.Open("/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("unexpected content %q: %v", data, err)
+	}
+}
+
+func TestTarImporterStream(t *testing.T) {
+	names := []string{"/z", "/a/2", "/a/1", "/m"}
+
+	for _, compression := range []string{"gzip", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			// nothing is spooled to a temporary file
+			tmpdir := t.TempDir()
+			t.Setenv("TMPDIR", tmpdir)
+
+			archive := filepath.Join(t.TempDir(), "test.tar")
+			fp, err := os.Create(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var zw io.WriteCloser
+			if compression == "gzip" {
+				zw = gzip.NewWriter(fp)
+			} else if zw, err = zstd.NewWriter(fp); err != nil {
+				t.Fatal(err)
+			}
+			tw := tar.NewWriter(zw)
+			for _, name := range names {
+				content := []byte("content of " + name)
+				tw.WriteHeader(&tar.Header{Name: name[1:], Mode: 0644, Size: int64(len(content)), ModTime: time.Now(), Typeflag: tar.TypeReg})
+				tw.Write(content)
+			}
+			tw.Close()
+			zw.Close()
+			fp.Close()
+
+			imp := NewTarImporter()
+			if err := imp.Begin("tar://" + archive); err != nil {
+				t.Fatal(err)
+			}
+			defer imp.End()
+
+			records, errs, err := imp.Scan()
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				for err := range errs {
+					t.Error(err)
+				}
+			}()
+			for range records {
+			}
+
+			if order := imp.(*TarImporter).Order(); !reflect.DeepEqual(order, names) {
+				t.Errorf("expected members in archive order %v, got %v", names, order)
+			}
+
+			// in order, then out of order which starts over
+			for _, name := range append(names, "/a/1", "/z") {
+				rd, err := imp.Open(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(rd)
+				rd.Close()
+				if err != nil || string(data) != fmt.Sprintf("content of %s", name) {
+					t.Errorf("%s: unexpected content %q: %v", name, data, err)
+				}
+			}
+
+			if entries, err := os.ReadDir(tmpdir); err != nil || len(entries) != 0 {
+				t.Errorf("unexpected temporary files %v: %v", entries, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package archive
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/PlakarLabs/plakar/vfs/importer"
+)
+
+// extra field written by Info-ZIP to record unix uid and gid
+const zipExtraUnixN = 0x7875
+
+type ZipImporter struct {
+	importer.ImporterBackend
+
+	location string
+	archive  string
+	reader   *zip.ReadCloser
+	members  map[string]*zip.File
+}
+
+func init() {
+	importer.Register("zip", NewZipImporter)
+}
+
+func NewZipImporter() importer.ImporterBackend {
+	return &ZipImporter{}
+}
+
+func (p *ZipImporter) Begin(location string) error {
+	p.location = location
+	p.archive = strings.TrimPrefix(location, "zip://")
+	p.members = make(map[string]*zip.File)
+	return nil
+}
+
+// zipOwner extracts uid and gid from the Info-ZIP unix extra field
+func zipOwner(extra []byte) (uint64, uint64, bool) {
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra[0:2])
+		size := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+size {
+			break
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+
+		if tag != zipExtraUnixN || len(field) < 2 || field[0] != 1 {
+			continue
+		}
+		uidSize := int(field[1])
+		if len(field) < 2+uidSize+1 {
+			continue
+		}
+		uid := field[2 : 2+uidSize]
+		gidSize := int(field[2+uidSize])
+		if len(field) < 3+uidSize+gidSize {
+			continue
+		}
+		gid := field[3+uidSize : 3+uidSize+gidSize]
+		return leUint(uid), leUint(gid), true
+	}
+	return 0, 0, false
+}
+
+func leUint(buf []byte) uint64 {
+	var value uint64
+	for i := len(buf) - 1; i >= 0; i-- {
+		value = value<<8 | uint64(buf[i])
+	}
+	return value
+}
+
+func (p *ZipImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, error) {
+	reader, err := zip.OpenReader(p.archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.reader = reader
+
+	c := make(chan importer.ImporterRecord)
+	cerr := make(chan error)
+
+	go func() {
+		t := newTree()
+		for _, file := range reader.File {
+			pathname := cleanPathname(file.Name)
+			fi := file.FileInfo()
+
+			uid, gid, _ := zipOwner(file.Extra)
+			info := vfs.NewFileInfo(fi.Name(), fi.Size(), fi.Mode(), file.Modified, 0, 0, uid, gid)
+			if pathname == "/" {
+				info.Lname = "/"
+			}
+
+			target := ""
+			switch {
+			case fi.Mode()&os.ModeSymlink != 0:
+				// symlink targets are stored as the member content
+				rd, err := file.Open()
+				if err != nil {
+					cerr <- fmt.Errorf("%s: %s: %w", p.archive, file.Name, err)
+					continue
+				}
+				buf, err := io.ReadAll(io.LimitReader(rd, 4096))
+				rd.Close()
+				if err != nil {
+					cerr <- fmt.Errorf("%s: %s: %w", p.archive, file.Name, err)
+					continue
+				}
+				target = string(buf)
+
+			case fi.Mode().IsRegular():
+				p.members[pathname] = file
+			}
+			t.add(pathname, info, target)
+		}
+
+		t.emit(c)
+		close(cerr)
+		close(c)
+	}()
+	return c, cerr, nil
+}
+
+func (p *ZipImporter) Open(pathname string) (io.ReadCloser, error) {
+	file, exists := p.members[cleanPathname(pathname)]
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+	return file.Open()
+}
+
+func (p *ZipImporter) End() error {
+	if p.reader != nil {
+		return p.reader.Close()
+	}
+	return nil
+}
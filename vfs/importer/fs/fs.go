@@ -19,7 +19,6 @@ package fs
 import (
 	"fmt"
 	"io"
-	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -31,7 +30,8 @@ import (
 
 type FSImporter struct {
 	importer.ImporterBackend
-	config string
+	config  string
+	options *importer.Options
 }
 
 func init() {
@@ -39,11 +39,15 @@ func init() {
 }
 
 func NewFSImporter() importer.ImporterBackend {
-	return &FSImporter{}
+	return &FSImporter{options: &importer.Options{}}
+}
+
+func (p *FSImporter) SetOptions(options *importer.Options) {
+	p.options = options
 }
 
 func (p *FSImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, error) {
-	c := make(chan importer.ImporterRecord)
+	c := make(chan importer.ImporterRecord, 1024)
 	cerr := make(chan error)
 	go func() {
 		directory := filepath.Clean(p.config)
@@ -59,54 +63,14 @@ func (p *FSImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, error
 			if err != nil {
 				cerr <- err
 				close(cerr)
+				close(c)
 				return
 			}
 			fileinfo := vfs.FileInfoFromStat(f)
 			c <- importer.ImporterRecord{Pathname: filepath.ToSlash(path), Stat: fileinfo}
 		}
 
-		err := filepath.WalkDir(directory, func(path string, di fs.DirEntry, err error) error {
-			if err != nil {
-				cerr <- err
-				return nil
-			}
-
-			info, err := di.Info()
-			if err != nil {
-				cerr <- err
-				return nil
-			}
-
-			fileinfo := vfs.FileInfoFromStat(info)
-			c <- importer.ImporterRecord{Pathname: filepath.ToSlash(path), Stat: fileinfo}
-
-			if !fileinfo.Mode().IsDir() && !fileinfo.Mode().IsRegular() {
-				lstat, err := os.Lstat(path)
-				if err != nil {
-					cerr <- err
-					return nil
-				}
-
-				lfileinfo := vfs.FileInfoFromStat(lstat)
-				if lfileinfo.Mode()&os.ModeSymlink != 0 {
-					originFile, err := os.Readlink(lfileinfo.Name())
-					if err != nil {
-						cerr <- err
-						return nil
-					}
-					_ = originFile
-
-					c <- importer.ImporterRecord{Pathname: filepath.ToSlash(path), Stat: lfileinfo}
-
-					// need to figure out how to notidy fakefs
-					// that a pathname actually link to another
-				}
-			}
-			return nil
-		})
-		if err != nil {
-			cerr <- err
-		}
+		newWalker(p.options, directory, c, cerr).walk()
 		close(cerr)
 		close(c)
 	}()
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package fs
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+var filesystemTypes = map[int64]string{
+	unix.AUTOFS_SUPER_MAGIC:    "autofs",
+	unix.BINFMTFS_MAGIC:        "binfmt_misc",
+	unix.BPF_FS_MAGIC:          "bpf",
+	unix.BTRFS_SUPER_MAGIC:     "btrfs",
+	unix.CGROUP2_SUPER_MAGIC:   "cgroup2",
+	unix.CGROUP_SUPER_MAGIC:    "cgroup",
+	unix.CIFS_SUPER_MAGIC:      "cifs",
+	0x62656570:                 "configfs",
+	unix.DEBUGFS_MAGIC:         "debugfs",
+	unix.DEVPTS_SUPER_MAGIC:    "devpts",
+	unix.EFIVARFS_MAGIC:        "efivarfs",
+	unix.EXT4_SUPER_MAGIC:      "ext4",
+	unix.FUSE_SUPER_MAGIC:      "fuse",
+	0x65735543:                 "fusectl",
+	unix.HUGETLBFS_MAGIC:       "hugetlbfs",
+	unix.ISOFS_SUPER_MAGIC:     "iso9660",
+	0x19800202:                 "mqueue",
+	unix.MSDOS_SUPER_MAGIC:     "vfat",
+	unix.NFS_SUPER_MAGIC:       "nfs",
+	unix.NSFS_MAGIC:            "nsfs",
+	unix.OVERLAYFS_SUPER_MAGIC: "overlay",
+	unix.PROC_SUPER_MAGIC:      "proc",
+	unix.PSTOREFS_MAGIC:        "pstore",
+	unix.RAMFS_MAGIC:           "ramfs",
+	0x67596969:                 "rpc_pipefs",
+	unix.SECURITYFS_MAGIC:      "securityfs",
+	unix.SELINUX_MAGIC:         "selinuxfs",
+	unix.SMB2_SUPER_MAGIC:      "smb2",
+	unix.SQUASHFS_MAGIC:        "squashfs",
+	unix.SYSFS_MAGIC:           "sysfs",
+	unix.TMPFS_MAGIC:           "tmpfs",
+	unix.TRACEFS_MAGIC:         "tracefs",
+	unix.XFS_SUPER_MAGIC:       "xfs",
+	0x2fc12fc1:                 "zfs",
+}
+
+// filesystemType returns the name of the filesystem holding pathname, or
+// its magic number in hexadecimal when the type is not known.
+func filesystemType(pathname string) (string, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(pathname, &stat); err != nil {
+		return "", err
+	}
+	if name, exists := filesystemTypes[int64(stat.Type)]; exists {
+		return name, nil
+	}
+	return fmt.Sprintf("0x%x", stat.Type), nil
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const ignoreFilename = ".plakarignore"
+
+// cachedirTagSignature starts every CACHEDIR.TAG file, see
+// https://bford.info/cachedir/
+const cachedirTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreFile holds the rules of a .plakarignore file, patterns follow the
+// gitignore syntax and are relative to the directory holding the file.
+type ignoreFile struct {
+	rules []ignoreRule
+}
+
+func loadIgnoreFile(pathname string) (*ignoreFile, error) {
+	fp, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return parseIgnoreFile(fp)
+}
+
+func parseIgnoreFile(rd io.Reader) (*ignoreFile, error) {
+	ignore := &ignoreFile{rules: make([]ignoreRule, 0)}
+
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		rule, ok := parseIgnoreRule(scanner.Text())
+		if ok {
+			ignore.rules = append(ignore.rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ignore, nil
+}
+
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	rule := ignoreRule{}
+
+	// trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+
+	// a separator anywhere but at the end anchors the pattern to the
+	// directory of the ignore file, otherwise it matches at any depth
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+
+	pattern, err := regexp.Compile(ignorePatternToRegexp(line))
+	if err != nil {
+		return rule, false
+	}
+	rule.pattern = pattern
+	return rule, true
+}
+
+func ignorePatternToRegexp(pattern string) string {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				atStart := i == 0 || pattern[i-1] == '/'
+				atEnd := i+2 == len(pattern) || pattern[i+2] == '/'
+				if atStart && atEnd {
+					i++
+					if i+1 == len(pattern) {
+						// trailing /** matches everything inside
+						buf.WriteString(".*")
+					} else {
+						// leading **/ and /**/ match zero or more directories
+						buf.WriteString("(?:.*/)?")
+						i++
+					}
+					continue
+				}
+				// any other ** behaves like a regular *
+				i++
+			}
+			buf.WriteString("[^/]*")
+		case '?':
+			buf.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				buf.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				buf.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	buf.WriteString("$")
+	return buf.String()
+}
+
+// match reports whether relpath, relative to the directory of the ignore
+// file, is ignored or re-included by the last matching rule.
+func (ignore *ignoreFile) match(relpath string, isDir bool) (ignored bool, matched bool) {
+	for _, rule := range ignore.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.pattern.MatchString(relpath) {
+			ignored = !rule.negate
+			matched = true
+		}
+	}
+	return ignored, matched
+}
+
+// ignoreStack tracks the ignore files found while walking down a tree,
+// deeper files take precedence over the ones found in their parents.
+// Pathnames use forward slashes.
+type ignoreStack struct {
+	root  string
+	files map[string]*ignoreFile
+}
+
+func newIgnoreStack(root string) *ignoreStack {
+	return &ignoreStack{
+		root:  root,
+		files: make(map[string]*ignoreFile),
+	}
+}
+
+func (stack *ignoreStack) add(directory string, ignore *ignoreFile) {
+	stack.files[directory] = ignore
+}
+
+func (stack *ignoreStack) ignored(pathname string, isDir bool) bool {
+	directories := make([]string, 0)
+	for directory := path.Dir(pathname); ; directory = path.Dir(directory) {
+		directories = append(directories, directory)
+		if directory == stack.root || directory == "/" || directory == "." {
+			break
+		}
+	}
+
+	ignored := false
+	for i := len(directories) - 1; i >= 0; i-- {
+		ignore, exists := stack.files[directories[i]]
+		if !exists {
+			continue
+		}
+		relpath := strings.TrimPrefix(strings.TrimPrefix(pathname, directories[i]), "/")
+		if result, matched := ignore.match(relpath, isDir); matched {
+			ignored = result
+		}
+	}
+	return ignored
+}
+
+func isCacheDirectory(directory string) bool {
+	fp, err := os.Open(filepath.Join(directory, "CACHEDIR.TAG"))
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+
+	buf := make([]byte, len(cachedirTagSignature))
+	if _, err := io.ReadFull(fp, buf); err != nil {
+		return false
+	}
+	return string(buf) == cachedirTagSignature
+}
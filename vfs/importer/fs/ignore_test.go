@@ -0,0 +1,128 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/PlakarLabs/plakar/vfs/importer"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	ignore, err := parseIgnoreFile(strings.NewReader(`
+# comment
+*.log
+!keep.log
+build/
+/root.txt
+docs/**/*.pdf
+**/tmp
+a/**
+\#hash
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		pathname string
+		isDir    bool
+		ignored  bool
+	}{
+		{"x.log", false, true},
+		{"sub/dir/x.log", false, true},
+		{"keep.log", false, false},
+		{"sub/keep.log", false, false},
+		{"build", true, true},
+		{"sub/build", true, true},
+		{"build", false, false},
+		{"root.txt", false, true},
+		{"sub/root.txt", false, false},
+		{"docs/a.pdf", false, true},
+		{"docs/x/y/a.pdf", false, true},
+		{"other/docs/a.pdf", false, false},
+		{"tmp", true, true},
+		{"x/y/tmp", false, true},
+		{"a", true, false},
+		{"a/b/c", false, true},
+		{"#hash", false, true},
+		{"comment", false, false},
+	} {
+		ignored, _ := ignore.match(test.pathname, test.isDir)
+		if ignored != test.ignored {
+			t.Errorf("%s: expected ignored=%v", test.pathname, test.ignored)
+		}
+	}
+}
+
+func TestScanExclusions(t *testing.T) {
+	root := t.TempDir()
+	for pathname, content := range map[string]string{
+		".plakarignore":          "*.o\n/vendor/\n",
+		"main.c":                 "",
+		"main.o":                 "",
+		"vendor/lib.c":           "",
+		"src/vendor/lib.c":       "",
+		"src/.plakarignore":      "!keep.o\n",
+		"src/keep.o":             "",
+		"src/drop.o":             "",
+		"cache/CACHEDIR.TAG":     cachedirTagSignature + "\n",
+		"cache/data":             "",
+		"fakecache/CACHEDIR.TAG": "not a cache\n",
+		"fakecache/data":         "",
+		"private/.nobackup":      "",
+		"private/secret":         "",
+	} {
+		pathname = filepath.Join(root, pathname)
+		if err := os.MkdirAll(filepath.Dir(pathname), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(pathname, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := NewFSImporter().(*FSImporter)
+	p.SetOptions(&importer.Options{ExcludeCaches: true, ExcludeIfPresent: []string{".nobackup"}})
+	if err := p.Begin(root); err != nil {
+		t.Fatal(err)
+	}
+
+	c, cerr, err := p.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for err := range cerr {
+			t.Error(err)
+		}
+	}()
+
+	scanned := make([]string, 0)
+	for record := range c {
+		if strings.HasPrefix(record.Pathname, filepath.ToSlash(root)+"/") {
+			scanned = append(scanned, strings.TrimPrefix(record.Pathname, filepath.ToSlash(root)+"/"))
+		}
+	}
+	sort.Strings(scanned)
+
+	expected := []string{
+		".plakarignore",
+		"cache",
+		"cache/CACHEDIR.TAG",
+		"fakecache",
+		"fakecache/CACHEDIR.TAG",
+		"fakecache/data",
+		"main.c",
+		"src",
+		"src/.plakarignore",
+		"src/keep.o",
+		"src/vendor",
+		"src/vendor/lib.c",
+	}
+	if strings.Join(scanned, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected scan result:\n%s", strings.Join(scanned, "\n"))
+	}
+}
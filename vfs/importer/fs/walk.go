@@ -0,0 +1,384 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package fs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/PlakarLabs/plakar/vfs/importer"
+)
+
+// upper bound on the number of directories read ahead of the emitter
+const walkWindow = 4096
+
+// pseudoFilesystems hold no data worth saving and are skipped with
+// SkipPseudoFilesystems, their mount points are kept.
+var pseudoFilesystems = []string{
+	"autofs", "binfmt_misc", "bpf", "cgroup", "cgroup2", "configfs",
+	"debugfs", "devpts", "efivarfs", "fusectl", "hugetlbfs", "mqueue",
+	"nsfs", "proc", "pstore", "rpc_pipefs", "securityfs", "selinuxfs",
+	"sysfs", "tracefs",
+}
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+type walkEntry struct {
+	record importer.ImporterRecord
+	errs   []error
+
+	// set when the entry is a directory to descend into
+	directory *walkDirectory
+}
+
+// walkDirectory is read once, by a worker or by the emitter if it gets
+// there first, entries are sorted by name.
+type walkDirectory struct {
+	path      string
+	dev       uint64
+	ancestors []inodeKey
+
+	once    sync.Once
+	entries []*walkEntry
+	errs    []error
+
+	// guarded by walker.mu
+	windowed bool
+	emitted  bool
+}
+
+// walker reads directories concurrently but emits records depth-first in
+// lexical order so that scans are deterministic, parents always come
+// before their children.
+type walker struct {
+	options *importer.Options
+	root    string
+	records chan<- importer.ImporterRecord
+	errors  chan<- error
+
+	muIgnores       sync.RWMutex
+	ignores         *ignoreStack
+	rootDev         uint64
+	excludedFsTypes map[string]bool
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*walkDirectory
+	window  int
+	done    bool
+}
+
+func newWalker(options *importer.Options, root string, records chan<- importer.ImporterRecord, errors chan<- error) *walker {
+	w := &walker{
+		options:         options,
+		root:            root,
+		records:         records,
+		errors:          errors,
+		ignores:         newIgnoreStack(filepath.ToSlash(root)),
+		excludedFsTypes: make(map[string]bool),
+		pending:         make([]*walkDirectory, 0),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	for _, fstype := range options.ExcludeFilesystemTypes {
+		w.excludedFsTypes[fstype] = true
+	}
+	if options.SkipPseudoFilesystems {
+		for _, fstype := range pseudoFilesystems {
+			w.excludedFsTypes[fstype] = true
+		}
+	}
+	return w
+}
+
+func (w *walker) concurrency() int {
+	if w.options.MaxConcurrency > 0 {
+		return w.options.MaxConcurrency
+	}
+	return runtime.NumCPU()*2 + 1
+}
+
+func (w *walker) walk() {
+	info, err := os.Lstat(w.root)
+	if err != nil {
+		w.errors <- err
+		return
+	}
+	if info.Mode()&os.ModeSymlink != 0 && w.options.FollowSymlinks {
+		if target, err := os.Stat(w.root); err == nil && target.IsDir() {
+			info = target
+		}
+	}
+	w.rootDev = vfs.FileInfoFromStat(info).Dev()
+
+	entry := w.entry(w.root, info, nil, w.rootDev)
+	if entry == nil {
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < w.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.worker()
+		}()
+	}
+
+	w.emit(entry)
+
+	w.mu.Lock()
+	w.done = true
+	w.cond.Broadcast()
+	w.mu.Unlock()
+	wg.Wait()
+}
+
+// emit sends an entry, then the content of the directory it describes
+func (w *walker) emit(entry *walkEntry) {
+	for _, err := range entry.errs {
+		w.errors <- err
+	}
+	if entry.record.Pathname != "" {
+		w.records <- entry.record
+	}
+
+	directory := entry.directory
+	if directory == nil {
+		return
+	}
+	w.read(directory)
+
+	for _, err := range directory.errs {
+		w.errors <- err
+	}
+	for _, child := range directory.entries {
+		w.emit(child)
+	}
+
+	w.mu.Lock()
+	directory.emitted = true
+	// the emitted subtree is released so that only the directories in the
+	// window are kept in memory
+	directory.entries = nil
+	directory.errs = nil
+	if directory.windowed {
+		w.window--
+		w.cond.Broadcast()
+	}
+	w.mu.Unlock()
+}
+
+// worker reads pending directories ahead of the emitter, most recently
+// discovered first so that reads roughly follow the emission order.
+func (w *walker) worker() {
+	for {
+		w.mu.Lock()
+		for !w.done && (len(w.pending) == 0 || w.window >= walkWindow) {
+			w.cond.Wait()
+		}
+		if w.done {
+			w.mu.Unlock()
+			return
+		}
+		directory := w.pending[len(w.pending)-1]
+		w.pending = w.pending[:len(w.pending)-1]
+		if directory.emitted {
+			w.mu.Unlock()
+			continue
+		}
+		directory.windowed = true
+		w.window++
+		w.mu.Unlock()
+
+		w.read(directory)
+	}
+}
+
+func (w *walker) schedule(directories []*walkDirectory) {
+	if len(directories) == 0 {
+		return
+	}
+	w.mu.Lock()
+	for i := len(directories) - 1; i >= 0; i-- {
+		w.pending = append(w.pending, directories[i])
+	}
+	w.cond.Broadcast()
+	w.mu.Unlock()
+}
+
+func (w *walker) read(directory *walkDirectory) {
+	directory.once.Do(func() {
+		w.readDirectory(directory)
+
+		subdirectories := make([]*walkDirectory, 0)
+		for _, entry := range directory.entries {
+			if entry.directory != nil {
+				subdirectories = append(subdirectories, entry.directory)
+			}
+		}
+		w.schedule(subdirectories)
+	})
+}
+
+func (w *walker) readDirectory(directory *walkDirectory) {
+	path := directory.path
+
+	if ignore, err := loadIgnoreFile(filepath.Join(path, ignoreFilename)); err == nil {
+		w.muIgnores.Lock()
+		w.ignores.add(filepath.ToSlash(path), ignore)
+		w.muIgnores.Unlock()
+	} else if !os.IsNotExist(err) {
+		directory.errs = append(directory.errs, err)
+	}
+
+	// only the tag file is kept from a cache directory
+	if w.options.ExcludeCaches && isCacheDirectory(path) {
+		tag := filepath.Join(path, "CACHEDIR.TAG")
+		if info, err := os.Lstat(tag); err != nil {
+			directory.errs = append(directory.errs, err)
+		} else if entry := w.entry(tag, info, directory.ancestors, directory.dev); entry != nil {
+			directory.entries = append(directory.entries, entry)
+		}
+		return
+	}
+
+	dirEntries, err := os.ReadDir(path)
+	if err != nil {
+		directory.errs = append(directory.errs, err)
+	}
+	sort.Slice(dirEntries, func(i, j int) bool {
+		return dirEntries[i].Name() < dirEntries[j].Name()
+	})
+
+	for _, dirEntry := range dirEntries {
+		child := filepath.Join(path, dirEntry.Name())
+		info, err := dirEntry.Info()
+		if err != nil {
+			directory.errs = append(directory.errs, err)
+			continue
+		}
+		if entry := w.entry(child, info, directory.ancestors, directory.dev); entry != nil {
+			directory.entries = append(directory.entries, entry)
+		}
+	}
+}
+
+// entry builds the record for path described by info, as returned by
+// Lstat, ancestors lists the directories above it to detect loops through
+// symlinks. It returns nil for excluded paths.
+func (w *walker) entry(path string, info fs.FileInfo, ancestors []inodeKey, parentDev uint64) *walkEntry {
+	entry := &walkEntry{}
+
+	if info.Mode()&os.ModeSymlink != 0 && w.options.FollowSymlinks {
+		if target, err := os.Stat(path); err == nil && target.IsDir() {
+			fileinfo := vfs.FileInfoFromStat(target)
+			key := inodeKey{dev: fileinfo.Dev(), ino: fileinfo.Ino()}
+			loop := false
+			for _, ancestor := range ancestors {
+				if ancestor == key {
+					loop = true
+					break
+				}
+			}
+			if loop {
+				entry.errs = append(entry.errs, &fs.PathError{Op: "walk", Path: path, Err: errors.New("symlink loop, not followed")})
+			} else {
+				info = target
+			}
+		}
+	}
+
+	if path != w.root {
+		w.muIgnores.RLock()
+		ignored := w.ignores.ignored(filepath.ToSlash(path), info.IsDir())
+		w.muIgnores.RUnlock()
+		if ignored {
+			return nil
+		}
+	}
+
+	if info.IsDir() {
+		for _, name := range w.options.ExcludeIfPresent {
+			if _, err := os.Lstat(filepath.Join(path, name)); err == nil {
+				return nil
+			}
+		}
+	}
+
+	fileinfo := vfs.FileInfoFromStat(info)
+	fileinfo.Lname = filepath.Base(path)
+	if xattrs, err := vfs.Xattrs(path); err != nil {
+		entry.errs = append(entry.errs, err)
+	} else {
+		fileinfo.Lxattrs = xattrs
+	}
+
+	var target string
+	if fileinfo.Mode()&os.ModeSymlink != 0 {
+		var err error
+		target, err = os.Readlink(path)
+		if err != nil {
+			entry.errs = append(entry.errs, err)
+			return entry
+		}
+	}
+	entry.record = importer.ImporterRecord{Pathname: filepath.ToSlash(path), Stat: fileinfo, Target: target}
+
+	if info.IsDir() {
+		if descend, err := w.descend(path, fileinfo.Dev(), parentDev); err != nil {
+			entry.errs = append(entry.errs, err)
+		} else if descend {
+			childAncestors := make([]inodeKey, len(ancestors), len(ancestors)+1)
+			copy(childAncestors, ancestors)
+			entry.directory = &walkDirectory{
+				path:      path,
+				dev:       fileinfo.Dev(),
+				ancestors: append(childAncestors, inodeKey{dev: fileinfo.Dev(), ino: fileinfo.Ino()}),
+			}
+		}
+	}
+	return entry
+}
+
+// descend tells if the content of a directory should be walked, which is
+// decided when crossing into another filesystem.
+func (w *walker) descend(path string, dev uint64, parentDev uint64) (bool, error) {
+	if dev == parentDev && path != w.root {
+		return true, nil
+	}
+	if w.options.OneFileSystem && dev != w.rootDev {
+		return false, nil
+	}
+	if len(w.excludedFsTypes) != 0 {
+		fstype, err := filesystemType(path)
+		if err != nil {
+			return false, err
+		}
+		if w.excludedFsTypes[fstype] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,200 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/PlakarLabs/plakar/vfs/importer"
+)
+
+func walkTree(t *testing.T, options *importer.Options, root string) (map[string]vfs.FileInfo, []error) {
+	records := make(chan importer.ImporterRecord)
+	errs := make(chan error)
+	go func() {
+		newWalker(options, root, records, errs).walk()
+		close(errs)
+		close(records)
+	}()
+
+	walkErrors := make([]error, 0)
+	done := make(chan struct{})
+	go func() {
+		for err := range errs {
+			walkErrors = append(walkErrors, err)
+		}
+		close(done)
+	}()
+
+	scanned := make(map[string]vfs.FileInfo)
+	for record := range records {
+		relpath := strings.TrimPrefix(record.Pathname, filepath.ToSlash(root))
+		scanned["/"+strings.TrimPrefix(relpath, "/")] = record.Stat.(vfs.FileInfo)
+	}
+	<-done
+	return scanned, walkErrors
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "data/sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "data/sub/file"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("data", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(root, "data/sub/loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	scanned, errs := walkTree(t, &importer.Options{}, root)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if scanned["/link"].Mode()&os.ModeSymlink == 0 {
+		t.Errorf("/link should have been recorded as a symlink")
+	}
+	if _, exists := scanned["/link/sub/file"]; exists {
+		t.Errorf("/link should not have been followed")
+	}
+
+	scanned, errs = walkTree(t, &importer.Options{FollowSymlinks: true}, root)
+	if !scanned["/link"].Mode().IsDir() {
+		t.Errorf("/link should have been recorded as a directory")
+	}
+	if scanned["/link/sub/file"].Size() != 5 {
+		t.Errorf("/link/sub/file should have been scanned through the symlink")
+	}
+	if scanned["/data/sub/loop"].Mode()&os.ModeSymlink == 0 {
+		t.Errorf("/data/sub/loop should have been kept as a symlink")
+	}
+	if len(errs) != 2 {
+		t.Errorf("expected a loop error for each path to data/sub/loop, got %v", errs)
+	}
+}
+
+func TestSkipPseudoFilesystems(t *testing.T) {
+	fstype, err := filesystemType("/proc")
+	if err != nil || fstype != "proc" {
+		t.Skip("/proc is not mounted")
+	}
+
+	w := newWalker(&importer.Options{SkipPseudoFilesystems: true}, "/", nil, nil)
+	info, err := os.Lstat("/proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if descend, _ := w.descend("/proc", vfs.FileInfoFromStat(info).Dev(), 0); descend {
+		t.Errorf("/proc should not be walked")
+	}
+
+	root, err := os.Lstat("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = newWalker(&importer.Options{OneFileSystem: true}, "/", nil, nil)
+	w.rootDev = vfs.FileInfoFromStat(root).Dev()
+	if descend, _ := w.descend("/proc", vfs.FileInfoFromStat(info).Dev(), 0); descend {
+		t.Errorf("/proc should not be walked with one filesystem")
+	}
+}
+
+func TestParallelWalkIsDeterministic(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 20; j++ {
+			directory := filepath.Join(root, fmt.Sprintf("d%02d", 19-i), fmt.Sprintf("s%02d", j))
+			if err := os.MkdirAll(directory, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(directory, "file"), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	order := func(concurrency int) []string {
+		records := make(chan importer.ImporterRecord)
+		errs := make(chan error)
+		go func() {
+			newWalker(&importer.Options{MaxConcurrency: concurrency}, root, records, errs).walk()
+			close(errs)
+			close(records)
+		}()
+		go func() {
+			for err := range errs {
+				t.Error(err)
+			}
+		}()
+
+		pathnames := make([]string, 0)
+		for record := range records {
+			pathnames = append(pathnames, record.Pathname)
+		}
+		return pathnames
+	}
+
+	sequential := order(1)
+	if len(sequential) != 1+20+20*20*2 {
+		t.Fatalf("unexpected number of records: %d", len(sequential))
+	}
+	if !sort.StringsAreSorted(sequential) {
+		t.Errorf("records are not emitted depth-first in lexical order")
+	}
+	for i := 0; i < 5; i++ {
+		if strings.Join(order(16), "\n") != strings.Join(sequential, "\n") {
+			t.Fatalf("parallel walk emitted records in a different order")
+		}
+	}
+}
+
+func TestEmitReleasesDirectories(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.MkdirAll(filepath.Join(root, name, "sub"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records := make(chan importer.ImporterRecord)
+	errs := make(chan error)
+	w := newWalker(&importer.Options{MaxConcurrency: 1}, root, records, errs)
+	info, err := os.Lstat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := w.entry(root, info, nil, vfs.FileInfoFromStat(info).Dev())
+	w.read(entry.directory)
+
+	directories := []*walkDirectory{entry.directory}
+	for _, child := range entry.directory.entries {
+		directories = append(directories, child.directory)
+	}
+
+	go func() {
+		w.emit(entry)
+		close(errs)
+		close(records)
+	}()
+	go func() {
+		for err := range errs {
+			t.Error(err)
+		}
+	}()
+	for range records {
+	}
+
+	// emitted directories no longer hold their entries
+	for _, directory := range directories {
+		if directory.entries != nil {
+			t.Errorf("%s: entries kept after being emitted", directory.path)
+		}
+	}
+}
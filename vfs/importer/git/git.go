@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package git
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/PlakarLabs/plakar/vfs/importer"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// GitImporter snapshots the trees of a local repository without a
+// checkout, each ref lands under its full name, e.g. /refs/heads/main.
+// Locations are git:///path/to/repo or git+file:///path/to/repo with
+// an optional ?ref=REVISION (defaults to HEAD) or ?all=true for every
+// branch and tag.
+type GitImporter struct {
+	importer.ImporterBackend
+
+	location   string
+	repository string
+	revision   string
+	allRefs    bool
+
+	muBlobs sync.Mutex
+	blobs   map[string]plumbing.Hash
+
+	// go-git repositories can't be read concurrently, Open borrows one
+	muPool sync.Mutex
+	pool   []*git.Repository
+}
+
+func init() {
+	importer.Register("git", NewGitImporter)
+}
+
+func NewGitImporter() importer.ImporterBackend {
+	return &GitImporter{}
+}
+
+func (p *GitImporter) Begin(location string) error {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+
+	p.location = location
+	p.repository = parsed.Host + parsed.Path
+	p.revision = parsed.Query().Get("ref")
+	p.allRefs = parsed.Query().Get("all") == "true"
+	p.blobs = make(map[string]plumbing.Hash)
+
+	if p.revision != "" && p.allRefs {
+		return fmt.Errorf("%s: ref and all are mutually exclusive", location)
+	}
+
+	repo, err := git.PlainOpen(p.repository)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.repository, err)
+	}
+	p.pool = append(p.pool, repo)
+	return nil
+}
+
+func (p *GitImporter) acquire() (*git.Repository, error) {
+	p.muPool.Lock()
+	if len(p.pool) != 0 {
+		repo := p.pool[len(p.pool)-1]
+		p.pool = p.pool[:len(p.pool)-1]
+		p.muPool.Unlock()
+		return repo, nil
+	}
+	p.muPool.Unlock()
+	return git.PlainOpen(p.repository)
+}
+
+func (p *GitImporter) release(repo *git.Repository) {
+	p.muPool.Lock()
+	defer p.muPool.Unlock()
+	p.pool = append(p.pool, repo)
+}
+
+type namedCommit struct {
+	name   string
+	commit *object.Commit
+}
+
+// resolveCommit peels annotated tags down to the commit they point to
+func resolveCommit(repo *git.Repository, hash plumbing.Hash) (*object.Commit, error) {
+	if commit, err := repo.CommitObject(hash); err == nil {
+		return commit, nil
+	}
+	tag, err := repo.TagObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	return tag.Commit()
+}
+
+func (p *GitImporter) commits(repo *git.Repository) ([]namedCommit, error) {
+	ret := make([]namedCommit, 0)
+
+	if !p.allRefs {
+		if p.revision == "" {
+			head, err := repo.Head()
+			if err != nil {
+				return nil, err
+			}
+			commit, err := resolveCommit(repo, head.Hash())
+			if err != nil {
+				return nil, err
+			}
+			return append(ret, namedCommit{name: head.Name().String(), commit: commit}), nil
+		}
+
+		if ref, err := repo.Reference(plumbing.ReferenceName(p.revision), true); err == nil {
+			commit, err := resolveCommit(repo, ref.Hash())
+			if err != nil {
+				return nil, err
+			}
+			return append(ret, namedCommit{name: ref.Name().String(), commit: commit}), nil
+		}
+
+		hash, err := repo.ResolveRevision(plumbing.Revision(p.revision))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.revision, err)
+		}
+		commit, err := resolveCommit(repo, *hash)
+		if err != nil {
+			return nil, err
+		}
+		name := p.revision
+		for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+			if _, err := repo.Reference(plumbing.ReferenceName(prefix+p.revision), false); err == nil {
+				name = prefix + p.revision
+				break
+			}
+		}
+		return append(ret, namedCommit{name: name, commit: commit}), nil
+	}
+
+	refs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		if !ref.Name().IsBranch() && !ref.Name().IsTag() {
+			return nil
+		}
+		commit, err := resolveCommit(repo, ref.Hash())
+		if err != nil {
+			// tags may point to trees or blobs, nothing to snapshot
+			return nil
+		}
+		ret = append(ret, namedCommit{name: ref.Name().String(), commit: commit})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].name < ret[j].name
+	})
+	return ret, nil
+}
+
+func (p *GitImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, error) {
+	repo, err := p.acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	commits, err := p.commits(repo)
+	if err != nil {
+		p.release(repo)
+		return nil, nil, err
+	}
+
+	c := make(chan importer.ImporterRecord)
+	cerr := make(chan error)
+
+	go func() {
+		defer p.release(repo)
+
+		ino := uint64(0)
+		directory := func(pathname string, mtime time.Time) {
+			ino++
+			name := path.Base(pathname)
+			c <- importer.ImporterRecord{Pathname: pathname, Stat: vfs.NewFileInfo(name, 0, 0755|fs.ModeDir, mtime, 0, ino, 0, 0)}
+		}
+
+		seen := make(map[string]struct{})
+		directory("/", time.Now())
+		seen["/"] = struct{}{}
+
+		for _, nc := range commits {
+			mtime := nc.commit.Committer.When
+			root := path.Clean("/" + nc.name)
+
+			atoms := strings.Split(root, "/")
+			for i := 1; i < len(atoms); i++ {
+				dir := "/" + strings.Join(atoms[1:i+1], "/")
+				if _, exists := seen[dir]; !exists {
+					directory(dir, mtime)
+					seen[dir] = struct{}{}
+				}
+			}
+
+			tree, err := nc.commit.Tree()
+			if err != nil {
+				cerr <- fmt.Errorf("%s: %w", nc.name, err)
+				continue
+			}
+
+			walker := object.NewTreeWalker(tree, true, nil)
+			for {
+				name, entry, err := walker.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					cerr <- fmt.Errorf("%s: %w", nc.name, err)
+					break
+				}
+
+				pathname := path.Join(root, name)
+				switch entry.Mode {
+				case filemode.Dir:
+					directory(pathname, mtime)
+
+				case filemode.Regular, filemode.Deprecated, filemode.Executable, filemode.Symlink:
+					blob, err := repo.BlobObject(entry.Hash)
+					if err != nil {
+						cerr <- fmt.Errorf("%s: %w", pathname, err)
+						continue
+					}
+
+					mode := fs.FileMode(0644)
+					target := ""
+					switch entry.Mode {
+					case filemode.Executable:
+						mode = 0755
+					case filemode.Symlink:
+						mode = 0777 | fs.ModeSymlink
+						target, err = readBlob(blob)
+						if err != nil {
+							cerr <- fmt.Errorf("%s: %w", pathname, err)
+							continue
+						}
+					}
+
+					p.muBlobs.Lock()
+					p.blobs[pathname] = entry.Hash
+					p.muBlobs.Unlock()
+
+					ino++
+					fi := vfs.NewFileInfo(path.Base(pathname), blob.Size, mode, mtime, 0, ino, 0, 0)
+					c <- importer.ImporterRecord{Pathname: pathname, Stat: fi, Target: target}
+
+				default:
+					// submodules reference commits of another repository
+				}
+			}
+		}
+
+		close(cerr)
+		close(c)
+	}()
+	return c, cerr, nil
+}
+
+func readBlob(blob *object.Blob) (string, error) {
+	rd, err := blob.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer rd.Close()
+
+	buf, err := io.ReadAll(rd)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+type blobReader struct {
+	io.ReadCloser
+	importer *GitImporter
+	repo     *git.Repository
+}
+
+func (rd *blobReader) Close() error {
+	err := rd.ReadCloser.Close()
+	rd.importer.release(rd.repo)
+	return err
+}
+
+func (p *GitImporter) Open(pathname string) (io.ReadCloser, error) {
+	p.muBlobs.Lock()
+	hash, exists := p.blobs[path.Clean(pathname)]
+	p.muBlobs.Unlock()
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+
+	repo, err := p.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := repo.BlobObject(hash)
+	if err != nil {
+		p.release(repo)
+		return nil, err
+	}
+
+	rd, err := blob.Reader()
+	if err != nil {
+		p.release(repo)
+		return nil, err
+	}
+	return &blobReader{ReadCloser: rd, importer: p, repo: repo}, nil
+}
+
+func (p *GitImporter) End() error {
+	return nil
+}
@@ -0,0 +1,343 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PlakarLabs/plakar/vfs/importer"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// testRepository builds its objects directly so that trees can hold
+// symlinks and submodules
+type testRepository struct {
+	t    *testing.T
+	dir  string
+	repo *git.Repository
+
+	commits map[string]plumbing.Hash
+}
+
+func (r *testRepository) store(encode func(obj plumbing.EncodedObject) error) plumbing.Hash {
+	obj := r.repo.Storer.NewEncodedObject()
+	if err := encode(obj); err != nil {
+		r.t.Fatal(err)
+	}
+	hash, err := r.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return hash
+}
+
+func (r *testRepository) blob(content string) plumbing.Hash {
+	return r.store(func(obj plumbing.EncodedObject) error {
+		obj.SetType(plumbing.BlobObject)
+		w, err := obj.Writer()
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
+
+func (r *testRepository) tree(entries ...object.TreeEntry) plumbing.Hash {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return r.store((&object.Tree{Entries: entries}).Encode)
+}
+
+func (r *testRepository) commit(name string, when time.Time, tree plumbing.Hash, parents ...plumbing.Hash) plumbing.Hash {
+	signature := object.Signature{Name: "plakar", Email: "plakar@example.org", When: when}
+	hash := r.store((&object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      name,
+		TreeHash:     tree,
+		ParentHashes: parents,
+	}).Encode)
+	r.commits[name] = hash
+	return hash
+}
+
+func (r *testRepository) tag(name string, targetType plumbing.ObjectType, target plumbing.Hash) plumbing.Hash {
+	return r.store((&object.Tag{
+		Name:       name,
+		Tagger:     object.Signature{Name: "plakar", Email: "plakar@example.org", When: time.Now()},
+		Message:    name,
+		TargetType: targetType,
+		Target:     target,
+	}).Encode)
+}
+
+func (r *testRepository) reference(name string, hash plumbing.Hash) {
+	if err := r.repo.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(name), hash)); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// newTestRepository creates a repository with main and v1 on a first
+// commit, dev and the annotated v2 on a second one, and a tag of a tree
+func newTestRepository(t *testing.T) *testRepository {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testRepository{t: t, dir: dir, repo: repo, commits: make(map[string]plumbing.Hash)}
+
+	bin := r.tree(object.TreeEntry{Name: "run.sh", Mode: filemode.Executable, Hash: r.blob("#!/bin/sh\n")})
+	first := r.tree(
+		object.TreeEntry{Name: "a.txt", Mode: filemode.Regular, Hash: r.blob("alpha")},
+		object.TreeEntry{Name: "bin", Mode: filemode.Dir, Hash: bin},
+		object.TreeEntry{Name: "link", Mode: filemode.Symlink, Hash: r.blob("a.txt")},
+		object.TreeEntry{Name: "module", Mode: filemode.Submodule, Hash: plumbing.NewHash("0123456789abcdef0123456789abcdef01234567")},
+	)
+	second := r.tree(
+		object.TreeEntry{Name: "a.txt", Mode: filemode.Regular, Hash: r.blob("alpha, again")},
+		object.TreeEntry{Name: "b.txt", Mode: filemode.Regular, Hash: r.blob("bravo")},
+	)
+
+	c1 := r.commit("first", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), first)
+	c2 := r.commit("second", time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC), second, c1)
+
+	r.reference("refs/heads/main", c1)
+	r.reference("refs/heads/dev", c2)
+	r.reference("refs/tags/v1", c1)
+	r.reference("refs/tags/v2", r.tag("v2", plumbing.CommitObject, c2))
+	r.reference("refs/tags/tree", r.tag("tree", plumbing.TreeObject, first))
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/main")); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func scan(t *testing.T, location string) (importer.ImporterBackend, map[string]importer.ImporterRecord) {
+	imp := NewGitImporter()
+	if err := imp.Begin(location); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { imp.End() })
+
+	records, errs, err := imp.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for err := range errs {
+			t.Error(err)
+		}
+	}()
+	ret := make(map[string]importer.ImporterRecord)
+	for record := range records {
+		ret[record.Pathname] = record
+	}
+	<-done
+	return imp, ret
+}
+
+func read(t *testing.T, imp importer.ImporterBackend, pathname string) string {
+	rd, err := imp.Open(pathname)
+	if err != nil {
+		t.Fatalf("%s: %v", pathname, err)
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatalf("%s: %v", pathname, err)
+	}
+	return string(data)
+}
+
+// roots returns the refs a scan snapshotted, as the parents of a.txt
+func roots(records map[string]importer.ImporterRecord) []string {
+	ret := make([]string, 0)
+	for pathname := range records {
+		if strings.HasSuffix(pathname, "/a.txt") {
+			ret = append(ret, strings.TrimSuffix(pathname, "/a.txt"))
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestScan(t *testing.T) {
+	r := newTestRepository(t)
+	imp, records := scan(t, "git://"+r.dir)
+
+	expected := []string{
+		"/",
+		"/refs",
+		"/refs/heads",
+		"/refs/heads/main",
+		"/refs/heads/main/a.txt",
+		"/refs/heads/main/bin",
+		"/refs/heads/main/bin/run.sh",
+		"/refs/heads/main/link",
+	}
+	pathnames := make([]string, 0, len(records))
+	for pathname := range records {
+		pathnames = append(pathnames, pathname)
+	}
+	sort.Strings(pathnames)
+	// the submodule is skipped
+	if !reflect.DeepEqual(pathnames, expected) {
+		t.Fatalf("expected %v, got %v", expected, pathnames)
+	}
+
+	mtime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	if record := records["/refs/heads/main/a.txt"]; record.Stat.Size() != 5 || record.Stat.Mode() != 0644 || !record.Stat.ModTime().Equal(mtime) {
+		t.Errorf("unexpected a.txt %v %v %v", record.Stat.Size(), record.Stat.Mode(), record.Stat.ModTime())
+	}
+	if record := records["/refs/heads/main/bin/run.sh"]; record.Stat.Mode() != 0755 {
+		t.Errorf("unexpected run.sh mode %v", record.Stat.Mode())
+	}
+	if record := records["/refs/heads/main/bin"]; !record.Stat.IsDir() {
+		t.Errorf("expected bin to be a directory, got %v", record.Stat.Mode())
+	}
+	if record := records["/refs/heads/main/link"]; record.Stat.Mode()&fs.ModeSymlink == 0 || record.Target != "a.txt" {
+		t.Errorf("unexpected link %v -> %q", record.Stat.Mode(), record.Target)
+	}
+
+	if content := read(t, imp, "/refs/heads/main/a.txt"); content != "alpha" {
+		t.Errorf("unexpected content %q", content)
+	}
+	if _, err := imp.Open("/refs/heads/main/module"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the submodule to be missing, got %v", err)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	r := newTestRepository(t)
+
+	for _, test := range []struct {
+		ref     string
+		root    string
+		content string
+	}{
+		{"refs/heads/dev", "/refs/heads/dev", "alpha, again"},
+		{"dev", "/refs/heads/dev", "alpha, again"},
+		{"v1", "/refs/tags/v1", "alpha"},
+		// annotated tags are peeled to their commit
+		{"v2", "/refs/tags/v2", "alpha, again"},
+		{"refs/tags/v2", "/refs/tags/v2", "alpha, again"},
+		{r.commits["second"].String(), "/" + r.commits["second"].String(), "alpha, again"},
+		{"dev~1", "/dev~1", "alpha"},
+	} {
+		imp, records := scan(t, "git://"+r.dir+"?ref="+test.ref)
+		if found := roots(records); !reflect.DeepEqual(found, []string{test.root}) {
+			t.Errorf("%s: expected %s, got %v", test.ref, test.root, found)
+			continue
+		}
+		if content := read(t, imp, test.root+"/a.txt"); content != test.content {
+			t.Errorf("%s: unexpected content %q", test.ref, content)
+		}
+	}
+
+	imp := NewGitImporter()
+	if err := imp.Begin("git://" + r.dir + "?ref=missing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := imp.Scan(); err == nil {
+		t.Error("expected a missing revision to fail")
+	}
+}
+
+func TestAllRefs(t *testing.T) {
+	r := newTestRepository(t)
+	imp, records := scan(t, "git+file://"+r.dir+"?all=true")
+
+	// the tag of a tree has no commit to snapshot
+	expected := []string{"/refs/heads/dev", "/refs/heads/main", "/refs/tags/v1", "/refs/tags/v2"}
+	if found := roots(records); !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected %v, got %v", expected, found)
+	}
+	if content := read(t, imp, "/refs/tags/v2/b.txt"); content != "bravo" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	if err := NewGitImporter().Begin("git://" + r.dir + "?all=true&ref=main"); err == nil {
+		t.Error("expected ref and all together to fail")
+	}
+	if err := NewGitImporter().Begin("git://" + t.TempDir()); err == nil {
+		t.Error("expected a directory without a repository to fail")
+	}
+}
+
+func TestConcurrentOpen(t *testing.T) {
+	r := newTestRepository(t)
+	imp, _ := scan(t, "git://"+r.dir+"?all=true")
+
+	// readers hold their repository until closed, the others open new
+	// ones and all of them go back to the pool
+	readers := make([]io.ReadCloser, 0)
+	for _, pathname := range []string{"/refs/heads/main/a.txt", "/refs/heads/dev/b.txt", "/refs/tags/v1/bin/run.sh"} {
+		rd, err := imp.Open(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, rd)
+	}
+	for _, rd := range readers {
+		rd.Close()
+	}
+	if pool := len(imp.(*GitImporter).pool); pool != 3 {
+		t.Errorf("expected 3 repositories in the pool, got %d", pool)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pathname, expected := "/refs/heads/main/a.txt", "alpha"
+			if i%2 == 1 {
+				pathname, expected = "/refs/tags/v2/a.txt", "alpha, again"
+			}
+			rd, err := imp.Open(pathname)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rd.Close()
+			data, err := io.ReadAll(rd)
+			if err != nil || string(data) != expected {
+				t.Error(fmt.Errorf("%s: unexpected content %q: %v", pathname, data, err))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
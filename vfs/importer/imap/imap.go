@@ -17,10 +17,12 @@
 package imap
 
 import (
+	"crypto/tls"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/fs"
-	"log"
+	"net"
 	"net/url"
 	"sort"
 	"strconv"
@@ -32,14 +34,38 @@ import (
 	"github.com/PlakarLabs/plakar/vfs/importer"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/gobwas/glob"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 type IMAPImporter struct {
 	importer.ImporterBackend
 
 	location string
+	address  string
+	username string
 	client   *client.Client
 	clientMu sync.Mutex
+
+	includes []glob.Glob
+	excludes []glob.Glob
+
+	state     importer.StateStore
+	tlsConfig *tls.Config
+}
+
+// mailboxState is what is remembered about a mailbox between runs, the
+// metadata of messages up to HighestUid is reused as long as the mailbox
+// UIDVALIDITY doesn't change.
+type mailboxState struct {
+	UidValidity uint32
+	HighestUid  uint32
+	Messages    map[uint32]messageState
+}
+
+type messageState struct {
+	Size int64
+	Date time.Time
 }
 
 func init() {
@@ -50,12 +76,12 @@ func NewIMAPImporter() importer.ImporterBackend {
 	return &IMAPImporter{}
 }
 
-func (p *IMAPImporter) connect(location *url.URL) error {
-	port := "993"
-	if location.Port() != "" {
-		port = location.Port()
-	}
-	client, err := client.DialTLS(location.Host+":"+port, nil)
+func (p *IMAPImporter) SetStateStore(store importer.StateStore) {
+	p.state = store
+}
+
+func (p *IMAPImporter) connect() error {
+	client, err := client.DialTLS(p.address, p.tlsConfig)
 	if err != nil {
 		return err
 	}
@@ -63,21 +89,173 @@ func (p *IMAPImporter) connect(location *url.URL) error {
 	return nil
 }
 
+// parseFilters reads the include and exclude query parameters, both take
+// a comma separated list of mailbox patterns and may be repeated.
+func parseFilters(values []string) ([]glob.Glob, error) {
+	ret := make([]glob.Glob, 0)
+	for _, value := range values {
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern == "" {
+				continue
+			}
+			g, err := glob.Compile(pattern, '/')
+			if err != nil {
+				return nil, fmt.Errorf("invalid mailbox pattern %q: %w", pattern, err)
+			}
+			ret = append(ret, g)
+		}
+	}
+	return ret, nil
+}
+
+func (p *IMAPImporter) selected(mailbox string) bool {
+	if len(p.includes) != 0 {
+		included := false
+		for _, include := range p.includes {
+			if include.Match(mailbox) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, exclude := range p.excludes {
+		if exclude.Match(mailbox) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *IMAPImporter) stateKey(mailbox string) string {
+	return fmt.Sprintf("imap:%s@%s:%s", p.username, p.address, mailbox)
+}
+
+func (p *IMAPImporter) loadState(mailbox string) *mailboxState {
+	state := &mailboxState{Messages: make(map[uint32]messageState)}
+	if p.state == nil {
+		return state
+	}
+	data, err := p.state.GetState(p.stateKey(mailbox))
+	if err != nil {
+		return state
+	}
+	if err := msgpack.Unmarshal(data, state); err != nil || state.Messages == nil {
+		return &mailboxState{Messages: make(map[uint32]messageState)}
+	}
+	return state
+}
+
+func (p *IMAPImporter) saveState(mailbox string, state *mailboxState) error {
+	if p.state == nil {
+		return nil
+	}
+	data, err := msgpack.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return p.state.PutState(p.stateKey(mailbox), data)
+}
+
+// device identifies a mailbox incarnation: the account in the upper half
+// and UIDVALIDITY in the lower one, so that cached objects are no longer
+// reused once the server renumbers a mailbox.
+func (p *IMAPImporter) device(uidValidity uint32) uint64 {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(p.username + "@" + p.address))
+	return uint64(hasher.Sum32())<<32 | uint64(uidValidity)
+}
+
+// scanMailbox returns the messages of a mailbox, only messages that were
+// not seen by a previous run with the same UIDVALIDITY are fetched.
+func (p *IMAPImporter) scanMailbox(mailbox string) (uint32, map[uint32]messageState, error) {
+	mbox, err := p.client.Select(mailbox, true)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	state := p.loadState(mailbox)
+	if state.UidValidity != mbox.UidValidity {
+		state = &mailboxState{UidValidity: mbox.UidValidity, Messages: make(map[uint32]messageState)}
+	}
+
+	messages := make(map[uint32]messageState)
+	if mbox.Messages != 0 {
+		uids, err := p.client.UidSearch(imap.NewSearchCriteria())
+		if err != nil {
+			return 0, nil, err
+		}
+
+		seqset := new(imap.SeqSet)
+		for _, uid := range uids {
+			if msg, exists := state.Messages[uid]; exists && uid <= state.HighestUid {
+				messages[uid] = msg
+			} else {
+				seqset.AddNum(uid)
+			}
+		}
+
+		if !seqset.Empty() {
+			fetched := make(chan *imap.Message, 10)
+			done := make(chan error, 1)
+			go func() {
+				done <- p.client.UidFetch(seqset, []imap.FetchItem{imap.FetchRFC822Size, imap.FetchUid, imap.FetchEnvelope, imap.FetchInternalDate}, fetched)
+			}()
+			for msg := range fetched {
+				date := msg.InternalDate
+				if msg.Envelope != nil && !msg.Envelope.Date.IsZero() {
+					date = msg.Envelope.Date
+				}
+				messages[msg.Uid] = messageState{Size: int64(msg.Size), Date: date}
+			}
+			if err := <-done; err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+
+	state.Messages = messages
+	for uid := range messages {
+		if uid > state.HighestUid {
+			state.HighestUid = uid
+		}
+	}
+	if err := p.saveState(mailbox, state); err != nil {
+		return 0, nil, err
+	}
+	return mbox.UidValidity, messages, nil
+}
+
 func (p *IMAPImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, error) {
 	parsed, err := url.Parse(p.location)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	err = p.connect(parsed)
-	if err != nil {
+	query := parsed.Query()
+	if p.includes, err = parseFilters(query["include"]); err != nil {
+		return nil, nil, err
+	}
+	if p.excludes, err = parseFilters(query["exclude"]); err != nil {
 		return nil, nil, err
 	}
 
-	username := parsed.User.Username()
+	port := "993"
+	if parsed.Port() != "" {
+		port = parsed.Port()
+	}
+	p.address = net.JoinHostPort(parsed.Hostname(), port)
+	p.username = parsed.User.Username()
 	password, _ := parsed.User.Password()
 
-	err = p.client.Login(username, password)
+	err = p.connect()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = p.client.Login(p.username, password)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -86,6 +264,9 @@ func (p *IMAPImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, err
 	cerr := make(chan error)
 
 	go func() {
+		defer close(c)
+		defer close(cerr)
+
 		directories := make(map[string]vfs.FileInfo)
 		files := make(map[string]vfs.FileInfo)
 		ino := uint64(0)
@@ -108,11 +289,23 @@ func (p *IMAPImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, err
 			done <- p.client.List("", "*", mailboxes)
 		}()
 
+		names := make([]string, 0)
 		for m := range mailboxes {
-			atoms := strings.Split(m.Name, "/")
+			if p.selected(m.Name) {
+				names = append(names, m.Name)
+			}
+		}
+		if err := <-done; err != nil {
+			cerr <- err
+			return
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			atoms := strings.Split(name, "/")
 			for i := 0; i < len(atoms)-1; i++ {
 				dir := strings.Join(atoms[0:i+1], "/")
-				if _, exists := directories[dir]; !exists {
+				if _, exists := directories["/"+dir]; !exists {
 					fi := vfs.NewFileInfo(
 						atoms[i],
 						0,
@@ -138,45 +331,27 @@ func (p *IMAPImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, err
 				0,
 			)
 			ino++
-			directories["/"+m.Name] = stat
+			directories["/"+name] = stat
 
-			mbox, err := p.client.Select(m.Name, false)
+			uidValidity, messages, err := p.scanMailbox(name)
 			if err != nil {
-				log.Fatal(err)
-			}
-
-			from := uint32(1)
-			to := mbox.Messages
-			if mbox.Messages == 0 {
+				cerr <- &fs.PathError{Op: "scan", Path: "/" + name, Err: err}
 				continue
 			}
 
-			seqset := new(imap.SeqSet)
-			seqset.AddRange(from, to)
-
-			messages := make(chan *imap.Message, 10)
-			done = make(chan error, 1)
-			go func() {
-				done <- p.client.Fetch(seqset, []imap.FetchItem{imap.FetchRFC822Size, imap.FetchUid, imap.FetchEnvelope}, messages)
-			}()
-
-			for msg := range messages {
+			for uid, msg := range messages {
 				stat := vfs.NewFileInfo(
-					fmt.Sprint(msg.Uid),
-					int64(msg.Size),
+					fmt.Sprint(uid),
+					msg.Size,
 					0700,
-					msg.Envelope.Date,
-					0,
+					msg.Date,
+					p.device(uidValidity),
 					ino,
 					0,
 					0,
 				)
 				ino++
-				files["/"+m.Name+"/"+fmt.Sprint(msg.Uid)] = stat
-			}
-
-			if err := <-done; err != nil {
-				log.Fatal(err)
+				files["/"+name+"/"+fmt.Sprint(uid)] = stat
 			}
 		}
 
@@ -203,10 +378,6 @@ func (p *IMAPImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, err
 		for _, filename := range fileNames {
 			c <- importer.ImporterRecord{Pathname: filename, Stat: files[filename]}
 		}
-
-		//fmt.Println(files)
-		close(cerr)
-		close(c)
 	}()
 	return c, cerr, nil
 }
@@ -252,5 +423,8 @@ func (p *IMAPImporter) Begin(location string) error {
 }
 
 func (p *IMAPImporter) End() error {
-	return nil
+	if p.client == nil {
+		return nil
+	}
+	return p.client.Logout()
 }
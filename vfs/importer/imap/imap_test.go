@@ -0,0 +1,198 @@
+package imap
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type memoryState map[string][]byte
+
+func (state memoryState) GetState(key string) ([]byte, error) {
+	data, exists := state[key]
+	if !exists {
+		return nil, fmt.Errorf("no state for %s", key)
+	}
+	return data, nil
+}
+
+func (state memoryState) PutState(key string, data []byte) error {
+	state[key] = data
+	return nil
+}
+
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func startServer(t *testing.T) (*memory.Backend, string) {
+	be := memory.New()
+	srv := server.New(be)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return be, l.Addr().String()
+}
+
+func scan(t *testing.T, state memoryState, location string) map[string]int64 {
+	p := &IMAPImporter{tlsConfig: &tls.Config{InsecureSkipVerify: true}}
+	p.SetStateStore(state)
+	if err := p.Begin(location); err != nil {
+		t.Fatal(err)
+	}
+	defer p.End()
+
+	c, cerr, err := p.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for err := range cerr {
+			t.Error(err)
+		}
+	}()
+
+	ret := make(map[string]int64)
+	for record := range c {
+		if record.Stat.IsDir() {
+			ret[record.Pathname] = -1
+		} else {
+			ret[record.Pathname] = record.Stat.Size()
+		}
+	}
+	return ret
+}
+
+func TestIncrementalScan(t *testing.T) {
+	be, address := startServer(t)
+
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Archive/2023", "Spam"} {
+		if err := user.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+		mbox, err := user.GetMailbox(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := "Subject: " + name + "\r\n\r\nhello\r\n"
+		if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state := make(memoryState)
+	location := fmt.Sprintf("imap://username:password@%s?exclude=Spam", address)
+
+	records := scan(t, state, location)
+	for _, pathname := range []string{"/", "/INBOX", "/Archive", "/Archive/2023", "/INBOX/6", "/Archive/2023/1"} {
+		if _, exists := records[pathname]; !exists {
+			t.Errorf("%s was not scanned", pathname)
+		}
+	}
+	if _, exists := records["/Spam"]; exists {
+		t.Errorf("/Spam was not excluded")
+	}
+	inboxSize := records["/INBOX/6"]
+
+	// alter the recorded size to check metadata is reused, not refetched
+	key := fmt.Sprintf("imap:username@%s:INBOX", address)
+	var inbox mailboxState
+	if err := msgpack.Unmarshal(state[key], &inbox); err != nil {
+		t.Fatal(err)
+	}
+	if inbox.HighestUid != 6 {
+		t.Fatalf("expected highest uid 6, got %d", inbox.HighestUid)
+	}
+	msg := inbox.Messages[6]
+	msg.Size = 1
+	inbox.Messages[6] = msg
+	state[key], _ = msgpack.Marshal(&inbox)
+
+	mbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString("Subject: new\r\n\r\nnew\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	records = scan(t, state, location)
+	if records["/INBOX/6"] != 1 {
+		t.Errorf("metadata of /INBOX/6 was refetched")
+	}
+	if _, exists := records["/INBOX/7"]; !exists {
+		t.Errorf("new message /INBOX/7 was not scanned")
+	}
+
+	// a different UIDVALIDITY discards everything known about the mailbox
+	if err := msgpack.Unmarshal(state[key], &inbox); err != nil {
+		t.Fatal(err)
+	}
+	inbox.UidValidity++
+	state[key], _ = msgpack.Marshal(&inbox)
+
+	records = scan(t, state, location)
+	if records["/INBOX/6"] != inboxSize {
+		t.Errorf("expected size %d for /INBOX/6 after UIDVALIDITY change, got %d", inboxSize, records["/INBOX/6"])
+	}
+}
+
+func TestMailboxFilters(t *testing.T) {
+	includes, err := parseFilters([]string{"INBOX,Archive/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	excludes, err := parseFilters([]string{"Archive/2019"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &IMAPImporter{includes: includes, excludes: excludes}
+
+	for mailbox, expected := range map[string]bool{
+		"INBOX":        true,
+		"Archive/2023": true,
+		"Archive/2019": false,
+		"Archive/a/b":  false,
+		"Spam":         false,
+	} {
+		if p.selected(mailbox) != expected {
+			t.Errorf("%s: expected selected=%v", mailbox, expected)
+		}
+	}
+}
@@ -33,6 +33,7 @@ import (
 type ImporterRecord struct {
 	Pathname string
 	Stat     fs.FileInfo
+	Target   string // symlink target, if any
 }
 
 type ImporterBackend interface {
@@ -42,6 +43,57 @@ type ImporterBackend interface {
 	End() error
 }
 
+// Options tunes how a backend walks its source, backends ignore options
+// that make no sense for them.
+type Options struct {
+	// ExcludeCaches skips the content of directories holding a valid
+	// CACHEDIR.TAG file, the directory and its tag file are kept
+	ExcludeCaches bool
+
+	// ExcludeIfPresent skips directories containing one of these files
+	ExcludeIfPresent []string
+
+	// OneFileSystem doesn't descend into directories on other devices
+	// than the scan root, mount points themselves are kept
+	OneFileSystem bool
+
+	// ExcludeFilesystemTypes doesn't descend into mount points of these
+	// types, SkipPseudoFilesystems adds proc, sysfs and the like
+	ExcludeFilesystemTypes []string
+	SkipPseudoFilesystems  bool
+
+	// FollowSymlinks walks symlinks to directories as directories
+	FollowSymlinks bool
+
+	// MaxConcurrency bounds the number of directories read in parallel
+	MaxConcurrency int
+}
+
+// ConfigurableBackend is implemented by backends accepting Options.
+type ConfigurableBackend interface {
+	SetOptions(options *Options)
+}
+
+// StateStore persists importer state between runs, such as the last
+// message seen in a mailbox, it is backed by the repository cache.
+type StateStore interface {
+	GetState(key string) ([]byte, error)
+	PutState(key string, data []byte) error
+}
+
+// StatefulBackend is implemented by backends able to skip work already
+// done by a previous run when given a StateStore.
+type StatefulBackend interface {
+	SetStateStore(store StateStore)
+}
+
+// OrderedBackend is implemented by backends reading content sequentially,
+// such as compressed archives, Order returns the pathnames of regular
+// files in the order they are best opened, one at a time.
+type OrderedBackend interface {
+	Order() []string
+}
+
 type Importer struct {
 	backend ImporterBackend
 }
@@ -83,6 +135,18 @@ func NewImporter(location string) (*Importer, error) {
 			backendName = "s3"
 		} else if strings.HasPrefix(location, "imap://") {
 			backendName = "imap"
+		} else if strings.HasPrefix(location, "tar://") {
+			backendName = "tar"
+		} else if strings.HasPrefix(location, "zip://") {
+			backendName = "zip"
+		} else if strings.HasPrefix(location, "stdin://") {
+			backendName = "stdin"
+		} else if strings.HasPrefix(location, "git://") || strings.HasPrefix(location, "git+file://") {
+			backendName = "git"
+		} else if strings.HasPrefix(location, "maildir://") {
+			backendName = "maildir"
+		} else if strings.HasPrefix(location, "mbox://") {
+			backendName = "mbox"
 		} else if strings.HasPrefix(location, "fs://") {
 			backendName = "fs"
 		} else {
@@ -105,6 +169,31 @@ func NewImporter(location string) (*Importer, error) {
 	}
 }
 
+// SetOptions hands options to the backend if it accepts them, it must be
+// called before Begin.
+func (importer *Importer) SetOptions(options *Options) {
+	if backend, ok := importer.backend.(ConfigurableBackend); ok {
+		backend.SetOptions(options)
+	}
+}
+
+// SetStateStore hands store to the backend if it keeps state, it must be
+// called before Begin.
+func (importer *Importer) SetStateStore(store StateStore) {
+	if backend, ok := importer.backend.(StatefulBackend); ok {
+		backend.SetStateStore(store)
+	}
+}
+
+// Order returns the pathnames in the order the backend reads them best,
+// or nil if files can be opened in any order.
+func (importer *Importer) Order() []string {
+	if backend, ok := importer.backend.(OrderedBackend); ok {
+		return backend.Order()
+	}
+	return nil
+}
+
 func (importer *Importer) Begin(config string) error {
 	t0 := time.Now()
 	defer func() {
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package mailbox
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net/mail"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/PlakarLabs/plakar/vfs/importer"
+)
+
+// message locates a message of a mailbox, the pathname layout mirrors
+// the IMAP importer: /<mailbox>/<uid>
+type message struct {
+	mailbox string
+	uid     uint32
+	size    int64
+	date    time.Time
+}
+
+func (m *message) pathname() string {
+	return fmt.Sprintf("/%s/%d", m.mailbox, m.uid)
+}
+
+// emit sends the mailbox directories, then the messages they contain
+func emit(c chan<- importer.ImporterRecord, mailboxes []string, messages []*message) {
+	ino := uint64(0)
+	directories := map[string]struct{}{"/": {}}
+	for _, mailbox := range mailboxes {
+		atoms := strings.Split(mailbox, "/")
+		for i := range atoms {
+			directories["/"+strings.Join(atoms[0:i+1], "/")] = struct{}{}
+		}
+	}
+
+	directoryNames := make([]string, 0, len(directories))
+	for name := range directories {
+		directoryNames = append(directoryNames, name)
+	}
+	sort.Slice(directoryNames, func(i, j int) bool {
+		if len(directoryNames[i]) != len(directoryNames[j]) {
+			return len(directoryNames[i]) < len(directoryNames[j])
+		}
+		return directoryNames[i] < directoryNames[j]
+	})
+
+	for _, directory := range directoryNames {
+		name := path.Base(directory)
+		fi := vfs.NewFileInfo(name, 0, 0700|fs.ModeDir, time.Now(), 0, ino, 0, 0)
+		ino++
+		c <- importer.ImporterRecord{Pathname: directory, Stat: fi}
+	}
+
+	for _, m := range messages {
+		fi := vfs.NewFileInfo(fmt.Sprint(m.uid), m.size, 0700, m.date, 0, ino, 0, 0)
+		ino++
+		c <- importer.ImporterRecord{Pathname: m.pathname(), Stat: fi}
+	}
+}
+
+// headerDate returns the Date header of a message given its header
+// block, like the envelope date used by the IMAP importer.
+func headerDate(header []byte) (time.Time, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(append(header, '\n')))
+	if err != nil {
+		return time.Time{}, false
+	}
+	date, err := msg.Header.Date()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
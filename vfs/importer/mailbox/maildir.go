@@ -0,0 +1,270 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package mailbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/PlakarLabs/plakar/vfs/importer"
+)
+
+// MaildirImporter reads a Maildir++ tree: the top-level maildir is the
+// INBOX and .Foo.Bar subfolders become the Foo/Bar mailbox. Uids come
+// from dovecot-uidlist when present, otherwise messages are numbered in
+// the order of their unique names, which start with the delivery time.
+type MaildirImporter struct {
+	importer.ImporterBackend
+
+	location string
+	root     string
+
+	muFiles sync.Mutex
+	files   map[string]string
+}
+
+func init() {
+	importer.Register("maildir", NewMaildirImporter)
+}
+
+func NewMaildirImporter() importer.ImporterBackend {
+	return &MaildirImporter{}
+}
+
+func (p *MaildirImporter) Begin(location string) error {
+	p.location = location
+	p.root = filepath.Clean(strings.TrimPrefix(location, "maildir://"))
+	p.files = make(map[string]string)
+	return nil
+}
+
+// uniqueName strips the ":2,FLAGS" info suffix, which changes as flags
+// are updated while the rest of the name identifies the message
+func uniqueName(name string) string {
+	if idx := strings.IndexByte(name, ':'); idx != -1 {
+		return name[:idx]
+	}
+	return name
+}
+
+// readUidlist parses a dovecot-uidlist into unique name -> uid, along
+// with the next uid dovecot would assign
+func readUidlist(folder string) (map[string]uint32, uint32) {
+	fp, err := os.Open(filepath.Join(folder, "dovecot-uidlist"))
+	if err != nil {
+		return nil, 1
+	}
+	defer fp.Close()
+
+	uids := make(map[string]uint32)
+	next := uint32(1)
+	scanner := bufio.NewScanner(fp)
+	first := true
+	for scanner.Scan() {
+		line := scanner.Text()
+		if first {
+			// header line: version, uidvalidity and next uid
+			first = false
+			fields := strings.Fields(line)
+			for i, field := range fields {
+				var value string
+				if len(fields) == 3 && fields[0] == "1" && i == 2 {
+					value = field
+				} else if strings.HasPrefix(field, "N") {
+					value = field[1:]
+				} else {
+					continue
+				}
+				if n, err := strconv.ParseUint(value, 10, 32); err == nil {
+					next = uint32(n)
+				}
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		// version 3 prefixes the name with ':', earlier versions don't
+		name := fields[len(fields)-1]
+		if idx := strings.Index(line, " :"); idx != -1 {
+			name = line[idx+2:]
+		}
+		uids[uniqueName(name)] = uint32(uid)
+		if uint32(uid) >= next {
+			next = uint32(uid) + 1
+		}
+	}
+	return uids, next
+}
+
+func (p *MaildirImporter) folders() (map[string]string, error) {
+	folders := map[string]string{"INBOX": p.root}
+
+	entries, err := os.ReadDir(p.root)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, ".") || name == "." || name == ".." {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(p.root, name, "cur")); err != nil {
+			continue
+		}
+		mailbox := strings.ReplaceAll(strings.Trim(name, "."), ".", "/")
+		folders[mailbox] = filepath.Join(p.root, name)
+	}
+	return folders, nil
+}
+
+func (p *MaildirImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, error) {
+	folders, err := p.folders()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := make(chan importer.ImporterRecord)
+	cerr := make(chan error)
+
+	go func() {
+		mailboxes := make([]string, 0, len(folders))
+		for mailbox := range folders {
+			mailboxes = append(mailboxes, mailbox)
+		}
+		sort.Strings(mailboxes)
+
+		messages := make([]*message, 0)
+		for _, mailbox := range mailboxes {
+			folder := folders[mailbox]
+			uids, next := readUidlist(folder)
+
+			type entry struct {
+				unique   string
+				filename string
+				info     os.FileInfo
+			}
+			entries := make([]entry, 0)
+			for _, sub := range []string{"cur", "new"} {
+				dirents, err := os.ReadDir(filepath.Join(folder, sub))
+				if err != nil {
+					if !os.IsNotExist(err) {
+						cerr <- err
+					}
+					continue
+				}
+				for _, dirent := range dirents {
+					if !dirent.Type().IsRegular() {
+						continue
+					}
+					info, err := dirent.Info()
+					if err != nil {
+						cerr <- err
+						continue
+					}
+					entries = append(entries, entry{
+						unique:   uniqueName(dirent.Name()),
+						filename: filepath.Join(folder, sub, dirent.Name()),
+						info:     info,
+					})
+				}
+			}
+			sort.Slice(entries, func(i, j int) bool {
+				return entries[i].unique < entries[j].unique
+			})
+
+			for _, e := range entries {
+				// messages missing from the uidlist are numbered after it
+				uid, exists := uids[e.unique]
+				if !exists {
+					uid = next
+					next++
+				}
+
+				m := &message{mailbox: mailbox, uid: uid, size: e.info.Size(), date: e.info.ModTime()}
+				if header, err := readHeader(e.filename); err != nil {
+					cerr <- err
+				} else if date, ok := headerDate(header); ok {
+					m.date = date
+				}
+
+				p.muFiles.Lock()
+				p.files[m.pathname()] = e.filename
+				p.muFiles.Unlock()
+				messages = append(messages, m)
+			}
+		}
+
+		emit(c, mailboxes, messages)
+		close(cerr)
+		close(c)
+	}()
+	return c, cerr, nil
+}
+
+// readHeader returns the header block of a message file
+func readHeader(filename string) ([]byte, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var header bytes.Buffer
+	rd := bufio.NewReader(fp)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		header.Write(line)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+	}
+	return header.Bytes(), nil
+}
+
+func (p *MaildirImporter) Open(pathname string) (io.ReadCloser, error) {
+	p.muFiles.Lock()
+	filename, exists := p.files[filepath.ToSlash(pathname)]
+	p.muFiles.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("%s: %w", pathname, os.ErrNotExist)
+	}
+	return os.Open(filename)
+}
+
+func (p *MaildirImporter) End() error {
+	return nil
+}
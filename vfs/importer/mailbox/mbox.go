@@ -0,0 +1,293 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package mailbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PlakarLabs/plakar/vfs/importer"
+)
+
+// mboxMessage locates the raw lines of a message within an mbox file,
+// from the line following its "From " separator to the next separator.
+type mboxMessage struct {
+	filename string
+	offset   int64
+	length   int64
+}
+
+// MboxImporter splits mbox files into messages, a location may point to
+// a single mbox or to a directory of them, one mailbox per file. Quoted
+// ">From " lines are unquoted as in mboxrd, uids number the messages in
+// file order.
+type MboxImporter struct {
+	importer.ImporterBackend
+
+	location string
+	root     string
+
+	muMessages sync.Mutex
+	messages   map[string]*mboxMessage
+}
+
+func init() {
+	importer.Register("mbox", NewMboxImporter)
+}
+
+func NewMboxImporter() importer.ImporterBackend {
+	return &MboxImporter{}
+}
+
+func (p *MboxImporter) Begin(location string) error {
+	p.location = location
+	p.root = filepath.Clean(strings.TrimPrefix(location, "mbox://"))
+	p.messages = make(map[string]*mboxMessage)
+	return nil
+}
+
+func (p *MboxImporter) mailboxes() (map[string]string, error) {
+	info, err := os.Stat(p.root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return map[string]string{filepath.Base(p.root): p.root}, nil
+	}
+
+	mailboxes := make(map[string]string)
+	err = filepath.WalkDir(p.root, func(pathname string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(p.root, pathname)
+		if err != nil {
+			return err
+		}
+		mailboxes[filepath.ToSlash(rel)] = pathname
+		return nil
+	})
+	return mailboxes, err
+}
+
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+// isQuotedFrom matches the ">From ", ">>From ", ... lines mboxrd quotes
+func isQuotedFrom(line []byte) bool {
+	return isFromLine(bytes.TrimLeft(line, ">")) && len(line) > 0 && line[0] == '>'
+}
+
+// separatorDate parses the date of a "From sender date" separator line
+func separatorDate(line []byte) (time.Time, bool) {
+	fields := strings.Fields(string(line))
+	if len(fields) < 7 {
+		return time.Time{}, false
+	}
+	date, err := time.Parse(time.ANSIC, strings.Join(fields[2:7], " "))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+func (p *MboxImporter) split(mailbox string, filename string) ([]*message, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	info, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*message, 0)
+	var current *message
+	var raw *mboxMessage
+	var header bytes.Buffer
+	inHeader := false
+	previousBlank := true
+
+	// the blank line preceding a separator belongs to the mbox format,
+	// it is only added to a message once a non-separator line follows
+	pendingBlank := int64(0)
+
+	finish := func() {
+		if current != nil {
+			if date, ok := headerDate(header.Bytes()); ok {
+				current.date = date
+			}
+			p.muMessages.Lock()
+			p.messages[current.pathname()] = raw
+			p.muMessages.Unlock()
+			messages = append(messages, current)
+		}
+	}
+
+	rd := bufio.NewReader(fp)
+	offset := int64(0)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if len(line) != 0 {
+			lineOffset := offset
+			offset += int64(len(line))
+
+			if previousBlank && isFromLine(line) {
+				finish()
+				current = &message{mailbox: mailbox, uid: uint32(len(messages) + 1), date: info.ModTime()}
+				if date, ok := separatorDate(line); ok {
+					current.date = date
+				}
+				raw = &mboxMessage{filename: filename, offset: offset}
+				header.Reset()
+				inHeader = true
+				pendingBlank = 0
+				previousBlank = false
+				continue
+			}
+
+			blank := len(bytes.TrimRight(line, "\r\n")) == 0
+			if current != nil {
+				if pendingBlank != 0 {
+					raw.length += pendingBlank
+					current.size += pendingBlank
+					pendingBlank = 0
+				}
+				if blank {
+					inHeader = false
+					pendingBlank = int64(len(line))
+				} else {
+					raw.length = lineOffset + int64(len(line)) - raw.offset
+					current.size += int64(len(line))
+					if isQuotedFrom(line) {
+						current.size--
+					}
+					if inHeader {
+						header.Write(line)
+					}
+				}
+			}
+			previousBlank = blank
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	finish()
+	return messages, nil
+}
+
+func (p *MboxImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, error) {
+	files, err := p.mailboxes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := make(chan importer.ImporterRecord)
+	cerr := make(chan error)
+
+	go func() {
+		mailboxes := make([]string, 0, len(files))
+		for mailbox := range files {
+			mailboxes = append(mailboxes, mailbox)
+		}
+		sort.Strings(mailboxes)
+
+		messages := make([]*message, 0)
+		for _, mailbox := range mailboxes {
+			split, err := p.split(mailbox, files[mailbox])
+			if err != nil {
+				cerr <- fmt.Errorf("%s: %w", files[mailbox], err)
+				continue
+			}
+			messages = append(messages, split...)
+		}
+
+		emit(c, mailboxes, messages)
+		close(cerr)
+		close(c)
+	}()
+	return c, cerr, nil
+}
+
+// unquoteReader strips one '>' from quoted "From " lines
+type unquoteReader struct {
+	rd      *bufio.Reader
+	fp      *os.File
+	pending []byte
+}
+
+func (r *unquoteReader) Read(buf []byte) (int, error) {
+	for len(r.pending) == 0 {
+		line, err := r.rd.ReadBytes('\n')
+		if isQuotedFrom(line) {
+			line = line[1:]
+		}
+		r.pending = line
+		if err != nil {
+			if len(line) == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+	n := copy(buf, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *unquoteReader) Close() error {
+	return r.fp.Close()
+}
+
+func (p *MboxImporter) Open(pathname string) (io.ReadCloser, error) {
+	p.muMessages.Lock()
+	raw, exists := p.messages[filepath.ToSlash(pathname)]
+	p.muMessages.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("%s: %w", pathname, os.ErrNotExist)
+	}
+
+	fp, err := os.Open(raw.filename)
+	if err != nil {
+		return nil, err
+	}
+	section := io.NewSectionReader(fp, raw.offset, raw.length)
+	return &unquoteReader{rd: bufio.NewReader(section), fp: fp}, nil
+}
+
+func (p *MboxImporter) End() error {
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package mailbox
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMboxSplit(t *testing.T) {
+	mbox := filepath.Join(t.TempDir(), "inbox")
+	content := "From a@b Mon Jan  2 15:04:05 2006\n" +
+		"Subject: first\n" +
+		"\n" +
+		">From quoted\n" +
+		"\n" +
+		"\n" +
+		"From c@d Tue Jan  3 15:04:05 2006\n" +
+		"Subject: second\n" +
+		"\n" +
+		"body\n"
+	if err := os.WriteFile(mbox, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	imp := NewMboxImporter()
+	if err := imp.Begin("mbox://" + mbox); err != nil {
+		t.Fatal(err)
+	}
+	records, errs, err := imp.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for err := range errs {
+			t.Error(err)
+		}
+	}()
+
+	sizes := make(map[string]int64)
+	for record := range records {
+		sizes[record.Pathname] = record.Stat.Size()
+	}
+
+	expected := map[string]string{
+		"/inbox/1": "Subject: first\n\nFrom quoted\n\n",
+		"/inbox/2": "Subject: second\n\nbody\n",
+	}
+	for pathname, body := range expected {
+		if sizes[pathname] != int64(len(body)) {
+			t.Errorf("%s: size %d, expected %d", pathname, sizes[pathname], len(body))
+		}
+		rd, err := imp.Open(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil || string(data) != body {
+			t.Errorf("%s: got %q, expected %q", pathname, data, body)
+		}
+	}
+}
@@ -18,11 +18,12 @@ package s3
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"net/url"
-	"sort"
+	"path"
 	"strings"
 	"time"
 
@@ -33,12 +34,24 @@ import (
 	"github.com/PlakarLabs/plakar/vfs/importer"
 )
 
+// nullVersionID identifies the version of objects stored while versioning
+// was not enabled
+const nullVersionID = "null"
+
 type S3Importer struct {
 	importer.ImporterBackend
 
 	location    string
 	minioClient *minio.Client
 	bucketName  string
+	prefix      string
+
+	// versions imports every version of an object as key@versionID
+	versions bool
+
+	// metadata records content-type, user metadata and tags as xattrs,
+	// it is opt-in as servers other than MinIO need two requests per object
+	metadata bool
 }
 
 func init() {
@@ -68,8 +81,100 @@ func (provider *S3Importer) connect(location *url.URL) error {
 	return nil
 }
 
+// parseLocation splits s3://host/bucket/prefix and its options, the
+// prefix always designates a directory.
+func (p *S3Importer) parseLocation(location string) (*url.URL, error) {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	atoms := strings.SplitN(strings.TrimPrefix(parsed.Path, "/"), "/", 2)
+	if atoms[0] == "" {
+		return nil, fmt.Errorf("%s: missing bucket name", location)
+	}
+	p.bucketName = atoms[0]
+	p.prefix = ""
+	if len(atoms) == 2 && strings.Trim(atoms[1], "/") != "" {
+		p.prefix = strings.Trim(atoms[1], "/") + "/"
+	}
+
+	query := parsed.Query()
+	p.versions = query.Get("versions") == "true"
+	p.metadata = query.Get("metadata") == "true"
+	return parsed, nil
+}
+
+// objectPathname maps an object to its pathname in the snapshot and back,
+// version identifiers never contain an @ so the last one is the separator.
+// Objects stored before versioning was enabled have the null version, S3
+// names it "null" so that every pathname carries a version.
+func (p *S3Importer) objectPathname(key string, versionID string) string {
+	if p.versions {
+		if versionID == "" {
+			versionID = nullVersionID
+		}
+		return "/" + key + "@" + versionID
+	}
+	return "/" + key
+}
+
+func (p *S3Importer) objectKey(pathname string) (string, string) {
+	key := strings.TrimPrefix(pathname, "/")
+	if p.versions {
+		if i := strings.LastIndex(key, "@"); i != -1 {
+			return key[:i], key[i+1:]
+		}
+	}
+	return key, ""
+}
+
+// objectXattrs returns the object metadata, MinIO includes it in listings
+// while other servers require a HEAD request, and another one for tags.
+func (p *S3Importer) objectXattrs(object minio.ObjectInfo) (map[string][]byte, error) {
+	if object.UserMetadata == nil {
+		stat, err := p.minioClient.StatObject(context.Background(), p.bucketName, object.Key, minio.StatObjectOptions{VersionID: object.VersionID})
+		if err != nil {
+			return nil, err
+		}
+		object = stat
+
+		if object.UserTagCount != 0 {
+			tags, err := p.minioClient.GetObjectTagging(context.Background(), p.bucketName, object.Key, minio.GetObjectTaggingOptions{VersionID: object.VersionID})
+			if err != nil {
+				return nil, err
+			}
+			object.UserTags = tags.ToMap()
+		}
+	}
+
+	xattrs := make(map[string][]byte)
+	if object.ContentType != "" {
+		xattrs["user.s3.content-type"] = []byte(object.ContentType)
+	}
+	if object.ETag != "" {
+		xattrs["user.s3.etag"] = []byte(object.ETag)
+	}
+	if object.VersionID != "" {
+		xattrs["user.s3.version-id"] = []byte(object.VersionID)
+	}
+	for name, value := range object.UserMetadata {
+		// MinIO listings keep the header prefix and list the content-type
+		name = strings.TrimPrefix(strings.ToLower(name), "x-amz-meta-")
+		if name == "content-type" {
+			xattrs["user.s3.content-type"] = []byte(value)
+			continue
+		}
+		xattrs["user.s3.meta."+name] = []byte(value)
+	}
+	for name, value := range object.UserTags {
+		xattrs["user.s3.tag."+name] = []byte(value)
+	}
+	return xattrs, nil
+}
+
 func (p *S3Importer) Scan() (<-chan importer.ImporterRecord, <-chan error, error) {
-	parsed, err := url.Parse(p.location)
+	parsed, err := p.parseLocation(p.location)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -78,51 +183,66 @@ func (p *S3Importer) Scan() (<-chan importer.ImporterRecord, <-chan error, error
 	if err != nil {
 		return nil, nil, err
 	}
-	p.bucketName = parsed.RequestURI()[1:]
 
 	c := make(chan importer.ImporterRecord)
 	cerr := make(chan error)
 
 	go func() {
-		directories := make(map[string]vfs.FileInfo)
-		files := make(map[string]vfs.FileInfo)
+		defer close(c)
+		defer close(cerr)
+
+		// listings are streamed, parents are emitted the first time one
+		// of their children shows up so only directories are remembered
+		directories := make(map[string]struct{})
 		ino := uint64(0)
-		fi := vfs.NewFileInfo(
-			"/",
-			0,
-			0700|fs.ModeDir,
-			time.Now(),
-			0,
-			ino,
-			0,
-			0,
-		)
-		directories["/"] = fi
-		ino++
-
-		for object := range p.minioClient.ListObjects(context.Background(), p.bucketName, minio.ListObjectsOptions{Prefix: "", Recursive: true}) {
-			atoms := strings.Split(object.Key, "/")
-
-			for i := 0; i < len(atoms)-1; i++ {
-				dir := strings.Join(atoms[0:i+1], "/")
-				if _, exists := directories[dir]; !exists {
-					fi := vfs.NewFileInfo(
-						atoms[i],
-						0,
-						0700|fs.ModeDir,
-						time.Now(),
-						0,
-						ino,
-						0,
-						0,
-					)
-					directories["/"+dir] = fi
-					ino++
-				}
+		emitDirectory := func(pathname string) {
+			if _, exists := directories[pathname]; exists {
+				return
+			}
+			directories[pathname] = struct{}{}
+			c <- importer.ImporterRecord{
+				Pathname: pathname,
+				Stat:     vfs.NewFileInfo(path.Base(pathname), 0, 0700|fs.ModeDir, time.Now(), 0, ino, 0, 0),
 			}
+			ino++
+		}
+		emitParents := func(pathname string) {
+			atoms := strings.Split(pathname, "/")
+			for i := 1; i < len(atoms); i++ {
+				emitDirectory("/" + strings.Join(atoms[1:i], "/"))
+			}
+		}
+
+		emitDirectory("/")
+
+		options := minio.ListObjectsOptions{
+			Prefix:       p.prefix,
+			Recursive:    true,
+			WithVersions: p.versions,
+			WithMetadata: p.metadata,
+		}
+		for object := range p.minioClient.ListObjects(context.Background(), p.bucketName, options) {
+			if object.Err != nil {
+				cerr <- object.Err
+				return
+			}
+			if object.IsDeleteMarker {
+				continue
+			}
+
+			// zero-length keys ending with a slash are directory markers
+			if strings.HasSuffix(object.Key, "/") {
+				pathname := "/" + strings.TrimSuffix(object.Key, "/")
+				emitParents(pathname)
+				emitDirectory(pathname)
+				continue
+			}
+
+			pathname := p.objectPathname(object.Key, object.VersionID)
+			emitParents(pathname)
 
 			stat := vfs.NewFileInfo(
-				atoms[len(atoms)-1],
+				path.Base(pathname),
 				object.Size,
 				0700,
 				object.LastModified,
@@ -132,43 +252,26 @@ func (p *S3Importer) Scan() (<-chan importer.ImporterRecord, <-chan error, error
 				0,
 			)
 			ino++
-			files["/"+object.Key] = stat
-		}
-
-		directoryNames := make([]string, 0)
-		for name := range directories {
-			directoryNames = append(directoryNames, name)
-		}
-
-		fileNames := make([]string, 0)
-		for name := range files {
-			fileNames = append(fileNames, name)
-		}
 
-		sort.Slice(directoryNames, func(i, j int) bool {
-			return len(directoryNames[i]) < len(directoryNames[j])
-		})
-		sort.Slice(fileNames, func(i, j int) bool {
-			return len(fileNames[i]) < len(fileNames[j])
-		})
+			if p.metadata {
+				xattrs, err := p.objectXattrs(object)
+				if err != nil {
+					cerr <- &fs.PathError{Op: "stat", Path: pathname, Err: err}
+				} else if len(xattrs) != 0 {
+					stat.Lxattrs = xattrs
+				}
+			}
 
-		for _, directory := range directoryNames {
-			c <- importer.ImporterRecord{Pathname: directory, Stat: directories[directory]}
-		}
-		for _, filename := range fileNames {
-			c <- importer.ImporterRecord{Pathname: filename, Stat: files[filename]}
+			c <- importer.ImporterRecord{Pathname: pathname, Stat: stat}
 		}
-
-		//fmt.Println(files)
-		close(cerr)
-		close(c)
 	}()
 	return c, cerr, nil
 }
 
 func (p *S3Importer) Open(pathname string) (io.ReadCloser, error) {
-	obj, err := p.minioClient.GetObject(context.Background(), p.bucketName, pathname,
-		minio.GetObjectOptions{})
+	key, versionID := p.objectKey(pathname)
+	obj, err := p.minioClient.GetObject(context.Background(), p.bucketName, key,
+		minio.GetObjectOptions{VersionID: versionID})
 	if err != nil {
 		return nil, err
 	}
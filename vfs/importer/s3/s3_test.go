@@ -0,0 +1,72 @@
+package s3
+
+import (
+	"testing"
+)
+
+func TestParseLocation(t *testing.T) {
+	for location, expected := range map[string][2]string{
+		"s3://localhost:9000/bucket":                {"bucket", ""},
+		"s3://localhost:9000/bucket/":               {"bucket", ""},
+		"s3://localhost:9000/bucket/photos":         {"bucket", "photos/"},
+		"s3://localhost:9000/bucket/photos/2023/":   {"bucket", "photos/2023/"},
+		"s3://user:pass@localhost:9000/bucket/a?x=": {"bucket", "a/"},
+	} {
+		p := &S3Importer{}
+		if _, err := p.parseLocation(location); err != nil {
+			t.Fatalf("%s: %s", location, err)
+		}
+		if p.bucketName != expected[0] || p.prefix != expected[1] {
+			t.Errorf("%s: got bucket=%q prefix=%q", location, p.bucketName, p.prefix)
+		}
+		if p.metadata {
+			t.Errorf("%s: expected metadata to be opt-in", location)
+		}
+	}
+
+	p := &S3Importer{}
+	if _, err := p.parseLocation("s3://localhost:9000/bucket?metadata=true"); err != nil || !p.metadata {
+		t.Errorf("expected metadata to be enabled: %v", err)
+	}
+
+	p = &S3Importer{}
+	if _, err := p.parseLocation("s3://localhost:9000/"); err == nil {
+		t.Errorf("expected an error for a location without bucket")
+	}
+}
+
+func TestVersionPathnames(t *testing.T) {
+	p := &S3Importer{}
+	if _, err := p.parseLocation("s3://localhost/bucket?versions=true"); err != nil {
+		t.Fatal(err)
+	}
+
+	pathname := p.objectPathname("mail/user@example.org", "3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY")
+	if pathname != "/mail/user@example.org@3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY" {
+		t.Fatalf("unexpected pathname %s", pathname)
+	}
+	key, versionID := p.objectKey(pathname)
+	if key != "mail/user@example.org" || versionID != "3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY" {
+		t.Errorf("got key=%q version=%q", key, versionID)
+	}
+
+	// objects without a version get the null one, the @ of their key is
+	// not taken for the separator
+	pathname = p.objectPathname("mail/user@example.org", "")
+	if pathname != "/mail/user@example.org@null" {
+		t.Fatalf("unexpected pathname %s", pathname)
+	}
+	key, versionID = p.objectKey(pathname)
+	if key != "mail/user@example.org" || versionID != "null" {
+		t.Errorf("got key=%q version=%q", key, versionID)
+	}
+
+	p.versions = false
+	if pathname := p.objectPathname("mail/user@example.org", ""); pathname != "/mail/user@example.org" {
+		t.Fatalf("unexpected pathname %s", pathname)
+	}
+	key, versionID = p.objectKey("/mail/user@example.org")
+	if key != "mail/user@example.org" || versionID != "" {
+		t.Errorf("got key=%q version=%q", key, versionID)
+	}
+}
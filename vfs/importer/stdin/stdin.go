@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package stdin
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PlakarLabs/plakar/vfs"
+	"github.com/PlakarLabs/plakar/vfs/importer"
+)
+
+// StdinImporter exposes stdin as a single file whose size is unknown
+// until it has been read, configured as stdin://name?mode=0600&mtime=...
+// with mtime in RFC3339 format.
+type StdinImporter struct {
+	importer.ImporterBackend
+
+	location string
+	pathname string
+	mode     fs.FileMode
+	mtime    time.Time
+
+	muOpened sync.Mutex
+	opened   bool
+}
+
+func init() {
+	importer.Register("stdin", NewStdinImporter)
+}
+
+func NewStdinImporter() importer.ImporterBackend {
+	return &StdinImporter{}
+}
+
+func (p *StdinImporter) Begin(location string) error {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+
+	name := strings.Trim(parsed.Host+parsed.Path, "/")
+	if name == "" {
+		name = "stdin"
+	}
+
+	p.location = location
+	p.pathname = path.Clean("/" + name)
+	p.mode = 0644
+	p.mtime = time.Now()
+
+	query := parsed.Query()
+	if value := query.Get("mode"); value != "" {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q: %w", value, err)
+		}
+		p.mode = fs.FileMode(mode) & fs.ModePerm
+	}
+	if value := query.Get("mtime"); value != "" {
+		mtime, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf("invalid mtime %q: %w", value, err)
+		}
+		p.mtime = mtime
+	}
+	return nil
+}
+
+func owner() (uint64, uint64) {
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid < 0 || gid < 0 {
+		return 0, 0
+	}
+	return uint64(uid), uint64(gid)
+}
+
+func (p *StdinImporter) Scan() (<-chan importer.ImporterRecord, <-chan error, error) {
+	c := make(chan importer.ImporterRecord)
+	cerr := make(chan error)
+
+	go func() {
+		uid, gid := owner()
+
+		ino := uint64(0)
+		atoms := strings.Split(p.pathname, "/")
+		for i := 0; i < len(atoms)-1; i++ {
+			dir := path.Clean("/" + strings.Join(atoms[0:i+1], "/"))
+			ino++
+			fi := vfs.NewFileInfo(path.Base(dir), 0, 0700|fs.ModeDir, p.mtime, 0, ino, uid, gid)
+			c <- importer.ImporterRecord{Pathname: dir, Stat: fi}
+		}
+
+		// size is unknown until stdin is consumed, push fills it in
+		ino++
+		fi := vfs.NewFileInfo(path.Base(p.pathname), -1, p.mode, p.mtime, 0, ino, uid, gid)
+		c <- importer.ImporterRecord{Pathname: p.pathname, Stat: fi}
+
+		close(cerr)
+		close(c)
+	}()
+	return c, cerr, nil
+}
+
+func (p *StdinImporter) Open(pathname string) (io.ReadCloser, error) {
+	if path.Clean(pathname) != p.pathname {
+		return nil, os.ErrNotExist
+	}
+
+	p.muOpened.Lock()
+	defer p.muOpened.Unlock()
+	if p.opened {
+		return nil, fmt.Errorf("%s: stdin can only be read once", pathname)
+	}
+	p.opened = true
+	return io.NopCloser(os.Stdin), nil
+}
+
+func (p *StdinImporter) End() error {
+	return nil
+}
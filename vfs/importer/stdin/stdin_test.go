@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package stdin
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/PlakarLabs/plakar/vfs"
+)
+
+func TestScan(t *testing.T) {
+	imp := NewStdinImporter()
+	if err := imp.Begin("stdin://backups/dump.sql?mode=0600&mtime=2023-01-02T03:04:05Z"); err != nil {
+		t.Fatal(err)
+	}
+	defer imp.End()
+
+	records, errs, err := imp.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pathnames := make([]string, 0)
+	sizes := make(map[string]int64)
+	for record := range records {
+		pathnames = append(pathnames, record.Pathname)
+		sizes[record.Pathname] = record.Stat.Size()
+		if record.Pathname == "/backups/dump.sql" {
+			if record.Stat.Mode() != 0600 {
+				t.Errorf("unexpected mode %v", record.Stat.Mode())
+			}
+			if !record.Stat.ModTime().Equal(time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)) {
+				t.Errorf("unexpected mtime %v", record.Stat.ModTime())
+			}
+		}
+	}
+	for err := range errs {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(pathnames, []string{"/", "/backups", "/backups/dump.sql"}) {
+		t.Errorf("unexpected pathnames %v", pathnames)
+	}
+	// the size is unknown until stdin is read
+	if sizes["/backups/dump.sql"] != -1 {
+		t.Errorf("expected an unknown size, got %d", sizes["/backups/dump.sql"])
+	}
+
+	if _, err := imp.Open("/backups/other"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a missing file, got %v", err)
+	}
+	if _, err := imp.Open("/backups/dump.sql"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := imp.Open("/backups/dump.sql"); err == nil {
+		t.Error("expected stdin to be read only once")
+	}
+}
+
+func TestLocation(t *testing.T) {
+	for _, location := range []string{
+		"stdin://dump.sql?mode=0999",
+		"stdin://dump.sql?mtime=yesterday",
+	} {
+		if err := NewStdinImporter().Begin(location); err == nil {
+			t.Errorf("%s: expected an error", location)
+		}
+	}
+}
+
+func TestSetSize(t *testing.T) {
+	filesystem, err := vfs.NewFilesystemFromScan(t.TempDir(), "stdin://dump.sql", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown sizes are not accounted for until they are set
+	fileinfo, exists := filesystem.LookupInodeForFile("/dump.sql")
+	if !exists || fileinfo.Size() != -1 {
+		t.Fatalf("unexpected inode %+v", fileinfo)
+	}
+	if filesystem.Size() != 0 {
+		t.Errorf("expected an empty filesystem, got %d bytes", filesystem.Size())
+	}
+	if files := filesystem.ListFiles(); !reflect.DeepEqual(files, []string{"/dump.sql"}) {
+		t.Errorf("unexpected files %v", files)
+	}
+
+	if err := filesystem.SetSize("/dump.sql", 1234); err != nil {
+		t.Fatal(err)
+	}
+	if fileinfo, exists := filesystem.LookupInodeForFile("/dump.sql"); !exists || fileinfo.Size() != 1234 {
+		t.Errorf("unexpected inode %+v", fileinfo)
+	}
+	if filesystem.Size() != 1234 {
+		t.Errorf("expected a size of 1234, got %d", filesystem.Size())
+	}
+	if err := filesystem.SetSize("/missing", 1); err == nil {
+		t.Error("expected setting the size of a missing file to fail")
+	}
+}
@@ -0,0 +1,399 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package vfs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/PlakarLabs/plakar/logger"
+	"github.com/PlakarLabs/plakar/profiler"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Directories with more than directoryInlineEntries entries are split into
+// chunks stored as separate blobs. Chunk boundaries depend on entry names
+// rather than positions, so adding or removing an entry only rewrites the
+// chunk holding it.
+const (
+	directoryInlineEntries = 1024
+	directoryChunkMin      = 64
+	directoryChunkMask     = 1024 - 1
+	directoryChunkMax      = 8192
+)
+
+// BlobStore holds the content-addressed blobs a filesystem is stored as,
+// one per directory, so that unchanged subtrees are shared by snapshots.
+type BlobStore interface {
+	Checksum(data []byte) [32]byte
+	CheckBlob(checksum [32]byte) (bool, error)
+	CheckBlobBatch(checksums [][32]byte) ([]bool, error)
+	GetBlob(checksum [32]byte) ([]byte, error)
+	PutBlob(checksum [32]byte, data []byte) error
+}
+
+type serializedEntry struct {
+	Name    string
+	Info    FileInfo
+	Target  string   `msgpack:",omitempty"`
+	Subtree [32]byte `msgpack:",omitempty"`
+}
+
+type chunkReference struct {
+	First    string
+	Checksum [32]byte
+}
+
+type serializedDirectory struct {
+	Entries []serializedEntry `msgpack:",omitempty"`
+	Chunks  []chunkReference  `msgpack:",omitempty"`
+}
+
+type serializedChunk struct {
+	Entries []serializedEntry
+}
+
+type serializedFilesystem struct {
+	Version      string
+	Root         serializedEntry
+	Errors       []ErrorEntry
+	NFiles       uint64
+	NDirectories uint64
+	TotalSize    uint64
+}
+
+func newNode(entry serializedEntry) *FilesystemNode {
+	return &FilesystemNode{
+		Inode:   entry.Info,
+		Target:  entry.Target,
+		name:    entry.Name,
+		subtree: entry.Subtree,
+		loaded:  !entry.Info.Mode().IsDir() || entry.Subtree == [32]byte{},
+	}
+}
+
+func newNodes(entries []serializedEntry) []*FilesystemNode {
+	nodes := make([]*FilesystemNode, 0, len(entries))
+	for _, entry := range entries {
+		nodes = append(nodes, newNode(entry))
+	}
+	return nodes
+}
+
+func splitEntries(entries []serializedEntry) [][]serializedEntry {
+	chunks := make([][]serializedEntry, 0)
+	begin := 0
+	for i, entry := range entries {
+		hasher := fnv.New32a()
+		hasher.Write([]byte(entry.Name))
+
+		size := i + 1 - begin
+		if (size >= directoryChunkMin && hasher.Sum32()&directoryChunkMask == 0) || size == directoryChunkMax {
+			chunks = append(chunks, entries[begin:i+1])
+			begin = i + 1
+		}
+	}
+	if begin < len(entries) {
+		chunks = append(chunks, entries[begin:])
+	}
+	return chunks
+}
+
+func putBlob(store BlobStore, data []byte) ([32]byte, error) {
+	checksum := store.Checksum(data)
+	if exists, err := store.CheckBlob(checksum); err != nil {
+		return checksum, err
+	} else if exists {
+		return checksum, nil
+	}
+	return checksum, store.PutBlob(checksum, data)
+}
+
+// Store writes the directories of the filesystem that are missing from
+// store and returns its serialized root. A directory is written after its
+// children, finding it in store means the whole subtree is there already.
+func (filesystem *Filesystem) Store(store BlobStore) ([]byte, error) {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("vfs.Store", time.Since(t0))
+		logger.Trace("vfs", "Store(): %s", time.Since(t0))
+	}()
+
+	subtree, err := filesystem.storeDirectory(store, filesystem.root, false)
+	if err != nil {
+		return nil, err
+	}
+
+	filesystem.root.muNode.Lock()
+	root := serializedEntry{Name: "/", Info: filesystem.root.Inode, Subtree: subtree}
+	filesystem.root.muNode.Unlock()
+
+	return msgpack.Marshal(&serializedFilesystem{
+		Version:      VERSION,
+		Root:         root,
+		Errors:       filesystem.ListErrors(),
+		NFiles:       atomic.LoadUint64(&filesystem.nFiles),
+		NDirectories: atomic.LoadUint64(&filesystem.nDirectories),
+		TotalSize:    atomic.LoadUint64(&filesystem.totalSize),
+	})
+}
+
+// storeDirectory writes a directory and its missing subtrees, checked tells
+// that its caller already found it missing. The subtrees of the children are
+// checked in a single batch, as each check may be a round-trip to a server.
+func (filesystem *Filesystem) storeDirectory(store BlobStore, node *FilesystemNode, checked bool) ([32]byte, error) {
+	node.muNode.Lock()
+	subtree := node.subtree
+	node.muNode.Unlock()
+
+	if subtree != ([32]byte{}) && !checked {
+		if exists, err := store.CheckBlob(subtree); err != nil {
+			return subtree, err
+		} else if exists {
+			return subtree, nil
+		}
+	}
+
+	children, err := filesystem.readChildren(node)
+	if err != nil {
+		return subtree, err
+	}
+
+	entries := make([]serializedEntry, 0, len(children))
+	subtrees := make([][32]byte, 0)
+	for _, child := range children {
+		child.muNode.Lock()
+		entry := serializedEntry{Name: child.name, Info: child.Inode, Target: child.Target}
+		if entry.Info.Mode().IsDir() && child.subtree != ([32]byte{}) {
+			entry.Subtree = child.subtree
+			subtrees = append(subtrees, child.subtree)
+		}
+		child.muNode.Unlock()
+		entries = append(entries, entry)
+	}
+
+	stored := make(map[[32]byte]bool)
+	if len(subtrees) != 0 {
+		exists, err := store.CheckBlobBatch(subtrees)
+		if err != nil {
+			return subtree, err
+		}
+		for i, checksum := range subtrees {
+			stored[checksum] = exists[i]
+		}
+	}
+
+	for i, child := range children {
+		if !entries[i].Info.Mode().IsDir() || stored[entries[i].Subtree] {
+			continue
+		}
+		entries[i].Subtree, err = filesystem.storeDirectory(store, child, entries[i].Subtree != [32]byte{})
+		if err != nil {
+			return subtree, err
+		}
+	}
+
+	directory := serializedDirectory{}
+	if len(entries) <= directoryInlineEntries {
+		directory.Entries = entries
+	} else {
+		for _, chunk := range splitEntries(entries) {
+			serialized, err := msgpack.Marshal(&serializedChunk{Entries: chunk})
+			if err != nil {
+				return subtree, err
+			}
+			checksum, err := putBlob(store, serialized)
+			if err != nil {
+				return subtree, err
+			}
+			directory.Chunks = append(directory.Chunks, chunkReference{First: chunk[0].Name, Checksum: checksum})
+		}
+	}
+
+	serialized, err := msgpack.Marshal(&directory)
+	if err != nil {
+		return subtree, err
+	}
+	subtree, err = putBlob(store, serialized)
+	if err != nil {
+		return subtree, err
+	}
+
+	// a directory that is not loaded still reads from its original blob
+	node.muNode.Lock()
+	if node.loaded {
+		node.subtree = subtree
+	}
+	node.muNode.Unlock()
+	return subtree, nil
+}
+
+// NewFilesystemFromBytes loads the root of a filesystem, directories are
+// read from store as they are looked up.
+func NewFilesystemFromBytes(serialized []byte, store BlobStore) (*Filesystem, error) {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("vfs.NewFilesystemFromBytes", time.Since(t0))
+		logger.Trace("vfs", "NewFilesystemFromBytes(): %s", time.Since(t0))
+	}()
+
+	var version struct {
+		Version string
+	}
+	if err := msgpack.Unmarshal(serialized, &version); err != nil {
+		return nil, err
+	}
+	if version.Version == "" {
+		return newFilesystemFromLegacy(serialized)
+	}
+
+	var root serializedFilesystem
+	if err := msgpack.Unmarshal(serialized, &root); err != nil {
+		return nil, err
+	}
+
+	filesystem := &Filesystem{}
+	filesystem.store = store
+	filesystem.cache = newBlobCache(directoryCacheSize)
+	filesystem.root = newNode(root.Root)
+	filesystem.errors = root.Errors
+	if filesystem.errors == nil {
+		filesystem.errors = make([]ErrorEntry, 0)
+	}
+	filesystem.nFiles = root.NFiles
+	filesystem.nDirectories = root.NDirectories
+	filesystem.totalSize = root.TotalSize
+	return filesystem, nil
+}
+
+// readBlob decodes a blob into v and returns its size
+func (filesystem *Filesystem) readBlob(checksum [32]byte, v interface{}) (int, error) {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("vfs.readBlob", time.Since(t0))
+		logger.Trace("vfs", "readBlob(%064x): %s", checksum, time.Since(t0))
+	}()
+
+	if filesystem.store == nil {
+		return 0, fmt.Errorf("no store to read blob %064x from", checksum)
+	}
+	data, err := filesystem.store.GetBlob(checksum)
+	if err != nil {
+		return 0, err
+	}
+	if filesystem.store.Checksum(data) != checksum {
+		return 0, fmt.Errorf("blob %064x mismatches its checksum", checksum)
+	}
+	return len(data), msgpack.Unmarshal(data, v)
+}
+
+// readDirectory and readChunk share the decoded blobs through the cache,
+// which callers must not modify. A chunk may encode as a directory does,
+// the type of a cached blob is checked before it is returned.
+func (filesystem *Filesystem) readDirectory(checksum [32]byte) (*serializedDirectory, error) {
+	if cached, exists := filesystem.cache.Get(checksum); exists {
+		if directory, ok := cached.(*serializedDirectory); ok {
+			return directory, nil
+		}
+	}
+
+	var directory serializedDirectory
+	size, err := filesystem.readBlob(checksum, &directory)
+	if err != nil {
+		return nil, err
+	}
+	filesystem.cache.Put(checksum, &directory, uint64(size))
+	return &directory, nil
+}
+
+func (filesystem *Filesystem) readChunk(checksum [32]byte) ([]serializedEntry, error) {
+	if cached, exists := filesystem.cache.Get(checksum); exists {
+		if chunk, ok := cached.(*serializedChunk); ok {
+			return chunk.Entries, nil
+		}
+	}
+
+	var chunk serializedChunk
+	size, err := filesystem.readBlob(checksum, &chunk)
+	if err != nil {
+		return nil, err
+	}
+	filesystem.cache.Put(checksum, &chunk, uint64(size))
+	return chunk.Entries, nil
+}
+
+// legacyNode is the layout of filesystems serialized as a single blob,
+// before directories were stored separately.
+type legacyNode struct {
+	Inode    FileInfo
+	Children []struct {
+		Name string
+		Node *legacyNode
+	}
+}
+
+type legacyFilesystem struct {
+	Root     *legacyNode
+	Symlinks []struct {
+		Origin string
+		Target string
+	}
+	Errors []ErrorEntry
+}
+
+func newFilesystemFromLegacy(serialized []byte) (*Filesystem, error) {
+	var legacy legacyFilesystem
+	if err := msgpack.Unmarshal(serialized, &legacy); err != nil {
+		return nil, err
+	}
+
+	filesystem := NewFilesystem()
+	if legacy.Root != nil {
+		filesystem.root = filesystem.newNodeFromLegacy("/", legacy.Root)
+	}
+	for _, symlink := range legacy.Symlinks {
+		if node, err := filesystem.Lookup(symlink.Origin); err == nil {
+			node.Target = symlink.Target
+		}
+	}
+	if legacy.Errors != nil {
+		filesystem.errors = legacy.Errors
+	}
+	return filesystem, nil
+}
+
+func (filesystem *Filesystem) newNodeFromLegacy(name string, legacy *legacyNode) *FilesystemNode {
+	node := &FilesystemNode{Inode: legacy.Inode, name: name, loaded: true}
+	if node.Inode.Size() > 0 {
+		filesystem.totalSize += uint64(node.Inode.Size())
+	}
+	if node.Inode.Mode().IsRegular() {
+		filesystem.nFiles++
+	} else if node.Inode.Mode().IsDir() {
+		filesystem.nDirectories++
+	}
+
+	node.children = make([]*FilesystemNode, 0, len(legacy.Children))
+	for _, child := range legacy.Children {
+		if child.Node != nil {
+			node.children = append(node.children, filesystem.newNodeFromLegacy(child.Name, child.Node))
+		}
+	}
+	return node
+}
@@ -17,9 +17,12 @@
 package vfs
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	iofs "io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -31,43 +34,44 @@ import (
 	"github.com/PlakarLabs/plakar/profiler"
 	"github.com/PlakarLabs/plakar/vfs/importer"
 	"github.com/gobwas/glob"
-	"github.com/iafan/cwalk"
-	"github.com/vmihailenco/msgpack/v5"
 )
 
-const VERSION string = "0.0.1"
-
-type ChildEntry struct {
-	Name string
-	Node *FilesystemNode
-}
+const VERSION string = "0.1.0"
 
+// FilesystemNode is a pathname of the tree, the children of a directory
+// read from a store are only loaded once looked up.
 type FilesystemNode struct {
-	muNode   sync.Mutex
-	Inode    FileInfo
-	Children []ChildEntry
-	children map[string]*FilesystemNode
+	muNode sync.Mutex
+	Inode  FileInfo
+	Target string
+
+	name     string
+	children []*FilesystemNode
+
+	// subtree is the blob the directory was read from or last stored
+	// to, it is reset when the directory is modified. large directories
+	// are loaded a chunk at a time until all their children are needed.
+	loaded     bool
+	subtree    [32]byte
+	chunks     []chunkReference
+	chunkNodes map[int][]*FilesystemNode
 }
 
-type SymlinkEntry struct {
-	Origin string
-	Target string
+// ErrorEntry records a pathname that could not be saved in a snapshot
+type ErrorEntry struct {
+	Pathname string
+	Error    string
 }
 
 type Filesystem struct {
 	importer *importer.Importer
+	store    BlobStore
+	cache    *blobCache
 
-	Root *FilesystemNode
-
-	muScannedDirectories sync.Mutex
-	scannedDirectories   []string
+	root *FilesystemNode
 
-	muStat   sync.Mutex
-	statInfo map[string]*FileInfo
-
-	muSymlinks sync.Mutex
-	Symlinks   []SymlinkEntry
-	symlinks   map[string]string
+	muErrors sync.Mutex
+	errors   []ErrorEntry
 
 	nFiles       uint64
 	nDirectories uint64
@@ -76,49 +80,20 @@ type Filesystem struct {
 
 func NewFilesystem() *Filesystem {
 	filesystem := &Filesystem{}
-	filesystem.Root = &FilesystemNode{
-		Children: make([]ChildEntry, 0),
-		children: make(map[string]*FilesystemNode),
+	filesystem.cache = newBlobCache(directoryCacheSize)
+	filesystem.root = &FilesystemNode{
+		Inode:  FileInfo{Lname: "/", Lmode: os.ModeDir | 0755},
+		name:   "/",
+		loaded: true,
 	}
-	filesystem.statInfo = make(map[string]*FileInfo)
-	filesystem.Symlinks = make([]SymlinkEntry, 0)
-	filesystem.symlinks = make(map[string]string)
+	filesystem.errors = make([]ErrorEntry, 0)
 	filesystem.nFiles = 0
 	filesystem.nDirectories = 0
 	filesystem.totalSize = 0
 	return filesystem
 }
 
-func (filesystem *Filesystem) Serialize() ([]byte, error) {
-	t0 := time.Now()
-	defer func() {
-		profiler.RecordEvent("vfs.Serialize", time.Since(t0))
-		logger.Trace("vfs", "Serialize(): %s", time.Since(t0))
-	}()
-
-	serialized, err := msgpack.Marshal(filesystem)
-	if err != nil {
-		return nil, err
-	}
-	return serialized, nil
-}
-
-func NewFilesystemFromBytes(serialized []byte) (*Filesystem, error) {
-	t0 := time.Now()
-	defer func() {
-		profiler.RecordEvent("vfs.NewFilesystemFromBytes", time.Since(t0))
-		logger.Trace("vfs", "NewFilesystemFromBytes(): %s", time.Since(t0))
-	}()
-
-	var filesystem Filesystem
-	if err := msgpack.Unmarshal(serialized, &filesystem); err != nil {
-		return nil, err
-	}
-	filesystem.reindex()
-	return &filesystem, nil
-}
-
-func NewFilesystemFromScan(repository string, directory string, excludes []glob.Glob) (*Filesystem, error) {
+func NewFilesystemFromScan(repository string, directory string, excludes []glob.Glob, options *importer.Options, state importer.StateStore) (*Filesystem, error) {
 	t0 := time.Now()
 	defer func() {
 		profiler.RecordEvent("vfs.NewFilesystemFromScan", time.Since(t0))
@@ -129,7 +104,15 @@ func NewFilesystemFromScan(repository string, directory string, excludes []glob.
 	if err != nil {
 		return nil, err
 	}
-	imp.Begin(directory)
+	if options != nil {
+		imp.SetOptions(options)
+	}
+	if state != nil {
+		imp.SetStateStore(state)
+	}
+	if err := imp.Begin(directory); err != nil {
+		return nil, err
+	}
 
 	schan, echan, err := imp.Scan()
 	if err != nil {
@@ -139,12 +122,22 @@ func NewFilesystemFromScan(repository string, directory string, excludes []glob.
 	fs := NewFilesystem()
 	fs.importer = imp
 
+	errorsDone := make(chan struct{})
 	go func() {
+		defer close(errorsDone)
 		for msg := range echan {
 			logger.Warn("%s", msg)
+
+			var pathError *iofs.PathError
+			if errors.As(msg, &pathError) {
+				fs.RecordError(filepath.ToSlash(pathError.Path), pathError.Err)
+			} else {
+				fs.RecordError("", msg)
+			}
 		}
 	}()
 
+	excluded := make(map[string]bool)
 	for msg := range schan {
 		pathname := filepath.Clean(msg.Pathname)
 		if pathname == repository || strings.HasPrefix(filepath.ToSlash(pathname), filepath.ToSlash(repository)+"/") {
@@ -158,6 +151,20 @@ func NewFilesystemFromScan(repository string, directory string, excludes []glob.
 				break
 			}
 		}
+		if doExclude {
+			if msg.Stat.Mode().IsDir() {
+				excluded[pathname] = true
+			}
+			continue
+		}
+
+		// the pathnames below an excluded directory are excluded with it
+		for child, dir := pathname, filepath.Dir(pathname); len(excluded) != 0 && dir != child; child, dir = dir, filepath.Dir(dir) {
+			if excluded[dir] {
+				doExclude = true
+				break
+			}
+		}
 		if doExclude {
 			continue
 		}
@@ -171,185 +178,235 @@ func NewFilesystemFromScan(repository string, directory string, excludes []glob.
 					path := filepath.Clean(fmt.Sprintf("%s%s", "/", strings.Join(atoms[0:i], "/")))
 					path = filepath.ToSlash(path)
 					if _, found := fs.LookupInodeForDirectory(path); !found {
-						return nil, err
+						return nil, fmt.Errorf("%s: parent directory %s was not scanned", pathname, path)
 					}
 				}
 			}
 			pathname = filepath.ToSlash(pathname)
-			fs.buildTree(pathname, &stat)
-
-			/*
-				if !fileinfo.Mode.IsDir() && !fileinfo.Mode.IsRegular() {
-					lstat, err := os.Lstat(pathname)
-					if err != nil {
-						logger.Warn("%s", err)
-						return nil
-					}
-
-					lfileinfo := FileinfoFromStat(lstat)
-					if lfileinfo.Mode&os.ModeSymlink != 0 {
-						originFile, err := os.Readlink(lfileinfo.Name)
-						if err != nil {
-							logger.Warn("%s", err)
-							return nil
-						}
-
-						filesystem.muStat.Lock()
-						filesystem.statInfo[pathname] = &lfileinfo
-						filesystem.muStat.Unlock()
-
-						filesystem.muSymlinks.Lock()
-						filesystem.Symlinks[pathname] = originFile
-						filesystem.muSymlinks.Unlock()
-					}
-				}
-			*/
+			if err := fs.buildTree(pathname, &stat, msg.Target); err != nil {
+				return nil, err
+			}
 		}
 	}
+	<-errorsDone
 
 	return fs, nil
 }
 
-func sortedChildInsert(slice []ChildEntry, val ChildEntry) []ChildEntry {
-	index := sort.Search(len(slice), func(i int) bool { return slice[i].Name >= val.Name })
-
-	slice = append(slice, val)
-	copy(slice[index+1:], slice[index:])
-	slice[index] = val
-
-	return slice
+func cleanPathname(pathname string) string {
+	pathname = filepath.Clean(pathname)
+	pathname = filepath.ToSlash(pathname)
+	if pathname == "." {
+		pathname = "/"
+	}
+	return pathname
 }
 
-func sortedSymlinkInsert(slice []SymlinkEntry, val SymlinkEntry) []SymlinkEntry {
-	index := sort.Search(len(slice), func(i int) bool { return slice[i].Origin >= val.Origin })
-
-	slice = append(slice, val)
-	copy(slice[index+1:], slice[index:])
-	slice[index] = val
-
-	return slice
+func searchChildren(children []*FilesystemNode, name string) (int, bool) {
+	index := sort.Search(len(children), func(i int) bool { return children[i].name >= name })
+	return index, index < len(children) && children[index].name == name
 }
 
-func (filesystem *Filesystem) buildTree(pathname string, fileinfo *FileInfo) {
-	filesystem.totalSize += uint64(fileinfo.Size())
+func (filesystem *Filesystem) buildTree(pathname string, fileinfo *FileInfo, target string) error {
+	// a negative size is unknown until the content is read, see SetSize
+	if fileinfo.Size() > 0 {
+		atomic.AddUint64(&filesystem.totalSize, uint64(fileinfo.Size()))
+	}
 
-	pathname = filepath.Clean(pathname)
-	pathname = filepath.ToSlash(pathname)
+	pathname = cleanPathname(pathname)
 
-	p := filesystem.Root
+	p := filesystem.root
 	if pathname != "/" {
 		atoms := strings.Split(pathname, "/")[1:]
 		for _, atom := range atoms {
 			p.muNode.Lock()
-			tmp, exists := p.children[atom]
-			p.muNode.Unlock()
-
-			if !exists {
-				p.muNode.Lock()
-				node := &FilesystemNode{
-					Children: make([]ChildEntry, 0),
-					children: make(map[string]*FilesystemNode),
-				}
-				p.Children = sortedChildInsert(p.Children, ChildEntry{Name: atom, Node: node})
-				p.children[atom] = node
-				tmp = p.children[atom]
+			if err := filesystem.loadChildren(p); err != nil {
 				p.muNode.Unlock()
+				return err
+			}
+			index, exists := searchChildren(p.children, atom)
+			if !exists {
+				node := &FilesystemNode{name: atom, loaded: true}
+				p.children = append(p.children, nil)
+				copy(p.children[index+1:], p.children[index:])
+				p.children[index] = node
 			}
+			tmp := p.children[index]
+			p.subtree = [32]byte{}
+			p.muNode.Unlock()
 			p = tmp
 		}
 	}
 	p.muNode.Lock()
 	p.Inode = *fileinfo
+	if fileinfo.Mode()&os.ModeSymlink != 0 {
+		p.Target = target
+	}
 	p.muNode.Unlock()
 
-	filesystem.muStat.Lock()
-	filesystem.statInfo[pathname] = fileinfo
-	filesystem.muStat.Unlock()
-
 	if fileinfo.Mode().IsRegular() {
 		atomic.AddUint64(&filesystem.nFiles, uint64(1))
-		return
+		return nil
 	}
 
 	if fileinfo.Mode().IsDir() {
 		atomic.AddUint64(&filesystem.nDirectories, uint64(1))
-		return
+		return nil
 	}
+	return nil
+}
 
+// loadDirectory reads the blob of a directory node: small directories are
+// loaded at once, larger ones only get their list of chunks. The caller
+// holds node.muNode.
+func (filesystem *Filesystem) loadDirectory(node *FilesystemNode) error {
+	if node.subtree == ([32]byte{}) {
+		node.loaded = true
+		return nil
+	}
+
+	directory, err := filesystem.readDirectory(node.subtree)
+	if err != nil {
+		return err
+	}
+	if len(directory.Chunks) == 0 {
+		node.children = newNodes(directory.Entries)
+		node.loaded = true
+		return nil
+	}
+	node.chunks = directory.Chunks
+	node.chunkNodes = make(map[int][]*FilesystemNode)
+	return nil
 }
 
-func (filesystem *Filesystem) Scan(c chan<- int64, directory string, skip []string) error {
-	directory = filepath.Clean(directory)
+// loadChunk loads the children held in a chunk of a large directory. The
+// caller holds node.muNode.
+func (filesystem *Filesystem) loadChunk(node *FilesystemNode, index int) ([]*FilesystemNode, error) {
+	if nodes, exists := node.chunkNodes[index]; exists {
+		return nodes, nil
+	}
+
+	entries, err := filesystem.readChunk(node.chunks[index].Checksum)
+	if err != nil {
+		return nil, err
+	}
+	nodes := newNodes(entries)
+	node.chunkNodes[index] = nodes
+	return nodes, nil
+}
 
-	for _, scanned := range filesystem.scannedDirectories {
-		if scanned == directory {
+// loadChildren loads all the children of a directory node. The caller holds
+// node.muNode.
+func (filesystem *Filesystem) loadChildren(node *FilesystemNode) error {
+	if node.loaded {
+		return nil
+	}
+	if node.chunks == nil {
+		if err := filesystem.loadDirectory(node); err != nil {
+			return err
+		}
+		if node.loaded {
 			return nil
 		}
 	}
-	filesystem.muScannedDirectories.Lock()
-	filesystem.scannedDirectories = append(filesystem.scannedDirectories, directory)
-	filesystem.muScannedDirectories.Unlock()
 
-	atoms := strings.Split(directory, "/")
-	for i := len(atoms) - 1; i != 0; i-- {
-		path := filepath.Clean(fmt.Sprintf("%s%s", "/", strings.Join(atoms[0:i], "/")))
-		f, err := os.Stat(path)
+	children := make([]*FilesystemNode, 0)
+	for index := range node.chunks {
+		nodes, err := filesystem.loadChunk(node, index)
 		if err != nil {
 			return err
 		}
-		fi := FileInfoFromStat(f)
-		filesystem.buildTree(path, &fi)
+		children = append(children, nodes...)
+	}
+	node.children = children
+	node.chunks = nil
+	node.chunkNodes = nil
+	node.loaded = true
+	return nil
+}
+
+// readChildren returns the children of a directory node, they are not kept
+// in the tree if they were not loaded already.
+func (filesystem *Filesystem) readChildren(node *FilesystemNode) ([]*FilesystemNode, error) {
+	node.muNode.Lock()
+	loaded, children, subtree := node.loaded, node.children, node.subtree
+	node.muNode.Unlock()
+
+	if loaded {
+		return children, nil
+	}
+	if subtree == ([32]byte{}) {
+		return nil, nil
 	}
 
-	err := cwalk.Walk(directory, func(path string, f os.FileInfo, err error) error {
+	directory, err := filesystem.readDirectory(subtree)
+	if err != nil {
+		return nil, err
+	}
+	if len(directory.Chunks) == 0 {
+		return newNodes(directory.Entries), nil
+	}
+
+	children = make([]*FilesystemNode, 0)
+	for _, chunk := range directory.Chunks {
+		entries, err := filesystem.readChunk(chunk.Checksum)
 		if err != nil {
-			logger.Warn("%s", err)
-			return nil
+			return nil, err
 		}
+		children = append(children, newNodes(entries)...)
+	}
+	return children, nil
+}
 
-		for _, skipPath := range skip {
-			if strings.HasPrefix(filepath.Join(directory, path), skipPath) {
-				return nil
-			}
-		}
+func (filesystem *Filesystem) lookupChild(node *FilesystemNode, name string) (*FilesystemNode, error) {
+	node.muNode.Lock()
+	defer node.muNode.Unlock()
 
-		pathname := fmt.Sprintf("%s/%s", directory, path)
+	if !node.loaded && node.chunks == nil {
+		if err := filesystem.loadDirectory(node); err != nil {
+			return nil, err
+		}
+	}
 
-		fileinfo := FileInfoFromStat(f)
-		filesystem.buildTree(pathname, &fileinfo)
+	children := node.children
+	if !node.loaded {
+		index := sort.Search(len(node.chunks), func(i int) bool { return node.chunks[i].First > name }) - 1
+		if index < 0 {
+			return nil, os.ErrNotExist
+		}
+		nodes, err := filesystem.loadChunk(node, index)
+		if err != nil {
+			return nil, err
+		}
+		children = nodes
+	}
 
-		if !fileinfo.Mode().IsDir() && !fileinfo.Mode().IsRegular() {
-			lstat, err := os.Lstat(pathname)
-			if err != nil {
-				logger.Warn("%s", err)
-				return nil
-			}
+	if index, exists := searchChildren(children, name); exists {
+		return children[index], nil
+	}
+	return nil, os.ErrNotExist
+}
 
-			lfileinfo := FileInfoFromStat(lstat)
-			if lfileinfo.Mode()&os.ModeSymlink != 0 {
-				originFile, err := os.Readlink(lfileinfo.Name())
-				if err != nil {
-					logger.Warn("%s", err)
-					return nil
-				}
+// lookupPath returns the nodes from the root down to pathname
+func (filesystem *Filesystem) lookupPath(pathname string) ([]*FilesystemNode, error) {
+	pathname = cleanPathname(pathname)
 
-				filesystem.muStat.Lock()
-				filesystem.statInfo[pathname] = &lfileinfo
-				filesystem.muStat.Unlock()
+	p := filesystem.root
+	nodes := []*FilesystemNode{p}
+	if pathname == "/" {
+		return nodes, nil
+	}
 
-				filesystem.muSymlinks.Lock()
-				filesystem.Symlinks = sortedSymlinkInsert(filesystem.Symlinks, SymlinkEntry{Origin: pathname, Target: originFile})
-				filesystem.symlinks[pathname] = originFile
-				filesystem.muSymlinks.Unlock()
-			}
+	atoms := strings.Split(pathname, "/")[1:]
+	for _, atom := range atoms {
+		tmp, err := filesystem.lookupChild(p, atom)
+		if err != nil {
+			return nil, err
 		}
-		c <- 1
-		return nil
-	})
-	if err != nil {
-		logger.Warn("%s", err)
+		nodes = append(nodes, tmp)
+		p = tmp
 	}
-	return err
+	return nodes, nil
 }
 
 func (filesystem *Filesystem) Lookup(pathname string) (*FilesystemNode, error) {
@@ -358,29 +415,27 @@ func (filesystem *Filesystem) Lookup(pathname string) (*FilesystemNode, error) {
 		profiler.RecordEvent("vfs.Lookup", time.Since(t0))
 		logger.Trace("vfs", "Lookup(%s): %s", pathname, time.Since(t0))
 	}()
-	pathname = filepath.Clean(pathname)
-	pathname = filepath.ToSlash(pathname)
-	if pathname == "." {
-		pathname = "/"
-	}
 
-	p := filesystem.Root
-	if pathname == "/" {
-		return p, nil
+	nodes, err := filesystem.lookupPath(pathname)
+	if err != nil {
+		return nil, err
 	}
+	return nodes[len(nodes)-1], nil
+}
 
-	atoms := strings.Split(pathname, "/")[1:]
-	for _, atom := range atoms {
-		p.muNode.Lock()
-		tmp, exists := p.children[atom]
-		p.muNode.Unlock()
-
-		if !exists {
-			return nil, os.ErrNotExist
+func (filesystem *Filesystem) lookupInode(pathname string) (*FileInfo, bool) {
+	node, err := filesystem.Lookup(pathname)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("%s: %s", pathname, err)
 		}
-		p = tmp
+		return nil, false
 	}
-	return p, nil
+
+	node.muNode.Lock()
+	fileinfo := node.Inode
+	node.muNode.Unlock()
+	return &fileinfo, true
 }
 
 func (filesystem *Filesystem) LookupInode(pathname string) (*FileInfo, bool) {
@@ -389,17 +444,7 @@ func (filesystem *Filesystem) LookupInode(pathname string) (*FileInfo, bool) {
 		profiler.RecordEvent("vfs.LookupInode", time.Since(t0))
 		logger.Trace("vfs", "LookupInode(%s): %s", pathname, time.Since(t0))
 	}()
-	filesystem.muStat.Lock()
-	defer filesystem.muStat.Unlock()
-
-	pathname = filepath.Clean(pathname)
-	pathname = filepath.ToSlash(pathname)
-	if pathname == "." {
-		pathname = "/"
-	}
-
-	fileinfo, exists := filesystem.statInfo[pathname]
-	return fileinfo, exists
+	return filesystem.lookupInode(pathname)
 }
 
 func (filesystem *Filesystem) LookupInodeForFile(pathname string) (*FileInfo, bool) {
@@ -408,16 +453,8 @@ func (filesystem *Filesystem) LookupInodeForFile(pathname string) (*FileInfo, bo
 		profiler.RecordEvent("vfs.LookupInodeForFile", time.Since(t0))
 		logger.Trace("vfs", "LookupInodeForFile(%s): %s", pathname, time.Since(t0))
 	}()
-	filesystem.muStat.Lock()
-	defer filesystem.muStat.Unlock()
 
-	pathname = filepath.Clean(pathname)
-	pathname = filepath.ToSlash(pathname)
-	if pathname == "." {
-		pathname = "/"
-	}
-
-	fileinfo, exists := filesystem.statInfo[pathname]
+	fileinfo, exists := filesystem.lookupInode(pathname)
 	if !exists || !fileinfo.Mode().IsRegular() {
 		return nil, false
 	}
@@ -430,89 +467,137 @@ func (filesystem *Filesystem) LookupInodeForDirectory(pathname string) (*FileInf
 		profiler.RecordEvent("vfs.LookupInodeForDirectory", time.Since(t0))
 		logger.Trace("vfs", "LookupInodeForDirectory(%s): %s", pathname, time.Since(t0))
 	}()
-	filesystem.muStat.Lock()
-	defer filesystem.muStat.Unlock()
-
-	pathname = filepath.Clean(pathname)
-	pathname = filepath.ToSlash(pathname)
-	if pathname == "." {
-		pathname = "/"
-	}
 
-	fileinfo, exists := filesystem.statInfo[pathname]
+	fileinfo, exists := filesystem.lookupInode(pathname)
 	if !exists || !fileinfo.Mode().IsDir() {
 		return nil, false
 	}
 	return fileinfo, exists
 }
 
+func (filesystem *Filesystem) LookupSymlink(pathname string) (string, bool) {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("vfs.LookupSymlink", time.Since(t0))
+		logger.Trace("vfs", "LookupSymlink(%s): %s", pathname, time.Since(t0))
+	}()
+
+	node, err := filesystem.Lookup(pathname)
+	if err != nil {
+		return "", false
+	}
+
+	node.muNode.Lock()
+	defer node.muNode.Unlock()
+	if node.Inode.Mode()&os.ModeSymlink == 0 || node.Target == "" {
+		return "", false
+	}
+	return node.Target, true
+}
+
 func (filesystem *Filesystem) LookupChildren(pathname string) ([]string, error) {
 	t0 := time.Now()
 	defer func() {
 		profiler.RecordEvent("vfs.LookupChildren", time.Since(t0))
 		logger.Trace("vfs", "LookupChildren(%s): %s", pathname, time.Since(t0))
 	}()
-	pathname = filepath.Clean(pathname)
-	pathname = filepath.ToSlash(pathname)
-	if pathname == "." {
-		pathname = "/"
-	}
 
 	parent, err := filesystem.Lookup(pathname)
 	if err != nil {
-		return nil, os.ErrNotExist
+		return nil, err
 	}
 
-	parentInode := parent.Inode
+	parent.muNode.Lock()
+	defer parent.muNode.Unlock()
 
-	if !parentInode.Mode().IsDir() {
+	if !parent.Inode.Mode().IsDir() {
 		return nil, os.ErrInvalid
 	}
-
-	ret := make([]string, 0)
-	for _, child := range parent.Children {
-		ret = append(ret, child.Name)
+	if err := filesystem.loadChildren(parent); err != nil {
+		return nil, err
 	}
-	//sort.Strings(ret)
 
+	ret := make([]string, 0, len(parent.children))
+	for _, child := range parent.children {
+		ret = append(ret, child.name)
+	}
 	return ret, nil
-
 }
 
-func (filesystem *Filesystem) ListFiles() []string {
+// Walk calls fn for pathname and every pathname below it in lexical order,
+// directories that were not loaded yet are read but not kept in memory.
+func (filesystem *Filesystem) Walk(pathname string, fn func(pathname string, fileinfo *FileInfo) error) error {
 	t0 := time.Now()
 	defer func() {
-		profiler.RecordEvent("vfs.ListFiles", time.Since(t0))
-		logger.Trace("vfs", "ListFiles(): %s", time.Since(t0))
+		profiler.RecordEvent("vfs.Walk", time.Since(t0))
+		logger.Trace("vfs", "Walk(%s): %s", pathname, time.Since(t0))
 	}()
-	filesystem.muStat.Lock()
-	defer filesystem.muStat.Unlock()
 
+	node, err := filesystem.Lookup(pathname)
+	if err != nil {
+		return err
+	}
+	return filesystem.walk(cleanPathname(pathname), node, fn)
+}
+
+func (filesystem *Filesystem) walk(pathname string, node *FilesystemNode, fn func(pathname string, fileinfo *FileInfo) error) error {
+	node.muNode.Lock()
+	fileinfo := node.Inode
+	node.muNode.Unlock()
+
+	if err := fn(pathname, &fileinfo); err != nil {
+		return err
+	}
+	if !fileinfo.Mode().IsDir() {
+		return nil
+	}
+
+	children, err := filesystem.readChildren(node)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := filesystem.walk(path.Join(pathname, child.name), child, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (filesystem *Filesystem) list(filter func(fileinfo *FileInfo) bool) []string {
 	list := make([]string, 0)
-	for pathname, stat := range filesystem.statInfo {
-		if stat.Mode().IsRegular() {
+	err := filesystem.Walk("/", func(pathname string, fileinfo *FileInfo) error {
+		if filter(fileinfo) {
 			list = append(list, pathname)
 		}
+		return nil
+	})
+	if err != nil {
+		logger.Warn("%s", err)
 	}
 	return list
 }
 
+func (filesystem *Filesystem) ListFiles() []string {
+	t0 := time.Now()
+	defer func() {
+		profiler.RecordEvent("vfs.ListFiles", time.Since(t0))
+		logger.Trace("vfs", "ListFiles(): %s", time.Since(t0))
+	}()
+	return filesystem.list(func(fileinfo *FileInfo) bool {
+		return fileinfo.Mode().IsRegular()
+	})
+}
+
 func (filesystem *Filesystem) ListDirectories() []string {
 	t0 := time.Now()
 	defer func() {
 		profiler.RecordEvent("vfs.ListDirectories", time.Since(t0))
 		logger.Trace("vfs", "ListDirectories(): %s", time.Since(t0))
 	}()
-	filesystem.muStat.Lock()
-	defer filesystem.muStat.Unlock()
-
-	list := make([]string, 0)
-	for pathname, stat := range filesystem.statInfo {
-		if stat.Mode().IsDir() {
-			list = append(list, pathname)
-		}
-	}
-	return list
+	return filesystem.list(func(fileinfo *FileInfo) bool {
+		return fileinfo.Mode().IsDir()
+	})
 }
 
 func (filesystem *Filesystem) ListNonRegular() []string {
@@ -521,17 +606,9 @@ func (filesystem *Filesystem) ListNonRegular() []string {
 		profiler.RecordEvent("vfs.ListNonRegular", time.Since(t0))
 		logger.Trace("vfs", "ListNonRegular(): %s", time.Since(t0))
 	}()
-
-	filesystem.muStat.Lock()
-	defer filesystem.muStat.Unlock()
-
-	list := make([]string, 0)
-	for pathname, stat := range filesystem.statInfo {
-		if !stat.Mode().IsDir() && !stat.Mode().IsRegular() {
-			list = append(list, pathname)
-		}
-	}
-	return list
+	return filesystem.list(func(fileinfo *FileInfo) bool {
+		return !fileinfo.Mode().IsDir() && !fileinfo.Mode().IsRegular()
+	})
 }
 
 func (filesystem *Filesystem) ListStat() []string {
@@ -540,56 +617,63 @@ func (filesystem *Filesystem) ListStat() []string {
 		profiler.RecordEvent("vfs.ListStat", time.Since(t0))
 		logger.Trace("vfs", "ListStat(): %s", time.Since(t0))
 	}()
-
-	filesystem.muStat.Lock()
-	defer filesystem.muStat.Unlock()
-
-	list := make([]string, 0)
-	for pathname := range filesystem.statInfo {
-		list = append(list, pathname)
-	}
-	return list
+	return filesystem.list(func(fileinfo *FileInfo) bool {
+		return true
+	})
 }
 
-func (filesystem *Filesystem) _reindex(pathname string) {
-	t0 := time.Now()
-	defer func() {
-		profiler.RecordEvent("vfs._reindex", time.Since(t0))
-		logger.Trace("vfs", "_reindex(): %s", time.Since(t0))
-	}()
-
-	node, err := filesystem.Lookup(pathname)
+// SetSize records the size of a pathname that was scanned with an unknown
+// size, once its content has been read.
+func (filesystem *Filesystem) SetSize(pathname string, size int64) error {
+	nodes, err := filesystem.lookupPath(pathname)
 	if err != nil {
-		return
+		return err
 	}
 
-	pathnameInode := node.Inode
-	filesystem.statInfo[pathname] = &pathnameInode
-	filesystem.totalSize += uint64(pathnameInode.Size())
-
-	node.children = make(map[string]*FilesystemNode)
-	for _, child := range node.Children {
-		node.children[child.Name] = child.Node
-		nodeInode := child.Node.Inode
-		child := filepath.Clean(fmt.Sprintf("%s/%s", pathname, child.Name))
-		if nodeInode.Mode().IsDir() {
-			filesystem._reindex(child)
-		} else {
-			filesystem.statInfo[child] = &nodeInode
+	node := nodes[len(nodes)-1]
+	node.muNode.Lock()
+	node.Inode.Lsize = size
+	node.muNode.Unlock()
+
+	// the parents no longer match the blobs they were read from
+	for _, parent := range nodes[:len(nodes)-1] {
+		parent.muNode.Lock()
+		err := filesystem.loadChildren(parent)
+		parent.subtree = [32]byte{}
+		parent.muNode.Unlock()
+		if err != nil {
+			return err
 		}
 	}
 
+	atomic.AddUint64(&filesystem.totalSize, uint64(size))
+	return nil
 }
 
-func (filesystem *Filesystem) reindex() {
-	t0 := time.Now()
-	defer func() {
-		profiler.RecordEvent("vfs.reindex", time.Since(t0))
-		logger.Trace("vfs", "reindex(): %s", time.Since(t0))
-	}()
+// RecordError remembers that pathname could not be saved, errors are
+// serialized with the filesystem so they survive in the snapshot.
+func (filesystem *Filesystem) RecordError(pathname string, err error) {
+	filesystem.muErrors.Lock()
+	defer filesystem.muErrors.Unlock()
+	filesystem.errors = append(filesystem.errors, ErrorEntry{Pathname: pathname, Error: err.Error()})
+}
+
+func (filesystem *Filesystem) ListErrors() []ErrorEntry {
+	filesystem.muErrors.Lock()
+	defer filesystem.muErrors.Unlock()
+
+	list := make([]ErrorEntry, len(filesystem.errors))
+	copy(list, filesystem.errors)
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Pathname < list[j].Pathname
+	})
+	return list
+}
 
-	filesystem.statInfo = make(map[string]*FileInfo)
-	filesystem._reindex("/")
+func (filesystem *Filesystem) NErrors() uint64 {
+	filesystem.muErrors.Lock()
+	defer filesystem.muErrors.Unlock()
+	return uint64(len(filesystem.errors))
 }
 
 func (filesystem *Filesystem) Size() uint64 {
@@ -637,6 +721,34 @@ func (filesystem *Filesystem) ImporterEnd() error {
 	return filesystem.importer.End()
 }
 
+// ImporterOrder sorts pathnames in the order the importer reads them
+// best and reports whether it reads them sequentially, pathnames it
+// doesn't know of are kept last.
+func (filesystem *Filesystem) ImporterOrder(pathnames []string) bool {
+	if filesystem.importer == nil {
+		return false
+	}
+	order := filesystem.importer.Order()
+	if order == nil {
+		return false
+	}
+
+	rank := make(map[string]int, len(order))
+	for i, pathname := range order {
+		rank[filepath.ToSlash(pathname)] = i
+	}
+	position := func(pathname string) int {
+		if i, exists := rank[pathname]; exists {
+			return i
+		}
+		return len(order)
+	}
+	sort.SliceStable(pathnames, func(i, j int) bool {
+		return position(pathnames[i]) < position(pathnames[j])
+	})
+	return true
+}
+
 func (filesystem *Filesystem) ImporterOpen(filename string) (io.ReadCloser, error) {
 	t0 := time.Now()
 	defer func() {
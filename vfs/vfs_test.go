@@ -0,0 +1,393 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type memoryStore struct {
+	blobs  map[[32]byte][]byte
+	puts   int
+	gets   int
+	checks int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{blobs: make(map[[32]byte][]byte)}
+}
+
+func (store *memoryStore) Checksum(data []byte) [32]byte {
+	return sha256.Sum256(data)
+}
+
+func (store *memoryStore) CheckBlob(checksum [32]byte) (bool, error) {
+	store.checks++
+	_, exists := store.blobs[checksum]
+	return exists, nil
+}
+
+func (store *memoryStore) CheckBlobBatch(checksums [][32]byte) ([]bool, error) {
+	store.checks++
+	exists := make([]bool, len(checksums))
+	for i, checksum := range checksums {
+		_, exists[i] = store.blobs[checksum]
+	}
+	return exists, nil
+}
+
+func (store *memoryStore) GetBlob(checksum [32]byte) ([]byte, error) {
+	store.gets++
+	data, exists := store.blobs[checksum]
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (store *memoryStore) PutBlob(checksum [32]byte, data []byte) error {
+	store.puts++
+	store.blobs[checksum] = data
+	return nil
+}
+
+func buildFilesystem(t *testing.T, files map[string]int64) *Filesystem {
+	filesystem := NewFilesystem()
+	directories := map[string]bool{"/": true}
+	for pathname := range files {
+		for dir := path.Dir(pathname); dir != "/"; dir = path.Dir(dir) {
+			directories[dir] = true
+		}
+	}
+	for directory := range directories {
+		if err := filesystem.buildTree(directory, &FileInfo{Lname: directory, Lmode: os.ModeDir | 0700, LmodTime: time.Unix(0, 0)}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pathname, size := range files {
+		if err := filesystem.buildTree(pathname, &FileInfo{Lname: pathname, Lsize: size, Lmode: 0600, LmodTime: time.Unix(0, 0)}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filesystem
+}
+
+func TestStoreDeduplicatesSubtrees(t *testing.T) {
+	files := map[string]int64{
+		"/etc/passwd":      10,
+		"/etc/group":       20,
+		"/home/a/notes":    30,
+		"/home/b/todo":     40,
+		"/home/b/sub/file": 50,
+	}
+	store := newMemoryStore()
+
+	serialized, err := buildFilesystem(t, files).Store(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one blob per directory: /, /etc, /home, /home/a, /home/b, /home/b/sub
+	if store.puts != 6 {
+		t.Fatalf("expected 6 blobs, got %d", store.puts)
+	}
+
+	store.puts = 0
+	files["/home/b/todo"] = 41
+	if _, err := buildFilesystem(t, files).Store(store); err != nil {
+		t.Fatal(err)
+	}
+	// only /home/b, /home and / changed
+	if store.puts != 3 {
+		t.Errorf("expected 3 new blobs, got %d", store.puts)
+	}
+
+	filesystem, err := NewFilesystemFromBytes(serialized, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filesystem.NFiles() != 5 || filesystem.NDirectories() != 6 || filesystem.Size() != 150 {
+		t.Errorf("unexpected counters %d %d %d", filesystem.NFiles(), filesystem.NDirectories(), filesystem.Size())
+	}
+
+	// a forked filesystem is committed without rewriting anything
+	store.puts = 0
+	if _, err := filesystem.Store(store); err != nil {
+		t.Fatal(err)
+	}
+	if store.puts != 0 {
+		t.Errorf("expected no new blobs, got %d", store.puts)
+	}
+
+	// and is copied as a whole to another store
+	other := newMemoryStore()
+	if _, err := filesystem.Store(other); err != nil {
+		t.Fatal(err)
+	}
+	if other.puts != 6 {
+		t.Errorf("expected 6 blobs copied, got %d", other.puts)
+	}
+	// the root, a batch for each directory with subdirectories: /, /home
+	// and /home/b, and a check before writing each blob
+	if other.checks != 10 {
+		t.Errorf("expected 10 checks, got %d", other.checks)
+	}
+}
+
+func TestLazyLookup(t *testing.T) {
+	files := map[string]int64{
+		"/etc/passwd":      10,
+		"/home/a/notes":    30,
+		"/home/b/sub/file": 50,
+	}
+	store := newMemoryStore()
+	serialized, err := buildFilesystem(t, files).Store(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filesystem, err := NewFilesystemFromBytes(serialized, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.gets != 0 {
+		t.Fatalf("root should not read any directory")
+	}
+
+	fileinfo, exists := filesystem.LookupInodeForFile("/home/a/notes")
+	if !exists || fileinfo.Size() != 30 {
+		t.Fatalf("could not find /home/a/notes")
+	}
+	if store.gets != 3 {
+		t.Errorf("expected /, /home and /home/a to be read, got %d reads", store.gets)
+	}
+
+	children, err := filesystem.LookupChildren("/home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(children) != "[a b]" {
+		t.Errorf("unexpected children %v", children)
+	}
+	if _, exists := filesystem.LookupInode("/home/c"); exists {
+		t.Errorf("/home/c should not exist")
+	}
+
+	store.gets = 0
+	pathnames := filesystem.ListStat()
+	if len(pathnames) != 9 {
+		t.Errorf("unexpected pathnames %v", pathnames)
+	}
+	if store.gets != 3 {
+		t.Errorf("expected the 3 unloaded directories to be read, got %d reads", store.gets)
+	}
+
+	if err := filesystem.SetSize("/home/b/sub/file", 51); err != nil {
+		t.Fatal(err)
+	}
+	store.puts = 0
+	if _, err := filesystem.Store(store); err != nil {
+		t.Fatal(err)
+	}
+	if store.puts != 4 {
+		t.Errorf("expected 4 new blobs after SetSize, got %d", store.puts)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	filesystem := buildFilesystem(t, map[string]int64{"/etc/passwd": 10})
+	filesystem.RecordError("/home/b", os.ErrPermission)
+	filesystem.RecordError("/home/a", os.ErrNotExist)
+	if filesystem.NErrors() != 2 {
+		t.Errorf("expected 2 errors, got %d", filesystem.NErrors())
+	}
+
+	// errors are listed by pathname and survive serialization
+	store := newMemoryStore()
+	serialized, err := filesystem.Store(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filesystem, err = NewFilesystemFromBytes(serialized, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ErrorEntry{
+		{Pathname: "/home/a", Error: os.ErrNotExist.Error()},
+		{Pathname: "/home/b", Error: os.ErrPermission.Error()},
+	}
+	if entries := filesystem.ListErrors(); fmt.Sprint(entries) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, entries)
+	}
+	if filesystem.NErrors() != 2 {
+		t.Errorf("expected 2 errors, got %d", filesystem.NErrors())
+	}
+}
+
+func TestFileInfoEqual(t *testing.T) {
+	modTime := time.Now()
+	fileinfo := FileInfo{Lname: "passwd", Lsize: 10, Lmode: 0644, LmodTime: modTime, Lxattrs: map[string][]byte{"user.a": []byte("b")}}
+
+	// times decoded from a snapshot lose their monotonic reading and location
+	serialized, err := msgpack.Marshal(fileinfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded FileInfo
+	if err := msgpack.Unmarshal(serialized, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !fileinfo.Equal(decoded) {
+		t.Errorf("expected %+v to equal %+v", fileinfo, decoded)
+	}
+
+	decoded.LmodTime = modTime.Add(time.Nanosecond)
+	if fileinfo.Equal(decoded) {
+		t.Error("expected different times to differ")
+	}
+}
+
+func TestChunkedDirectory(t *testing.T) {
+	files := make(map[string]int64)
+	for i := 0; i < 20000; i++ {
+		files[fmt.Sprintf("/large/%05d", i)] = int64(i)
+	}
+	store := newMemoryStore()
+	serialized, err := buildFilesystem(t, files).Store(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := store.puts - 2
+	if chunks < 3 {
+		t.Fatalf("expected /large to be chunked, got %d chunks", chunks)
+	}
+
+	filesystem, err := NewFilesystemFromBytes(serialized, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileinfo, exists := filesystem.LookupInode("/large/12345")
+	if !exists || fileinfo.Size() != 12345 {
+		t.Fatalf("could not find /large/12345")
+	}
+	if store.gets != 3 {
+		t.Errorf("expected /, /large and a single chunk to be read, got %d reads", store.gets)
+	}
+
+	children, err := filesystem.LookupChildren("/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 20000 || children[0] != "00000" || children[19999] != "19999" {
+		t.Errorf("unexpected children")
+	}
+
+	// inserting an entry only rewrites its chunk and the parents
+	files["/large/12345.new"] = 1
+	store.puts = 0
+	if _, err := buildFilesystem(t, files).Store(store); err != nil {
+		t.Fatal(err)
+	}
+	if store.puts != 3 {
+		t.Errorf("expected 3 new blobs, got %d", store.puts)
+	}
+}
+
+func TestDirectoryCache(t *testing.T) {
+	files := make(map[string]int64)
+	for i := 0; i < 5000; i++ {
+		files[fmt.Sprintf("/large/%04d", i)] = int64(i)
+	}
+	files["/etc/passwd"] = 10
+	store := newMemoryStore()
+	serialized, err := buildFilesystem(t, files).Store(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filesystem, err := NewFilesystemFromBytes(serialized, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := filesystem.ListFiles(); len(files) != 5001 {
+		t.Fatalf("expected 5001 files, got %d", len(files))
+	}
+	if store.gets != len(store.blobs) {
+		t.Errorf("expected every blob to be read once, got %d reads of %d blobs", store.gets, len(store.blobs))
+	}
+
+	// the listings that follow are served from the decoded blobs
+	store.gets = 0
+	if directories := filesystem.ListDirectories(); len(directories) != 3 {
+		t.Errorf("unexpected directories %v", directories)
+	}
+	if pathnames := filesystem.ListStat(); len(pathnames) != 5004 {
+		t.Errorf("expected 5004 pathnames, got %d", len(pathnames))
+	}
+	if store.gets != 0 {
+		t.Errorf("expected no blob to be read again, got %d reads", store.gets)
+	}
+}
+
+func TestBlobCache(t *testing.T) {
+	cache := newBlobCache(10)
+	cache.Put([32]byte{1}, "a", 4)
+	cache.Put([32]byte{2}, "b", 4)
+	if _, exists := cache.Get([32]byte{1}); !exists {
+		t.Fatal("expected the first blob to be cached")
+	}
+
+	// the least recently used blob is evicted to stay within the bound
+	cache.Put([32]byte{3}, "c", 4)
+	if _, exists := cache.Get([32]byte{2}); exists {
+		t.Error("expected the second blob to be evicted")
+	}
+	if value, exists := cache.Get([32]byte{1}); !exists || value != "a" {
+		t.Errorf("unexpected value %v", value)
+	}
+	cache.Put([32]byte{4}, "d", 11)
+	if _, exists := cache.Get([32]byte{4}); exists {
+		t.Error("expected a blob larger than the cache not to be kept")
+	}
+	if cache.size != 8 {
+		t.Errorf("expected 8 bytes cached, got %d", cache.size)
+	}
+}
+
+func TestLegacyFilesystem(t *testing.T) {
+	type legacyChild struct {
+		Name string
+		Node *legacyNode
+	}
+	file := &legacyNode{Inode: FileInfo{Lname: "file", Lsize: 42, Lmode: 0600}}
+	link := &legacyNode{Inode: FileInfo{Lname: "link", Lmode: os.ModeSymlink | 0777}}
+	root := &legacyNode{Inode: FileInfo{Lname: "/", Lmode: os.ModeDir | 0700}}
+	root.Children = append(root.Children, legacyChild{"file", file}, legacyChild{"link", link})
+
+	serialized, err := msgpack.Marshal(map[string]interface{}{
+		"Root":     root,
+		"Symlinks": []map[string]string{{"Origin": "/link", "Target": "file"}},
+		"Errors":   []ErrorEntry{{Pathname: "/missing", Error: "permission denied"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filesystem, err := NewFilesystemFromBytes(serialized, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileinfo, exists := filesystem.LookupInodeForFile("/file"); !exists || fileinfo.Size() != 42 {
+		t.Errorf("could not find /file")
+	}
+	if target, exists := filesystem.LookupSymlink("/link"); !exists || target != "file" {
+		t.Errorf("could not find /link target")
+	}
+	if filesystem.NErrors() != 1 || filesystem.NFiles() != 1 {
+		t.Errorf("unexpected counters")
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Xattrs returns the extended attributes of pathname without following
+// symlinks, filesystems lacking support yield no attributes.
+func Xattrs(pathname string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(pathname, nil)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(pathname, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(pathname, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, vsize)
+		vsize, err = unix.Lgetxattr(pathname, string(name), value)
+		if err != nil {
+			continue
+		}
+		xattrs[string(name)] = value[:vsize]
+	}
+	return xattrs, nil
+}